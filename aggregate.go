@@ -0,0 +1,192 @@
+package lager
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AccessAggregator accumulates request counts, status counts, and latency
+// histograms per route and periodically writes one summary Access log line
+// per route.  For very high QPS services, this can replace (or supplement)
+// writing an Access log line for every request.  Use NewAccessAggregator()
+// to create one.
+//
+type AccessAggregator struct {
+	buckets []time.Duration
+	stop    chan struct{}
+	done    chan struct{}
+
+	mu     sync.Mutex
+	since  time.Time
+	routes map[string]*routeStats
+	closed bool
+}
+
+// The statistics accumulated for one route.
+type routeStats struct {
+	count  int
+	status map[int]int
+	counts []int // One per bucket plus one for larger latencies.
+	sum    time.Duration
+	max    time.Duration
+}
+
+// The default latency histogram bucket boundaries.
+var defaultBuckets = []time.Duration{
+	5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond,
+	50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond,
+	500 * time.Millisecond, time.Second, 2500 * time.Millisecond,
+	5 * time.Second, 10 * time.Second,
+}
+
+// NewAccessAggregator() returns an AccessAggregator that writes summary log
+// lines every 'every' (if 'every' is positive).  'buckets' are the upper
+// bounds of the latency histogram buckets, in increasing order.  If none
+// are given, then 5ms, 10ms, 25ms, 50ms, 100ms, 250ms, 500ms, 1s, 2.5s,
+// 5s, and 10s are used.
+//
+//      agg := lager.NewAccessAggregator(time.Minute)
+//      defer agg.Close()
+//      ...
+//      agg.Record("/api/v1/users/{id}", resp.StatusCode, time.Since(start))
+//
+// Each summary line has the message "Access summary" and includes:
+//
+//      "route"         The route passed to Record().
+//      "seconds"       How many seconds the summary covers.
+//      "count"         The number of requests recorded.
+//      "status"        E.g. {"200":95, "404":5}
+//      "latency"       E.g. {"sum":1.25, "max":0.3, "buckets":[...],
+//                          "counts":[...]} (latencies in seconds)
+//
+// "counts" has one more element than "buckets", the count of requests
+// with latencies larger than the last bucket.  Each other element is the
+// count of requests with latencies larger than the prior bucket but no
+// larger than the corresponding bucket.
+//
+func NewAccessAggregator(
+	every time.Duration, buckets ...time.Duration,
+) *AccessAggregator {
+	if 0 == len(buckets) {
+		buckets = defaultBuckets
+	}
+	a := &AccessAggregator{
+		buckets: append([]time.Duration(nil), buckets...),
+		since:   Now(),
+		routes:  make(map[string]*routeStats),
+	}
+	if 0 < every {
+		a.stop = make(chan struct{})
+		a.done = make(chan struct{})
+		go a.flusher(every, a.stop)
+	}
+	return a
+}
+
+// Periodically calls Flush() until Close() is called (closing 'stop').
+func (a *AccessAggregator) flusher(every time.Duration, stop chan struct{}) {
+	defer close(a.done)
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick.C:
+			a.Flush()
+		}
+	}
+}
+
+// Record() adds one request to the statistics for 'route'.  'route' should
+// be a route template (like "/users/{id}"), not a full URL path, so the
+// number of distinct routes stays small.
+//
+func (a *AccessAggregator) Record(route string, status int, lag time.Duration) {
+	defer AutoLock(&a.mu)()
+	rs := a.routes[route]
+	if nil == rs {
+		rs = &routeStats{
+			status: make(map[int]int),
+			counts: make([]int, len(a.buckets)+1),
+		}
+		a.routes[route] = rs
+	}
+	rs.count++
+	rs.status[status]++
+	rs.counts[sort.Search(
+		len(a.buckets), func(i int) bool { return lag <= a.buckets[i] })]++
+	rs.sum += lag
+	if rs.max < lag {
+		rs.max = lag
+	}
+}
+
+// Flush() writes a summary line for each route with requests recorded since
+// the prior Flush() and then resets the statistics.
+//
+func (a *AccessAggregator) Flush() {
+	a.mu.Lock()
+	routes, since := a.routes, a.since
+	a.routes = make(map[string]*routeStats)
+	a.since = Now()
+	a.mu.Unlock()
+
+	names := make([]string, 0, len(routes))
+	for name := range routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	secs := Now().Sub(since).Seconds()
+	buckets := make([]float64, len(a.buckets))
+	for i, b := range a.buckets {
+		buckets[i] = b.Seconds()
+	}
+	for _, name := range names {
+		rs := routes[name]
+		Acc().MMap("Access summary",
+			"route", name,
+			"seconds", secs,
+			"count", rs.count,
+			"status", rs.statusCounts(),
+			"latency", Map(
+				"sum", rs.sum.Seconds(),
+				"max", rs.max.Seconds(),
+				"buckets", buckets,
+				"counts", rs.counts,
+			),
+		)
+	}
+}
+
+// Returns the counts per status code, in order by status code.
+func (rs *routeStats) statusCounts() RawMap {
+	codes := make([]int, 0, len(rs.status))
+	for code := range rs.status {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	m := make(RawMap, 0, 2*len(codes))
+	for _, code := range codes {
+		m = append(m, strconv.Itoa(code), rs.status[code])
+	}
+	return m
+}
+
+// Close() stops periodic flushing and then calls Flush() one last time.
+func (a *AccessAggregator) Close() {
+	a.mu.Lock()
+	closed := a.closed
+	a.closed = true
+	a.mu.Unlock()
+	if closed {
+		return
+	}
+	if nil != a.stop {
+		close(a.stop)
+		<-a.done
+	}
+	a.Flush()
+}
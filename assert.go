@@ -0,0 +1,61 @@
+package lager
+
+import (
+	"sync/atomic"
+)
+
+// Whether Assert() and Check() panic after logging a violation.
+var _assertPanics int32 = 0
+
+// SetAssertPanics() controls whether Assert() and Check() call panic()
+// after logging a violation, which is useful in development and tests so
+// that violations can't go unnoticed.  It is off by default.
+//
+func SetAssertPanics(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&_assertPanics, v)
+}
+
+// Assert() does nothing but return 'true' if 'cond' is 'true'.  Otherwise
+// it logs 'msg' and the key/value 'pairs' at the Fail level, along with
+// the caller's location and a stack trace, and returns 'false'.  If
+// SetAssertPanics(true) is in effect, then it then calls panic().
+//
+//      if !lager.Assert(0 <= n, "Negative count", "n", n) {
+//          n = 0
+//      }
+//
+func Assert(cond bool, msg string, pairs ...interface{}) bool {
+	if cond {
+		return true
+	}
+	violated(msg, pairs)
+	return false
+}
+
+// Check() is like Assert() but is for unexpected errors.  If 'err' is
+// 'nil', then it does nothing but return 'true'.  Otherwise it logs like
+// Assert() does (including the error as if lager.Err(err) were among the
+// 'pairs') and returns 'false'.
+//
+//      lager.Check(f.Close(), "Could not close temp file", "path", path)
+//
+func Check(err error, msg string, pairs ...interface{}) bool {
+	if nil == err {
+		return true
+	}
+	violated(msg, append([]interface{}{Err(err)}, pairs...))
+	return false
+}
+
+// Logs a failed Assert() or Check() (which must be our caller).
+func violated(msg string, pairs []interface{}) {
+	// 0 is here, 1 is Assert(), 2 is what called Assert():
+	Fail().WithCaller(2).WithStack(2, 0).MMap(msg, pairs...)
+	if 0 != atomic.LoadInt32(&_assertPanics) {
+		panic("Assertion failed: " + msg)
+	}
+}
@@ -0,0 +1,248 @@
+/*
+Package audit writes append-only audit events (logins, permission changes,
+and other compliance-sensitive actions) via a lager.Module.  Each event is
+given a sequence number and a hash that covers the event and the hash of
+the prior event, so that removing, reordering, or altering logged events
+can be detected by Verify().
+
+	var trail = audit.New("audit")
+
+	trail.Event(ctx, "Permission granted", "user", user, "role", role)
+
+Each event is logged at the Note level of the module as a line similar to
+(but on a single line):
+
+	["2019-12-31 23:59:59.1234Z", "NOTE", "Permission granted",
+		{"audit":{"trail":"audit", "seq":7, "action":"Permission granted",
+		"prev":"9f8e...", "hash":"1a2b...",
+		"data":{"role":"admin", "user":"tye"}}}, "mod=audit"]
+*/
+package audit
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/TyeMcQueen/go-lager"
+)
+
+// Key is the key under which the audit details are logged.
+const Key = "audit"
+
+// Trail is a chain of audit events.  Use New() to create one.
+type Trail struct {
+	name string
+	mod  *lager.Module
+	mu   sync.Mutex
+	seq  uint64
+	prev string
+}
+
+// New() returns a Trail that logs via lager.NewModule(name, "FWNA") so the
+// levels can be adjusted via LAGER_{name}_LEVELS (but audit events are
+// only written if the Note level is enabled).  PromoteMatching() rules and
+// request log budgets are not applied to audit events (see
+// lager.Unfiltered()), so an event is never dropped once it is part of the
+// chain.  New() also calls lager.SetVerbatimKey(Key, true) so that a key
+// normalizer [see lager.SetKeyNormalizer()] can't alter logged events.
+//
+// Each process starts a new chain (with sequence number 1 and an empty
+// prior hash) unless Resume() is called.
+//
+func New(name string) *Trail {
+	lager.SetVerbatimKey(Key, true)
+	return &Trail{name: name, mod: lager.NewModule(name, "FWNA")}
+}
+
+// Resume() continues the chain from a prior process, given the sequence
+// number and hash of the last event that process logged.  It must be
+// called before any events are logged via the Trail.  'prevHash' should
+// not be empty since Verify() expects an event with no prior hash to be
+// the first of its chain.
+//
+func (t *Trail) Resume(seq uint64, prevHash string) {
+	defer lager.AutoLock(&t.mu)()
+	t.seq = seq
+	t.prev = prevHash
+}
+
+// Event() logs one audit event.  'action' is used as the log message.
+// 'pairs' are key/value pairs (keys are converted to strings via lager.S())
+// describing the event.  The values are converted to plain JSON data (via
+// encoding/json) before they are hashed and logged, so values that can't
+// be marshaled as JSON are logged as their error string instead.
+//
+// Event() returns the hash of the logged event.  If the Note level of the
+// Trail's module is disabled, then nothing is logged, the chain is not
+// advanced, and "" is returned.
+//
+func (t *Trail) Event(
+	ctx context.Context, action string, pairs ...interface{},
+) string {
+	data := make(map[string]interface{}, (len(pairs)+1)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		var val interface{}
+		if i+1 < len(pairs) {
+			val = pairs[i+1]
+		}
+		data[lager.S(pairs[i])] = plain(val)
+	}
+
+	defer lager.AutoLock(&t.mu)()
+	l := lager.Unfiltered(t.mod.Note(ctx))
+	if !l.Enabled() {
+		return ""
+	}
+	seq := t.seq + 1
+	hash := Hash(t.name, seq, action, t.prev, data)
+	l.MMap(action, Key, lager.Map(
+		"trail", t.name,
+		"seq", seq,
+		"action", action,
+		"prev", t.prev,
+		"hash", hash,
+		"data", data,
+	))
+	t.seq, t.prev = seq, hash
+	return hash
+}
+
+// plain() converts a value to what you get by unmarshaling its JSON.
+func plain(val interface{}) interface{} {
+	buf, err := json.Marshal(val)
+	if nil != err {
+		return "! " + err.Error()
+	}
+	var ret interface{}
+	if err := json.Unmarshal(buf, &ret); nil != err {
+		return "! " + err.Error()
+	}
+	return ret
+}
+
+// Hash() computes the hash of one audit event given the name of its trail,
+// its sequence number, its action, the hash of the prior event, and its
+// data (which must be plain JSON data like you get from json.Unmarshal()).
+//
+func Hash(
+	trail string, seq uint64, action, prev string, data interface{},
+) string {
+	canon, err := json.Marshal(map[string]interface{}{
+		"trail": trail, "seq": seq, "action": action, "data": data,
+	})
+	if nil != err {
+		canon = []byte(err.Error())
+	}
+	sum := sha256.New()
+	io.WriteString(sum, prev)
+	sum.Write([]byte{'\n'})
+	sum.Write(canon)
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// Verify() reads log lines and checks that the audit events found in them
+// have not been altered, removed, or reordered.  Lines that are not audit
+// events are ignored (so the normal log output can be passed in) as is any
+// text before the first '[' or '{' on each line.  Events from different
+// Trails are checked separately.  The first event seen from each Trail
+// is only checked against its own hash, since the events before it may
+// have been rotated away, except that it must be #1 if it has no prior
+// hash (since its Trail was not resumed via Resume()).
+//
+// The number of audit events verified is returned along with an error
+// describing the first problem found (if any).
+//
+func Verify(r io.Reader) (int, error) {
+	type state struct {
+		seq  uint64
+		hash string
+	}
+	last := make(map[string]state)
+	scan := bufio.NewScanner(r)
+	scan.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	events := 0
+	for lineNum := 1; scan.Scan(); lineNum++ {
+		ev := findEvent(scan.Bytes())
+		if nil == ev {
+			continue
+		}
+		events++
+		trail, _ := ev["trail"].(string)
+		action, _ := ev["action"].(string)
+		prev, _ := ev["prev"].(string)
+		hash, _ := ev["hash"].(string)
+		fseq, _ := ev["seq"].(float64)
+		seq := uint64(fseq)
+		if want := Hash(trail, seq, action, prev, ev["data"]); want != hash {
+			return events, fmt.Errorf(
+				"line %d: audit event %s#%d was altered (hash %s not %s)",
+				lineNum, trail, seq, hash, want)
+		}
+		if st, ok := last[trail]; !ok && "" == prev && 1 != seq {
+			return events, fmt.Errorf(
+				"line %d: audit event %s#%d has no prior event",
+				lineNum, trail, seq)
+		} else if ok {
+			if st.seq+1 != seq {
+				return events, fmt.Errorf(
+					"line %d: audit event %s#%d follows #%d",
+					lineNum, trail, seq, st.seq)
+			} else if st.hash != prev {
+				return events, fmt.Errorf(
+					"line %d: audit event %s#%d does not chain to prior event",
+					lineNum, trail, seq)
+			}
+		}
+		last[trail] = state{seq: seq, hash: hash}
+	}
+	return events, scan.Err()
+}
+
+// findEvent() returns the audit details from a log line or 'nil'.
+func findEvent(line []byte) map[string]interface{} {
+	start := -1
+	for i, c := range line {
+		if '[' == c || '{' == c {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return nil
+	}
+	var parsed interface{}
+	if err := json.Unmarshal(line[start:], &parsed); nil != err {
+		return nil
+	}
+	return search(parsed, 2)
+}
+
+// search() looks for a map containing the Key in 'v' and returns the value.
+func search(v interface{}, depth int) map[string]interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		if ev, ok := x[Key].(map[string]interface{}); ok {
+			return ev
+		}
+		if 0 < depth {
+			for _, sub := range x {
+				if ev := search(sub, depth-1); nil != ev {
+					return ev
+				}
+			}
+		}
+	case []interface{}:
+		for _, sub := range x {
+			if ev := search(sub, depth); nil != ev {
+				return ev
+			}
+		}
+	}
+	return nil
+}
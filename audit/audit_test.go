@@ -0,0 +1,102 @@
+package audit_test
+
+import (
+	"bytes"
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/TyeMcQueen/go-lager"
+	"github.com/TyeMcQueen/go-lager/audit"
+	"github.com/TyeMcQueen/go-tutl"
+)
+
+func TestAudit(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+
+	ctx := lager.AddPairs(context.Background(), "ip", "10.0.1.2")
+	trail := audit.New("audit")
+	other := audit.New("other")
+	h1 := trail.Event(ctx, "Login", "user", "tye", "ok", true)
+	lager.Note().MMap("Not an audit event")
+	other.Event(ctx, "Reboot")
+	trail.Event(ctx, "Grant", "user", "tye", "roles", []string{"admin"})
+	lager.Keys("t", "l", "msg", "data", "", "mod")
+	trail.Event(ctx, "Logout", "user", "tye", "after", 1.5)
+	lager.Keys("", "", "", "", "", "")
+	good := log.String()
+
+	n, err := audit.Verify(strings.NewReader(good))
+	u.Is(nil, err, "verify good")
+	u.Is(4, n, "verify good count")
+	u.Like(good, "event format", `"audit":\{"trail":"audit", "seq":1,`,
+		`"prev":"", "hash":"`+h1+`", "data":\{"ok":true, "user":"tye"\}`)
+
+	lines := strings.SplitAfter(good, "\n")
+	altered := strings.Replace(good, `"admin"`, `"root"`, 1)
+	_, err = audit.Verify(strings.NewReader(altered))
+	u.Like(err, "verify altered", "*line 4: audit event audit#2 was altered")
+
+	removed := lines[0] + lines[1] + lines[2] + lines[4]
+	_, err = audit.Verify(strings.NewReader(removed))
+	u.Like(err, "verify removed", "*audit event audit#3 follows #1")
+
+	n, err = audit.Verify(strings.NewReader(lines[3] + lines[4]))
+	u.Is(nil, err, "verify rotated")
+	u.Is(2, n, "verify rotated count")
+
+	resumed := audit.New("resumed")
+	resumed.Resume(3, "abc")
+	log.Reset()
+	resumed.Event(ctx, "Resumed")
+	u.Like(log.String(), "resumed", `"seq":4,`, `"prev":"abc"`)
+}
+
+func TestAuditGaps(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+	ctx := context.Background()
+
+	trail := audit.New("gaps")
+	lager.SetModuleLevels("gaps", "FWA")
+	u.Is("", trail.Event(ctx, "Hidden"), "disabled event hash")
+	u.Is("", log.String(), "disabled event not logged")
+	lager.SetModuleLevels("gaps", "FWNA")
+	defer lager.PromoteMatching(regexp.MustCompile("."), 'D')()
+	trail.Event(ctx, "Shown")
+	u.Like(log.String(), "event not promoted",
+		`"NOTE", "Shown"`, `"seq":1, "action":"Shown", "prev":""`)
+
+	n, err := audit.Verify(strings.NewReader(log.String()))
+	u.Is(nil, err, "verify after disabled event")
+	u.Is(1, n, "verify after disabled event count")
+
+	unresumed := audit.New("unresumed")
+	unresumed.Resume(1, "")
+	log.Reset()
+	unresumed.Event(ctx, "Orphan")
+	_, err = audit.Verify(strings.NewReader(log.String()))
+	u.Like(err, "verify chain not starting at #1",
+		"*line 1: audit event unresumed#2 has no prior event")
+}
+
+func TestAuditNormalizer(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+	trail := audit.New("normed")
+	lager.SetKeyNormalizer(strings.ToLower)
+	defer lager.SetKeyNormalizer(nil)
+
+	ctx := lager.AddPairs(context.Background(), "reqID", 7)
+	trail.Event(ctx, "Login", "userID", "tye")
+	u.Like(log.String(), "normalized around event",
+		`{"reqid":7}`, `"data":{"userID":"tye"}`)
+	n, err := audit.Verify(strings.NewReader(log.String()))
+	u.Is(nil, err, "verify normalized")
+	u.Is(1, n, "verify normalized count")
+}
@@ -0,0 +1,85 @@
+package lager
+
+import (
+	"sync"
+	"time"
+)
+
+// Batcher accumulates the steps of one operation so they can be logged as
+// a single line.  See Batch().
+//
+type Batcher struct {
+	mu     sync.Mutex
+	l      Lager
+	start  time.Time
+	events []interface{}
+	closed bool
+}
+
+// Batch() returns a Batcher that accumulates multiple messages (and their
+// key/value pairs) and, when Close() is called, writes them as a single log
+// line at the given level.  Since it is a single line, the steps of one
+// operation can't be interleaved with log lines from other requests.
+//
+//      b := lager.Batch(lager.INFO, ctx)
+//      defer b.Close("Synced account", "account", id)
+//      b.Add("Fetched remote state", "items", len(items))
+//      ...
+//      b.Add("Applied changes", "updated", n)
+//
+// The line written by Close() includes an "events" pair whose value is a
+// list with one map per call to Add(), each holding "msg", "elapsed" (the
+// time since Batch() was called), and the pairs passed to Add().
+//
+// If the log level is disabled, then the returned Batcher does nothing (as
+// cheaply as possible).  A Batcher can be used from multiple goroutines.
+//
+func Batch(lev LogLevel, cs ...Ctx) *Batcher {
+	l := AtLevel(lev, cs...)
+	if !l.Enabled() {
+		return &Batcher{closed: true}
+	}
+	return &Batcher{l: l, start: Now()}
+}
+
+// Add() records one message and its key/value pairs to be logged when the
+// Batcher is closed.  Does nothing if the Batcher is disabled or closed.
+//
+func (b *Batcher) Add(msg string, pairs ...interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.events = append(b.events, Map(
+		"msg", msg,
+		"elapsed", Now().Sub(b.start),
+		InlinePairs, RawMap(pairs),
+	))
+}
+
+// Len() returns the number of messages added so far.
+//
+func (b *Batcher) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.events)
+}
+
+// Close() writes the single log line holding all of the added messages,
+// using 'msg' and 'pairs' as with MMap().  Only the first call to Close()
+// writes anything.  A line is written even if no messages were added.
+//
+func (b *Batcher) Close(msg string, pairs ...interface{}) {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.closed = true
+	events := b.events
+	b.events = nil
+	b.mu.Unlock()
+
+	b.l.MMap(msg, InlinePairs, RawMap(pairs), "events", List(events...))
+}
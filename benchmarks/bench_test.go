@@ -0,0 +1,168 @@
+package benchmarks
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/TyeMcQueen/go-lager"
+	"github.com/rs/zerolog"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// The ways each logger is benchmarked.
+type cases struct {
+	disabled, message, fields, contextFields func()
+}
+
+// A logger to compare and how to set it up to write to 'w'.
+type contender struct {
+	name  string
+	setup func(w io.Writer) cases
+}
+
+var contenders = []contender{
+	{"lager", lagerCases},
+	{"zap", zapCases},
+	{"zerolog", zerologCases},
+}
+
+func lagerCases(w io.Writer) cases {
+	lager.SetOutput(w)
+	lager.Keys("time", "level", "msg", "args", "", "mod")
+	lager.Init("FWNAI")
+	ctx := lager.AddPairs(context.Background(),
+		"method", method, "path", path, "user", user)
+	return cases{
+		disabled: func() { lager.Debug().MMap(msg, "status", status) },
+		message:  func() { lager.Info().MMap(msg) },
+		fields: func() {
+			lager.Info().MMap(msg,
+				"method", method, "path", path, "status", status,
+				"latency", latency, "user", user, "cached", cached,
+				"err", failure)
+		},
+		contextFields: func() {
+			lager.Info(ctx).MMap(msg,
+				"status", status, "latency", latency, "cached", cached,
+				"err", failure)
+		},
+	}
+}
+
+func zapCases(w io.Writer) cases {
+	log := zap.New(zapcore.NewCore(
+		zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
+		zapcore.AddSync(w), zap.InfoLevel))
+	child := log.With(
+		zap.String("method", method), zap.String("path", path),
+		zap.Int64("user", user))
+	return cases{
+		disabled: func() { log.Debug(msg, zap.Int("status", status)) },
+		message:  func() { log.Info(msg) },
+		fields: func() {
+			log.Info(msg,
+				zap.String("method", method), zap.String("path", path),
+				zap.Int("status", status), zap.Duration("latency", latency),
+				zap.Int64("user", user), zap.Bool("cached", cached),
+				zap.NamedError("err", failure))
+		},
+		contextFields: func() {
+			child.Info(msg,
+				zap.Int("status", status), zap.Duration("latency", latency),
+				zap.Bool("cached", cached), zap.NamedError("err", failure))
+		},
+	}
+}
+
+func zerologCases(w io.Writer) cases {
+	log := zerolog.New(w).With().Timestamp().Logger().Level(zerolog.InfoLevel)
+	child := log.With().
+		Str("method", method).Str("path", path).Int64("user", user).Logger()
+	return cases{
+		disabled: func() { log.Debug().Int("status", status).Msg(msg) },
+		message:  func() { log.Info().Msg(msg) },
+		fields: func() {
+			log.Info().
+				Str("method", method).Str("path", path).
+				Int("status", status).Dur("latency", latency).
+				Int64("user", user).Bool("cached", cached).
+				AnErr("err", failure).Msg(msg)
+		},
+		contextFields: func() {
+			child.Info().
+				Int("status", status).Dur("latency", latency).
+				Bool("cached", cached).AnErr("err", failure).Msg(msg)
+		},
+	}
+}
+
+// Runs one case for each contender, after checking that the contender
+// logs what it should (or, if 'keys' is nil, that it logs nothing).
+func bench(b *testing.B, pick func(cases) func(), keys []string) {
+	for _, c := range contenders {
+		c := c
+		b.Run(c.name, func(b *testing.B) {
+			d := &Discard{}
+			log := pick(c.setup(d))
+			log()
+			if nil == keys {
+				if 0 != d.Lines {
+					b.Fatalf("%s logged a disabled line: %s", c.name, d.Last)
+				}
+			} else if err := d.Validate(keys...); nil != err {
+				b.Fatalf("%s: %v", c.name, err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				log()
+			}
+		})
+	}
+}
+
+func BenchmarkDisabled(b *testing.B) {
+	bench(b, func(c cases) func() { return c.disabled }, nil)
+}
+
+func BenchmarkMessage(b *testing.B) {
+	bench(b, func(c cases) func() { return c.message }, []string{})
+}
+
+func BenchmarkFields(b *testing.B) {
+	bench(b, func(c cases) func() { return c.fields }, fieldKeys)
+}
+
+func BenchmarkContextFields(b *testing.B) {
+	bench(b, func(c cases) func() { return c.contextFields }, fieldKeys)
+}
+
+// TestOutputValidity runs each case once per contender so that invalid
+// output is caught by 'go test' without running the benchmarks.
+func TestOutputValidity(t *testing.T) {
+	for _, c := range contenders {
+		for _, tc := range []struct {
+			name string
+			pick func(cases) func()
+			keys []string
+		}{
+			{"Message", func(c cases) func() { return c.message }, nil},
+			{"Fields", func(c cases) func() { return c.fields }, fieldKeys},
+			{"ContextFields",
+				func(c cases) func() { return c.contextFields }, fieldKeys},
+		} {
+			d := &Discard{}
+			tc.pick(c.setup(d))()
+			if err := d.Validate(tc.keys...); nil != err {
+				t.Errorf("%s %s: %v", c.name, tc.name, err)
+			}
+		}
+		d := &Discard{}
+		c.setup(d).disabled()
+		if 0 != d.Lines {
+			t.Errorf("%s logged a disabled line: %s", c.name, d.Last)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+/*
+Package benchmarks compares the cost of logging via Lager with zap and
+zerolog.  Each logger writes the same message and the same pairs, as one
+JSON object per line, to the same kind of destination, and each benchmark
+first checks that the logger's output is a valid JSON object holding all of
+the expected values, so that no logger is measured doing less work.
+
+It is a separate module so that Lager itself does not depend on zap or
+zerolog.  Run the benchmarks via:
+
+	cd benchmarks && go test -bench . -benchmem
+
+The cases are:
+
+	Disabled        A Debug line when only Info and above are enabled.
+	Message         A line with just a message.
+	Fields          A line with a message and 7 pairs of assorted types.
+	ContextFields   Like Fields but 3 of the pairs were bound in advance
+	                (a Context for Lager, a child logger for zap/zerolog).
+*/
+package benchmarks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The values logged by each benchmark.
+var (
+	msg     = "Handled request"
+	method  = "GET"
+	path    = "/api/v1/users/17"
+	status  = 200
+	latency = 1500 * time.Microsecond
+	user    = int64(1234567)
+	cached  = true
+	failure = errors.New("connection reset by peer")
+)
+
+// The keys of the pairs that must be in each line written by the Fields
+// and ContextFields benchmarks.
+var fieldKeys = []string{
+	"method", "path", "status", "latency", "user", "cached", "err"}
+
+// Discard is an io.Writer that throws away what is written to it (like
+// ioutil.Discard) but remembers the last line so its validity can be
+// checked.
+type Discard struct {
+	Last  []byte
+	Lines int
+}
+
+func (d *Discard) Write(p []byte) (int, error) {
+	d.Lines++
+	d.Last = append(d.Last[:0], p...)
+	return len(p), nil
+}
+
+// Validate() returns an error if the last line written to 'd' is not a
+// JSON object holding the message and the given keys.
+func (d *Discard) Validate(keys ...string) error {
+	if 0 == d.Lines {
+		return errors.New("nothing was logged")
+	}
+	obj := make(map[string]interface{})
+	if err := json.Unmarshal(d.Last, &obj); nil != err {
+		return fmt.Errorf("invalid JSON (%v): %s", err, d.Last)
+	}
+	found := false
+	for _, v := range obj {
+		if msg == v {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("no message in %s", d.Last)
+	}
+	for _, key := range keys {
+		if _, ok := obj[key]; !ok {
+			return fmt.Errorf("no %q in %s", key, d.Last)
+		}
+	}
+	return nil
+}
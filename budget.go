@@ -0,0 +1,105 @@
+package lager
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// The limits set via SetRequestBudget().
+var _budgetLines, _budgetBytes int64
+
+// The context key for a request's *budget.
+type budgetKey struct{}
+
+// Tracks how much one request has logged.
+type budget struct {
+	maxLines, maxBytes int64
+	lines, bytes       int64
+	exceeded           int32
+}
+
+// SetRequestBudget() sets how much each request may log before its verbose
+// log lines (Trace, Debug, Obj, and Guts) are suppressed, stopping one
+// pathological request from flooding the logs.  'lines' limits the number
+// of lines and 'bytes' limits their total size (including the newline).  A
+// limit of 0 (or less) means no limit.  Both limits being 0 (the default)
+// disables budgets.
+//
+//      lager.SetRequestBudget(500, 256*1024)
+//
+// Only requests whose Context came from RequestBudget() (which is called by
+// GcpContextReceivedRequest() and GcpReceivedRequest()) are tracked and
+// only lines logged via a Lager that was passed that Context (or one
+// derived from it) are counted.  Lines at every level count toward the
+// budget but only verbose lines are suppressed.
+//
+// When a request first exceeds its budget, a single Warn line is logged
+// (with the request's pairs) noting the limits.  Changing the limits only
+// affects Contexts created afterward.
+//
+func SetRequestBudget(lines, bytes int) {
+	if lines < 0 {
+		lines = 0
+	}
+	if bytes < 0 {
+		bytes = 0
+	}
+	atomic.StoreInt64(&_budgetLines, int64(lines))
+	atomic.StoreInt64(&_budgetBytes, int64(bytes))
+}
+
+// RequestBudget() returns a Context that tracks a new log budget for one
+// request [see SetRequestBudget()].  It returns 'ctx' unchanged if budgets
+// are disabled or if 'ctx' already has a budget.
+//
+func RequestBudget(ctx Ctx) Ctx {
+	lines := atomic.LoadInt64(&_budgetLines)
+	bytes := atomic.LoadInt64(&_budgetBytes)
+	if 0 == lines && 0 == bytes || nil != ctxBudget(ctx) {
+		return ctx
+	}
+	return context.WithValue(
+		ctx, budgetKey{}, &budget{maxLines: lines, maxBytes: bytes})
+}
+
+func ctxBudget(ctx Ctx) *budget {
+	if nil == ctx {
+		return nil
+	}
+	b, _ := ctx.Value(budgetKey{}).(*budget)
+	return b
+}
+
+// Whether log lines at this level are suppressed once over budget.
+func (lev level) verbose() bool {
+	return lTrace <= lev
+}
+
+// charge() counts one log line against the budget.  It returns whether the
+// line should be suppressed and whether this line is the first to exceed
+// the budget.
+func (b *budget) charge(lev level, size int) (suppress, first bool) {
+	lines := atomic.AddInt64(&b.lines, 1)
+	bytes := atomic.AddInt64(&b.bytes, int64(size))
+	if 0 == atomic.LoadInt32(&b.exceeded) {
+		over := 0 < b.maxLines && b.maxLines < lines ||
+			0 < b.maxBytes && b.maxBytes < bytes
+		if !over {
+			return false, false
+		}
+		first = atomic.CompareAndSwapInt32(&b.exceeded, 0, 1)
+	}
+	return lev.verbose(), first
+}
+
+// Logs the one line noting that a request went over its budget.
+func (l *logger) overBudget() {
+	w, ok := l.g.forLevel(lWarn).(*logger)
+	if !ok {
+		return
+	}
+	cp := *w
+	cp.kvp = l.kvp
+	cp.MMap("Request exceeded its log budget; suppressing verbose lines",
+		"lineBudget", l.bud.maxLines, "byteBudget", l.bud.maxBytes)
+}
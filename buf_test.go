@@ -3,9 +3,10 @@ package lager
 import (
 	"bytes"
 	"context"
-	"io"
+	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/TyeMcQueen/go-tutl"
 )
@@ -16,7 +17,7 @@ func TestEscape(t *testing.T) {
 	b := bufPool.Get().(*buffer)
 	b.g = getGlobals()
 	out := &bytes.Buffer{}
-	b.w = out
+	b.w, b.out = out, new(outLock)
 
 	b.escape1Rune('"')
 	u.Is(`\"`, b.buf, `esc1 "`)
@@ -85,19 +86,22 @@ func TestEscape(t *testing.T) {
 	u.Is(`\u0001 \"«x9ABC»\" «»`, b.buf, `b:\x01 "\x9A\xBC" «»`)
 	b.buf = b.buf[0:0]
 
-	b.int(10, 4)
-	u.Is("0010", b.buf, "int(10,4)")
-	b.buf = b.buf[0:0]
+	u.Is("0010", appendDigits(nil, 10, 4), "appendDigits(10,4)")
+	u.Is("07", appendInt2(nil, 7), "appendInt2(7)")
 
 	b.scalar(nLevels)
 	u.Is(`"11"`, b.buf, "nLevels goes to 11")
 	b.buf = b.buf[0:0]
 
-	b.w = io.Discard
 	b.buf = b.buf[0 : 16*1024-10]
+	b.delim = ""
 	b.scalar(1.0 / 3.0)
-	u.Like(b.buf, "b.scalar() lock works", "^0[.]3+$")
-	b.unlock()
+	u.Like(b.buf[16*1024-10:], "b.scalar() grows buffer", "^0[.]3+$")
+	u.Is(16*1024-10+18, len(b.buf), "b.scalar() grows buffer len")
+	out.Reset()
+	b.flush()
+	u.Is(16*1024-10+18, out.Len(), "flush wrote grown buffer")
+	u.Is(0, len(b.buf), "flush empties buffer")
 
 	u.Like(
 		u.GetPanic(func() {
@@ -162,3 +166,249 @@ func TestInit(t *testing.T) {
 
 	defer updateGlobals(setRunningInGcp(false))
 }
+
+func TestDetectGcpEnvironment(t *testing.T) {
+	u := tutl.New(t)
+	defer updateGlobals(setRunningInGcp(getGlobals().inGcp))
+	defer Keys("", "", "", "", "", "")
+	updateGlobals(setRunningInGcp(false))
+
+	vars := []string{"K_SERVICE", "K_REVISION", "FUNCTION_TARGET",
+		"CLOUD_RUN_JOB", "CLOUD_RUN_EXECUTION", "GAE_SERVICE", "GAE_VERSION"}
+	for _, v := range vars {
+		if val, ok := os.LookupEnv(v); ok {
+			defer os.Setenv(v, val)
+		} else {
+			defer os.Unsetenv(v)
+		}
+		os.Unsetenv(v)
+	}
+	pairs := func(m AMap) string {
+		return fmt.Sprint(m.keys, m.vals)
+	}
+
+	u.Is(nil, DetectGcpEnvironment(), "not in GCP")
+	u.Is(false, getGlobals().inGcp, "GCP mode not enabled")
+
+	os.Setenv("K_SERVICE", "api")
+	os.Setenv("K_REVISION", "api-00042")
+	u.Is("[service revision] [api api-00042]",
+		pairs(DetectGcpEnvironment()), "Cloud Run")
+	u.Is(true, getGlobals().inGcp, "GCP mode enabled")
+
+	os.Setenv("FUNCTION_TARGET", "Handle")
+	u.Is("[function service revision] [Handle api api-00042]",
+		pairs(DetectGcpEnvironment()), "Cloud Functions")
+
+	for _, v := range vars {
+		os.Unsetenv(v)
+	}
+	os.Setenv("CLOUD_RUN_JOB", "nightly")
+	os.Setenv("CLOUD_RUN_EXECUTION", "nightly-x7")
+	u.Is("[job execution] [nightly nightly-x7]",
+		pairs(DetectGcpEnvironment()), "Cloud Run job")
+
+	os.Unsetenv("CLOUD_RUN_JOB")
+	os.Setenv("GAE_SERVICE", "default")
+	os.Setenv("GAE_VERSION", "v3")
+	u.Is("[service revision] [default v3]",
+		pairs(DetectGcpEnvironment()), "App Engine")
+}
+
+func TestParseSpanExport(t *testing.T) {
+	u := tutl.New(t)
+	for _, tc := range []struct {
+		in   string
+		rate float64
+		ok   bool
+	}{
+		{"", 0, false}, {"on", 1, true}, {"TRUE", 1, true},
+		{"off", 0, true}, {"no", 0, true}, {"0.25", 0.25, true},
+		{"1.5", 0, false}, {"-1", 0, false}, {"maybe", 0, false},
+	} {
+		rate, ok := parseSpanExport(tc.in)
+		u.Is(tc.rate, rate, "rate for "+tc.in)
+		u.Is(tc.ok, ok, "ok for "+tc.in)
+	}
+}
+
+func TestQuoteCache(t *testing.T) {
+	u := tutl.New(t)
+	b := bufPool.Get().(*buffer)
+	b.g = getGlobals()
+
+	b.quoteCached("cachedKey")
+	b.quoteCached("cachedKey")
+	u.Is(`"cachedKey", "cachedKey"`, b.buf, "cached key")
+	cache := quotedCache.Load().(map[string][]byte)
+	u.Is(`"cachedKey"`, cache["cachedKey"], "key in cache")
+	b.buf = b.buf[0:0]
+	b.delim = ""
+
+	b.quoteCached("<tab>\t")
+	b.quoteCached("<tab>\t")
+	u.Is(`"<tab>\t", "<tab>\t"`, b.buf, "escaped key")
+	cache = quotedCache.Load().(map[string][]byte)
+	_, ok := cache["<tab>\t"]
+	u.Is(true, ok, "escaped key in cache")
+	u.Is(true, nil == cache["<tab>\t"], "escaped key not pre-quoted")
+	b.buf = b.buf[0:0]
+	b.delim = ""
+
+	u.Is(`"time":`, quotedKey("time"), "quotedKey")
+	u.Is(true, nil == quotedKey("a&b"), "quotedKey needs HTML escaping")
+	bufPool.Put(b)
+}
+
+func TestPlainWords(t *testing.T) {
+	u := tutl.New(t)
+	b := bufPool.Get().(*buffer)
+	b.g = getGlobals()
+	defer bufPool.Put(b)
+
+	// Compare to escaping one byte at a time, for every byte at each
+	// position within a word:
+	for m := range escapers {
+		fast := &escapers[m]
+		slow := *fast
+		slow.words = false
+		for c := 0; c < 256; c++ {
+			for pos := 0; pos < 9; pos++ {
+				in := []byte("abcdefgh_ijklmnop")
+				in[pos] = byte(c)
+				b.escapeWith(fast, string(in))
+				got := string(b.buf)
+				b.buf = b.buf[0:0]
+				b.escapeWith(&slow, string(in))
+				if !u.Is(string(b.buf), got, fmt.Sprintf(
+					"mode %d, byte %#x at %d", m, c, pos),
+				) {
+					return
+				}
+				b.buf = b.buf[0:0]
+			}
+		}
+	}
+	u.Is(true, escapers[EscapeDefault].words, "default mode uses words")
+	u.Is(false, escapers[EscapeHTML].words, "HTML mode does not")
+}
+
+var plainText = "Test logging, but use a somewhat realistic message length."
+
+func BenchmarkEscapeASCII(bb *testing.B) {
+	b := bufPool.Get().(*buffer)
+	b.g = getGlobals()
+	bb.SetBytes(int64(len(plainText)))
+	for i := 0; i < bb.N; i++ {
+		b.escape(plainText)
+		b.buf = b.buf[0:0]
+	}
+}
+
+func BenchmarkEscapeMixed(bb *testing.B) {
+	b := bufPool.Get().(*buffer)
+	b.g = getGlobals()
+	text := "Tab:\t, quote:\", «non-ASCII», then " + plainText
+	bb.SetBytes(int64(len(text)))
+	for i := 0; i < bb.N; i++ {
+		b.escape(text)
+		b.buf = b.buf[0:0]
+	}
+}
+
+func TestEscalator(t *testing.T) {
+	u := tutl.New(t)
+	log := &bytes.Buffer{}
+	defer SetOutput(log)()
+	mod := NewModule("escalate").Init("FW")
+	x := &escalator{e: Escalation{
+		Threshold: 3, Period: time.Minute, Levels: "TD",
+		Window: 5 * time.Minute, Module: "escalate",
+	}}
+	x.lastFail = x.fails()
+	now := time.Now()
+
+	mod.Fail().MMap("one")
+	mod.Fail().MMap("two")
+	x.check(now)
+	u.Is("'F''W'", GetModuleLevels("escalate"), "below threshold")
+
+	for i := 0; i < 3; i++ {
+		mod.Fail().MMap("spike")
+	}
+	log.Reset()
+	x.check(now.Add(time.Minute))
+	u.Is("'F''W''T''D'", GetModuleLevels("escalate"), "escalated")
+	u.Like(log.String(), "escalation logged",
+		"Escalating log levels", `"failures":3`, "escalate")
+	u.Is(false, isNoop(mod.Debug()), "debug enabled")
+
+	x.check(now.Add(3 * time.Minute))
+	u.Is("'F''W''T''D'", GetModuleLevels("escalate"), "within window")
+
+	log.Reset()
+	x.check(now.Add(6 * time.Minute))
+	u.Is("'F''W'", GetModuleLevels("escalate"), "restored")
+	u.Like(log.String(), "restore logged", "Restored log levels")
+	u.Is(true, isNoop(mod.Debug()), "debug disabled")
+
+	for i := 0; i < 3; i++ {
+		mod.Fail().MMap("spike")
+	}
+	x.check(now.Add(7 * time.Minute))
+	mod.Init("FWN")
+	x.restore()
+	u.Is("'F''W''N'", GetModuleLevels("escalate"), "changed levels kept")
+
+	defer Init("")
+	Init("-")
+	x = &escalator{e: Escalation{
+		Threshold: 1, Period: time.Minute, Levels: "TD", Window: time.Minute,
+	}}
+	x.lastFail = x.fails()
+	mod.Fail().MMap("spike")
+	x.check(now)
+	u.Is("TD", getGlobals().enabled, "escalated from none")
+	x.check(now.Add(time.Minute))
+	u.Is("", getGlobals().enabled, "restored to none")
+
+	u.Like(u.GetPanic(func() { EscalateOnFailures(Escalation{}) }),
+		"zero threshold", "*positive Threshold")
+	stop := EscalateOnFailures(Escalation{Threshold: 1, Module: "escalate"})
+	stop()
+	stop()
+}
+
+func isNoop(l Lager) bool {
+	switch l.(type) {
+	case noop, mute:
+		return true
+	}
+	return false
+}
+
+func TestShadowCheck(t *testing.T) {
+	u := tutl.New(t)
+	u.Is(nil, shadowCheck(FramingNewline, []byte("[1, \"x\"]\n")), "valid")
+	u.Is(nil, shadowCheck(FramingJSONSeq, []byte("\x1E{\"a\":1}\n")),
+		"valid json-seq")
+	u.Is(nil, shadowCheck(FramingLength, []byte("8 {\"a\":1}\n")),
+		"valid length-prefixed")
+	u.Like(shadowCheck(FramingNewline, []byte("{\"a\":1,}\n")), "invalid",
+		"*invalid character")
+
+	log := &bytes.Buffer{}
+	defer SetOutput(log)()
+	SetShadowCheck(1.0)
+	defer SetShadowCheck(0.0)
+	before := ShadowMismatches()
+	Warn().MMap("Fine", "a", 1, "f", 2.5, "m", Map("x", []string{"y"}))
+	u.Is(before, ShadowMismatches(), "valid line not counted")
+	u.Is(1, bytes.Count(log.Bytes(), []byte("\n")), "no report")
+
+	getGlobals().shadowMismatch([]byte("{\"a\":}\n"),
+		shadowCheck(FramingNewline, []byte("{\"a\":}\n")))
+	u.Is(before+1, ShadowMismatches(), "mismatch counted")
+	u.Like(log.String(), "mismatch logged",
+		"not valid JSON", `"line":"{\\"a\\":}`, "*invalid character")
+}
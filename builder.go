@@ -0,0 +1,131 @@
+package lager
+
+// PairsBuilder accumulates key/value pairs in reusable storage, so that
+// middleware can gather the pairs for each request without allocating a
+// new AMap every time a pair is added.  The pairs are only copied into an
+// (immutable) AMap when AMap() or InContext() is called.
+//
+// A PairsBuilder is not safe for concurrent use.  To reuse one across
+// requests, call Reset() between requests (often via a sync.Pool):
+//
+//      var builders = sync.Pool{New: func() interface{} {
+//          return new(lager.PairsBuilder)
+//      }}
+//
+//      func middleware(w http.ResponseWriter, req *http.Request) {
+//          pb := builders.Get().(*lager.PairsBuilder)
+//          defer builders.Put(pb)
+//          pb.Reset()
+//          pb.Add("method", req.Method, "path", req.URL.Path)
+//          if id := req.Header.Get("X-Request-Id"); "" != id {
+//              pb.Add("requestId", id)
+//          }
+//          req = req.WithContext(pb.InContext(req.Context()))
+//          ...
+//      }
+//
+// The zero value is an empty PairsBuilder ready to use.
+//
+type PairsBuilder struct {
+	keys []string
+	vals []interface{}
+}
+
+// Reset() removes all of the pairs but keeps the storage for reuse.
+//
+func (pb *PairsBuilder) Reset() {
+	for i := range pb.vals {
+		pb.vals[i] = nil // Don't keep the values from being collected.
+	}
+	pb.keys = pb.keys[:0]
+	pb.vals = pb.vals[:0]
+}
+
+// Len() returns the number of pairs added (not counting replaced ones).
+//
+func (pb *PairsBuilder) Len() int {
+	return len(pb.keys)
+}
+
+// Add() adds key/value pairs, like AMap's AddPairs() method.  A pair whose
+// key was already added replaces the prior value (but keeps its position).
+// It returns the PairsBuilder so calls can be chained.
+//
+func (pb *PairsBuilder) Add(pairs ...interface{}) *PairsBuilder {
+	for i := 0; i < len(pairs); i += 2 {
+		if one, ok := pairs[i].(onePair); ok {
+			if key, val, ok := one.onePair(); ok {
+				pb.set(key, val)
+			}
+			i-- // It takes up only one slot.
+			continue
+		}
+		var val interface{}
+		if i+1 < len(pairs) {
+			val = pairs[i+1]
+		}
+		pb.set(S(pairs[i]), val)
+	}
+	return pb
+}
+
+// Merge() adds the pairs from an AMap (which can be nil), like AMap's
+// Merge() method.  It returns the PairsBuilder so calls can be chained.
+//
+func (pb *PairsBuilder) Merge(m AMap) *PairsBuilder {
+	m.Range(func(key string, val interface{}) bool {
+		pb.set(key, val)
+		return true
+	})
+	return pb
+}
+
+// Adds or replaces one pair.  A linear search is used to find duplicate
+// keys since middleware rarely adds more than a few pairs.
+func (pb *PairsBuilder) set(key string, val interface{}) {
+	for i, k := range pb.keys {
+		if k == key {
+			pb.vals[i] = val
+			return
+		}
+	}
+	pb.keys = append(pb.keys, key)
+	pb.vals = append(pb.vals, val)
+}
+
+// AMap() returns a new AMap holding a copy of the pairs (or 'nil' if there
+// are none).  The PairsBuilder can then be changed or Reset() without
+// changing the returned AMap.
+//
+func (pb *PairsBuilder) AMap() AMap {
+	if 0 == len(pb.keys) {
+		return nil
+	}
+	return pb.mergeInto(nil, "")
+}
+
+// InContext() returns a Context holding the pairs from 'ctx' with a copy
+// of the builder's pairs added to them, like AddPairs() (including adding
+// the prefix of a Namespace() Context to the keys).  It returns 'ctx' if
+// there are no pairs.
+//
+func (pb *PairsBuilder) InContext(ctx Ctx) Ctx {
+	if 0 == len(pb.keys) {
+		return ctx
+	}
+	prefix := ""
+	if nil != ctx {
+		prefix, _ = ctx.Value(namespace{}).(string)
+	}
+	return pb.mergeInto(ContextPairs(ctx), prefix).InContext(ctx)
+}
+
+// Returns a copy of 'base' with the builder's pairs added, with 'prefix'
+// added to their keys.
+func (pb *PairsBuilder) mergeInto(base AMap, prefix string) AMap {
+	kv, idx := base.grow(len(pb.keys))
+	for i, key := range pb.keys {
+		kv.set(prefix+key, pb.vals[i], idx)
+	}
+	return kv
+}
@@ -0,0 +1,76 @@
+package lager
+
+import (
+	"context"
+	"runtime/debug"
+	"sync"
+)
+
+var (
+	_buildOnce sync.Once
+	_buildInfo AMap
+)
+
+// BuildInfo() returns key/value pairs describing the build of the running
+// executable, read once via runtime/debug.ReadBuildInfo().  The pairs are
+// "build.module" (the main module's path), "build.version" (its version,
+// often "(devel)"), "build.revision" (the VCS revision), and "build.dirty"
+// (whether the working tree had uncommitted changes).  Pairs for which no
+// information is available are omitted (the VCS details are only recorded
+// by 'go build' when building from within a VCS working tree).
+//
+func BuildInfo() AMap {
+	_buildOnce.Do(func() {
+		bi, ok := debug.ReadBuildInfo()
+		if !ok {
+			return
+		}
+		pairs := make([]interface{}, 0, 8)
+		add := func(key, val string) {
+			if "" != val {
+				pairs = append(pairs, key, val)
+			}
+		}
+		add("build.module", bi.Main.Path)
+		add("build.version", bi.Main.Version)
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				add("build.revision", s.Value)
+			case "vcs.modified":
+				pairs = append(pairs, "build.dirty", "true" == s.Value)
+			}
+		}
+		_buildInfo = Pairs(pairs...)
+	})
+	return _buildInfo
+}
+
+// WithBuildInfo() adds the BuildInfo() pairs to every Fail, Exit, and Panic
+// log line (in the context section) and to the line written by LogStartup().
+// So logs of problems can be correlated with the exact build that produced
+// them.  It returns a function that undoes the change:
+//
+//      defer lager.WithBuildInfo()()
+//
+func WithBuildInfo() func() {
+	ctx := BuildInfo().InContext(context.Background())
+	var prior Ctx
+	updateGlobals(func(g *globals) {
+		prior, g.buildCtx = g.buildCtx, ctx
+	})
+	return func() {
+		updateGlobals(func(g *globals) {
+			g.buildCtx = prior
+		})
+	}
+}
+
+// Adds the build info pairs to 'l' if WithBuildInfo() is in effect and
+// 'lev' is Fail or more severe.
+func (g *globals) withBuild(l Lager, lev level) Lager {
+	if nil == g.buildCtx || lFail < lev {
+		return l
+	}
+	return l.With(g.buildCtx)
+}
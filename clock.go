@@ -0,0 +1,41 @@
+package lager
+
+import (
+	"time"
+)
+
+// SetClock() sets the function that Lager uses to get the current time, so
+// tests and replay tools can log deterministic timestamps and simulations
+// can log in virtual time.  Passing in 'nil' restores the default of
+// time.Now.
+//
+//      now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+//      lager.SetClock(func() time.Time { return now })
+//      defer lager.SetClock(nil)
+//
+// The clock is used for the timestamp of each log line and for the
+// durations that Lager computes [such as the "latency" from GcpHttp(), the
+// "duration" from StartOperation(), or how much the "uptime" from
+// Heartbeat() advances].  Use Now() to get start times that are consistent
+// with it.
+//
+func SetClock(now func() time.Time) {
+	updateGlobals(func(g *globals) {
+		g.clock = now
+	})
+}
+
+// Now() returns the current time according to the clock set via
+// SetClock() [which is time.Now() by default].
+//
+func Now() time.Time {
+	return getGlobals().now()
+}
+
+// Returns the current time according to the configured clock.
+func (g *globals) now() time.Time {
+	if nil != g.clock {
+		return g.clock()
+	}
+	return time.Now()
+}
@@ -0,0 +1,70 @@
+package lager
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"strconv"
+	"time"
+)
+
+// CloudEvent() writes a line that is a CloudEvents 1.0 envelope (in the
+// JSON "structured content mode") rather than a normal log line, so that
+// some events can be routed to an event bus directly from the logs.  It
+// is written to the same place as other log lines (see SetOutput()) and is
+// written regardless of which log levels are enabled.
+//
+//      lager.CloudEvent(ctx, "com.example.order.placed", "/orders",
+//          "order", order.ID, "total", order.Total)
+//
+// could write (as a single line):
+//
+//      {"specversion":"1.0", "type":"com.example.order.placed",
+//          "source":"/orders", "id":"5c1a0b9e64a3f2d1c0e9b8a7f6e5d4c3",
+//          "time":"2019-12-31T23:59:59.123456789Z",
+//          "datacontenttype":"application/json",
+//          "data":{"order":"A123", "total":99.5, "reqID":"x7"}}
+//
+// 'pairs' are key/value pairs like those passed to MMap().  They and any
+// pairs from 'ctx' make up "data".  "id" is random and "time" is when
+// CloudEvent() was called.
+//
+func CloudEvent(ctx Ctx, eventType, source string, pairs ...interface{}) {
+	g := getGlobals()
+	b := bufPool.Get().(*buffer)
+	b.g = g
+	b.w, b.out = os.Stdout, &stdoutLock
+	if nil != g.dest {
+		b.w, b.out = g.dest, g.destOut
+	}
+	b.frame()
+
+	b.open("{") // }
+	b.ownPair("specversion", "1.0")
+	b.ownPair("type", eventType)
+	b.ownPair("source", source)
+	b.ownPair("id", randomID())
+	b.ownPair("time", g.now().UTC().Format(time.RFC3339Nano))
+	b.ownPair("datacontenttype", "application/json")
+	b.quoteCached("data")
+	b.colon()
+	b.open("{") // }
+	b.rawPairs(RawMap(pairs))
+	b.pairs(ContextPairs(ctx))
+	b.close("}")
+	b.close("}\n")
+
+	b.delim = ""
+	b.out.write(b.w, b.line())
+	b.reset()
+	bufPool.Put(b)
+}
+
+// Returns a random ID (for a CloudEvent or an operation).
+func randomID() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); nil != err {
+		return strconv.FormatInt(Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(id[:])
+}
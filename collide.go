@@ -0,0 +1,126 @@
+package lager
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// The prefix of the special keys GCP Cloud Logging uses, like GcpTraceKey.
+const gcpKeyPrefix = "logging.googleapis.com/"
+
+// Whether 'key' is one that GCP Cloud Logging treats specially.
+func gcpSpecialKey(key string) bool {
+	return "httpRequest" == key || strings.HasPrefix(key, gcpKeyPrefix)
+}
+
+// KeyCollisions specifies what happens when a key in logged pairs is the
+// same as a key that Lager uses for its own parts of each log line.  See
+// SetKeyCollisions().
+type KeyCollisions int8
+
+const (
+	// CollisionsAllowed writes colliding keys as is, the default.  This
+	// produces a JSON object with a duplicate key (or, in GCP, a log entry
+	// whose severity, timestamp, etc. may be corrupted).
+	CollisionsAllowed KeyCollisions = iota
+
+	// CollisionsRenamed appends "_" to each colliding key, so logging
+	// "severity" writes "severity_" instead.
+	CollisionsRenamed
+
+	// CollisionsWarned renames colliding keys like CollisionsRenamed and
+	// also writes a Warn log line the first time each key collides.
+	CollisionsWarned
+
+	nKeyCollisions
+)
+
+// Keys that already got a CollisionsWarned warning.
+var _warnedKeys sync.Map
+
+// SetKeyCollisions() sets what happens when a key in the pairs written at
+// the top level of a log line (when logging JSON objects, see Keys()) is
+// also a key that Lager uses for its own parts of the line.  That includes
+// the keys set via Keys() or LAGER_KEYS (so "time", "severity", "message",
+// "data", and "module" when running in GCP) and, when running in GCP, the
+// other keys that GCP uses for the timestamp ("timestamp",
+// "timestampSeconds", and "timestampNanos").  Keys in nested maps and
+// pairs logged while writing a list (the default format) never collide.
+//
+// Special GCP keys like "httpRequest" and "logging.googleapis.com/trace"
+// are not included since Lager (and you) log those on purpose.  But a key
+// starting with "logging.googleapis.com/" that is written more than once at
+// the top level of a line (say, a trace logged explicitly while the context
+// also holds one) collides with itself, so each later copy is renamed.
+//
+//	lager.SetKeyCollisions(lager.CollisionsWarned)
+//
+// Passing in an invalid KeyCollisions value calls panic().
+func SetKeyCollisions(mode KeyCollisions) {
+	if mode < 0 || nKeyCollisions <= mode {
+		panic(fmt.Sprintf("Invalid lager.KeyCollisions (%d)", mode))
+	}
+	updateGlobals(func(g *globals) {
+		g.collisions = mode
+	})
+}
+
+// Whether 'key' is one Lager uses for its own parts of each log line.
+func (g *globals) reservedKey(key string) bool {
+	if k := g.keys; nil != k && "" != key {
+		switch key {
+		case k.when, k.lev, k.msg, k.args, k.ctx, k.mod:
+			return true
+		}
+	}
+	if g.inGcp {
+		switch key {
+		case "timestamp", "timestampSeconds", "timestampNanos":
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the key to write for a key from logged pairs, renaming it if it
+// is written at the top level and collides with a reserved key or with a
+// "logging.googleapis.com/" key already written in this line.
+func (b *buffer) userKey(key string) string {
+	if !b.guard || 1 != b.depth {
+		return key
+	} else if strings.HasPrefix(key, gcpKeyPrefix) {
+		if !b.repeated(key) {
+			return key
+		}
+	} else if !b.g.reservedKey(key) {
+		return key
+	}
+	if CollisionsWarned == b.g.collisions {
+		b.renamed = append(b.renamed, key)
+	}
+	return key + "_"
+}
+
+// Records a "logging.googleapis.com/" key written at the top level of the
+// line, returning 'true' if it was already written.
+func (b *buffer) repeated(key string) bool {
+	for _, k := range b.special {
+		if k == key {
+			return true
+		}
+	}
+	b.special = append(b.special, key)
+	return false
+}
+
+// Writes a Warn line for each key that collided in the line just written
+// (unless a prior line already warned about it).
+func (b *buffer) warnCollisions() {
+	for _, key := range b.renamed {
+		if _, dup := _warnedKeys.LoadOrStore(key, true); !dup {
+			Warn().MMap("Logged key collides with a reserved key",
+				"key", key, "renamedTo", key+"_")
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package lager
+
+import (
+	"compress/gzip"
+	"io"
+	"sync"
+	"time"
+)
+
+// Compressor is a compressing writer.  It is implemented by *gzip.Writer
+// and by compressing writers from other packages (such as zstd.Encoder
+// from github.com/klauspost/compress/zstd).
+type Compressor interface {
+	io.WriteCloser
+	// Flush() writes any pending data such that it can be decompressed.
+	Flush() error
+}
+
+// CompressWriter compresses log lines before writing them, for when logs
+// are written to disk and storage is the bottleneck.  Use NewGzipWriter()
+// or NewCompressWriter() to create one and then pass it to SetOutput().
+//
+// Lager calls Flush() after writing a Panic or Exit log line, so all prior
+// log lines can be decompressed even if the process ends without Close()
+// being called.  But only Close() writes the end of the compressed stream.
+//
+type CompressWriter struct {
+	mu     sync.Mutex
+	c      Compressor
+	closed bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewGzipWriter() returns a CompressWriter that writes log lines to 'w' in
+// gzip format.  See NewCompressWriter() for details.
+//
+//      out := lager.NewGzipWriter(file, 5*time.Second)
+//      defer out.Close()
+//      defer lager.SetOutput(out)()
+//
+func NewGzipWriter(w io.Writer, flushEvery time.Duration) *CompressWriter {
+	return NewCompressWriter(gzip.NewWriter(w), flushEvery)
+}
+
+// NewCompressWriter() returns a CompressWriter that writes log lines via
+// 'c'.  If 'flushEvery' is positive, then a goroutine calls Flush() that
+// often (if anything was logged) so that recent log lines don't sit in the
+// compressor's buffer indefinitely.  Close() stops that goroutine.
+//
+func NewCompressWriter(c Compressor, flushEvery time.Duration) *CompressWriter {
+	cw := &CompressWriter{c: c}
+	if 0 < flushEvery {
+		cw.stop = make(chan struct{})
+		cw.done = make(chan struct{})
+		go cw.flusher(flushEvery, cw.stop)
+	}
+	return cw
+}
+
+// Periodically calls Flush() until Close() is called (closing 'stop').
+func (cw *CompressWriter) flusher(every time.Duration, stop chan struct{}) {
+	defer close(cw.done)
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick.C:
+			cw.Flush()
+		}
+	}
+}
+
+// Write() compresses 'p'.  Writing after Close() returns an error.
+func (cw *CompressWriter) Write(p []byte) (int, error) {
+	defer AutoLock(&cw.mu)()
+	if cw.closed {
+		return 0, io.ErrClosedPipe
+	}
+	return cw.c.Write(p)
+}
+
+// Flush() writes any pending compressed data.
+func (cw *CompressWriter) Flush() error {
+	defer AutoLock(&cw.mu)()
+	if cw.closed {
+		return nil
+	}
+	return cw.c.Flush()
+}
+
+// Close() stops any periodic flushing and writes the end of the compressed
+// stream.  It does not close the io.Writer passed to NewGzipWriter().  Be
+// sure to stop logging to the CompressWriter first [such as by calling the
+// function returned from SetOutput()].
+//
+func (cw *CompressWriter) Close() error {
+	cw.mu.Lock()
+	stop := cw.stop
+	cw.stop = nil
+	cw.mu.Unlock()
+	if nil != stop {
+		close(stop)
+		<-cw.done
+	}
+	defer AutoLock(&cw.mu)()
+	if cw.closed {
+		return nil
+	}
+	cw.closed = true
+	return cw.c.Close()
+}
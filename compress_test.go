@@ -0,0 +1,66 @@
+package lager_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/TyeMcQueen/go-lager"
+	"github.com/TyeMcQueen/go-lager/buffer"
+	"github.com/TyeMcQueen/go-tutl"
+)
+
+func gunzip(b []byte) (string, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if nil != err {
+		return "", err
+	}
+	out, err := io.ReadAll(r)
+	return string(out), err
+}
+
+func TestGzipWriter(t *testing.T) {
+	u := tutl.New(t)
+	file := new(buffer.AsyncBuffer)
+	out := lager.NewGzipWriter(file, time.Hour)
+	restore := lager.SetOutput(out)
+
+	lager.Note().MMap("compressed")
+	u.Is(nil, u.GetPanic(func() {
+		defer lager.ExitViaPanic()(func(x *int) { *x = -1 })
+		lager.Exit().MMap("exiting")
+	}), "exit via panic")
+	text, err := gunzip(file.Bytes())
+	u.Is(io.ErrUnexpectedEOF, err, "flushed but not closed")
+	u.Like(text, "flushed on exit", `"compressed"`, `"exiting"`)
+
+	lager.Note().MMap("closing")
+	restore()
+	u.Is(nil, out.Close(), "close")
+	u.Is(nil, out.Close(), "close twice")
+	text, err = gunzip(file.Bytes())
+	u.Is(nil, err, "closed stream")
+	u.Like(text, "closed stream", `"compressed"`, `"exiting"`, `"closing"`)
+
+	_, err = out.Write([]byte("late\n"))
+	u.Is(io.ErrClosedPipe, err, "write after close")
+}
+
+func TestGzipFlusher(t *testing.T) {
+	u := tutl.New(t)
+	file := new(buffer.AsyncBuffer)
+	out := lager.NewGzipWriter(file, time.Millisecond)
+	defer out.Close()
+	out.Write([]byte("periodic\n"))
+
+	text := ""
+	var data []byte
+	for i := 0; i < 500 && "" == text; i++ {
+		time.Sleep(time.Millisecond)
+		data = append(data, file.ReadAll()...)
+		text, _ = gunzip(data)
+	}
+	u.Is("periodic\n", text, "flushed periodically")
+}
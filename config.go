@@ -0,0 +1,135 @@
+package lager
+
+import (
+	"os"
+	"sort"
+	"sync"
+)
+
+// So LogStartup() only logs once.
+var _startupOnce sync.Once
+
+// LogStartup() writes a single Note log line that records the effective
+// Lager configuration along with the passed-in key/value pairs (usually
+// build information like a version number or commit ID).  So every process
+// start can be found and identified in aggregated logs.  Only the first call
+// to LogStartup() logs anything; subsequent calls do nothing.
+//
+//      func main() {
+//          lager.LogStartup("version", version, "commit", commit)
+//          ...
+//      }
+//
+// The configuration is logged under the key "lager" as a map with keys
+// "levels", "keys" (omitted unless lager.Keys() are in use), "gcp",
+// "modules" (omitted if no modules exist yet), "pathParts", "spanPrefix",
+// "spanExport", and "pid".  If WithBuildInfo() is in effect, then the
+// BuildInfo() pairs are included (after "lager").
+//
+func LogStartup(pairs ...interface{}) {
+	_startupOnce.Do(func() {
+		var build AMap
+		if nil != getGlobals().buildCtx {
+			build = BuildInfo()
+		}
+		Note().MMap("Process starting",
+			"lager", Config(), InlinePairs, build, InlinePairs, RawMap(pairs))
+	})
+}
+
+// Config() returns the current Lager configuration as a value suitable for
+// logging (see LogStartup() for details).
+//
+func Config() RawMap {
+	g := getGlobals()
+	var keys []string
+	if nil != g.keys {
+		k := g.keys
+		keys = []string{k.when, k.lev, k.msg, k.args, k.ctx, k.mod}
+	}
+	mods := GetModules()
+	modLevels := make(map[string]interface{}, len(mods))
+	for name, levels := range mods {
+		modLevels[name] = levels
+	}
+	return Map(
+		"levels", g.enabled,
+		Unless(nil == keys, "keys"), keys,
+		"gcp", g.inGcp,
+		Unless(0 == len(modLevels), "modules"), modLevels,
+		"pathParts", g.pathParts,
+		"spanPrefix", g.spanPrefix,
+		"spanExport", g.spanExport,
+		"pid", os.Getpid(),
+	)
+}
+
+// EnvVar describes one environment variable that Lager recognizes.  See
+// EnvUsage().
+//
+type EnvVar struct {
+	Name        string // Like "LAGER_LEVELS".
+	Value       string // The current value (as found in the environment).
+	Set         bool   // Whether the variable is set in the environment.
+	Description string // One sentence describing the variable's purpose.
+}
+
+// The environment variables Lager reads (other than those for Modules).
+var envVars = []EnvVar{
+	{Name: "LAGER_LEVELS", Description: "Letters from \"FWNAITDOG\" " +
+		"(or level names like \"error,warn,info\") selecting which log " +
+		"levels are enabled (default \"FWNA\")."},
+	{Name: "LAGER_MIN_LEVEL", Description: "The name (or letter) of the " +
+		"least severe log level to enable, like \"Debug\" (enables " +
+		"Debug and all more severe levels).  Overrides LAGER_LEVELS."},
+	{Name: "LAGER_KEYS", Description: "6 comma-separated keys for " +
+		"timestamp, level, message, arguments, context, and module that " +
+		"make each log line a JSON object instead of a JSON list."},
+	{Name: "LAGER_GCP", Description: "If not empty, log in the format " +
+		"that works best with GCP Cloud Logging."},
+	{Name: "LAGER_SPAN_PREFIX", Description: "The prefix for the names of " +
+		"trace spans (defaults to the name of the executable)."},
+	{Name: "LAGER_SPAN_EXPORT", Description: "The fraction of new traces " +
+		"whose spans are exported, like \"0.1\", or \"off\" to only use " +
+		"trace IDs to correlate log lines (default \"on\")."},
+	{Name: "LAGER_STDERR_LEVELS", Description: "Letters from " +
+		"\"FWNAITDOG\" (or level names) selecting which log levels are " +
+		"written to stderr instead of stdout (default \"\")."},
+	{Name: "LAGER_STDOUT_FALLBACK", Description: "A file to append log " +
+		"lines to if writing them to stdout (or stderr) fails."},
+	{Name: "GCP_PROJECT_ID", Description: "The GCP project ID, so " +
+		"GcpProjectID() need not ask the GCP metadata service."},
+}
+
+// EnvUsage() returns a description of each environment variable that Lager
+// recognizes, including the LAGER_{module}_LEVELS variable for each Module
+// that exists so far (in order by module name), along with its current
+// value.  So a service can include Lager's configuration in a help screen:
+//
+//      for _, v := range lager.EnvUsage() {
+//          fmt.Printf("%s=%q\n    %s\n", v.Name, v.Value, v.Description)
+//      }
+//
+func EnvUsage() []EnvVar {
+	mods := GetModules()
+	names := make([]string, 0, len(mods))
+	for name := range mods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	vars := make([]EnvVar, 0, len(envVars)+len(names))
+	vars = append(vars, envVars...)
+	for _, name := range names {
+		vars = append(vars, EnvVar{
+			Name: "LAGER_" + name + "_LEVELS",
+			Description: "Letters from \"FWNAITDOG\" (or level names " +
+				"like \"error,warn,info\") selecting which log levels " +
+				"are enabled for the " + name + " module.",
+		})
+	}
+	for i := range vars {
+		vars[i].Value, vars[i].Set = os.LookupEnv(vars[i].Name)
+	}
+	return vars
+}
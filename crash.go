@@ -0,0 +1,73 @@
+package lager
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// The most crash output that CaptureCrashOutput() will log.
+const maxCrashOutput = 64 * 1024
+
+// CaptureCrashOutput() makes the Go runtime also write the output of a
+// fatal crash (such as an unrecovered panic in any goroutine, with the
+// stack traces of all goroutines) to the file at 'path'.  Such output is
+// normally only written to stderr, unstructured, where it is easily lost.
+//
+// Call it early in main().  If the file already holds output from a prior
+// run that crashed, then that output is first logged as an Exit line (that
+// does not cause an exit), with the output split into lines as
+// "crashOutput", along with "crashFile" and "crashTime" (when the file was
+// last written).  Then the file is truncated.
+//
+//      if err := lager.CaptureCrashOutput("/var/run/myapp.crash"); nil != err {
+//          lager.Warn().MMap("Can't capture crash output", "err", err)
+//      }
+//
+// Only the first 64KiB of prior crash output is logged.  Directing crash
+// output to the file requires Go 1.23 or later; with older versions, prior
+// output is still logged but an error is returned.
+//
+func CaptureCrashOutput(path string) error {
+	if err := replayCrash(path); nil != err {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if nil != err {
+		return err
+	}
+	defer f.Close() // The runtime keeps its own copy of the descriptor.
+	return setCrashOutput(f)
+}
+
+// Logs the crash output left in 'path' by a prior run (if any).
+func replayCrash(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if nil != err {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if nil != err {
+		return err
+	}
+	out, err := ioutil.ReadAll(io.LimitReader(f, maxCrashOutput))
+	if nil != err {
+		return err
+	}
+	if 0 == len(out) {
+		return nil
+	}
+	l := getGlobals().forLevel(lExit).(*logger)
+	cp := *l
+	cp.noExit = true
+	cp.MMap("Prior run crashed",
+		"crashOutput", Lines(string(out)),
+		Unless(info.Size() <= maxCrashOutput, "crashBytes"), info.Size(),
+		"crashFile", path,
+		"crashTime", info.ModTime().UTC().Format(time.RFC3339Nano))
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !go1.23
+
+package lager
+
+import (
+	"errors"
+	"os"
+)
+
+func setCrashOutput(_ *os.File) error {
+	return errors.New("lager.CaptureCrashOutput() requires Go 1.23 or later")
+}
@@ -3,6 +3,9 @@ package lager
 import (
 	"context"
 	"fmt"
+	"math"
+	"sort"
+	"strings"
 )
 
 type skipThisPair string
@@ -18,6 +21,8 @@ type inlinePairs string
 // InlinePairs can be used as a "label" to indicate that the following
 // value that contains label-subvalue pairs (a value of type AMap or RawMap)
 // should be treated as if the pairs had been passed in at that higher level.
+// The value can also be a 'func() interface{}' that returns such a value,
+// so the pairs are only built if the line is actually logged.
 //
 //      func Assert(pairs ...interface{}) {
 //          lager.Fail().MMap("Assertion failed", lager.InlinePairs, pairs)
@@ -25,6 +30,60 @@ type inlinePairs string
 //
 const InlinePairs = inlinePairs("")
 
+type errPair struct{ err error }
+
+// Err() is used in place of a key/value pair (it takes up only one slot in
+// the list of pairs) to log an error under the key set via SetErrorKey()
+// ("err" by default) so that the key used for errors is consistent across
+// a code base:
+//
+//      lager.Fail(ctx).MMap("Can't merge", "dest", dest, lager.Err(err))
+//
+// The logged value is a map containing "msg" (the result of err.Error()),
+// "type" (the Go type of 'err'), and, if formatting 'err' via "%+v" gives
+// more details than err.Error() does (such as errors that record a stack
+// trace), "stack" which is a list of the lines of that extra detail.  If
+// 'err' is 'nil', then nothing is logged (like when lager.Unless() is used).
+//
+// Err() is only special when used as the key in the arguments to a [C]Map()
+// or [C]MMap() method or to lager.Map().
+//
+func Err(err error) interface{} { return errPair{err} }
+
+type exitCodePair struct{ code int }
+
+// ExitCode() is used in place of a key/value pair (it takes up only one
+// slot in the list of pairs) to set the status that lager.Exit() exits
+// with, both when it calls os.Exit() directly and when it is deferred via
+// ExitViaPanic().  So operational tooling can tell different reasons for
+// exiting apart (such as misconfiguration vs. a dependency being down):
+//
+//      lager.Exit().MMap("Invalid config", "file", path, lager.ExitCode(3))
+//
+// It is logged as an "exitCode" pair.  If it is used more than once in a
+// line, the last one wins.  It only sets the status when it is one of the
+// line's own pairs (including those inlined via InlinePairs), not when it
+// is inside of a nested value like Map(ExitCode(3)).  It has no effect at
+// levels other than Exit except that the pair is logged.  Handlers passed
+// to RecoverPanicToExit() are given the code (instead of 1) and can still
+// change it.
+//
+func ExitCode(code int) interface{} { return exitCodePair{code} }
+
+// errDetails() returns the value logged for lager.Err(err).
+func errDetails(err error) RawMap {
+	msg := err.Error()
+	var stack []string
+	if full := fmt.Sprintf("%+v", err); full != msg {
+		stack = strings.Split(strings.TrimPrefix(full, msg+"\n"), "\n")
+	}
+	return Map(
+		"msg", msg,
+		"type", fmt.Sprintf("%T", err),
+		Unless(0 == len(stack), "stack"), stack,
+	)
+}
+
 // Storage for an ordered list of key/value pairs (without duplicate keys).
 type KVPairs struct {
 	keys []string
@@ -86,6 +145,27 @@ func S(arg interface{}) string {
 //
 func List(args ...interface{}) AList { return args }
 
+// lager.Lines() splits multi-line text (such as the output of a subprocess
+// or a stack trace from another language) into a list (lager.AList) of
+// lines, which is much easier to read in log viewers than one string full
+// of "\n" escapes.  A single trailing newline is ignored, as is a "\r"
+// at the end of each line.
+//
+//      lager.Fail().MMap("Command failed", "output", lager.Lines(out))
+//
+func Lines(s string) AList {
+	s = strings.TrimSuffix(s, "\n")
+	if "" == s {
+		return AList{}
+	}
+	parts := strings.Split(s, "\n")
+	lines := make(AList, len(parts))
+	for i, line := range parts {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	return lines
+}
+
 // lager.Map() returns a raw list of key/value pairs (lager.RawMap) that can
 // be passed as an argument to a Lager's [C][M]Map() or [C][M]List() method
 // to construct nested data that can be quickly serialized to JSON.  I.e.:
@@ -105,32 +185,88 @@ func Pairs(pairs ...interface{}) AMap {
 	return AMap(nil).AddPairs(pairs...)
 }
 
-// Unless() is used to pass an optional label+value pair to Map().  Use
-// Unless() to specify the label and, if the value is unsafe or expensive to
-// compute, then wrap it in a deferring function:
+// Add/update Lager key/value pairs to/in a context.Context.  If 'ctx' is
+// from Namespace(), then each key is prefixed with the namespace.
+func AddPairs(ctx Ctx, pairs ...interface{}) Ctx {
+	if 0 == len(pairs) {
+		return ctx
+	}
+	if nil != ctx {
+		if ns, ok := ctx.Value(namespace{}).(string); ok && "" != ns {
+			pairs = prefixKeys(ns, pairs)
+		}
+	}
+	return ContextPairs(ctx).AddPairs(pairs...).InContext(ctx)
+}
+
+// Adds pairs to 'ctx' like AddPairs() but never prefixes their keys with a
+// Namespace(), for pairs that Lager adds (such as the trace or operation)
+// whose keys must not change for them to be recognized.
+func rawPairs(ctx Ctx, pairs ...interface{}) Ctx {
+	return ContextPairs(ctx).AddPairs(pairs...).InContext(ctx)
+}
+
+// Used to store the current namespace in a Context.
+type namespace struct{}
+
+// Namespace() returns a Context such that any pairs later added to it via
+// AddPairs() have their keys prefixed with 'name' and ".".  This lets
+// independent packages that share a request's Context add pairs without
+// their keys colliding.  A library would usually do something like:
 //
-//      lager.Debug().Map(
-//          "Ran", stage,
-//          // Don't include `"Error": null,` in the log:
-//          lager.Unless(nil == err, "Error"), err,
-//          // Don't call config.Proxy() if config is nil:
-//          lager.Unless(nil == config, "Proxy"),
-//              func() interface{} { return config.Proxy() },
-//      )
+//      func (c *Client) Fetch(ctx context.Context, id string) error {
+//          lctx := lager.AddPairs(lager.Namespace(ctx, "fetcher"), "id", id)
+//          // Logs `"fetcher.id":"..."` along with the caller's pairs:
+//          lager.Debug(lctx).MMap("Fetching")
+//          ...
+//      }
+//
+// Namespaces nest, so Namespace(Namespace(ctx, "a"), "b") prefixes keys
+// with "a.b.".  Pass in "" for 'name' to get a Context where keys are no
+// longer prefixed.  Pairs already in the Context are not changed and the
+// namespace only applies to pairs added via the AddPairs() function, not
+// to pairs passed directly to MMap() and similar methods.  Nor does it
+// apply to pairs that Lager adds for its own purposes, like those from
+// StartOperation() and GcpContextReceivedRequest().  Passing in a 'nil'
+// 'ctx' is the same as passing in context.Background().
 //
-func Unless(cond bool, label string) interface{} {
-	if !cond {
-		return label
+func Namespace(ctx Ctx, name string) Ctx {
+	if nil == ctx {
+		ctx = context.Background()
 	}
-	return SkipThisPair
+	if "" != name {
+		if ns, ok := ctx.Value(namespace{}).(string); ok {
+			name = ns + name
+		}
+		name += "."
+	}
+	return context.WithValue(ctx, namespace{}, name)
 }
 
-// Add/update Lager key/value pairs to/in a context.Context.
-func AddPairs(ctx Ctx, pairs ...interface{}) Ctx {
-	if 0 == len(pairs) {
-		return ctx
+// prefixKeys() returns a copy of 'pairs' with 'prefix' added to each key,
+// other than the special InlinePairs and SkipThisPair values.  Values like
+// KV() that take up only one slot become a regular, prefixed pair.
+//
+func prefixKeys(prefix string, pairs []interface{}) []interface{} {
+	out := make([]interface{}, 0, len(pairs))
+	for i := 0; i < len(pairs); i += 2 {
+		switch k := pairs[i].(type) {
+		case onePair:
+			if key, val, ok := k.onePair(); ok {
+				out = append(out, prefix+key, val)
+			}
+			i-- // It takes up only one slot.
+			continue
+		case inlinePairs, skipThisPair:
+			out = append(out, k)
+		default:
+			out = append(out, prefix+S(k))
+		}
+		if i+1 < len(pairs) {
+			out = append(out, pairs[i+1])
+		}
 	}
-	return ContextPairs(ctx).AddPairs(pairs...).InContext(ctx)
+	return out
 }
 
 // Fetches the lager key/value pairs stored in a context.Context.
@@ -148,6 +284,71 @@ func ContextPairs(ctx Ctx) AMap {
 	panic(fmt.Sprintf("Invalid type (%T not *lager.KVPairs) in context", x))
 }
 
+// PairFromContext() returns the value of the pair with the given key that
+// was added to 'ctx' via AddPairs() (or similar) and 'true'.  If there is
+// no such pair, then it returns 'nil' and 'false'.  So middleware can read
+// back values (like a request ID) that an earlier layer stored without
+// having to also store them under a separate Context key:
+//
+//      if id, ok := lager.StringFromContext(ctx, "requestId"); ok {
+//          w.Header().Set("X-Request-Id", id)
+//      }
+//
+// The value is returned as it was stored; for example, a func() value is
+// not called.  Keys given to Namespace() Contexts include the prefix.
+//
+func PairFromContext(ctx Ctx, key string) (interface{}, bool) {
+	return ContextPairs(ctx).Get(key)
+}
+
+// StringFromContext() is like PairFromContext() but only succeeds if the
+// value is a string (or []byte, which is converted to a string).
+//
+func StringFromContext(ctx Ctx, key string) (string, bool) {
+	val, _ := PairFromContext(ctx, key)
+	switch v := val.(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	}
+	return "", false
+}
+
+// IntFromContext() is like PairFromContext() but only succeeds if the value
+// is of one of Go's integer types that fits in an int64.
+//
+func IntFromContext(ctx Ctx, key string) (int64, bool) {
+	val, _ := PairFromContext(ctx, key)
+	switch v := val.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint:
+		if uint64(v) <= math.MaxInt64 {
+			return int64(v), true
+		}
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		if v <= math.MaxInt64 {
+			return int64(v), true
+		}
+	}
+	return 0, false
+}
+
 // Get a new context with this map stored in it.
 func (p AMap) InContext(ctx Ctx) Ctx {
 	return context.WithValue(ctx, noop{}, p)
@@ -156,44 +357,20 @@ func (p AMap) InContext(ctx Ctx) Ctx {
 // Return an AMap with the keys/values from the passed-in AMap added to and/or
 // replacing the keys/values from the method receiver.
 func (a AMap) Merge(b AMap) AMap {
-	m := 0
-	if nil != a {
-		m = len(a.keys)
-	}
+	m := a.size()
 	if 0 == m {
 		return b
 	}
-
-	n := 0
-	if nil != b {
-		n = len(b.keys)
-	}
+	n := b.size()
 	if 0 == n {
 		return a
 	}
 
-	keys := make([]string, m+n)
-	vals := make([]interface{}, m+n)
-	idx := make(map[string]int, m+n)
-	copy(keys, a.keys)
-	copy(vals, a.vals)
-	for i, k := range a.keys {
-		idx[k] = i
-	}
-
-	o := m
+	kv, idx := a.grow(n)
 	for i, key := range b.keys {
-		val := b.vals[i]
-		if j, ok := idx[key]; ok {
-			vals[j] = val
-		} else {
-			keys[o] = key
-			vals[o] = val
-			idx[key] = o
-			o++
-		}
+		kv.set(key, b.vals[i], idx)
 	}
-	return &KVPairs{keys: keys[:o], vals: vals[:o]}
+	return kv
 }
 
 // Return an AMap with the passed-in key/value pairs added to and/or replacing
@@ -205,36 +382,160 @@ func (p AMap) AddPairs(pairs ...interface{}) AMap {
 	}
 	n = (n + 1) / 2
 
-	m := 0
-	if nil != p {
-		m = len(p.keys)
+	kv, idx := p.grow(n)
+	for i := 0; i < len(pairs); i += 2 {
+		if one, ok := pairs[i].(onePair); ok {
+			if key, val, ok := one.onePair(); ok {
+				kv.set(key, val, idx)
+			}
+			i-- // It takes up only one slot.
+			continue
+		}
+		val := interface{}(nil)
+		if i+1 < len(pairs) {
+			val = pairs[i+1]
+		}
+		kv.set(S(pairs[i]), val, idx)
+	}
+	return kv
+}
+
+// An AMap that holds up to this many pairs is allocated as a single chunk
+// of memory.  This trades bytes for allocations: each AddPairs() still
+// copies the prior pairs (AMaps never share storage), and a chunk always
+// has room for 'smallPairs' pairs, so adding one pair at a time uses more
+// bytes than allocating exactly-sized slices would (but fewer allocations).
+// See BenchmarkAddPairs (which reports both).
+const smallPairs = 8
+
+// Duplicate keys are found via a linear search unless more than this many
+// key comparisons might be needed, which is rare.
+const maxScans = 256
+
+// A KVPairs along with the storage for its (few) keys and values, so that
+// only one allocation is needed when building small AMaps.
+type pairsChunk struct {
+	kv   KVPairs
+	keys [smallPairs]string
+	vals [smallPairs]interface{}
+}
+
+// Return the number of pairs in the AMap (which can be nil).
+func (p AMap) size() int {
+	if nil == p {
+		return 0
 	}
+	return len(p.keys)
+}
 
-	keys := make([]string, m+n)
-	vals := make([]interface{}, m+n)
-	idx := make(map[string]int, m+n)
-	if nil != p {
-		copy(keys, p.keys)
-		copy(vals, p.vals)
-		for i, k := range p.keys {
-			idx[k] = i
+// Len() returns the number of pairs in the AMap (which can be nil).
+func (p AMap) Len() int {
+	return p.size()
+}
+
+// Keys() returns a copy of the keys in the AMap (which can be nil), in order.
+func (p AMap) Keys() []string {
+	if 0 == p.size() {
+		return nil
+	}
+	return append([]string(nil), p.keys...)
+}
+
+// Get() returns the value for 'key' and 'true' or, if the AMap (which can
+// be nil) has no such key, 'nil' and 'false'.
+//
+func (p AMap) Get(key string) (interface{}, bool) {
+	for i := 0; i < p.size(); i++ {
+		if key == p.keys[i] {
+			return p.vals[i], true
 		}
 	}
-	o := m
-	for i := 0; i < n; i++ {
-		key := S(pairs[2*i])
-		val := interface{}(nil)
-		if 2*i+1 < len(pairs) {
-			val = pairs[2*i+1]
+	return nil, false
+}
+
+// Range() calls 'f' for each pair in the AMap (which can be nil), in
+// order, until 'f' returns 'false'.
+//
+func (p AMap) Range(f func(key string, val interface{}) bool) {
+	for i := 0; i < p.size(); i++ {
+		if !f(p.keys[i], p.vals[i]) {
+			return
+		}
+	}
+}
+
+// Return a new AMap holding a copy of the receiver's pairs and with room
+// for 'n' more pairs.  Also returns a map from key to index, unless there
+// are few enough pairs that a linear search is faster.  The receiver is
+// never modified so AMaps can be shared freely (such as between Contexts).
+func (p AMap) grow(n int) (AMap, map[string]int) {
+	m := p.size()
+	var kv *KVPairs
+	if m+n <= smallPairs {
+		c := new(pairsChunk)
+		kv = &c.kv
+		kv.keys = c.keys[:m]
+		kv.vals = c.vals[:m]
+	} else {
+		kv = &KVPairs{
+			keys: make([]string, m, m+n),
+			vals: make([]interface{}, m, m+n),
+		}
+	}
+	if 0 < m {
+		copy(kv.keys, p.keys)
+		copy(kv.vals, p.vals)
+	}
+
+	var idx map[string]int
+	if maxScans < n*(m+n) {
+		idx = make(map[string]int, m+n)
+		for i, k := range kv.keys {
+			idx[k] = i
 		}
+	}
+	return kv, idx
+}
+
+// Add or replace one key/value pair in an AMap allocated by grow().
+func (p AMap) set(key string, val interface{}, idx map[string]int) {
+	if nil != idx {
 		if j, ok := idx[key]; ok {
-			vals[j] = val
-		} else {
-			keys[o] = key
-			vals[o] = val
-			idx[key] = o
-			o++
+			p.vals[j] = val
+			return
+		}
+		idx[key] = len(p.keys)
+	} else {
+		for j, k := range p.keys {
+			if k == key {
+				p.vals[j] = val
+				return
+			}
 		}
 	}
-	return &KVPairs{keys: keys[:o], vals: vals[:o]}
+	p.keys = append(p.keys, key)
+	p.vals = append(p.vals, val)
+}
+
+// Return a copy of the AMap with the pairs sorted by key.
+func (p AMap) sorted() AMap {
+	if nil == p {
+		return nil
+	}
+	idx := make([]int, len(p.keys))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Slice(idx, func(i, j int) bool {
+		return p.keys[idx[i]] < p.keys[idx[j]]
+	})
+	kv := &KVPairs{
+		keys: make([]string, len(idx)),
+		vals: make([]interface{}, len(idx)),
+	}
+	for i, j := range idx {
+		kv.keys[i] = p.keys[j]
+		kv.vals[i] = p.vals[j]
+	}
+	return kv
 }
@@ -0,0 +1,214 @@
+package lager
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// Encoder writes one JSON value into a log line on behalf of a function
+// registered via RegisterEncoder().  Only the first value written via an
+// Encoder is used; later calls do nothing.  If no value is written, then
+// 'null' is logged.
+//
+type Encoder struct {
+	b     *buffer
+	wrote bool
+}
+
+// The registered encoders (an *encoders).
+var _encoders atomic.Value
+
+// Held while _encoders is being updated.
+var _encodersMu sync.Mutex
+
+type encodeFunc = func(*Encoder, interface{})
+
+// The encoders registered for specific types and for interfaces.  A new
+// one is built for each registration, so 'cache' never holds stale results.
+type encoders struct {
+	byType map[reflect.Type]encodeFunc
+	ifaces []reflect.Type // Interface types in the order registered.
+	cache  sync.Map       // reflect.Type -> encodeFunc (maybe nil).
+}
+
+// RegisterEncoder() teaches Lager how to log values of the given type, so
+// domain types (UUIDs, decimals, etc.) can be logged efficiently and
+// consistently rather than via their String() method or json.Marshal().
+// The encoder is used wherever such a value is logged, including in nested
+// maps and lists and in pairs from contexts.  Passing in a 'nil' encoder
+// removes the registration for the type.
+//
+//      lager.RegisterEncoder(reflect.TypeOf(decimal.Decimal{}),
+//          func(enc *lager.Encoder, v interface{}) {
+//              enc.RawJSON([]byte(v.(decimal.Decimal).String()))
+//          })
+//
+// If 't' is an interface type, then the encoder is used for values of any
+// type that implements the interface and that has no encoder registered
+// for it specifically.  If several such interfaces match, the one that was
+// registered first is used.
+//
+// The encoder must not log via Lager and must not pass a value of the same
+// type to Value() (which would recurse forever).  If the encoder panics,
+// then a string describing the panic is logged in place of the value and
+// the panic is reported via InternalErrors().
+//
+func RegisterEncoder(t reflect.Type, encode func(*Encoder, interface{})) {
+	defer AutoLock(&_encodersMu)()
+	e := &encoders{byType: make(map[reflect.Type]encodeFunc)}
+	if old, _ := _encoders.Load().(*encoders); nil != old {
+		for k, f := range old.byType {
+			e.byType[k] = f
+		}
+		for _, it := range old.ifaces {
+			if it != t || nil != encode {
+				e.ifaces = append(e.ifaces, it)
+			}
+		}
+	}
+	_, had := e.byType[t]
+	if nil == encode {
+		delete(e.byType, t)
+	} else {
+		e.byType[t] = encode
+		if reflect.Interface == t.Kind() && !had {
+			e.ifaces = append(e.ifaces, t)
+		}
+	}
+	if 0 == len(e.byType) {
+		e = nil
+	}
+	_encoders.Store(e)
+}
+
+// Returns the registered encoder for the type of 'v' (if any).
+func encoderFor(v interface{}) encodeFunc {
+	e, _ := _encoders.Load().(*encoders)
+	if nil == e || nil == v {
+		return nil
+	}
+	t := reflect.TypeOf(v)
+	if f, ok := e.byType[t]; ok {
+		return f
+	}
+	if 0 == len(e.ifaces) {
+		return nil
+	}
+	if f, ok := e.cache.Load(t); ok {
+		return f.(encodeFunc)
+	}
+	var found encodeFunc
+	for _, it := range e.ifaces {
+		if t.Implements(it) {
+			found = e.byType[it]
+			break
+		}
+	}
+	e.cache.Store(t, found)
+	return found
+}
+
+// Uses a registered encoder to append a value to the log line.  If the
+// encoder panics, then whatever it wrote is replaced by a string describing
+// the panic and the panic is reported via InternalErrors().
+func (b *buffer) encode(f encodeFunc, v interface{}) {
+	e := Encoder{b: b}
+	size, delim, depth := len(b.buf), b.delim, b.depth
+	defer func() {
+		if p := recover(); nil != p {
+			err := fmt.Errorf("encoder for %T panicked: %v", v, p)
+			internalError("encoder", err)
+			b.buf, b.delim, b.depth = b.buf[:size], delim, depth
+			b.quote("! ", err.Error())
+		}
+	}()
+	f(&e, v)
+	if !e.wrote {
+		b.scalar(nil)
+	}
+}
+
+// Whether this is the first value written (which also marks it written).
+func (e *Encoder) first() bool {
+	if e.wrote {
+		return false
+	}
+	e.wrote = true
+	return true
+}
+
+// String() writes a JSON string.
+func (e *Encoder) String(s string) {
+	if e.first() {
+		e.b.scalar(s)
+	}
+}
+
+// Int() writes a JSON number.
+func (e *Encoder) Int(i int64) {
+	if e.first() {
+		e.b.scalar(i)
+	}
+}
+
+// Uint() writes a JSON number.
+func (e *Encoder) Uint(u uint64) {
+	if e.first() {
+		e.b.scalar(u)
+	}
+}
+
+// Float() writes a JSON number (or a string for NaN and infinities).
+func (e *Encoder) Float(f float64) {
+	if e.first() {
+		e.b.scalar(f)
+	}
+}
+
+// Bool() writes 'true' or 'false'.
+func (e *Encoder) Bool(t bool) {
+	if e.first() {
+		e.b.scalar(t)
+	}
+}
+
+// Null() writes 'null'.
+func (e *Encoder) Null() {
+	if e.first() {
+		e.b.scalar(nil)
+	}
+}
+
+// Value() writes any value the same way Lager would log it.
+func (e *Encoder) Value(v interface{}) {
+	if e.first() {
+		e.b.scalar(v)
+	}
+}
+
+// Map() writes a JSON object from key/value pairs, like lager.Map().
+func (e *Encoder) Map(pairs ...interface{}) {
+	if e.first() {
+		e.b.scalar(RawMap(pairs))
+	}
+}
+
+// List() writes a JSON list, like lager.List().
+func (e *Encoder) List(vals ...interface{}) {
+	if e.first() {
+		e.b.scalar(AList(vals))
+	}
+}
+
+// RawJSON() writes the passed-in bytes unchanged.  They must be a single,
+// valid JSON value.
+//
+func (e *Encoder) RawJSON(j []byte) {
+	if e.first() {
+		e.b.write(e.b.delim)
+		e.b.writeBytes(j)
+		e.b.delim = comma
+	}
+}
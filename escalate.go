@@ -0,0 +1,179 @@
+package lager
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Escalation configures EscalateOnFailures().
+//
+type Escalation struct {
+	// The number of Fail lines logged within one Period that triggers an
+	// escalation.  Must be positive.
+	Threshold int64
+
+	// How often the Fail count is checked.  Defaults to 1 minute.
+	Period time.Duration
+
+	// The log levels to enable during an escalation.  Defaults to "TD"
+	// (Trace and Debug).
+	Levels string
+
+	// How long an escalation lasts before the prior log levels are
+	// restored.  Defaults to 5 minutes.
+	Window time.Duration
+
+	// The name of the Module whose Fail lines are counted and whose levels
+	// are escalated.  If "", then all Fail lines are counted and the
+	// package-level log levels are escalated.
+	Module string
+}
+
+// State for one EscalateOnFailures() controller.
+type escalator struct {
+	e        Escalation
+	lastFail int64     // Fail count at the prior check.
+	prior    string    // Levels to restore, if escalated.
+	raised   string    // Levels in effect during the escalation.
+	until    time.Time // When to restore them (zero if not escalated).
+}
+
+// EscalateOnFailures() starts a controller that watches how many Fail
+// lines are logged and, when they spike, temporarily enables more verbose
+// log levels so that richer diagnostics are logged while an incident is
+// happening.  It returns a function that stops the controller (restoring
+// the prior log levels if an escalation is in effect).
+//
+//      stop := lager.EscalateOnFailures(lager.Escalation{
+//          Threshold: 20, Period: time.Minute, Window: 10*time.Minute})
+//      defer stop()
+//
+// Each 'Period', if at least 'Threshold' Fail lines were logged since the
+// prior check, then 'Levels' are enabled for 'Window'.  An escalation is
+// not extended by further failures; once the prior levels are restored, a
+// new spike can start another escalation.  If the log levels were changed
+// by something else during an escalation, then they are not restored.
+//
+// A Warn line is logged when an escalation starts and when it ends.
+// Passing a 'Threshold' less than 1 calls panic().
+//
+func EscalateOnFailures(e Escalation) (stop func()) {
+	if e.Threshold < 1 {
+		panic("lager.EscalateOnFailures() requires a positive Threshold")
+	}
+	if e.Period <= 0 {
+		e.Period = time.Minute
+	}
+	if "" == e.Levels {
+		e.Levels = "TD"
+	}
+	if e.Window <= 0 {
+		e.Window = 5 * time.Minute
+	}
+	x := &escalator{e: e}
+	x.lastFail = x.fails()
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		tick := time.NewTicker(e.Period)
+		defer tick.Stop()
+		for {
+			select {
+			case now := <-tick.C:
+				x.check(now)
+			case <-done:
+				x.restore()
+				return
+			}
+		}
+	}()
+	var once int32
+	return func() {
+		if atomic.CompareAndSwapInt32(&once, 0, 1) {
+			close(done)
+		}
+		<-finished
+	}
+}
+
+// Returns the number of Fail lines logged so far that the controller
+// watches.
+func (x *escalator) fails() int64 {
+	if "" != x.e.Module {
+		return atomic.LoadInt64(&_stats.countersFor(x.e.Module).emitted[int(lFail)])
+	}
+	n := atomic.LoadInt64(&_stats.root.emitted[int(lFail)])
+	_stats.mods.Range(func(_, c interface{}) bool {
+		n += atomic.LoadInt64(&c.(*levelCounters).emitted[int(lFail)])
+		return true
+	})
+	return n
+}
+
+// Returns the currently enabled levels (for the Module, if any).
+func (x *escalator) levels() string {
+	if "" != x.e.Module {
+		return GetModuleLevels(x.e.Module)
+	}
+	return getGlobals().enabled
+}
+
+// Enables just the given levels (for the Module, if any).  "" enables none
+// of the optional levels, since that is what levels() returns when they
+// are all disabled (while Init("") would enable the default levels).
+func (x *escalator) setLevels(levels string) {
+	if "" == levels {
+		levels = "-"
+	}
+	if "" != x.e.Module {
+		SetModuleLevels(x.e.Module, levels)
+	} else {
+		Init(levels)
+	}
+}
+
+// Called each Period to start or end an escalation.
+func (x *escalator) check(now time.Time) {
+	fails := x.fails()
+	recent := fails - x.lastFail
+	x.lastFail = fails
+	if !x.until.IsZero() {
+		if !now.Before(x.until) {
+			x.restore()
+		}
+		return
+	}
+	if recent < x.e.Threshold {
+		return
+	}
+	x.prior = x.levels()
+	x.setLevels(x.prior + x.e.Levels)
+	x.raised = x.levels()
+	x.until = now.Add(x.e.Window)
+	x.warn().MMap("Escalating log levels due to failures",
+		"failures", recent, "period", x.e.Period,
+		"levels", x.raised, "window", x.e.Window)
+}
+
+// Ends an escalation (if one is in effect).
+func (x *escalator) restore() {
+	if x.until.IsZero() {
+		return
+	}
+	x.until = time.Time{}
+	if x.levels() != x.raised {
+		return // Something else changed the levels; leave them alone.
+	}
+	x.setLevels(x.prior)
+	x.warn().MMap("Restored log levels after escalation",
+		"levels", x.levels())
+}
+
+// Returns the Lager to log escalation changes to.
+func (x *escalator) warn() Lager {
+	if mod := getMod(x.e.Module); nil != mod {
+		return mod.Warn()
+	}
+	return Warn()
+}
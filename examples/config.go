@@ -0,0 +1,109 @@
+/*
+Package examples holds the recommended wiring for services that log via
+Lager, as importable code rather than snippets to copy.  It sets up log
+levels, GCP mode, request logging middleware, and trace spans, and shuts
+the server down gracefully when asked to stop.
+
+	func main() {
+		srv := examples.NewInstrumentedHTTPServer(
+			examples.Config{Addr: ":8080", Levels: "FWNAI"}, mux)
+		if err := srv.Run(context.Background()); nil != err {
+			lager.Exit().MMap("Server failed", "err", err)
+		}
+	}
+
+A gRPC service is wired up the same way via NewInstrumentedGrpcServer().
+Both Run() methods return once the passed-in Context is done or the process
+receives SIGINT or SIGTERM and the in-flight requests have finished (or
+Config.ShutdownTimeout has passed).
+*/
+package examples
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/TyeMcQueen/go-lager"
+	"github.com/TyeMcQueen/go-lager/gcp-spans"
+)
+
+// DefaultShutdownTimeout is how long Run() waits for in-flight requests to
+// finish if Config.ShutdownTimeout is not set.
+var DefaultShutdownTimeout = 10 * time.Second
+
+// Config holds the settings used by NewInstrumentedHTTPServer() and
+// NewInstrumentedGrpcServer().  The zero value is usable (other than Addr).
+type Config struct {
+	// The address to listen on, such as ":8080".
+	Addr string
+
+	// The log levels to enable, passed to lager.Init().  If "", then the
+	// levels are left as they are (so LAGER_LEVELS still applies).
+	Levels string
+
+	// Whether to log in the format best for GCP Cloud Logging [see
+	// lager.RunningInGcp()].  Even if false, GCP mode is used when
+	// lager.DetectGcpEnvironment() finds that the service is running in
+	// Cloud Run, Cloud Functions, or App Engine, and then the pairs that
+	// identify the workload are added to every request's log lines.
+	Gcp bool
+
+	// The span Factory used to import (and maybe create) a trace span for
+	// each HTTP request.  If nil, then a read-only span [see spans.ROSpan]
+	// is used when running in GCP mode and the GCP project ID can be found;
+	// otherwise requests are logged without spans.
+	Spans spans.Factory
+
+	// Pairs to add to the log lines of every request.
+	Pairs []interface{}
+
+	// How long Run() waits for in-flight requests to finish before forcing
+	// the server to stop.  Defaults to DefaultShutdownTimeout.
+	ShutdownTimeout time.Duration
+}
+
+// setup() applies the logging settings and returns the Context that every
+// request's Context is derived from.
+func (c *Config) setup() context.Context {
+	if "" != c.Levels {
+		lager.Init(c.Levels)
+	}
+	if c.ShutdownTimeout <= 0 {
+		c.ShutdownTimeout = DefaultShutdownTimeout
+	}
+	ctx := context.Background()
+	if env := lager.DetectGcpEnvironment(); nil != env {
+		ctx = lager.ContextPairs(ctx).Merge(env).InContext(ctx)
+		c.Gcp = true
+	} else if c.Gcp {
+		lager.RunningInGcp()
+	}
+	if nil == c.Spans && c.Gcp {
+		if proj, err := lager.GcpProjectID(nil); nil != err {
+			lager.Warn().MMap("Logging requests without trace spans",
+				"err", err)
+		} else {
+			c.Spans = spans.NewROSpan(proj)
+		}
+	}
+	return lager.AddPairs(ctx, c.Pairs...)
+}
+
+// waitForStop() waits until 'ctx' is done or the process is told to stop
+// (or 'failed' gets an error) and returns why.
+func waitForStop(ctx context.Context, failed <-chan error) (string, error) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	select {
+	case <-ctx.Done():
+		return "context done", nil
+	case sig := <-sigs:
+		return sig.String(), nil
+	case err := <-failed:
+		return "serving failed", err
+	}
+}
@@ -0,0 +1,132 @@
+package examples_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TyeMcQueen/go-lager"
+	"github.com/TyeMcQueen/go-lager/examples"
+	pb_testproto "github.com/TyeMcQueen/go-lager/grpc_lager/testproto"
+	"github.com/TyeMcQueen/go-tutl"
+	"google.golang.org/grpc"
+)
+
+func TestHTTPServer(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+	defer lager.Init("FWNA")
+	var mu sync.Mutex
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	lager.SetClock(func() time.Time {
+		defer lager.AutoLock(&mu)()
+		return now
+	})
+	defer lager.SetClock(nil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hi", func(w http.ResponseWriter, req *http.Request) {
+		lager.Info(req.Context()).MMap("Saying hi")
+		mu.Lock()
+		now = now.Add(1500 * time.Millisecond)
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("hi"))
+	})
+	srv := examples.NewInstrumentedHTTPServer(examples.Config{
+		Levels: "FWNAI", Pairs: []interface{}{"app", "demo"},
+	}, mux)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if !u.Is(nil, err, "listen") {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ctx, lis) }()
+
+	resp, err := http.Get("http://" + lis.Addr().String() + "/hi")
+	if u.Is(nil, err, "get") {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		u.Is(http.StatusAccepted, resp.StatusCode, "status")
+		u.Is("hi", string(body), "body")
+	}
+	cancel()
+	select {
+	case err = <-done:
+		u.Is(nil, err, "serve returns")
+	case <-time.After(5 * time.Second):
+		t.Fatal("HTTP server did not stop")
+	}
+
+	u.Like(log.String(), "log",
+		`"Serving HTTP requests", \{"addr":"127\.0\.0\.1:`,
+		`"INFO", "Saying hi", \{[^\n]*"app":"demo"`,
+		`"ACCESS", "Sending response", \{[^\n]*"app":"demo"`,
+		`"status":202, "requestSize":0, "responseSize":2,`,
+		`"latency":"1.5`,
+		`"Shutting down HTTP server", \{"reason":"context done"`,
+		`"HTTP server stopped"`)
+}
+
+type pingService struct {
+	pb_testproto.TestServiceServer
+}
+
+func (s *pingService) Ping(
+	ctx context.Context, ping *pb_testproto.PingRequest,
+) (*pb_testproto.PingResponse, error) {
+	lager.Info(ctx).MMap("Got ping")
+	return &pb_testproto.PingResponse{Value: ping.Value}, nil
+}
+
+func TestGrpcServer(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+	defer lager.Init("FWNA")
+
+	srv := examples.NewInstrumentedGrpcServer(examples.Config{
+		Levels: "FWNAI", Pairs: []interface{}{"app", "demo"},
+	})
+	pb_testproto.RegisterTestServiceServer(srv, &pingService{})
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if !u.Is(nil, err, "listen") {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ctx, lis) }()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if u.Is(nil, err, "dial") {
+		client := pb_testproto.NewTestServiceClient(conn)
+		resp, err := client.Ping(
+			context.Background(), &pb_testproto.PingRequest{Value: "hello"})
+		if u.Is(nil, err, "ping") {
+			u.Is("hello", resp.Value, "pong")
+		}
+		conn.Close()
+	}
+	cancel()
+	select {
+	case err = <-done:
+		u.Is(nil, err, "serve returns")
+	case <-time.After(5 * time.Second):
+		t.Fatal("gRPC server did not stop")
+	}
+
+	u.Like(log.String(), "log",
+		`"Serving gRPC calls"`,
+		`"Got ping", \{[^\n]*"app":"demo"`,
+		`"finished unary call with code OK", \{[^\n]*"app":"demo"`,
+		`"grpc.method":"Ping"`,
+		`"Shutting down gRPC server", \{"reason":"context done"`,
+		`"gRPC server stopped"`)
+}
@@ -0,0 +1,134 @@
+package examples
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/TyeMcQueen/go-lager"
+	"github.com/TyeMcQueen/go-lager/grpc_lager"
+	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
+	"google.golang.org/grpc"
+)
+
+// GrpcServer is a grpc.Server whose calls are logged.  Use
+// NewInstrumentedGrpcServer() to create one, register your services on it,
+// and then call Run() to serve calls.
+type GrpcServer struct {
+	*grpc.Server
+	cfg Config
+}
+
+// NewInstrumentedGrpcServer() applies the logging settings from 'cfg' and
+// returns a grpc.Server that listens on cfg.Addr and logs each call (and
+// each stream) via grpc_lager, using 'opts' to customize those log lines.
+// The grpc_ctxtags interceptors are chained first so handlers can add tags
+// to be logged.  cfg.Pairs (and the GCP workload pairs) are added to each
+// call's Context.  cfg.Spans is not used since spans are not yet supported
+// for gRPC.
+//
+//      srv := examples.NewInstrumentedGrpcServer(
+//          examples.Config{Addr: ":9090"}, grpc_lager.WithLazyTags())
+//      pb.RegisterUserServiceServer(srv, &userService{})
+//      err := srv.Run(ctx)
+//
+func NewInstrumentedGrpcServer(
+	cfg Config, opts ...grpc_lager.Option,
+) *GrpcServer {
+	base := lager.ContextPairs(cfg.setup())
+	return &GrpcServer{
+		Server: grpc.NewServer(
+			grpc.ChainUnaryInterceptor(
+				unaryPairs(base),
+				grpc_ctxtags.UnaryServerInterceptor(),
+				grpc_lager.UnaryServerInterceptor(opts...),
+			),
+			grpc.ChainStreamInterceptor(
+				streamPairs(base),
+				grpc_ctxtags.StreamServerInterceptor(),
+				grpc_lager.StreamServerInterceptor(opts...),
+			),
+		),
+		cfg: cfg,
+	}
+}
+
+// Run() listens on the server's address and serves calls until 'ctx' is
+// done or the process receives SIGINT or SIGTERM.  It then stops accepting
+// calls and waits for in-flight calls to finish (for at most
+// Config.ShutdownTimeout) before canceling them.  It returns an error only
+// if the server could not listen or failed while serving.
+//
+func (s *GrpcServer) Run(ctx context.Context) error {
+	lis, err := net.Listen("tcp", s.cfg.Addr)
+	if nil != err {
+		return err
+	}
+	return s.Serve(ctx, lis)
+}
+
+// Serve() is like Run() but uses an existing Listener.
+func (s *GrpcServer) Serve(ctx context.Context, lis net.Listener) error {
+	failed := make(chan error, 1)
+	go func() {
+		if err := s.Server.Serve(lis); nil != err {
+			failed <- err
+		}
+	}()
+	lager.Note().MMap("Serving gRPC calls", "addr", lis.Addr().String())
+
+	why, err := waitForStop(ctx, failed)
+	if nil != err {
+		return err
+	}
+	lager.Note().MMap("Shutting down gRPC server", "reason", why,
+		"timeout", s.cfg.ShutdownTimeout)
+	stopped := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		lager.Note().MMap("gRPC server stopped")
+	case <-time.After(s.cfg.ShutdownTimeout):
+		lager.Warn().MMap("In-flight gRPC calls did not finish")
+		s.Stop()
+	}
+	return nil
+}
+
+// unaryPairs() adds the base pairs to each call's Context.
+func unaryPairs(base lager.AMap) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context, req interface{},
+		info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		return handler(withPairs(ctx, base), req)
+	}
+}
+
+// streamPairs() adds the base pairs to each stream's Context.
+func streamPairs(base lager.AMap) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{}, stream grpc.ServerStream,
+		info *grpc.StreamServerInfo, handler grpc.StreamHandler,
+	) error {
+		return handler(srv, &pairsStream{stream, withPairs(stream.Context(), base)})
+	}
+}
+
+func withPairs(ctx context.Context, base lager.AMap) context.Context {
+	if 0 == base.Len() {
+		return ctx
+	}
+	return base.Merge(lager.ContextPairs(ctx)).InContext(ctx)
+}
+
+// pairsStream replaces the Context of a grpc.ServerStream.
+type pairsStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *pairsStream) Context() context.Context { return s.ctx }
@@ -0,0 +1,141 @@
+package examples
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/TyeMcQueen/go-lager"
+	"github.com/TyeMcQueen/go-lager/gcp-spans"
+)
+
+// HTTPServer is an http.Server whose requests are logged and traced.  Use
+// NewInstrumentedHTTPServer() to create one and Run() to serve requests.
+type HTTPServer struct {
+	*http.Server
+	cfg Config
+}
+
+// NewInstrumentedHTTPServer() applies the logging settings from 'cfg' and
+// returns a server for 'handler' (wrapped via InstrumentHandler()) that
+// listens on cfg.Addr.  The http.Server can be adjusted (such as to set
+// timeouts) before Run() is called.
+//
+func NewInstrumentedHTTPServer(cfg Config, handler http.Handler) *HTTPServer {
+	base := cfg.setup()
+	return &HTTPServer{
+		Server: &http.Server{
+			Addr:        cfg.Addr,
+			Handler:     InstrumentHandler(handler, cfg.Spans),
+			BaseContext: func(net.Listener) context.Context { return base },
+		},
+		cfg: cfg,
+	}
+}
+
+// Run() listens on the server's address and serves requests until 'ctx'
+// is done or the process receives SIGINT or SIGTERM.  It then stops
+// accepting requests and waits for in-flight requests to finish (for at
+// most Config.ShutdownTimeout).  It returns an error only if the server
+// could not listen or failed while serving.
+//
+func (s *HTTPServer) Run(ctx context.Context) error {
+	lis, err := net.Listen("tcp", s.Addr)
+	if nil != err {
+		return err
+	}
+	return s.Serve(ctx, lis)
+}
+
+// Serve() is like Run() but uses an existing Listener.
+func (s *HTTPServer) Serve(ctx context.Context, lis net.Listener) error {
+	failed := make(chan error, 1)
+	go func() {
+		if err := s.Server.Serve(lis); http.ErrServerClosed != err {
+			failed <- err
+		}
+	}()
+	lager.Note().MMap("Serving HTTP requests", "addr", lis.Addr().String())
+
+	why, err := waitForStop(ctx, failed)
+	if nil != err {
+		return err
+	}
+	lager.Note().MMap("Shutting down HTTP server", "reason", why,
+		"timeout", s.cfg.ShutdownTimeout)
+	stopCtx, cancel := context.WithTimeout(
+		context.Background(), s.cfg.ShutdownTimeout)
+	defer cancel()
+	if err := s.Shutdown(stopCtx); nil != err {
+		lager.Warn().MMap("In-flight HTTP requests did not finish",
+			"err", err)
+		return s.Close()
+	}
+	lager.Note().MMap("HTTP server stopped")
+	return nil
+}
+
+// InstrumentHandler() wraps 'h' so that each request gets a trace span
+// from 'factory' and a Context holding the request's pairs [see
+// lager.GcpContextReceivedRequest()], and so that an access log line is
+// written for each response [see lager.GcpLogAccess()].  If 'factory' is
+// nil, then requests are logged without spans.  The request ID and trace ID
+// (if any) are also returned in response headers so clients can quote them
+// [see lager.PairsToHeaders()].
+//
+func InstrumentHandler(h http.Handler, factory spans.Factory) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := lager.Now()
+		var span spans.Factory
+		if nil != factory {
+			var ctx context.Context
+			ctx, span = lager.GcpContextReceivedRequest(
+				spans.ContextStoreSpan(req.Context(), factory), req)
+			req = req.WithContext(ctx)
+		} else {
+			req = req.WithContext(lager.RequestBudget(lager.AddPairs(
+				req.Context(), "httpRequest", lager.GcpHttp(req, nil, nil))))
+		}
+		lager.PairsToHeaders(req.Context(), w.Header())
+		rw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			if 0 == rw.status {
+				rw.status = http.StatusOK
+			}
+			resp := lager.GcpFakeResponse(rw.status, rw.size, "")
+			lager.GcpLogAccess(req, resp, &start).MMap("Sending response")
+			lager.GcpFinishSpan(span, resp)
+		}()
+		h.ServeHTTP(rw, req)
+	})
+}
+
+// statusWriter records the status and size of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if 0 == w.status {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if 0 == w.status {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+// Flush() lets handlers stream responses through the wrapper.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
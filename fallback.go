@@ -0,0 +1,156 @@
+package lager
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// The current fallback for os.Stdout and os.Stderr (a *fallback, maybe nil).
+var _fallback atomic.Value
+
+// Serializes replacing the fallback (and closing the old one).
+var fallbackMu sync.Mutex
+
+// Reported when a line is lost because the fallback file could not be opened.
+var errNoFallback = errors.New("fallback file is not open")
+
+// Where log lines go once os.Stdout or os.Stderr can't be written to.
+type fallback struct {
+	path      string
+	mu        sync.RWMutex // Held (shared) while 'file' is being used.
+	once      sync.Once
+	file      *os.File // nil if it couldn't be opened or was closed.
+	closed    bool     // Whether it was replaced via SetStdoutFallback().
+	outBroken int32    // Whether os.Stdout failed.
+	errBroken int32    // Whether os.Stderr failed.
+}
+
+// SetStdoutFallback() sets a file that log lines are appended to if writing
+// them to os.Stdout (or os.Stderr) fails, such as in a service that was
+// detached from its console or whose stdout was closed.  Without this,
+// such log lines are silently lost.  Passing in "" disables the fallback.
+// It can also be set via the LAGER_STDOUT_FALLBACK environment variable.
+//
+//      lager.SetStdoutFallback("/var/log/myapp/fallback.log")
+//
+// The file is only opened when a write first fails.  A Note line recording
+// the fallback (with the write error) is then written to the file, before
+// the line that failed.  After that, lines for the failed stream go
+// directly to the file.  Lines written via SetOutput() are not affected.
+//
+func SetStdoutFallback(path string) {
+	var fb *fallback
+	if "" != path {
+		fb = &fallback{path: path}
+	}
+	fallbackMu.Lock()
+	old, _ := _fallback.Load().(*fallback)
+	_fallback.Store(fb)
+	fallbackMu.Unlock()
+	if nil != old {
+		old.close()
+	}
+}
+
+// Closes the fallback file once no lines are being written to it.
+func (fb *fallback) close() {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	fb.closed = true
+	if nil != fb.file {
+		fb.file.Close()
+		fb.file = nil
+	}
+}
+
+// Returns the flag for whether 'w' (os.Stdout or os.Stderr) failed, or nil
+// if 'w' is something else.
+func (fb *fallback) broken(w io.Writer) *int32 {
+	switch w {
+	case os.Stdout:
+		return &fb.outBroken
+	case os.Stderr:
+		return &fb.errBroken
+	}
+	return nil
+}
+
+// Writes one log line to 'w' unless 'w' is os.Stdout or os.Stderr and a
+// fallback is in effect for it.  If the write to os.Stdout or os.Stderr
+// fails, the fallback (if any) is put into effect.
+func writeLine(w io.Writer, line []byte) {
+	if _, ok := w.(fallbackFile); ok {
+		w.Write(line) // The Note line from note(), which is never failed.
+		return
+	}
+	fb, _ := _fallback.Load().(*fallback)
+	var broken *int32
+	if nil != fb {
+		broken = fb.broken(w)
+	}
+	if nil == broken {
+		internalError("write", tryWrite(w, line))
+		return
+	}
+	fb.mu.RLock()
+	defer fb.mu.RUnlock()
+	if 0 != atomic.LoadInt32(broken) {
+		fb.once.Do(fb.open) // So fb.file is safe to read.
+		fb.write(line)
+		return
+	}
+	err := tryWrite(w, line)
+	if nil == err {
+		return
+	}
+	internalError("write", err)
+	atomic.StoreInt32(broken, 1)
+	fb.once.Do(fb.open)
+	name := "stdout"
+	if os.Stderr == w {
+		name = "stderr"
+	}
+	fb.note(name, err)
+	fb.write(line)
+}
+
+// Opens the fallback file.  Only called via fb.once while holding fb.mu.
+func (fb *fallback) open() {
+	if fb.closed {
+		return
+	}
+	f, err := os.OpenFile(
+		fb.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if nil == err {
+		fb.file = f
+	} else {
+		internalError("fallback", err)
+	}
+}
+
+func (fb *fallback) write(line []byte) {
+	if nil == fb.file {
+		internalError("fallback", errNoFallback)
+	} else if _, err := fb.file.Write(line); nil != err {
+		internalError("fallback", err)
+	}
+}
+
+// The fallback file when used as a destination by note().
+type fallbackFile struct{ *os.File }
+
+// Writes a Note line to the fallback file about the failed stream.
+func (fb *fallback) note(stream string, err error) {
+	if nil == fb.file {
+		return
+	}
+	file := fallbackFile{fb.file}
+	g := getGlobals().updated(func(g *globals) {
+		g.dest, g.destOut = file, new(outLock)
+	})
+	g.forLevel(lNote).MMap("Can't write log lines; using fallback file",
+		"stream", stream, "err", err, "fallback", fb.path)
+}
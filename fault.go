@@ -0,0 +1,104 @@
+package lager
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync/atomic"
+)
+
+// ErrInjectedFault is the error used by FaultyWriter() and SetWriteFaults()
+// when they are not given one.
+var ErrInjectedFault = errors.New("lager: injected write fault")
+
+// The faults set via SetWriteFaults() (a *faultyWriter, maybe nil).
+var _writeFaults atomic.Value
+
+// The number of writes failed via SetWriteFaults().
+var _writeFaultCount int64
+
+// An io.Writer that fails some writes on purpose.
+type faultyWriter struct {
+	rate float64
+	err  error
+	w    io.Writer
+}
+
+// FaultyWriter() returns an io.Writer for testing how code copes with a
+// failing log sink.  The fraction 'rate' (from 0.0 to 1.0) of its Write()
+// calls, chosen at random, fail by returning 0 and 'err' (or
+// ErrInjectedFault if 'err' is 'nil').  The other writes are passed on to
+// 'w' (or are discarded if no 'w' is given).
+//
+//      defer lager.SetOutput(lager.FaultyWriter(0.1, nil, &buf))()
+//
+// See SetWriteFaults() for failing the writes to os.Stdout and os.Stderr.
+//
+func FaultyWriter(rate float64, err error, w ...io.Writer) io.Writer {
+	return newFaultyWriter(rate, err, w...)
+}
+
+func newFaultyWriter(rate float64, err error, w ...io.Writer) *faultyWriter {
+	if nil == err {
+		err = ErrInjectedFault
+	}
+	f := &faultyWriter{rate: rate, err: err, w: ioutil.Discard}
+	if 0 < len(w) && nil != w[0] {
+		f.w = w[0]
+	}
+	return f
+}
+
+// Whether this write should fail.
+func (f *faultyWriter) fault() bool {
+	return 1.0 <= f.rate || 0.0 < f.rate && rand.Float64() < f.rate
+}
+
+func (f *faultyWriter) Write(p []byte) (int, error) {
+	if f.fault() {
+		return 0, f.err
+	}
+	return f.w.Write(p)
+}
+
+// SetWriteFaults() turns on a "chaos" mode, for tests, where the fraction
+// 'rate' (from 0.0 to 1.0) of log lines, chosen at random, are not written
+// and are instead treated as if the destination's Write() had returned
+// 'err' (or ErrInjectedFault if 'err' is 'nil').  This applies to every
+// destination, including ones set via SetOutput().  A 'rate' of 0.0 (the
+// default) turns the mode off.
+//
+//      lager.SetStdoutFallback(filepath.Join(dir, "fallback.log"))
+//      lager.SetWriteFaults(1.0, syscall.EPIPE)
+//      defer lager.SetWriteFaults(0, nil)
+//
+// A fault when writing to os.Stdout or os.Stderr puts the fallback [see
+// SetStdoutFallback()] into effect, just like a real failure would.  Lines
+// written to the fallback file are never failed.  WriteFaults() reports how
+// many lines were failed.
+//
+func SetWriteFaults(rate float64, err error) {
+	var f *faultyWriter
+	if 0.0 < rate {
+		f = newFaultyWriter(rate, err)
+	}
+	_writeFaults.Store(f)
+}
+
+// WriteFaults() returns the number of log lines that were not written due
+// to SetWriteFaults().
+//
+func WriteFaults() int64 {
+	return atomic.LoadInt64(&_writeFaultCount)
+}
+
+// Writes one log line to 'w' unless SetWriteFaults() says to fail it.
+func tryWrite(w io.Writer, line []byte) error {
+	if f, _ := _writeFaults.Load().(*faultyWriter); nil != f && f.fault() {
+		atomic.AddInt64(&_writeFaultCount, 1)
+		return f.err
+	}
+	_, err := w.Write(line)
+	return err
+}
@@ -0,0 +1,57 @@
+package spans
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Encode() returns a compact token identifying the span held in 'span' so
+// that the trace can be resumed in another process, such as by storing the
+// token in a job payload or a database row that a background worker later
+// reads.  The token is in the form "{traceID}.{spanID}" where both IDs are
+// in hexadecimal (the span ID always being 16 digits).  If 'span' is 'nil'
+// or empty, then "" is returned.
+//
+// Use Decode() to turn the token back into a Factory.
+//
+func Encode(span Factory) string {
+	if nil == span || 0 == span.GetSpanID() {
+		return ""
+	}
+	return span.GetTraceID() + "." + HexSpanID(span.GetSpanID())
+}
+
+// Decode() turns a token from Encode() into an ROSpan holding the encoded
+// span so that the worker's log lines can be tied to the original trace.
+// An empty token gives an empty ROSpan and a 'nil' error.  An invalid
+// token gives a 'nil' Factory and an error.
+//
+// To create new spans as part of the resumed trace, pass the returned
+// Factory's IDs to your writable Factory's Import() method, or use
+// DecodeWith().
+//
+func Decode(projectID, token string) (Factory, error) {
+	return DecodeWith(NewROSpan(projectID), token)
+}
+
+// DecodeWith() is like Decode() except that the span is imported via
+// 'factory.Import()' so that the returned Factory can be used to create
+// sub-spans when 'factory' supports that.  If 'token' is "", then
+// 'factory.NewTrace()' is returned.
+//
+func DecodeWith(factory Factory, token string) (Factory, error) {
+	if "" == token {
+		return factory.NewTrace(), nil
+	}
+	dot := strings.IndexByte(token, '.')
+	if dot < 0 {
+		return nil, fmt.Errorf("Decode(): Span token lacks '.' (%s)", token)
+	}
+	spanID, err := strconv.ParseUint(token[dot+1:], 16, 64)
+	if nil != err {
+		return nil, fmt.Errorf(
+			"Decode(): Invalid span ID in token (%s): %v", token, err)
+	}
+	return factory.Import(token[:dot], spanID)
+}
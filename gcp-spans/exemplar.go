@@ -0,0 +1,45 @@
+package spans
+
+import (
+	"context"
+)
+
+// Label names used by ExemplarLabels().
+const (
+	ExemplarTraceLabel = "trace_id"
+	ExemplarSpanLabel  = "span_id"
+)
+
+// ExemplarLabels() returns the labels for recording the span held in 'span'
+// as a metrics exemplar, linking a latency histogram bucket to the trace
+// (and so to the log lines tagged with that trace).  Returns 'nil' if
+// 'span' is 'nil' or empty.
+//
+// The returned map can be passed directly to the Prometheus client library
+// [a map[string]string is assignable to prometheus.Labels]:
+//
+//      if ex := spans.ExemplarLabels(span); nil != ex {
+//          hist.(prometheus.ExemplarObserver).ObserveWithExemplar(secs, ex)
+//      } else {
+//          hist.Observe(secs)
+//      }
+//
+// This package does not depend on the Prometheus library, so the caller
+// must make that call.
+//
+func ExemplarLabels(span Factory) map[string]string {
+	if nil == span || 0 == span.GetSpanID() {
+		return nil
+	}
+	return map[string]string{
+		ExemplarTraceLabel: span.GetTraceID(),
+		ExemplarSpanLabel:  HexSpanID(span.GetSpanID()),
+	}
+}
+
+// ContextExemplarLabels() returns ExemplarLabels() for the span Factory
+// stored in 'ctx' [see ContextStoreSpan()] or 'nil' if there is none.
+//
+func ContextExemplarLabels(ctx context.Context) map[string]string {
+	return ExemplarLabels(ContextGetSpan(ctx))
+}
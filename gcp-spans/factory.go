@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -39,10 +40,78 @@ const _contextSpan = inContext("span")
 // span also do not log for ROSpans since those methods do nothing even
 // if the span is not empty.
 //
+// An ROSpan from NewRecordingROSpan() (and any span derived from it) also
+// remembers what is passed to SetDisplayName(), SetIs*(), AddAttribute(),
+// AddPairs(), SetStatusCode(), and SetStatusMessage() so that the data is
+// not silently dropped.  It can be fetched via GetRecorded(), for example
+// to be copied into a writable span or logged when the span is finished.
+//
 type ROSpan struct {
 	proj    string
 	traceID string
 	spanID  uint64
+	parent  uint64
+	depth   int
+	rec     *recording
+}
+
+// Recorded holds the span details that an ROSpan from NewRecordingROSpan()
+// was given but could not export.
+//
+type Recorded struct {
+	DisplayName   string
+	Kind          string // "SERVER", "CLIENT", "PRODUCER", or "CONSUMER"
+	StatusCode    int64
+	StatusMessage string
+	Attributes    map[string]interface{}
+}
+
+// Recorder is implemented by Factory types that can record span details
+// in memory, such as ROSpan.  Adapters can use it to retrieve data that
+// would otherwise have been discarded.
+//
+type Recorder interface {
+	// GetRecorded() returns a copy of the recorded details and 'true' or,
+	// if the span is not recording, a zero Recorded and 'false'.
+	//
+	GetRecorded() (Recorded, bool)
+}
+
+// Parented is implemented by Factory types that know the parent of the
+// span they hold, such as ROSpan.  It is separate from Factory so that
+// existing Factory implementations need not add these methods.  See also
+// ParentSpanID().
+//
+type Parented interface {
+	// GetParentSpanID() returns the span ID of the parent of the contained
+	// span.  Returns 0 if the Factory is empty, if the span is the root of
+	// its trace, or if the parent is not known (such as for a span from
+	// Import(), since only the span's own ID is propagated in headers).
+	//
+	GetParentSpanID() uint64
+
+	// GetDepth() returns how many ancestors of the contained span are known
+	// to this process.  A span from Import() or NewTrace() has a depth of 0,
+	// and a span from NewSubSpan() has a depth one greater than that of its
+	// parent.  Returns 0 if the Factory is empty.
+	//
+	GetDepth() int
+}
+
+// ParentSpanID() returns the parent span ID and depth of the span held in
+// 'span' if it implements Parented.  Otherwise (or if 'span' is 'nil') it
+// returns 0 and 0.
+//
+func ParentSpanID(span Factory) (uint64, int) {
+	if p, ok := span.(Parented); ok {
+		return p.GetParentSpanID(), p.GetDepth()
+	}
+	return 0, 0
+}
+
+type recording struct {
+	mu   sync.Mutex
+	data Recorded
 }
 
 // Factory is an interface that allows Spans to be created and manipulated
@@ -261,23 +330,152 @@ func HexSpanID(spanID uint64) string {
 	return fmt.Sprintf("%016x", spanID)
 }
 
-// FinishSpan() calls Finish() on the passed-in 'span', unless it is 'nil'.
-// It is most useful with 'defer' when a 'span' might be 'nil':
+// FinishSpan() calls Finish() on the passed-in 'span', unless it is 'nil'
+// (or empty or Import()ed).  It then calls any functions registered via
+// OnFinish().  It is most useful with 'defer' when a 'span' might be 'nil':
 //
 //      defer spans.FinishSpan(span)
 //
 func FinishSpan(span Factory) time.Duration {
 	if nil != span && 0 != span.GetSpanID() && !span.GetStart().IsZero() {
-		return span.Finish()
+		snap := snapshot(span)
+		dur := span.Finish()
+		RunFinishHooks(snap, dur)
+		return dur
 	}
 	return time.Duration(0)
 }
 
+var (
+	_hooksMu     sync.RWMutex
+	_finishHooks []func(Factory, time.Duration)
+	_hookPanic   func(p interface{})
+)
+
+// OnFinish() registers a function to be called each time a span is
+// finished via FinishSpan(), such as to feed span durations into a metric
+// or to log spans that exceed a latency target.  The returned func()
+// unregisters the hook.
+//
+// Since a Factory is empty after Finish(), the hook is passed a read-only
+// Factory [an ROSpan] holding the IDs of the finished span along with the
+// duration returned by Finish().  Hooks are called synchronously, in the
+// order they were registered, so they should be fast.  A hook that panics
+// does not keep later hooks from being called [see OnHookPanic()].
+//
+func OnFinish(hook func(span Factory, dur time.Duration)) func() {
+	_hooksMu.Lock()
+	defer _hooksMu.Unlock()
+	_finishHooks = append(_finishHooks, hook)
+	idx := len(_finishHooks) - 1
+	return func() {
+		_hooksMu.Lock()
+		defer _hooksMu.Unlock()
+		// Copy so RunFinishHooks() can iterate without holding the lock:
+		hooks := append([]func(Factory, time.Duration){}, _finishHooks...)
+		hooks[idx] = nil
+		_finishHooks = hooks
+	}
+}
+
+// OnHookPanic() sets the function to be called with the value from each
+// panic by a function registered via OnFinish().  Such panics are always
+// recovered so that a broken hook can't crash the code finishing a span.
+// Lager sets this so that such panics are reported via
+// lager.InternalErrors().  Passing in 'nil' ignores such panics.
+//
+func OnHookPanic(report func(p interface{})) {
+	_hooksMu.Lock()
+	defer _hooksMu.Unlock()
+	_hookPanic = report
+}
+
+// RunFinishHooks() calls each function registered via OnFinish().  It is
+// exported so that Factory implementations whose spans are not finished
+// via FinishSpan() can still honor the hooks.
+//
+func RunFinishHooks(span Factory, dur time.Duration) {
+	_hooksMu.RLock()
+	hooks, report := _finishHooks, _hookPanic
+	_hooksMu.RUnlock()
+	for _, hook := range hooks {
+		if nil != hook {
+			runHook(hook, span, dur, report)
+		}
+	}
+}
+
+// Calls one finish hook, recovering from (and reporting) any panic.
+func runHook(
+	hook func(Factory, time.Duration), span Factory, dur time.Duration,
+	report func(p interface{}),
+) {
+	defer func() {
+		if p := recover(); nil != p && nil != report {
+			report(p)
+		}
+	}()
+	hook(span, dur)
+}
+
+// snapshot() returns an ROSpan holding the same span as 'span'.
+func snapshot(span Factory) ROSpan {
+	snap := ROSpan{
+		proj: span.GetProjectID(), traceID: span.GetTraceID(),
+		spanID: span.GetSpanID(),
+	}
+	snap.SetParentSpanID(ParentSpanID(span))
+	return snap
+}
+
 // NewROSpan() returns an empty Factory.
 func NewROSpan(projectID string) ROSpan {
 	return ROSpan{proj: projectID}
 }
 
+// NewRecordingROSpan() returns an empty Factory that records span details
+// in memory.  Each span later created from it [via Import(), New*(), etc.]
+// gets its own, initially empty, recording.
+//
+func NewRecordingROSpan(projectID string) ROSpan {
+	return ROSpan{proj: projectID, rec: &recording{}}
+}
+
+// derive() returns an ROSpan for the given IDs that is recording if 's' is.
+func (s ROSpan) derive(traceID string, spanID uint64) ROSpan {
+	d := ROSpan{proj: s.proj, traceID: traceID, spanID: spanID}
+	if nil != s.rec {
+		d.rec = &recording{}
+	}
+	return d
+}
+
+// update() calls 'f' on the recorded data, if 's' is recording.
+func (s ROSpan) update(f func(*Recorded)) {
+	if nil != s.rec {
+		s.rec.mu.Lock()
+		defer s.rec.mu.Unlock()
+		f(&s.rec.data)
+	}
+}
+
+// GetRecorded() returns the span details recorded so far.
+func (s ROSpan) GetRecorded() (Recorded, bool) {
+	if nil == s.rec {
+		return Recorded{}, false
+	}
+	s.rec.mu.Lock()
+	defer s.rec.mu.Unlock()
+	r := s.rec.data
+	if nil != r.Attributes {
+		r.Attributes = make(map[string]interface{}, len(r.Attributes))
+		for k, v := range s.rec.data.Attributes {
+			r.Attributes[k] = v
+		}
+	}
+	return r, true
+}
+
 // SetSpanID() lets you set the spanID to make implementing a non-read-only
 // span type easier.  This is the only method that requires a '*ROSpan' not
 // just a 'ROSpan'.
@@ -286,6 +484,15 @@ func (s *ROSpan) SetSpanID(spanID uint64) {
 	s.spanID = spanID
 }
 
+// SetParentSpanID() lets you set the parent span ID and depth to make
+// implementing a non-read-only span type easier.  Like SetSpanID(), it
+// requires a '*ROSpan'.
+//
+func (s *ROSpan) SetParentSpanID(parentID uint64, depth int) {
+	s.parent = parentID
+	s.depth = depth
+}
+
 // GetProjectID() returns the GCP Project ID.
 func (s ROSpan) GetProjectID() string {
 	return s.proj
@@ -299,6 +506,16 @@ func (s ROSpan) GetSpanID() uint64 {
 	return s.spanID
 }
 
+// GetParentSpanID() returns 0 unless SetParentSpanID() was used.
+func (s ROSpan) GetParentSpanID() uint64 {
+	return s.parent
+}
+
+// GetDepth() returns 0 unless SetParentSpanID() was used.
+func (s ROSpan) GetDepth() int {
+	return s.depth
+}
+
 func (s ROSpan) GetStart() time.Time {
 	return time.Time{}
 }
@@ -346,18 +563,20 @@ func (s ROSpan) Import(traceID string, spanID uint64) (Factory, error) {
 	} else if traceID == "00000000000000000000000000000000" {
 		return nil, fmt.Errorf("Import(): Trace ID of 32 '0's not allowed")
 	}
-	return ROSpan{proj: s.proj, spanID: spanID, traceID: traceID}, nil
+	return s.derive(traceID, spanID), nil
 }
 
 func (s ROSpan) ImportFromHeaders(headers http.Header) Factory {
 	parts := strings.Split(headers.Get(TraceHeader), "/")
 	if 2 == len(parts) {
-		spanID, _ := strconv.ParseUint(parts[1], 10, 64)
+		// Ignore any options like ";o=1":
+		id, _, _ := strings.Cut(parts[1], ";")
+		spanID, _ := strconv.ParseUint(id, 10, 64)
 		if im, _ := s.Import(parts[0], spanID); nil != im {
 			return im
 		}
 	}
-	return ROSpan{proj: s.proj}
+	return s.derive("", 0)
 }
 
 func (s ROSpan) SetHeader(headers http.Header) Factory {
@@ -367,16 +586,33 @@ func (s ROSpan) SetHeader(headers http.Header) Factory {
 	return s
 }
 
-func (s ROSpan) SetIsServer() Factory              { return s }
-func (s ROSpan) SetIsClient() Factory              { return s }
-func (s ROSpan) SetIsPublisher() Factory           { return s }
-func (s ROSpan) SetIsSubscriber() Factory          { return s }
-func (s ROSpan) SetDisplayName(_ string) Factory   { return s }
-func (s ROSpan) SetStatusCode(_ int64) Factory     { return s }
-func (s ROSpan) SetStatusMessage(_ string) Factory { return s }
+func (s ROSpan) SetIsServer() Factory     { return s.setKind("SERVER") }
+func (s ROSpan) SetIsClient() Factory     { return s.setKind("CLIENT") }
+func (s ROSpan) SetIsPublisher() Factory  { return s.setKind("PRODUCER") }
+func (s ROSpan) SetIsSubscriber() Factory { return s.setKind("CONSUMER") }
+
+func (s ROSpan) setKind(kind string) Factory {
+	s.update(func(r *Recorded) { r.Kind = kind })
+	return s
+}
+
+func (s ROSpan) SetDisplayName(desc string) Factory {
+	s.update(func(r *Recorded) { r.DisplayName = desc })
+	return s
+}
+
+func (s ROSpan) SetStatusCode(code int64) Factory {
+	s.update(func(r *Recorded) { r.StatusCode = code })
+	return s
+}
+
+func (s ROSpan) SetStatusMessage(msg string) Factory {
+	s.update(func(r *Recorded) { r.StatusMessage = msg })
+	return s
+}
 
 func (s ROSpan) NewTrace() Factory {
-	return ROSpan{proj: s.proj}
+	return s.derive("", 0)
 }
 
 func (s ROSpan) NewSubSpan() Factory {
@@ -384,14 +620,45 @@ func (s ROSpan) NewSubSpan() Factory {
 }
 
 func (s ROSpan) NewSpan() Factory {
-	return ROSpan{proj: s.proj}
+	return s.derive("", 0)
 }
 
-func (s ROSpan) AddAttribute(_ string, _ interface{}) error {
+// AddAttribute() only validates and records the attribute if the span is
+// recording.  Otherwise it does nothing and returns 'nil'.
+//
+func (s ROSpan) AddAttribute(key string, val interface{}) error {
+	if nil == s.rec {
+		return nil
+	}
+	if "" == key {
+		return fmt.Errorf("AddAttribute(): Empty attribute key")
+	}
+	switch val.(type) {
+	case string, int, int64, bool:
+	default:
+		return fmt.Errorf(
+			"AddAttribute(): Invalid attribute type (%T) for %q", val, key)
+	}
+	s.update(func(r *Recorded) {
+		if nil == r.Attributes {
+			r.Attributes = make(map[string]interface{})
+		}
+		r.Attributes[key] = val
+	})
 	return nil
 }
 
-func (s ROSpan) AddPairs(_ ...interface{}) Factory {
+// AddPairs() records each valid pair if the span is recording.  Invalid
+// pairs are silently ignored since this package does no logging.
+//
+func (s ROSpan) AddPairs(pairs ...interface{}) Factory {
+	if nil != s.rec {
+		for i := 0; i+1 < len(pairs); i += 2 {
+			if key, ok := pairs[i].(string); ok {
+				s.AddAttribute(key, pairs[i+1])
+			}
+		}
+	}
 	return s
 }
 
@@ -95,6 +95,13 @@ func TestSpans(t *testing.T) {
 		u.Is(20, sp.GetSpanID(), "GetSpanID from headers")
 	}
 
+	fakeHeader.Set(spans.TraceHeader, ti+"/21;o=1")
+	sp = sp.ImportFromHeaders(fakeHeader)
+	if u.IsNot(nil, sp, "ImportFromHeaders with options") {
+		u.Is(ti, sp.GetTraceID(), "GetTraceID from headers with options")
+		u.Is(21, sp.GetSpanID(), "GetSpanID from headers with options")
+	}
+
 	fakeHeader.Set(spans.TraceHeader, "no slash")
 	sp = sp.ImportFromHeaders(fakeHeader)
 	if u.IsNot(nil, sp.ImportFromHeaders(fakeHeader), "ImportFromHeaders no slash") {
@@ -144,3 +151,169 @@ func TestSpans(t *testing.T) {
 	u.Is(false, spans.IsValidTraceID("00000000000000000000000000000000"),
 		"zero TraceID")
 }
+
+func TestRecording(t *testing.T) {
+	u := tutl.New(t)
+
+	plain := spans.NewROSpan("proj")
+	_, ok := plain.GetRecorded()
+	u.Is(false, ok, "NewROSpan not recording")
+	plain.SetDisplayName("ignored")
+	u.Is(nil, plain.AddAttribute("", nil), "not recording, no validation")
+
+	rec := spans.NewRecordingROSpan("proj")
+	sp, err := rec.Import("00000000000000000000000000000001", 20)
+	u.Is(nil, err, "Import error")
+	sp.SetDisplayName("my.span").SetIsServer()
+	sp.AddPairs("http.url", "/x", "retry", 2, "bad", 1.5, 3, "no key")
+	u.Like(sp.AddAttribute("", "x"), "empty key", "*empty attribute key")
+	u.Like(sp.AddAttribute("f", 1.5), "bad type", "*invalid", "float64")
+	sp.SetStatusCode(500).SetStatusMessage("oops")
+
+	r, ok := sp.(spans.Recorder).GetRecorded()
+	u.Is(true, ok, "recording")
+	u.Is("my.span", r.DisplayName, "DisplayName")
+	u.Is("SERVER", r.Kind, "Kind")
+	u.Is(500, r.StatusCode, "StatusCode")
+	u.Is("oops", r.StatusMessage, "StatusMessage")
+	u.Is(2, len(r.Attributes), "only valid attributes")
+	u.Is("/x", r.Attributes["http.url"], "string attribute")
+	u.Is(2, r.Attributes["retry"], "int attribute")
+
+	r.Attributes["retry"] = 3
+	r2, _ := sp.(spans.Recorder).GetRecorded()
+	u.Is(2, r2.Attributes["retry"], "GetRecorded returns a copy")
+
+	r, ok = sp.NewSpan().(spans.Recorder).GetRecorded()
+	u.Is(true, ok, "derived span recording")
+	u.Is("", r.DisplayName, "derived span has own recording")
+	r, _ = rec.GetRecorded()
+	u.Is("", r.DisplayName, "original span unchanged")
+}
+
+func TestEncode(t *testing.T) {
+	u := tutl.New(t)
+
+	ti := "0123456789abcdef0123456789abcdef"
+	sp, _ := spans.NewROSpan("proj").Import(ti, 20)
+	tok := spans.Encode(sp)
+	u.Is(ti+".0000000000000014", tok, "Encode")
+	u.Is("", spans.Encode(nil), "Encode nil")
+	u.Is("", spans.Encode(spans.NewROSpan("proj")), "Encode empty")
+
+	sp2, err := spans.Decode("other", tok)
+	u.Is(nil, err, "Decode error")
+	if u.IsNot(nil, sp2, "Decode") {
+		u.Is("other", sp2.GetProjectID(), "decoded project")
+		u.Is(ti, sp2.GetTraceID(), "decoded trace ID")
+		u.Is(20, sp2.GetSpanID(), "decoded span ID")
+	}
+
+	sp2, err = spans.Decode("proj", "")
+	u.Is(nil, err, "Decode empty error")
+	u.Is(0, sp2.GetSpanID(), "Decode empty")
+
+	sp2, err = spans.Decode("proj", ti)
+	u.Is(nil, sp2, "Decode no dot")
+	u.Like(err, "no dot err", "*lacks '.'", ti)
+	_, err = spans.Decode("proj", ti+".xyz")
+	u.Like(err, "bad span err", "*invalid span id", "xyz")
+	_, err = spans.Decode("proj", "abc.14")
+	u.Like(err, "bad trace err", "*invalid trace id")
+	_, err = spans.Decode("proj", ti+".0")
+	u.Like(err, "zero span err", "*span id of 0")
+
+	rec := spans.NewRecordingROSpan("proj")
+	sp2, _ = spans.DecodeWith(rec, tok)
+	_, ok := sp2.(spans.Recorder).GetRecorded()
+	u.Is(true, ok, "DecodeWith uses factory's Import")
+}
+
+func TestParentSpan(t *testing.T) {
+	u := tutl.New(t)
+
+	ro := spans.NewROSpan("proj")
+	u.Is(0, ro.GetParentSpanID(), "empty GetParentSpanID")
+	u.Is(0, ro.GetDepth(), "empty GetDepth")
+	sp, _ := ro.Import("00000000000000000000000000000001", 20)
+	parent, depth := spans.ParentSpanID(sp)
+	u.Is(0, parent, "imported parent unknown")
+	u.Is(0, depth, "imported depth")
+	parent, depth = spans.ParentSpanID(nil)
+	u.Is(0, parent, "nil parent")
+	u.Is(0, depth, "nil depth")
+
+	ro.SetSpanID(30)
+	ro.SetParentSpanID(20, 1)
+	u.Is(20, ro.GetParentSpanID(), "SetParentSpanID() parent")
+	u.Is(1, ro.GetDepth(), "SetParentSpanID() depth")
+}
+
+func TestOnFinish(t *testing.T) {
+	u := tutl.New(t)
+
+	var got []uint64
+	var gotDur time.Duration
+	stop := spans.OnFinish(func(sp spans.Factory, dur time.Duration) {
+		got = append(got, sp.GetSpanID())
+		gotDur = dur
+	})
+	calls := 0
+	stop2 := spans.OnFinish(func(_ spans.Factory, _ time.Duration) {
+		calls++
+	})
+	defer stop2()
+
+	ts := &TestSpan{spans.NewROSpan("proj"), 0}
+	spans.FinishSpan(ts)
+	u.Is(1, len(got), "hook called")
+	u.Is(20, got[0], "hook gets span's ID")
+	u.Is(time.Duration(0), gotDur, "hook gets duration")
+	u.Is(1, calls, "second hook called")
+
+	spans.FinishSpan(spans.NewROSpan("proj"))
+	u.Is(1, len(got), "hook not called for empty span")
+
+	stop()
+	spans.FinishSpan(ts)
+	u.Is(1, len(got), "hook unregistered")
+	u.Is(2, calls, "other hook still registered")
+
+	spans.RunFinishHooks(ts, time.Second)
+	u.Is(3, calls, "RunFinishHooks")
+
+	var panicked []interface{}
+	spans.OnHookPanic(func(p interface{}) { panicked = append(panicked, p) })
+	defer spans.OnHookPanic(nil)
+	stop2()
+	stop3 := spans.OnFinish(func(_ spans.Factory, _ time.Duration) {
+		panic("bad hook")
+	})
+	defer stop3()
+	stop4 := spans.OnFinish(func(_ spans.Factory, _ time.Duration) {
+		calls++
+	})
+	defer stop4()
+	u.Is(nil, u.GetPanic(func() { spans.FinishSpan(ts) }), "panic recovered")
+	u.Is(4, calls, "hook after panicking hook still called")
+	u.Is([]interface{}{"bad hook"}, panicked, "panic reported")
+
+	spans.OnHookPanic(nil)
+	u.Is(nil, u.GetPanic(func() { spans.FinishSpan(ts) }), "panic ignored")
+	u.Is(5, calls, "hooks still called")
+}
+
+func TestExemplarLabels(t *testing.T) {
+	u := tutl.New(t)
+
+	ctx := context.Background()
+	u.Is(0, len(spans.ContextExemplarLabels(ctx)), "no span in context")
+	u.Is(0, len(spans.ExemplarLabels(spans.NewROSpan("proj"))), "empty span")
+
+	ti := "00000000000000000000000000000001"
+	sp, _ := spans.NewROSpan("proj").Import(ti, 20)
+	ex := spans.ContextExemplarLabels(spans.ContextStoreSpan(ctx, sp))
+	u.Is(2, len(ex), "exemplar labels")
+	u.Is(ti, ex[spans.ExemplarTraceLabel], "trace label")
+	u.Is("0000000000000014", ex[spans.ExemplarSpanLabel], "span label")
+}
@@ -5,10 +5,13 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/TyeMcQueen/go-lager/gcp-spans"
@@ -17,6 +20,11 @@ import (
 const GcpSpanKey = "logging.googleapis.com/spanId"
 const GcpTraceKey = "logging.googleapis.com/trace"
 
+// GcpParentSpanKey is the key used by GcpContextAddTrace() to log the ID of
+// the parent span, when known.  GCP does not recognize it specially.
+//
+const GcpParentSpanKey = "parentSpanId"
+
 const projIdUrl = "http://metadata.google.internal/computeMetadata/v1/project/project-id"
 
 var projectID string
@@ -83,16 +91,65 @@ func RunningInGcp() {
 	updateGlobals(setRunningInGcp(true))
 }
 
+// DetectGcpEnvironment() checks for the environment variables that GCP sets
+// in Cloud Run services (K_SERVICE), Cloud Run jobs (CLOUD_RUN_JOB), Cloud
+// Functions (FUNCTION_TARGET), and App Engine (GAE_SERVICE).  If none are
+// found, then it does nothing and returns 'nil'.
+//
+// Otherwise, it calls RunningInGcp() and returns pairs identifying the
+// workload: "service" and "revision" for Cloud Run and App Engine (from
+// GAE_VERSION); "function" (plus "service" and "revision" when also set)
+// for Cloud Functions; and "job" and "execution" for Cloud Run jobs.  You
+// can add these to your base Context so they are included in every log line:
+//
+//      func main() {
+//          ctx := context.Background()
+//          if env := lager.DetectGcpEnvironment(); nil != env {
+//              ctx = lager.ContextPairs(ctx).Merge(env).InContext(ctx)
+//          }
+//          ...
+//      }
+//
+// The caveats about calling RunningInGcp() early also apply here.
+//
+func DetectGcpEnvironment() AMap {
+	pairs := make([]interface{}, 0, 6)
+	add := func(key, env string) {
+		if val := os.Getenv(env); "" != val {
+			pairs = append(pairs, key, val)
+		}
+	}
+	switch {
+	case "" != os.Getenv("FUNCTION_TARGET"):
+		add("function", "FUNCTION_TARGET")
+		add("service", "K_SERVICE")
+		add("revision", "K_REVISION")
+	case "" != os.Getenv("K_SERVICE"):
+		add("service", "K_SERVICE")
+		add("revision", "K_REVISION")
+	case "" != os.Getenv("CLOUD_RUN_JOB"):
+		add("job", "CLOUD_RUN_JOB")
+		add("execution", "CLOUD_RUN_EXECUTION")
+	case "" != os.Getenv("GAE_SERVICE"):
+		add("service", "GAE_SERVICE")
+		add("revision", "GAE_VERSION")
+	default:
+		return nil
+	}
+	RunningInGcp()
+	return Pairs(pairs...)
+}
+
 // How GCP options are set safely.
 func setRunningInGcp(enabled bool) func(*globals) {
 	return func(g *globals) {
 		g.inGcp = enabled
 		if enabled {
 			if "" == os.Getenv("LAGER_KEYS") {
-				g.keys = &keyStrs{
+				setKeys(&keyStrs{
 					when: "time", lev: "severity", msg: "message",
 					args: "data", mod: "module", ctx: "",
-				}
+				})(g)
 			}
 			g.levDesc = GcpLevelName
 		} else {
@@ -208,7 +265,7 @@ func RequestUrl(req *http.Request) *url.URL {
 //      "requestSize"       Omitted if the request body size is not yet known.
 //      "responseSize"      Omitted if 'resp' is 'nil' or body size not known.
 //      "latency"           E.g. "0.1270s".  Omitted if 'start' is 'nil'.
-//      "remoteIp"          E.g. "127.0.0.1"
+//      "remoteIp"          E.g. "127.0.0.1" (see SetAnonymizeIPs()).
 //      "serverIp"          Not currently ever included.
 //      "referer"           Omitted if there is no Referer[sic] header.
 //      "userAgent"         Omitted if there is no User-Agent header.
@@ -221,53 +278,117 @@ func RequestUrl(req *http.Request) *url.URL {
 // See also GcpHttpF() and GcpRequestAddTrace().
 //
 func GcpHttp(req *http.Request, resp *http.Response, start *time.Time) RawMap {
-	ua := req.Header.Get("User-Agent")
-	ref := req.Header.Get("Referer")
-	reqSize := req.ContentLength
+	return newHttpReqInfo(req).gcpPairs(resp, start)
+}
 
-	remoteAddr := req.RemoteAddr
-	if remoteIp, _, err := net.SplitHostPort(remoteAddr); nil == err {
-		remoteAddr = remoteIp
-	}
+// The details about an HTTP request that GcpHttp() and HttpInfo() log.
+type httpReqInfo struct {
+	method, url, path, proto, remoteIp, referer, userAgent string
+	reqSize                                                int64
+}
+
+func newHttpReqInfo(req *http.Request) *httpReqInfo {
+	remoteAddr := RemoteIP(req.RemoteAddr)
 	// TODO: Add support for proxy headers?
 	//  if ... req.Header.Get("X-Forwarded-For") {
 	//      remoteIp = ...
 	//  }
 
-	if nil != start && (*start).IsZero() {
-		start = nil
-	}
-	status := -1
-	respSize := int64(-1)
-	if nil != resp {
-		status = resp.StatusCode
-		respSize = resp.ContentLength
-	} else if nil != start {
-		status = 0
+	uri := RequestUrl(req)
+	return &httpReqInfo{
+		method:    req.Method,
+		url:       uri.String(),
+		path:      uri.RequestURI(),
+		proto:     req.Proto,
+		remoteIp:  remoteAddr,
+		referer:   req.Header.Get("Referer"),
+		userAgent: req.Header.Get("User-Agent"),
+		reqSize:   req.ContentLength,
 	}
+}
 
+// Returns the pairs for GcpHttp().
+func (i *httpReqInfo) gcpPairs(resp *http.Response, start *time.Time) RawMap {
+	status, respSize, start := respDetails(resp, start)
 	lag := ""
 	if nil != start {
-		lag = fmt.Sprintf("%.4fs", time.Now().Sub(*start).Seconds())
+		lag = fmt.Sprintf("%.4fs", Now().Sub(*start).Seconds())
 	}
 
-	uri := RequestUrl(req)
-
 	return Map(
-		"requestMethod", req.Method,
-		"requestUrl", uri.String(),
-		"protocol", req.Proto,
+		"requestMethod", i.method,
+		"requestUrl", i.url,
+		"protocol", i.proto,
 		Unless(-1 == status, "status"), status,
-		Unless(reqSize < 0, "requestSize"), reqSize,
+		Unless(i.reqSize < 0, "requestSize"), i.reqSize,
 		Unless(respSize < 0, "responseSize"), respSize,
 		Unless("" == lag, "latency"), lag,
-		"remoteIp", remoteAddr,
+		"remoteIp", i.remoteIp,
 		// "serverIp", ?,
-		Unless("" == ref, "referer"), ref,
-		Unless("" == ua, "userAgent"), ua,
+		Unless("" == i.referer, "referer"), i.referer,
+		Unless("" == i.userAgent, "userAgent"), i.userAgent,
 	)
 }
 
+// GcpHttpCache computes the request details logged by GcpHttp() only once,
+// so they can be cheaply included in many log lines.  Use GcpHttpCached()
+// to create one.
+//
+type GcpHttpCache struct {
+	req   *http.Request
+	once  sync.Once
+	info  *httpReqInfo
+	pairs RawMap
+}
+
+// GcpHttpCached() returns a GcpHttpCache for 'req'.  Nothing is computed
+// until the first time a log line needs the request details.  For example:
+//
+//      hc := lager.GcpHttpCached(req)
+//      ctx := lager.AddPairs(req.Context(), "httpRequest", hc.F())
+//      ...
+//      lager.Acc(lager.AddPairs(ctx,
+//          "httpRequest", hc.Response(resp, &start)),
+//      ).List("Response sent")
+//
+// 'req' should not be modified after being passed in.
+//
+func GcpHttpCached(req *http.Request) *GcpHttpCache {
+	return &GcpHttpCache{req: req}
+}
+
+func (c *GcpHttpCache) get() *httpReqInfo {
+	c.once.Do(func() {
+		c.info = newHttpReqInfo(c.req)
+		c.pairs = c.info.gcpPairs(nil, nil)
+	})
+	return c.info
+}
+
+// Request() returns the same value as 'GcpHttp(req, nil, nil)' but it is
+// only computed once and then shared by all calls.
+//
+func (c *GcpHttpCache) Request() RawMap {
+	c.get()
+	return c.pairs
+}
+
+// F() returns a function to be logged in place of Request() so that the
+// request details are not computed unless something gets logged.
+//
+func (c *GcpHttpCache) F() func() interface{} {
+	return func() interface{} {
+		return c.Request()
+	}
+}
+
+// Response() returns the same value as 'GcpHttp(req, resp, start)' but
+// only the response status, size, and latency need to be computed.
+//
+func (c *GcpHttpCache) Response(resp *http.Response, start *time.Time) RawMap {
+	return c.get().gcpPairs(resp, start)
+}
+
 // GcpHttpF() can be used for logging just like GcpHttp(), it just returns a
 // function so that the work is only performed if the logging level is enabled.
 //
@@ -307,24 +428,32 @@ func GcpHttpF(
 //
 //      lager.Acc(
 //          lager.AddPairs(req.Context(),
-//              "httpRequest", GcpHttp(req, resp, pStart)))
+//              "httpRequest", GcpHttp(req, resp, pStart),
+//              "route", RouteTemplate(req),
+//              "user", RequestUser(req)))
+//
+// except that "route" is omitted if RouteTemplate() returns "" and "user"
+// is omitted if RequestUser() returns "" [see AddUserFunc()].
 //
 // You would use it like, for example:
 //
 //      lager.GcpLogAccess(req, resp, &start).MMap(
-//          "Response sent", "User", userID)
+//          "Response sent", "cached", fromCache)
+//
+// See LogAccess() for other formats of access logs.
 //
 func GcpLogAccess(
 	req *http.Request, resp *http.Response, pStart *time.Time,
 ) Lager {
-	return Acc(
-		AddPairs(req.Context(), "httpRequest", GcpHttp(req, resp, pStart)))
+	return LogAccess(req, resp, pStart, HttpGcp)
 }
 
 // GcpContextAddTrace() takes a Context and returns one that has the span
 // added as 2 pairs that will be logged and recognized by GCP when that
 // Context is passed to lager.Warn() or similar methods.  If 'span' is 'nil'
-// or an empty Factory, then the original 'ctx' is just returned.
+// or an empty Factory, then the original 'ctx' is just returned.  If the
+// span's parent is known [see spans.Parented], then a third pair is added
+// using GcpParentSpanKey.
 //
 // 'ctx' is the Context from which the new Context is created.  'span'
 // contains the GCP CloudTrace span to be added.
@@ -333,14 +462,252 @@ func GcpLogAccess(
 // which call this and do several other useful things.
 //
 func GcpContextAddTrace(ctx Ctx, span spans.Factory) Ctx {
+	return addTrace(ctx, span, 0)
+}
+
+// Does GcpContextAddTrace() but, if the span does not know its parent, uses
+// 'parent' (the span that Lager created 'span' from, if not 0) instead.
+func addTrace(ctx Ctx, span spans.Factory, parent uint64) Ctx {
 	if nil != span && 0 != span.GetSpanID() {
-		ctx = AddPairs(ctx,
+		ctx = rawPairs(ctx,
 			GcpTraceKey, span.GetTracePath(),
 			GcpSpanKey, spans.HexSpanID(span.GetSpanID()))
+		if known, _ := spans.ParentSpanID(span); 0 != known {
+			parent = known
+		}
+		if 0 != parent && parent != span.GetSpanID() {
+			ctx = rawPairs(ctx, GcpParentSpanKey, spans.HexSpanID(parent))
+		}
 	}
 	return ctx
 }
 
+// GcpTraceURLKey is the key for the pair added to Fail lines when
+// SetTraceURLOnFail(true) is in effect.
+//
+const GcpTraceURLKey = "traceUrl"
+
+// TraceURL() returns the URL of the page in the GCP console that shows the
+// trace that 'span' is part of, so on-call engineers can go straight from
+// a log line (or an error page or a chat message) to the trace.  It returns
+// "" if 'span' is 'nil' or empty.
+//
+//      lager.Fail(ctx).MMap("Checkout failed", "err", err,
+//          "trace", lager.TraceURL(spans.ContextGetSpan(ctx)))
+//
+func TraceURL(span spans.Factory) string {
+	if nil == span {
+		return ""
+	}
+	return traceURL(span.GetTracePath())
+}
+
+// Returns the GCP console URL for a trace path of the form
+// "projects/{projectID}/traces/{traceID}" (or "" for any other string).
+func traceURL(path string) string {
+	const pre, mid = "projects/", "/traces/"
+	i := strings.Index(path, mid)
+	if !strings.HasPrefix(path, pre) || i <= len(pre) ||
+		len(path) == i+len(mid) {
+		return ""
+	}
+	return "https://console.cloud.google.com/traces/list?project=" +
+		url.QueryEscape(path[len(pre):i]) +
+		"&tid=" + url.QueryEscape(path[i+len(mid):])
+}
+
+// SetTraceURLOnFail() controls whether Fail lines logged with a Context
+// holding a trace [see GcpContextAddTrace()] also get a pair holding the
+// URL of the trace in the GCP console [see TraceURL()], using the key
+// GcpTraceURLKey.  The default is 'false'.
+//
+//      lager.SetTraceURLOnFail(true)
+//
+func SetTraceURLOnFail(include bool) {
+	updateGlobals(func(g *globals) {
+		g.traceURLOnFail = include
+	})
+}
+
+// Adds the GcpTraceURLKey pair to 'kvp' if it has a trace.
+func addTraceURL(kvp AMap) AMap {
+	if path, ok := kvp.Get(GcpTraceKey); ok {
+		if u := traceURL(S(path)); "" != u {
+			kvp = kvp.AddPairs(GcpTraceURLKey, u)
+		}
+	}
+	return kvp
+}
+
+// SpanOption customizes the span created by GcpContextReceivedRequest(),
+// GcpContextSendingRequest(), and the functions that call them.  See
+// SpanName(), SpanRoute(), SpanPeerService(), and SpanAttribute().
+//
+type SpanOption func(*spanOpts)
+
+type spanOpts struct {
+	name  string
+	attrs []interface{}
+}
+
+// SpanName() returns a SpanOption that sets the span's Display Name to
+// 'name' instead of GetSpanPrefix() + ".in.request" or ".out.request".
+//
+func SpanName(name string) SpanOption {
+	return func(o *spanOpts) { o.name = name }
+}
+
+// SpanAttribute() returns a SpanOption that adds an attribute to the span.
+//
+func SpanAttribute(key string, val interface{}) SpanOption {
+	return func(o *spanOpts) { o.attrs = append(o.attrs, key, val) }
+}
+
+// SpanRoute() returns a SpanOption that adds an "http.route" attribute to
+// the span, normally set to the route template that matched the request
+// [such as "/user/{id}"] rather than to the request's full path.
+//
+func SpanRoute(route string) SpanOption {
+	return SpanAttribute("http.route", route)
+}
+
+// SpanPeerService() returns a SpanOption that adds a "peer.service"
+// attribute to the span, normally used to name the dependent service
+// that a request is being sent to.
+//
+func SpanPeerService(name string) SpanOption {
+	return SpanAttribute("peer.service", name)
+}
+
+func spanOptions(opts []SpanOption) spanOpts {
+	o := spanOpts{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// applyTo() sets the span's Display Name (using 'dflt' if no SpanName()
+// was given) and adds any extra attributes.
+//
+func (o spanOpts) applyTo(span spans.Factory, dflt string) {
+	if "" == o.name {
+		o.name = dflt
+	}
+	span.SetDisplayName(o.name)
+	for i := 0; i+1 < len(o.attrs); i += 2 {
+		span.AddAttribute(o.attrs[i].(string), o.attrs[i+1])
+	}
+}
+
+// Marks a Context where GetSpanExport() decided to not create spans.
+type noSpanExport struct{}
+
+// spanExported() returns 'false' if no new span should be created as a
+// child of 'span' [see GetSpanExport()].
+//
+func spanExported(ctx Ctx, span spans.Factory) bool {
+	rate := getGlobals().spanExport
+	switch {
+	case nil != ctx.Value(noSpanExport{}), rate <= 0.0:
+		return false
+	case 1.0 <= rate, 0 != span.GetSpanID():
+		return true
+	}
+	return rand.Float64() < rate
+}
+
+// unexportedTrace() returns a read-only span (so one that is never exported)
+// holding new, random trace and span IDs.  It is used when a request that
+// is not part of a trace is not sampled [see GetSpanExport()] so that its
+// log lines can still be correlated.
+//
+func unexportedTrace(projectID string) spans.Factory {
+	// Neither ID may be 0:
+	traceID := fmt.Sprintf("%016x%016x", rand.Uint64(), rand.Uint64()|1)
+	span, _ := spans.NewROSpan(projectID).Import(traceID, rand.Uint64()|1)
+	return span
+}
+
+// Marks a Context where the received trace header said whether the trace
+// was sampled (the "o=1" or "o=0" option).
+type headerSampled struct{}
+
+// traceFlag() returns the value of the "o=" (sampled) option from the
+// trace header in 'h' and whether the option was present.
+//
+func traceFlag(h http.Header) (sampled, ok bool) {
+	_, opts, _ := strings.Cut(h.Get(spans.TraceHeader), ";")
+	switch opts {
+	case "o=1":
+		return true, true
+	case "o=0":
+		return false, true
+	}
+	return false, false
+}
+
+// TraceSampled() returns 'true' if 'ctx' holds a span [see
+// spans.ContextStoreSpan()] that is part of a trace that is sampled.  It
+// returns 'false' if there is no trace.
+//
+// If the trace header given to GcpContextReceivedRequest() had a sampled
+// flag (like "{trace}/{span};o=1"), then the flag decides.  Otherwise the
+// trace is sampled unless GcpContextReceivedRequest() or
+// GcpContextSendingRequest() decided not to create spans for it [see
+// GetSpanExport()].
+//
+func TraceSampled(ctx Ctx) bool {
+	if nil == ctx {
+		return false
+	} else if span := spans.ContextGetSpan(ctx); nil == span ||
+		"" == span.GetTraceID() {
+		return false
+	} else if sampled, ok := ctx.Value(headerSampled{}).(bool); ok {
+		return sampled
+	}
+	return nil == ctx.Value(noSpanExport{})
+}
+
+// IfSampled() is like AddPairs() except that the pairs are only added if
+// TraceSampled(ctx) is 'true'.  This ties how much detail gets logged to
+// trace sampling, so the requests that get deep diagnostics are the same
+// ones that have traces and the cost of those diagnostics scales with the
+// sampling rate.
+//
+//      ctx = lager.IfSampled(ctx, "cart", func() interface{} {
+//          return cart.Describe() // Only called for sampled requests.
+//      })
+//      lager.Info(ctx).MMap("Checking out")
+//
+// A 'func() interface{}' value is only called when a line is logged with
+// the returned Context, so it costs nothing for requests that are not
+// sampled, but it is called for each such line.
+//
+func IfSampled(ctx Ctx, pairs ...interface{}) Ctx {
+	if !TraceSampled(ctx) {
+		return ctx
+	}
+	return AddPairs(ctx, pairs...)
+}
+
+// parseSpanExport() parses the value of LAGER_SPAN_EXPORT.
+func parseSpanExport(s string) (float64, bool) {
+	switch strings.ToLower(s) {
+	case "":
+		return 0.0, false
+	case "on", "true", "yes":
+		return 1.0, true
+	case "off", "false", "no":
+		return 0.0, true
+	}
+	rate, err := strconv.ParseFloat(s, 64)
+	if nil != err || rate < 0.0 || 1.0 < rate {
+		return 0.0, false
+	}
+	return rate, true
+}
+
 // GcpContextReceivedRequest() does several things that are useful when
 // a server receives a new request.  'ctx' is the Context passed to the
 // request handler and 'req' is the received request.
@@ -359,12 +726,21 @@ func GcpContextAddTrace(ctx Ctx, span spans.Factory) Ctx {
 // set to GetSpanPrefix() + ".in.request", and it is stored in the context
 // via spans.ContextStoreSpan().  Also, an "http.url" attribute is set
 // to the request's URL (minus query parameters), and if the request method
-// is not "GET", then an "http.method" attribute is set to that.
+// is not "GET", then an "http.method" attribute is set to that.  Any
+// SpanOption arguments are then applied, which can replace the Display
+// Name [SpanName()] or add more attributes [such as SpanRoute()].
+//
+// No new span is created if GetSpanExport() says not to.  Then the span
+// imported from the headers (if any) is stored in the context instead so
+// it is still logged and passed along to dependent services.
 //
 // If a span was imported or created, then the span information is added
 // to the Context as pairs to be logged [see GcpContextAddTrace()] and
 // a span will be contained in the returned Factory.
 //
+// The returned Context also tracks the request's log budget, if one was
+// set via SetRequestBudget().
+//
 // The updated Context is returned (Contexts are immutable).
 //
 // It is usually called in a manner similar to:
@@ -375,6 +751,9 @@ func GcpContextAddTrace(ctx Ctx, span spans.Factory) Ctx {
 //      ctx, span := lager.GcpContextReceivedRequest(ctx, req)
 //      var resp *http.Response
 //      defer lager.GcpSendingResponse(span, req, resp)
+// or
+//      ctx, span := lager.GcpContextReceivedRequest(ctx, req,
+//          lager.SpanName("get.user"), lager.SpanRoute("/user/{id}"))
 //
 // See also GcpReceivedRequest().
 //
@@ -384,9 +763,9 @@ func GcpContextAddTrace(ctx Ctx, span spans.Factory) Ctx {
 // left in Go (in assignment statements and when using channels).
 //
 func GcpContextReceivedRequest(
-	ctx Ctx, req *http.Request,
+	ctx Ctx, req *http.Request, opts ...SpanOption,
 ) (Ctx, spans.Factory) {
-	ctx = AddPairs(ctx, "httpRequest", GcpHttp(req, nil, nil))
+	ctx = RequestBudget(rawPairs(ctx, "httpRequest", GcpHttp(req, nil, nil)))
 	span := spans.ContextGetSpan(ctx)
 	if nil == span {
 		if proj, err := GcpProjectID(nil); nil != err {
@@ -397,17 +776,28 @@ func GcpContextReceivedRequest(
 	}
 	if nil != span {
 		span = span.ImportFromHeaders(req.Header)
-		if sub := span.NewSpan(); nil != sub {
+		if sampled, ok := traceFlag(req.Header); ok {
+			ctx = context.WithValue(ctx, headerSampled{}, sampled)
+		}
+		parent := uint64(0)
+		if !spanExported(ctx, span) {
+			if 0 == span.GetSpanID() {
+				span = unexportedTrace(span.GetProjectID())
+			}
+			ctx = context.WithValue(ctx, noSpanExport{}, true)
+			ctx = spans.ContextStoreSpan(ctx, span)
+		} else if sub := span.NewSpan(); nil != sub {
+			parent = span.GetSpanID()
 			span = sub
-			span.SetDisplayName(GetSpanPrefix() + ".in.request")
 			span.SetIsServer()
 			span.AddAttribute("http.url", RequestUrl(req).String())
 			if "" != req.Method {
 				span.AddAttribute("http.method", req.Method)
 			}
+			spanOptions(opts).applyTo(span, GetSpanPrefix()+".in.request")
 			ctx = spans.ContextStoreSpan(ctx, span)
 		}
-		ctx = GcpContextAddTrace(ctx, span)
+		ctx = addTrace(ctx, span, parent)
 	}
 	return ctx, span
 }
@@ -415,6 +805,7 @@ func GcpContextReceivedRequest(
 // GcpReceivedRequest() gets the Context from '*pReq' and uses it to call
 // GcpContextReceivedRequest().  Then it replaces '*pReq' with a version of
 // the request with the new Context attached.  Then it returns the Factory.
+// Any SpanOption arguments are passed along to GcpContextReceivedRequest().
 //
 // It is usually called in a manner similar to:
 //
@@ -430,8 +821,10 @@ func GcpContextReceivedRequest(
 // it further before attaching it) since each time WithContext() is called
 // on a Request, the Request must be copied.
 //
-func GcpReceivedRequest(pReq **http.Request) spans.Factory {
-	ctx, span := GcpContextReceivedRequest((*pReq).Context(), *pReq)
+func GcpReceivedRequest(
+	pReq **http.Request, opts ...SpanOption,
+) spans.Factory {
+	ctx, span := GcpContextReceivedRequest((*pReq).Context(), *pReq, opts...)
 	*pReq = (*pReq).WithContext(ctx)
 	return span
 }
@@ -451,10 +844,17 @@ func GcpReceivedRequest(pReq **http.Request) spans.Factory {
 // is not (cannot be) modified, so the trace/span pair logged after the
 // request-sending function returns will revert to the prior span.
 //
+// No sub-span is created if GetSpanExport() says not to, including when
+// GcpContextReceivedRequest() decided that for the request being handled.
+//
 // If a span was found or created, then its CloudContext is added to the
 // headers for 'req' so that the dependent service can log it and add its
 // own spans to the trace (unless 'req' is 'nil').
 //
+// Any SpanOption arguments are applied to the new span, which can replace
+// its Display Name [SpanName()] or add more attributes [such as
+// SpanPeerService()].
+//
 // The updated Context is returned (Contexts are immutable).
 //
 // The order of arguments is 'req' then 'ctx' as information moves only
@@ -469,14 +869,19 @@ func GcpReceivedRequest(pReq **http.Request) spans.Factory {
 // See also GcpSendingRequest().
 //
 func GcpContextSendingRequest(
-	req *http.Request, ctx Ctx,
+	req *http.Request, ctx Ctx, opts ...SpanOption,
 ) (Ctx, spans.Factory) {
 	span := spans.ContextGetSpan(ctx)
 	if nil != span {
-		subspan := span.NewSpan()
+		var subspan spans.Factory
+		if spanExported(ctx, span) {
+			subspan = span.NewSpan()
+		} else {
+			ctx = context.WithValue(ctx, noSpanExport{}, true)
+		}
 		if nil != subspan {
+			parent := span.GetSpanID()
 			span = subspan
-			span.SetDisplayName(GetSpanPrefix() + ".out.request")
 			span.SetIsClient()
 			if nil != req {
 				span.AddAttribute("http.url", RequestUrl(req).String())
@@ -484,8 +889,9 @@ func GcpContextSendingRequest(
 					span.AddAttribute("http.method", req.Method)
 				}
 			}
+			spanOptions(opts).applyTo(span, GetSpanPrefix()+".out.request")
 			ctx = spans.ContextStoreSpan(ctx, span)
-			ctx = GcpContextAddTrace(ctx, span)
+			ctx = addTrace(ctx, span, parent)
 		}
 		if nil != req {
 			span.SetHeader(req.Header)
@@ -497,7 +903,8 @@ func GcpContextSendingRequest(
 // GcpSendingNewRequest() does several things that are useful when a
 // server is about to send a request to a dependent service, by calling
 // GcpContextSendingRequest().  It takes the same arguments as
-// http.NewRequestWithContext() but returns extra values.
+// http.NewRequestWithContext() but returns extra values.  Any SpanOption
+// arguments are passed along to GcpContextSendingRequest().
 //
 // It is usually called in a manner similar to:
 //
@@ -509,19 +916,21 @@ func GcpContextSendingRequest(
 // separately to ease updating 'ctx' such as shown above.
 //
 func GcpSendingNewRequest(
-	ctx Ctx, method, url string, body io.Reader,
+	ctx Ctx, method, url string, body io.Reader, opts ...SpanOption,
 ) (*http.Request, Ctx, spans.Factory, error) {
-	ctx, span := GcpContextSendingRequest(nil, ctx)
+	ctx, span := GcpContextSendingRequest(nil, ctx, opts...)
 	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if nil != err {
 		// ('span' will just get garbage collected and not registered.)
 		return nil, ctx, nil, err
 	}
-	if nil != span {
+	if nil != span && nil == ctx.Value(noSpanExport{}) {
 		span.AddAttribute("http.url", RequestUrl(req).String())
 		if "" != req.Method && "GET" != req.Method {
 			span.AddAttribute("http.method", req.Method)
 		}
+	}
+	if nil != span {
 		span.SetHeader(req.Header)
 	}
 	return req, ctx, span, nil
@@ -531,14 +940,20 @@ func GcpSendingNewRequest(
 // server is about to send a request to a dependent service, by calling
 // GcpContextSendingRequest().  It uses the Context from '*pReq' and then
 // replaces '*pReq' with a copy of the original Request but with the new
-// Context attached.
+// Context attached.  Any SpanOption arguments are passed along to
+// GcpContextSendingRequest().
 //
 // It is usually called in a manner similar to:
 //
 //      defer spans.FinishSpan(lager.GcpSendingRequest(&req))
+// or
+//      defer spans.FinishSpan(lager.GcpSendingRequest(
+//          &req, lager.SpanPeerService("billing")))
 //
-func GcpSendingRequest(pReq **http.Request) spans.Factory {
-	ctx, span := GcpContextSendingRequest(*pReq, (*pReq).Context())
+func GcpSendingRequest(
+	pReq **http.Request, opts ...SpanOption,
+) spans.Factory {
+	ctx, span := GcpContextSendingRequest(*pReq, (*pReq).Context(), opts...)
 	*pReq = (*pReq).WithContext(ctx)
 	return span
 }
@@ -554,7 +969,7 @@ func GcpFinishSpan(span spans.Factory, resp *http.Response) time.Duration {
 	if "" != resp.Status {
 		span.SetStatusMessage(resp.Status)
 	}
-	return span.Finish()
+	return spans.FinishSpan(span)
 }
 
 // GcpSendingResponse() does several things that are useful when a server
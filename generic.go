@@ -0,0 +1,94 @@
+package lager
+
+// onePair is implemented by the pairs made by KV(), UnlessKV(), and
+// Hashed(), which take up only one slot in the list of pairs.
+type onePair interface {
+	// onePair() returns the key and value to log or 'false' if nothing
+	// should be logged.
+	onePair() (key string, val interface{}, ok bool)
+}
+
+type kvPair[T any] struct {
+	key string
+	val T
+}
+
+func (p kvPair[T]) onePair() (string, interface{}, bool) {
+	return p.key, p.val, true
+}
+
+type noPair struct{}
+
+func (noPair) onePair() (string, interface{}, bool) { return "", nil, false }
+
+// KV() is used in place of a key/value pair (it takes up only one slot in
+// the list of pairs, like Err()) so that the key is always a string and
+// the key can't be separated from its value, which makes it impossible to
+// pass an odd number of items by mistake:
+//
+//      lager.Info().MMap("Sent", lager.KV("bytes", n), lager.KV("to", addr))
+//
+// The value is logged the same as if 'key' and 'val' had been passed as a
+// regular pair.  KV() is only special when used in the arguments to a
+// [C]Map() or [C]MMap() method or to lager.Map().
+//
+func KV[T any](key string, val T) interface{} { return kvPair[T]{key, val} }
+
+// Unless() is used to pass an optional label+value pair to Map().  Use
+// Unless() to specify the label and, if the value is unsafe or expensive to
+// compute, then wrap it in a deferring function:
+//
+//      lager.Debug().Map(
+//          "Ran", stage,
+//          // Don't include `"Error": null,` in the log:
+//          lager.Unless(nil == err, "Error"), err,
+//          // Don't call config.Proxy() if config is nil:
+//          lager.Unless(nil == config, "Proxy"),
+//              func() interface{} { return config.Proxy() },
+//      )
+//
+// If 'cond' is 'false', then 'label' is returned (as is, so it can be of
+// any type that is valid as a key).  Otherwise the returned marker causes
+// the label and the value after it to be skipped.  But if 'label' is
+// something that takes up only one slot in the list of pairs [like the
+// return value of KV(), Err(), or ExitCode()], then only it is skipped:
+//
+//      lager.Info().MMap("Ran", lager.Unless(nil == err, lager.Err(err)))
+//
+func Unless[T any](cond bool, label T) interface{} {
+	if !cond {
+		return label
+	}
+	switch interface{}(label).(type) {
+	case onePair, errPair, exitCodePair:
+		return noPair{}
+	}
+	return SkipThisPair
+}
+
+// UnlessKV() is like KV() except that nothing is logged if 'cond' is
+// 'true'.  It is a type-safe alternative to Unless() that takes up only one
+// slot in the list of pairs:
+//
+//      lager.Debug().MMap("Ran", "stage", stage,
+//          lager.UnlessKV(nil == err, "err", err))
+//
+func UnlessKV[T any](cond bool, key string, val T) interface{} {
+	if cond {
+		return noPair{}
+	}
+	return kvPair[T]{key, val}
+}
+
+// FromContext() is like PairFromContext() but only succeeds if the value is
+// of type T (which can be an interface type), returning it as a T:
+//
+//      if user, ok := lager.FromContext[*User](ctx, "user"); ok {
+//          ...
+//      }
+//
+func FromContext[T any](ctx Ctx, key string) (T, bool) {
+	val, _ := PairFromContext(ctx, key)
+	t, ok := val.(T)
+	return t, ok
+}
@@ -2,27 +2,88 @@ package grpc_lager
 
 import (
 	"context"
+	"sort"
 
 	"github.com/TyeMcQueen/go-lager"
 	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
 )
 
+type tagOptions struct {
+	prefix string
+	skip   map[string]bool
+}
+
+// TagOption customizes how TagsToPairs converts grpc_ctxtags tags into Lager pairs.
+type TagOption func(*tagOptions)
+
+// WithTagPrefix prepends 'prefix' to the key of each tag, for example "tags." so the tags
+// can't collide with other pairs.
+func WithTagPrefix(prefix string) TagOption {
+	return func(o *tagOptions) {
+		o.prefix = prefix
+	}
+}
+
+// WithoutTags skips the tags with the given keys (the keys before any prefix is added).
+func WithoutTags(keys ...string) TagOption {
+	return func(o *tagOptions) {
+		if nil == o.skip {
+			o.skip = make(map[string]bool, len(keys))
+		}
+		for _, key := range keys {
+			o.skip[key] = true
+		}
+	}
+}
+
 // TagsToPairs extracts the tags provided by the go-grpc-middleware library from
-// the context, adds them to the context as Lager pairs and returns an updated context
-func TagsToPairs(ctx context.Context) context.Context {
-	tags := grpc_ctxtags.Extract(ctx)
+// the context, adds them to the context as Lager pairs and returns an updated context.
+// A tag replaces any pair already in the context that has the same key.  The tags
+// are added in order by key so the log output does not vary from call to call.
+func TagsToPairs(ctx context.Context, opts ...TagOption) context.Context {
+	return lager.AddPairs(ctx, tagPairs(ctx, opts)...)
+}
+
+// LazyTags returns a function that extracts the tags from the context (like TagsToPairs) only when it is
+// called.  Log it after lager.InlinePairs so the tags are only converted if the line is actually logged:
+//
+//	lager.Info(ctx).MMap("Looked up user", "user", req.User, lager.InlinePairs, grpc_lager.LazyTags(ctx))
+//
+// Unlike with TagsToPairs, a tag does not replace a context pair with the same key, so both are logged.
+func LazyTags(ctx context.Context, opts ...TagOption) func() interface{} {
+	return func() interface{} { return lager.RawMap(tagPairs(ctx, opts)) }
+}
 
-	for k, v := range tags.Values() {
-		ctx = lager.AddPairs(ctx, k, v)
+// tagPairs returns the tags from the context as a list of key/value pairs in order by key.
+func tagPairs(ctx context.Context, opts []TagOption) []interface{} {
+	o := tagOptions{}
+	for _, opt := range opts {
+		opt(&o)
 	}
 
-	return ctx
+	values := grpc_ctxtags.Extract(ctx).Values()
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		if !o.skip[k] {
+			keys = append(keys, k)
+		}
+	}
+	if 0 == len(keys) {
+		return nil
+	}
+	sort.Strings(keys)
+
+	pairs := make([]interface{}, 0, 2*len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, o.prefix+k, values[k])
+	}
+	return pairs
 }
 
 // Pass in context and one character from "PEFWNAITDOG" to
 // get a Lager object that has all the grpc_ctxtags updated.
-func Extract(ctx context.Context, lev byte) lager.Lager {
-	ctx = TagsToPairs(ctx)
+func Extract(ctx context.Context, lev byte, opts ...TagOption) lager.Lager {
+	ctx = TagsToPairs(ctx, opts...)
 
 	return lager.Level(lev, ctx)
 }
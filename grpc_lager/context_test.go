@@ -0,0 +1,61 @@
+package grpc_lager_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/TyeMcQueen/go-lager"
+	"github.com/TyeMcQueen/go-lager/grpc_lager"
+	"github.com/TyeMcQueen/go-tutl"
+	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
+)
+
+func TestTagsToPairs(t *testing.T) {
+	u := tutl.New(t)
+	ctx := context.Background()
+	u.Is(ctx, grpc_lager.TagsToPairs(ctx), "no tags leaves context as is")
+
+	tags := grpc_ctxtags.NewTags().
+		Set("peer.address", "10.1.2.3").
+		Set("user", "ann").
+		Set("custom", 1337)
+	ctx = grpc_ctxtags.SetInContext(lager.AddPairs(ctx, "user", "bob"), tags)
+
+	u.Is(lager.Pairs("user", "ann", "custom", 1337, "peer.address", "10.1.2.3"),
+		lager.ContextPairs(grpc_lager.TagsToPairs(ctx)),
+		"tags replace existing pairs, added in order by key")
+	u.Is(lager.Pairs("user", "bob", "tag.custom", 1337, "tag.user", "ann"),
+		lager.ContextPairs(grpc_lager.TagsToPairs(ctx,
+			grpc_lager.WithTagPrefix("tag."),
+			grpc_lager.WithoutTags("peer.address"))),
+		"prefixed tags, one skipped")
+	u.Is(lager.Pairs("user", "bob"),
+		lager.ContextPairs(grpc_lager.TagsToPairs(ctx,
+			grpc_lager.WithoutTags("peer.address", "user"),
+			grpc_lager.WithoutTags("custom"))),
+		"all tags skipped")
+}
+
+func TestLogger(t *testing.T) {
+	u := tutl.New(t)
+	b := &bytes.Buffer{}
+	defer lager.SetOutput(b)()
+	defer saveLevels()()
+	lager.Init("FWNAI")
+
+	tags := grpc_ctxtags.NewTags().Set("user", "ann")
+	ctx := grpc_ctxtags.SetInContext(lager.AddPairs(context.Background(), "id", 7), tags)
+	log := grpc_lager.Logger(ctx, grpc_lager.WithTagPrefix("tag."))
+	tags.Set("peer", "10.1.2.3")
+
+	u.Is(false, log.Debug().Enabled(), "Debug disabled")
+	log.Debug().MMap("hidden")
+	log.Info().MMap("shown")
+	log.Warn().List("listed")
+	u.Like(b.String(), "log lines",
+		`^\["[^"]+", "INFO", "shown", {"id":7, "tag.peer":"10.1.2.3", "tag.user":"ann"}\]\n`,
+		`\n\["[^"]+", "WARN", "listed", {"id":7, "tag.peer":"10.1.2.3", "tag.user":"ann"}\]\n$`)
+	u.Is(lager.Pairs("id", 7, "tag.peer", "10.1.2.3", "tag.user", "ann"),
+		lager.ContextPairs(log.Context()), "Context")
+}
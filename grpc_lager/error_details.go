@@ -0,0 +1,79 @@
+package grpc_lager
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/TyeMcQueen/go-lager"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// errorDetailPairs returns the pairs added by WithErrorDetails.
+func errorDetailPairs(err error, redact ErrorRedactor) lager.AMap {
+	var pairs lager.AMap
+	if st := findStatus(err); nil != st {
+		var details []interface{}
+		for _, d := range st.Details() {
+			if nil != redact {
+				if d = redact(d); nil == d {
+					continue
+				}
+			}
+			details = append(details, detailValue(d))
+		}
+		if 0 < len(details) {
+			pairs = pairs.AddPairs("grpc.details", details)
+		}
+	}
+
+	if nil == errors.Unwrap(err) {
+		return pairs
+	}
+	var chain []interface{}
+	for e := err; nil != e; e = errors.Unwrap(e) {
+		var v interface{} = e
+		if nil != redact {
+			if v = redact(e); nil == v {
+				continue
+			}
+		}
+		if ve, ok := v.(error); ok {
+			v = ve.Error()
+		}
+		chain = append(chain, v)
+	}
+	return pairs.AddPairs("grpc.error_chain", chain)
+}
+
+// findStatus returns the gRPC status of the first error in the chain that has one (or nil).
+func findStatus(err error) *status.Status {
+	for e := err; nil != e; e = errors.Unwrap(e) {
+		if st, ok := status.FromError(e); ok {
+			return st
+		}
+	}
+	return nil
+}
+
+// detailValue returns a status detail in structured form (its type name and its value as JSON).
+func detailValue(d interface{}) interface{} {
+	switch v := d.(type) {
+	case proto.Message:
+		var value interface{}
+		b, err := protojson.Marshal(v)
+		if nil == err {
+			err = json.Unmarshal(b, &value)
+		}
+		if nil == err {
+			return lager.Map(
+				"type", string(v.ProtoReflect().Descriptor().FullName()),
+				"value", value,
+			)
+		}
+	case error:
+		return v.Error()
+	}
+	return d
+}
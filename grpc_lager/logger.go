@@ -0,0 +1,69 @@
+package grpc_lager
+
+import (
+	"context"
+
+	"github.com/TyeMcQueen/go-lager"
+)
+
+// CallLogger gives a gRPC handler Lager objects that include the call's grpc_ctxtags tags and Lager pairs,
+// one method per log level, so handlers don't need to pass level letters to Extract().  Use Logger() to
+// get one.
+//
+//	log := grpc_lager.Logger(ctx)
+//	log.Info().MMap("Looking up user", "user", req.User)
+type CallLogger struct {
+	ctx  context.Context
+	opts []TagOption
+}
+
+// Logger returns a CallLogger for the call whose context is 'ctx'.  The tags are converted into pairs
+// (see TagsToPairs) each time a Lager is requested, so tags set later in the call are also included.
+func Logger(ctx context.Context, opts ...TagOption) CallLogger {
+	return CallLogger{ctx: ctx, opts: opts}
+}
+
+// Level takes one character from "PEFWNAITDOG" and returns a Lager object that includes the call's
+// tags and pairs (or does nothing if that level is not enabled).
+func (l CallLogger) Level(lev byte) lager.Lager {
+	if lg := lager.Level(lev); !lg.Enabled() {
+		return lg
+	}
+	return lager.Level(lev, TagsToPairs(l.ctx, l.opts...))
+}
+
+// Context returns the call's context with the tags added as Lager pairs.
+func (l CallLogger) Context() context.Context { return TagsToPairs(l.ctx, l.opts...) }
+
+// Panic returns a Lager object that calls panic() after logging (see lager.Panic).
+func (l CallLogger) Panic() lager.Lager { return l.Level('P') }
+
+// Exit returns a Lager object that calls os.Exit(1) after logging (see lager.Exit).
+func (l CallLogger) Exit() lager.Lager { return l.Level('E') }
+
+// Fail returns a Lager object for the Fail log level.
+func (l CallLogger) Fail() lager.Lager { return l.Level('F') }
+
+// Warn returns a Lager object for the Warn log level.
+func (l CallLogger) Warn() lager.Lager { return l.Level('W') }
+
+// Note returns a Lager object for the Note log level.
+func (l CallLogger) Note() lager.Lager { return l.Level('N') }
+
+// Acc returns a Lager object for the Acc (access) log level.
+func (l CallLogger) Acc() lager.Lager { return l.Level('A') }
+
+// Info returns a Lager object for the Info log level.
+func (l CallLogger) Info() lager.Lager { return l.Level('I') }
+
+// Trace returns a Lager object for the Trace log level.
+func (l CallLogger) Trace() lager.Lager { return l.Level('T') }
+
+// Debug returns a Lager object for the Debug log level.
+func (l CallLogger) Debug() lager.Lager { return l.Level('D') }
+
+// Obj returns a Lager object for the Obj log level.
+func (l CallLogger) Obj() lager.Lager { return l.Level('O') }
+
+// Guts returns a Lager object for the Guts log level.
+func (l CallLogger) Guts() lager.Lager { return l.Level('G') }
@@ -16,7 +16,11 @@ var (
 		codeFunc:        grpc_logging.DefaultErrorToCode,
 		durationFunc:    DefaultDurationToField,
 		messageFunc:     DefaultMessageProducer,
+		codeMessageFunc: DefaultCodeToMessage,
 		timestampFormat: time.RFC3339,
+		canceledLevel:   'I',
+		deadlineLevel:   'W',
+		progressLevel:   lager.INFO,
 	}
 )
 
@@ -27,6 +31,23 @@ type options struct {
 	durationFunc    DurationToPairs
 	messageFunc     MessageProducer
 	timestampFormat string
+	fieldsFunc      FieldsFromContext
+	codeMessageFunc CodeToMessage
+	errorDetails    bool
+	redactFunc      ErrorRedactor
+	canceledLevel   byte
+	deadlineLevel   byte
+	messageSizes    bool
+	recoverPanics   bool
+	module          *lager.Module
+	singleLine      bool
+	lazyTags        bool
+	customMessage   bool
+	progressEvery   int64
+	progressPeriod  time.Duration
+	progressLevel   lager.LogLevel
+	userFunc        UserExtractor
+	peerInfo        bool
 }
 
 func evaluateServerOpt(opts []Option) *options {
@@ -45,9 +66,28 @@ type Option func(*options)
 // CodeToLevel function defines the mapping between gRPC return codes and interceptor log level.
 type CodeToLevel func(code codes.Code) byte
 
+// CodeToLogLevel is the same as CodeToLevel but returns a lager.LogLevel, like lager.WARN (see WithLogLevels).
+type CodeToLogLevel func(code codes.Code) lager.LogLevel
+
 // DurationToPairs function defines how to produce duration fields for logging
 type DurationToPairs func(duration time.Duration) lager.AMap
 
+// FieldsFromContext function defines which extra pairs (like a tenant ID or auth subject)
+// to add to the final interceptor log line, based on the call's context.
+type FieldsFromContext func(ctx context.Context) lager.AMap
+
+// CodeToMessage function defines the message of the final interceptor log line for each gRPC return code.
+type CodeToMessage func(code codes.Code) string
+
+// ErrorRedactor function is called with each status detail (usually a proto.Message) and each error in
+// the error chain before they are logged.  It returns the value to log in its place or nil to omit it.
+type ErrorRedactor func(v interface{}) interface{}
+
+// UserExtractor function returns the identity of the principal (user or service) that made a call, such as the
+// "sub" claim of an already-verified JWT or the name from a client certificate (see PeerCertUser), or "" if none
+// is found.  'req' is the request message for unary calls and is nil for streaming calls.
+type UserExtractor func(ctx context.Context, req interface{}) string
+
 // WithDecider customizes the function for deciding if the gRPC interceptor logs should log.
 func WithDecider(f grpc_logging.Decider) Option {
 	return func(o *options) {
@@ -62,6 +102,11 @@ func WithLevels(f CodeToLevel) Option {
 	}
 }
 
+// WithLogLevels is the same as WithLevels but takes a function that returns a lager.LogLevel.
+func WithLogLevels(f CodeToLogLevel) Option {
+	return WithLevels(func(code codes.Code) byte { return byte(f(code)) })
+}
+
 // WithCodes customizes the function for mapping errors to error codes.
 func WithCodes(f grpc_logging.ErrorToCode) Option {
 	return func(o *options) {
@@ -83,6 +128,15 @@ func WithMessageProducer(f MessageProducer) Option {
 	}
 }
 
+// WithLogLevelMessageProducer is the same as WithMessageProducer but takes a function that is passed a
+// lager.LogLevel.
+func WithLogLevelMessageProducer(f LogLevelMessageProducer) Option {
+	return WithMessageProducer(
+		func(ctx context.Context, msg string, level byte, code codes.Code, err error, duration *lager.KVPairs) {
+			f(ctx, msg, lager.LogLevel(level), code, err, duration)
+		})
+}
+
 // WithTimestampFormat customizes the timestamps emitted in the log fields.
 func WithTimestampFormat(format string) Option {
 	return func(o *options) {
@@ -90,6 +144,156 @@ func WithTimestampFormat(format string) Option {
 	}
 }
 
+// WithFieldsFromContext adds the pairs returned by the function to the final interceptor log line.
+func WithFieldsFromContext(f FieldsFromContext) Option {
+	return func(o *options) {
+		o.fieldsFunc = f
+	}
+}
+
+// WithCodeToMessage customizes the message of the final interceptor log line for each gRPC return code.
+func WithCodeToMessage(f CodeToMessage) Option {
+	return func(o *options) {
+		o.codeMessageFunc = f
+		o.customMessage = true
+	}
+}
+
+// WithErrorDetails adds the status details (as "grpc.details") and the chain of wrapped errors (as
+// "grpc.error_chain", only if an error wraps another) to the final interceptor log line of failed calls.
+// If 'redact' is not nil, it is called on each item first (see ErrorRedactor).
+func WithErrorDetails(redact ErrorRedactor) Option {
+	return func(o *options) {
+		o.errorDetails = true
+		o.redactFunc = redact
+	}
+}
+
+// WithTerminationLevels customizes the log levels used when a call was cancelled by the client ('I' by
+// default) or exceeded its deadline ('W' by default), whatever code was returned (see Termination).
+// These take precedence over the levels from WithLevels.
+func WithTerminationLevels(canceled, deadlineExceeded byte) Option {
+	return func(o *options) {
+		o.canceledLevel = canceled
+		o.deadlineLevel = deadlineExceeded
+	}
+}
+
+// WithMessageSizes adds the sizes (in bytes) of the request message ("grpc.request.size"), the response
+// message ("grpc.response.size"), and the incoming metadata ("grpc.request.metadata_size", the total
+// length of all keys and values) to the final interceptor log line, useful for spotting oversized payloads.
+// Sizes are omitted for messages that are not protobuf messages.
+func WithMessageSizes() Option {
+	return func(o *options) {
+		o.messageSizes = true
+	}
+}
+
+// WithPanicRecovery makes the interceptor recover from a panic in the handler, log it at the Fail level with
+// a stack trace (see lager.WithStack()), and return a codes.Internal error instead of crashing the server.
+func WithPanicRecovery() Option {
+	return func(o *options) {
+		o.recoverPanics = true
+	}
+}
+
+// WithModule makes the interceptor log through the lager.Module named 'name' so the verbosity of RPC logging
+// can be tuned separately from application logging, such as via LAGER_grpc_LEVELS for WithModule("grpc").
+// See lager.NewModule for how the module's levels are initialized.
+func WithModule(name string) Option {
+	mod := lager.NewModule(name)
+	return func(o *options) {
+		o.module = mod
+	}
+}
+
+// WithSingleLine makes PayloadUnaryServerInterceptor (when chained after this interceptor) add the request and
+// response contents to this interceptor's final log line rather than logging them as two separate lines, so
+// each call is logged as a single line.  If the final line is not logged (see WithDecider), then neither are
+// the contents.
+func WithSingleLine() Option {
+	return func(o *options) {
+		o.singleLine = true
+	}
+}
+
+// WithLazyTags delays converting the grpc_ctxtags tags into Lager pairs until a line is actually logged, so
+// no time is spent on them for lines at disabled log levels.  The tags are then
+// logged after the other pairs and a tag no longer replaces a pair with the same key.  This applies to the
+// lines logged by the interceptors and by DefaultMessageProducer; a custom MessageProducer can get the same
+// effect by logging LazyTags(ctx) after lager.InlinePairs.
+func WithLazyTags() Option {
+	return func(o *options) {
+		o.lazyTags = true
+	}
+}
+
+// WithStreamProgress makes StreamServerInterceptor log a progress line, at level 'lev', after every 'every'
+// messages (sent plus received) and every 'period' while a stream is open, so long-lived streams can be
+// observed mid-flight.  Either trigger can be disabled by passing 0.  Each progress line holds the counts of
+// messages received and sent ("grpc.stream.msgs_received", "grpc.stream.msgs_sent"), their total sizes in
+// bytes ("grpc.stream.bytes_received", "grpc.stream.bytes_sent", only counting protobuf messages), and the
+// time since the stream started ("grpc.stream.elapsed").  Time is measured via lager.Now (see lager.SetClock)
+// and the period restarts whenever a progress line is logged.  No progress lines are logged after the stream ends.
+func WithStreamProgress(every int, period time.Duration, lev lager.LogLevel) Option {
+	return func(o *options) {
+		o.progressEvery = int64(every)
+		o.progressPeriod = period
+		o.progressLevel = lev
+	}
+}
+
+// WithUserExtractor adds a "user" pair (lager.UserKey) holding the identity returned by 'f' to the final
+// interceptor log line (when it is not ""), matching the pair lager.GcpLogAccess adds to HTTP access lines (see
+// lager.AddUserFunc), so identity logging is centralized.
+func WithUserExtractor(f UserExtractor) Option {
+	return func(o *options) {
+		o.userFunc = f
+	}
+}
+
+// WithPeerInfo adds pairs describing the client to each call's context (so they are logged in the interceptor
+// log lines and in lines logged by the handler): its IP address ("grpc.peer.address", truncated if
+// lager.SetAnonymizeIPs(true) was called, the same as for HTTP access logs), the subject of its verified client
+// certificate when using mutual TLS ("grpc.peer.subject"), and its User-Agent ("grpc.user_agent").  Each pair
+// is omitted if its value is not known.
+func WithPeerInfo() Option {
+	return func(o *options) {
+		o.peerInfo = true
+	}
+}
+
+// PeerCertUser is a UserExtractor that returns the Common Name from the verified client certificate of a call
+// made via mutual TLS, or "" if there is none.
+func PeerCertUser(ctx context.Context, _ interface{}) string {
+	if cert := peerCert(ctx); nil != cert {
+		return cert.Subject.CommonName
+	}
+	return ""
+}
+
+// userPairs returns the "user" pair for the call (or nil) if WithUserExtractor was used.
+func (o *options) userPairs(ctx context.Context, req interface{}) lager.AMap {
+	if nil == o.userFunc {
+		return nil
+	}
+	if user := o.userFunc(ctx, req); "" != user {
+		return lager.Pairs(lager.UserKey, user)
+	}
+	return nil
+}
+
+// DefaultCodeToMessage is the default message of the final interceptor log line.
+func DefaultCodeToMessage(code codes.Code) string {
+	return "finished unary call with code " + code.String()
+}
+
+// DefaultStreamCodeToMessage is the default message of the final log line of StreamServerInterceptor (unless
+// WithCodeToMessage is used).
+func DefaultStreamCodeToMessage(code codes.Code) string {
+	return "finished streaming call with code " + code.String()
+}
+
 // DefaultCodeToLevel is the default implementation of gRPC return codes and interceptor log level for server side.
 func DefaultCodeToLevel(code codes.Code) byte {
 	switch code {
@@ -132,6 +336,11 @@ func DefaultCodeToLevel(code codes.Code) byte {
 	}
 }
 
+// DefaultCodeToLogLevel is the same as DefaultCodeToLevel but returns a lager.LogLevel.
+func DefaultCodeToLogLevel(code codes.Code) lager.LogLevel {
+	return lager.LogLevel(DefaultCodeToLevel(code))
+}
+
 // DefaultDurationToField is the default implementation of converting request duration to Lager pairs.
 var DefaultDurationToField = DurationToTimeMillisField
 
@@ -153,11 +362,17 @@ func durationToMilliseconds(duration time.Duration) float32 {
 // MessageProducer produces a user defined log message
 type MessageProducer func(ctx context.Context, msg string, level byte, code codes.Code, err error, duration *lager.KVPairs)
 
+// LogLevelMessageProducer is the same as MessageProducer but is passed a lager.LogLevel (see
+// WithLogLevelMessageProducer).
+type LogLevelMessageProducer func(ctx context.Context, msg string, level lager.LogLevel, code codes.Code, err error, duration *lager.KVPairs)
+
 // DefaultMessageProducer writes the default message
 func DefaultMessageProducer(ctx context.Context, msg string, level byte, code codes.Code, err error, duration *lager.KVPairs) {
-	ctx = lager.ContextPairs(TagsToPairs(ctx)).Merge(duration).InContext(ctx)
-	lager.Level(level, ctx).MMap(msg,
+	ctx, tags := callTags(ctx)
+	ctx = lager.ContextPairs(ctx).Merge(duration).InContext(ctx)
+	InterceptorLager(ctx, level).MMap(msg,
 		"grpc.code", code,
 		lager.Unless(nil == err, "error"), err,
+		lager.InlinePairs, tags,
 	)
 }
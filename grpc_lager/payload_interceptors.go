@@ -2,6 +2,7 @@ package grpc_lager
 
 import (
 	"context"
+	"sync"
 
 	"github.com/TyeMcQueen/go-lager"
 	"google.golang.org/grpc"
@@ -32,18 +33,42 @@ func PayloadUnaryServerInterceptor(decider ServerPayloadLoggingDecider) grpc.Una
 
 		loggerCtx := lager.ContextPairs(TagsToPairs(ctx)).Merge(serverCallFields(info.FullMethod)).InContext(ctx)
 		logEntry := lager.Acc(loggerCtx)
-		logProtoMessageAsJSON(logEntry, req, "grpc.request.content", "server request payload logged as grpc.request.content field")
+		logProtoMessageAsJSON(ctx, logEntry, req, "grpc.request.content", "server request payload logged as grpc.request.content field")
 		resp, err := handler(ctx, req)
 		if err == nil {
-			logProtoMessageAsJSON(logEntry, resp, "grpc.response.content", "server response payload logged as grpc.response.content field")
+			logProtoMessageAsJSON(ctx, logEntry, resp, "grpc.response.content", "server response payload logged as grpc.response.content field")
 		}
 
 		return resp, err
 	}
 }
 
-func logProtoMessageAsJSON(logger lager.Lager, pbMsg interface{}, key string, msg string) {
+func logProtoMessageAsJSON(ctx context.Context, logger lager.Lager, pbMsg interface{}, key string, msg string) {
 	if p, ok := pbMsg.(proto.Message); ok {
+		if payloads, ok := ctx.Value(payloadKey{}).(*payloadHolder); ok {
+			payloads.add(key, JSONPbFormatter.Format(p))
+			return
+		}
 		logger.MMap(msg, key, JSONPbFormatter.Format(p))
 	}
 }
+
+type payloadKey struct{}
+
+// payloadHolder collects the payload contents to be logged in the final interceptor log line (see WithSingleLine).
+type payloadHolder struct {
+	mu    sync.Mutex
+	pairs lager.AMap
+}
+
+func (h *payloadHolder) add(key string, content string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pairs = h.pairs.AddPairs(key, content)
+}
+
+func (h *payloadHolder) get() lager.AMap {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.pairs
+}
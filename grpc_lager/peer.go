@@ -0,0 +1,41 @@
+package grpc_lager
+
+import (
+	"context"
+	"crypto/x509"
+
+	"github.com/TyeMcQueen/go-lager"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// peerPairs returns the pairs added by WithPeerInfo.
+func peerPairs(ctx context.Context) lager.AMap {
+	pairs := make([]interface{}, 0, 6)
+	if p, ok := peer.FromContext(ctx); ok && nil != p.Addr {
+		pairs = append(pairs, "grpc.peer.address", lager.RemoteIP(p.Addr.String()))
+	}
+	if cert := peerCert(ctx); nil != cert {
+		pairs = append(pairs, "grpc.peer.subject", cert.Subject.String())
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ua := md.Get("user-agent"); 0 < len(ua) {
+			pairs = append(pairs, "grpc.user_agent", ua[0])
+		}
+	}
+	return lager.Pairs(pairs...)
+}
+
+// peerCert returns the client's verified certificate if the call was made via mutual TLS (else nil).
+func peerCert(ctx context.Context) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || 0 == len(info.State.VerifiedChains) || 0 == len(info.State.VerifiedChains[0]) {
+		return nil
+	}
+	return info.State.VerifiedChains[0][0]
+}
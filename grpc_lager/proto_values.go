@@ -0,0 +1,39 @@
+package grpc_lager
+
+import (
+	"reflect"
+
+	"github.com/TyeMcQueen/go-lager"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// MaxProtoValueBytes is the largest JSON encoding of a proto.Message that is logged as embedded JSON. A
+// larger message is logged as a map holding its type name and the start of its JSON encoding (as a string).
+// Set this before logging starts.
+var MaxProtoValueBytes = 16 * 1024
+
+// Importing this package makes any proto.Message logged as a value (such as a gRPC request passed to
+// MMap()) be written as embedded JSON via protojson, rather than via json.Marshal().
+func init() {
+	lager.RegisterEncoder(reflect.TypeOf((*proto.Message)(nil)).Elem(), encodeProtoMessage)
+}
+
+// encodeProtoMessage writes a proto.Message as embedded JSON (size-capped).
+func encodeProtoMessage(enc *lager.Encoder, v interface{}) {
+	m := v.(proto.Message)
+	b, err := protojson.Marshal(m)
+	switch {
+	case nil != err:
+		enc.Map("type", protoTypeName(m), "error", err)
+	case MaxProtoValueBytes < len(b):
+		enc.Map("type", protoTypeName(m), "bytes", len(b), "truncated", string(b[:MaxProtoValueBytes]))
+	default:
+		enc.RawJSON(b)
+	}
+}
+
+// protoTypeName returns the full name of the type of a proto.Message.
+func protoTypeName(m proto.Message) string {
+	return string(m.ProtoReflect().Descriptor().FullName())
+}
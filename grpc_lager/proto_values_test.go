@@ -0,0 +1,33 @@
+package grpc_lager_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/TyeMcQueen/go-lager"
+	"github.com/TyeMcQueen/go-lager/grpc_lager"
+	pb_testproto "github.com/TyeMcQueen/go-lager/grpc_lager/testproto"
+	"github.com/TyeMcQueen/go-tutl"
+)
+
+func TestProtoMessageValues(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+
+	req := &pb_testproto.PingRequest{Value: "hello", SleepTimeMs: 5}
+	lager.Warn().MMap("Got request", "req", req, "list", lager.List(req))
+	var line interface{}
+	u.Is(nil, json.Unmarshal(log.Bytes(), &line), "line is valid JSON")
+	u.Like(log.String(), "proto logged as embedded JSON",
+		`"req":\{\s*"value":\s*"hello",\s*"sleepTimeMs":\s*5\s*\}`, `"list":\[\{`)
+	log.Reset()
+
+	defer func(max int) { grpc_lager.MaxProtoValueBytes = max }(grpc_lager.MaxProtoValueBytes)
+	grpc_lager.MaxProtoValueBytes = 10
+	lager.Warn().MMap("Big request", "req", &pb_testproto.PingRequest{Value: strings.Repeat("x", 50)})
+	u.Like(log.String(), "large proto truncated",
+		`"req":\{"type":"grpc_lager.testproto.PingRequest", "bytes":\d+, "truncated":"\{`)
+}
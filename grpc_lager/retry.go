@@ -0,0 +1,111 @@
+package grpc_lager
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/TyeMcQueen/go-lager"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Metadata keys that the client interceptors use to send the idempotency key and attempt number of a call
+// (see WithRetryKey).
+const (
+	IdempotencyKeyMetadata = "idempotency-key"
+	AttemptMetadata        = "x-attempt"
+)
+
+// The metadata key that grpc-go sets when it retries a call itself (per the service config's retry policy).
+const previousAttemptsMetadata = "grpc-previous-rpc-attempts"
+
+type retryKey struct{}
+
+type retryState struct {
+	key      string
+	attempts int32
+}
+
+// WithRetryKey returns a context for making a call that may be retried.  Each call made with the returned
+// context through UnaryClientInterceptor or StreamClientInterceptor sends 'key' (in IdempotencyKeyMetadata)
+// and its attempt number (in AttemptMetadata, starting at 1), so the server interceptors can log them as
+// "grpc.idempotency_key" and "grpc.attempt" and all attempts of the call can be grouped in the logs.  (Retries
+// made by grpc-go itself are instead logged as "grpc.previous_attempts".)  If 'key' is "", a random key is
+// used.  Use a new context from WithRetryKey for each logical request:
+//
+//	ctx := grpc_lager.WithRetryKey(ctx, "")
+//	for try := 0; try < 3; try++ {
+//		if resp, err = client.Charge(ctx, req); !retryable(err) {
+//			break
+//		}
+//	}
+func WithRetryKey(ctx context.Context, key string) context.Context {
+	if "" == key {
+		var buf [16]byte
+		rand.Read(buf[:])
+		key = hex.EncodeToString(buf[:])
+	}
+	return context.WithValue(ctx, retryKey{}, &retryState{key: key})
+}
+
+// UnaryClientInterceptor returns a new unary client interceptor that sends the idempotency key and attempt
+// number of calls made with a context from WithRetryKey.  Other calls are not changed.
+func UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(
+		ctx context.Context, method string, req, reply interface{},
+		cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption,
+	) error {
+		return invoker(outgoingAttempt(ctx), method, req, reply, cc, opts...)
+	}
+}
+
+// StreamClientInterceptor returns a new streaming client interceptor that sends the idempotency key and attempt
+// number of streams opened with a context from WithRetryKey.  Other streams are not changed.
+func StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(
+		ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+		method string, streamer grpc.Streamer, opts ...grpc.CallOption,
+	) (grpc.ClientStream, error) {
+		return streamer(outgoingAttempt(ctx), desc, cc, method, opts...)
+	}
+}
+
+// outgoingAttempt counts an attempt of a call and adds its idempotency key and attempt number to the outgoing
+// metadata, if the context is from WithRetryKey.
+func outgoingAttempt(ctx context.Context) context.Context {
+	rs, ok := ctx.Value(retryKey{}).(*retryState)
+	if !ok {
+		return ctx
+	}
+	attempt := atomic.AddInt32(&rs.attempts, 1)
+	return metadata.AppendToOutgoingContext(ctx,
+		IdempotencyKeyMetadata, rs.key, AttemptMetadata, strconv.Itoa(int(attempt)))
+}
+
+// retryPairs returns the "grpc.idempotency_key" and "grpc.attempt" pairs for a call from its incoming metadata
+// (or nil), plus "grpc.previous_attempts" if grpc-go itself retried the call (per the service config's retry
+// policy).
+func retryPairs(ctx context.Context) lager.AMap {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil
+	}
+	var pairs lager.AMap
+	if key := md.Get(IdempotencyKeyMetadata); 0 < len(key) {
+		pairs = pairs.AddPairs("grpc.idempotency_key", key[0])
+	}
+	if v := md.Get(AttemptMetadata); 0 < len(v) {
+		if attempt, err := strconv.Atoi(v[0]); nil == err {
+			pairs = pairs.AddPairs("grpc.attempt", attempt)
+		}
+	}
+	if v := md.Get(previousAttemptsMetadata); 0 < len(v) {
+		if prior, err := strconv.Atoi(v[0]); nil == err {
+			pairs = pairs.AddPairs("grpc.previous_attempts", prior)
+		}
+	}
+	return pairs
+}
@@ -0,0 +1,62 @@
+package grpc_lager_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/TyeMcQueen/go-lager"
+	grpc_lager "github.com/TyeMcQueen/go-lager/grpc_lager"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestRetryCorrelation(t *testing.T) {
+	b := &bytes.Buffer{}
+	defer lager.SetOutput(b)()
+	defer saveLevels()()
+	lager.Init("FWNAI")
+
+	var sent []metadata.MD
+	invoker := func(ctx context.Context, method string, req, reply interface{},
+		cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ := metadata.FromOutgoingContext(ctx)
+		sent = append(sent, md)
+		return nil
+	}
+	client := grpc_lager.UnaryClientInterceptor()
+	require.NoError(t, client(context.Background(), "/pkg.Svc/Get", nil, nil, nil, invoker))
+	assert.Empty(t, sent[0].Get(grpc_lager.IdempotencyKeyMetadata), "no key without WithRetryKey")
+
+	ctx := grpc_lager.WithRetryKey(context.Background(), "charge-17")
+	client(ctx, "/pkg.Svc/Get", nil, nil, nil, invoker)
+	client(ctx, "/pkg.Svc/Get", nil, nil, nil, invoker)
+	require.Len(t, sent, 3, "calls made")
+	assert.Equal(t, []string{"charge-17"}, sent[1].Get(grpc_lager.IdempotencyKeyMetadata), "key sent")
+	assert.Equal(t, []string{"1"}, sent[1].Get(grpc_lager.AttemptMetadata), "first attempt")
+	assert.Equal(t, []string{"charge-17"}, sent[2].Get(grpc_lager.IdempotencyKeyMetadata), "same key on retry")
+	assert.Equal(t, []string{"2"}, sent[2].Get(grpc_lager.AttemptMetadata), "second attempt")
+
+	ctx = grpc_lager.WithRetryKey(context.Background(), "")
+	client(ctx, "/pkg.Svc/Get", nil, nil, nil, invoker)
+	assert.Len(t, sent[3].Get(grpc_lager.IdempotencyKeyMetadata)[0], 32, "random key")
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/pkg.Svc/Get"}
+	ok := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+	md := sent[2].Copy()
+	md.Set("grpc-previous-rpc-attempts", "1")
+	grpc_lager.UnaryServerInterceptor()(metadata.NewIncomingContext(context.Background(), md), nil, info, ok)
+	var line []interface{}
+	require.NoError(t, json.Unmarshal(b.Bytes(), &line), "log line must be valid JSON")
+	last := getMap(line[len(line)-1])
+	assert.Equal(t, "charge-17", last["grpc.idempotency_key"], "key logged")
+	assert.Equal(t, float64(2), last["grpc.attempt"], "attempt logged")
+	assert.Equal(t, float64(1), last["grpc.previous_attempts"], "grpc-go retries logged")
+
+	b.Reset()
+	grpc_lager.UnaryServerInterceptor()(context.Background(), nil, info, ok)
+	assert.NotContains(t, b.String(), "grpc.attempt", "nothing logged for calls without a key")
+}
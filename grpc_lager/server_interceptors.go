@@ -7,6 +7,10 @@ import (
 
 	"github.com/TyeMcQueen/go-lager"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 var (
@@ -21,31 +25,161 @@ func UnaryServerInterceptor(opts ...Option) grpc.UnaryServerInterceptor {
 	o := evaluateServerOpt(opts)
 
 	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-		startTime := time.Now()
+		startTime := lager.Now()
 
 		ctx = newContextForCall(ctx, info.FullMethod, startTime, o.timestampFormat)
+		if o.peerInfo {
+			ctx = lager.ContextPairs(ctx).Merge(peerPairs(ctx)).InContext(ctx)
+		}
+		if o.lazyTags {
+			ctx = context.WithValue(ctx, lazyTagsKey{}, true)
+		}
+		var payloads *payloadHolder
+		if o.singleLine {
+			payloads = &payloadHolder{}
+			ctx = context.WithValue(ctx, payloadKey{}, payloads)
+		}
 
-		resp, err := handler(ctx, req)
+		resp, err := callHandler(ctx, req, handler, o)
 		if !o.shouldLog(info.FullMethod, err) {
 			return resp, err
 		}
 		code := o.codeFunc(err)
 		level := o.levelFunc(code)
-		duration := o.durationFunc(time.Since(startTime))
+		term := Termination(ctx, code)
+		switch term {
+		case TerminationCanceled:
+			level = o.canceledLevel
+		case TerminationDeadline:
+			level = o.deadlineLevel
+		}
+		ctx = lager.AddPairs(ctx, "grpc.termination", term)
+		if nil != payloads {
+			ctx = lager.ContextPairs(ctx).Merge(payloads.get()).InContext(ctx)
+		}
+		if o.messageSizes {
+			ctx = lager.ContextPairs(ctx).Merge(messageSizePairs(ctx, req, resp)).InContext(ctx)
+		}
+		duration := o.durationFunc(lager.Now().Sub(startTime))
+		if nil != o.fieldsFunc {
+			ctx = lager.ContextPairs(ctx).Merge(o.fieldsFunc(ctx)).InContext(ctx)
+		}
+		if user := o.userPairs(ctx, req); nil != user {
+			ctx = lager.ContextPairs(ctx).Merge(user).InContext(ctx)
+		}
+		if o.errorDetails && nil != err {
+			ctx = lager.ContextPairs(ctx).Merge(errorDetailPairs(err, o.redactFunc)).InContext(ctx)
+		}
 
-		o.messageFunc(ctx, "finished unary call with code "+code.String(), level, code, err, duration)
+		if nil != o.module {
+			ctx = context.WithValue(ctx, moduleKey{}, o.module)
+		}
+		o.messageFunc(ctx, o.codeMessageFunc(code), level, code, err, duration)
 
 		return resp, err
 	}
 }
 
+// PanicErrorMessage is the message of the codes.Internal error returned for a recovered panic (see
+// WithPanicRecovery).  The panic value is only logged, not returned to the client.
+var PanicErrorMessage = "panic in handler"
+
+func callHandler(
+	ctx context.Context, req interface{}, handler grpc.UnaryHandler, o *options,
+) (resp interface{}, err error) {
+	if o.recoverPanics {
+		defer func() {
+			if r := recover(); nil != r {
+				tagCtx, tags := callTags(ctx)
+				lg := lager.Level('F', tagCtx)
+				if nil != o.module {
+					lg = o.module.Level('F', tagCtx)
+				}
+				// 0: this func, 1: runtime.gopanic, 2: where panic() was called:
+				lg.WithStack(2, 0).MMap(
+					"Recovered from panic in gRPC handler", "panic", r, lager.InlinePairs, tags)
+				resp, err = nil, status.Error(codes.Internal, PanicErrorMessage)
+			}
+		}()
+	}
+	return handler(ctx, req)
+}
+
+type moduleKey struct{}
+
+type lazyTagsKey struct{}
+
+// callTags returns the context with the call's tags added as pairs, unless WithLazyTags was used, in which
+// case it returns the context unchanged plus a LazyTags function to log after lager.InlinePairs.  In the
+// first case, the returned function logs no pairs.
+func callTags(ctx context.Context) (context.Context, func() interface{}) {
+	if lazy, _ := ctx.Value(lazyTagsKey{}).(bool); lazy {
+		return ctx, LazyTags(ctx)
+	}
+	return TagsToPairs(ctx), noTags
+}
+
+func noTags() interface{} { return lager.RawMap(nil) }
+
+// InterceptorLager returns the Lager object for level 'lev' (one character from "PEFWNAITDOG") that the
+// interceptor logs through, honoring WithModule.  A custom MessageProducer should use it rather than
+// lager.Level so that WithModule still works.
+func InterceptorLager(ctx context.Context, lev byte) lager.Lager {
+	if mod, ok := ctx.Value(moduleKey{}).(*lager.Module); ok {
+		return mod.Level(lev, ctx)
+	}
+	return lager.Level(lev, ctx)
+}
+
+// Values of the "grpc.termination" pair logged in the final interceptor log line.
+const (
+	TerminationOK       = "ok"
+	TerminationCanceled = "canceled"
+	TerminationDeadline = "deadline_exceeded"
+	TerminationError    = "error"
+)
+
+// Termination categorizes how a call ended so client cancellations and exceeded deadlines can be told apart
+// from server errors (even when the handler returned some other code because its context was done).
+func Termination(ctx context.Context, code codes.Code) string {
+	switch {
+	case codes.OK == code:
+		return TerminationOK
+	case codes.Canceled == code || context.Canceled == ctx.Err():
+		return TerminationCanceled
+	case codes.DeadlineExceeded == code || context.DeadlineExceeded == ctx.Err():
+		return TerminationDeadline
+	}
+	return TerminationError
+}
+
+func messageSizePairs(ctx context.Context, req, resp interface{}) lager.AMap {
+	var pairs lager.AMap
+	if m, ok := req.(proto.Message); ok {
+		pairs = pairs.AddPairs("grpc.request.size", proto.Size(m))
+	}
+	if m, ok := resp.(proto.Message); ok {
+		pairs = pairs.AddPairs("grpc.response.size", proto.Size(m))
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		size := 0
+		for k, vals := range md {
+			for _, v := range vals {
+				size += len(k) + len(v)
+			}
+		}
+		pairs = pairs.AddPairs("grpc.request.metadata_size", size)
+	}
+	return pairs
+}
+
 func newContextForCall(ctx context.Context, fullMethodString string, start time.Time, timestampFormat string) context.Context {
 	ctx = lager.AddPairs(ctx, "grpc.start_time", start.Format(timestampFormat))
 	if d, ok := ctx.Deadline(); ok {
 		ctx = lager.AddPairs(ctx, "grpc.request.deadline", d.Format(timestampFormat))
 	}
 
-	return lager.ContextPairs(ctx).Merge(serverCallFields(fullMethodString)).InContext(ctx)
+	return lager.ContextPairs(ctx).Merge(serverCallFields(fullMethodString)).Merge(retryPairs(ctx)).InContext(ctx)
 }
 
 func serverCallFields(fullMethodString string) *lager.KVPairs {
@@ -1,11 +1,21 @@
 package grpc_lager_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"runtime"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/TyeMcQueen/go-lager"
 	grpc_lager "github.com/TyeMcQueen/go-lager/grpc_lager"
 	pb_testproto "github.com/TyeMcQueen/go-lager/grpc_lager/testproto"
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
@@ -15,6 +25,10 @@ import (
 	"github.com/stretchr/testify/suite"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 )
 
 func customCodeToLevel(c codes.Code) byte {
@@ -286,3 +300,400 @@ func (s *serverMessageProducerSuite) TestPing_HasOverriddenMessageProducer() {
 	assert.Equal(s.T(), "custom message", msgs[1][2], "handler's message must contain user message")
 	assert.Equal(s.T(), "INFO", msgs[1][1], "OK error codes must be logged on info level.")
 }
+
+func TestLagerGrpcFieldsFromContextSuite(t *testing.T) {
+	opts := []grpc_lager.Option{
+		grpc_lager.WithFieldsFromContext(func(ctx context.Context) lager.AMap {
+			return lager.Pairs("tenant", "acme", "grpc.method", "replaced")
+		}),
+	}
+	b := newBaseSuite(t, "FWNAEIWP")
+	b.InterceptorTestSuite.ServerOpts = []grpc.ServerOption{
+		grpc_middleware.WithUnaryServerChain(
+			grpc_ctxtags.UnaryServerInterceptor(grpc_ctxtags.WithFieldExtractor(grpc_ctxtags.CodeGenRequestFieldExtractor)),
+			grpc_lager.UnaryServerInterceptor(opts...)),
+	}
+	suite.Run(t, &serverFieldsFromContextSuite{b})
+}
+
+type serverFieldsFromContextSuite struct {
+	*baseSuite
+}
+
+func (s *serverFieldsFromContextSuite) TestPing_HasFieldsFromContext() {
+	_, err := s.Client.Ping(s.SimpleCtx(), goodPing)
+	require.NoError(s.T(), err, "there must be not be an error on a successful call")
+	msgs := s.getOutputJSONs()
+	require.Len(s.T(), msgs, 2, "two log statements should be logged")
+
+	assert.NotContains(s.T(), getMap(msgs[0][3]), "tenant", "handler's message must not contain custom fields")
+	last := getMap(msgs[1][len(msgs[1])-1])
+	assert.Equal(s.T(), "finished unary call with code OK", msgs[1][2], "handler's message must contain user message")
+	assert.Equal(s.T(), "acme", last["tenant"], "interceptor log statement must contain custom fields")
+	assert.Equal(s.T(), "replaced", last["grpc.method"], "custom fields can replace default fields")
+}
+
+func TestErrorDetails(t *testing.T) {
+	b := &bytes.Buffer{}
+	defer lager.SetOutput(b)()
+
+	st, err := status.New(codes.NotFound, "no such user").WithDetails(
+		&pb_testproto.PingRequest{Value: "secret"}, &pb_testproto.PingRequest{Value: "drop"})
+	require.NoError(t, err, "adding status details")
+	redactor := func(v interface{}) interface{} {
+		if ping, ok := v.(*pb_testproto.PingRequest); ok {
+			if "drop" == ping.Value {
+				return nil
+			}
+			return &pb_testproto.PingRequest{Value: "xxx"}
+		}
+		return v
+	}
+	interceptor := grpc_lager.UnaryServerInterceptor(
+		grpc_lager.WithLevels(func(codes.Code) byte { return 'W' }),
+		grpc_lager.WithErrorDetails(redactor),
+		grpc_lager.WithCodes(func(err error) codes.Code { return codes.NotFound }),
+		grpc_lager.WithCodeToMessage(func(c codes.Code) string { return "call ended: " + c.String() }),
+	)
+	logged := func(callErr error) []interface{} {
+		b.Reset()
+		_, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/pkg.Svc/Get"},
+			func(ctx context.Context, req interface{}) (interface{}, error) { return nil, callErr })
+		require.Equal(t, callErr, err, "interceptor returns the handler's error")
+		var line []interface{}
+		require.NoError(t, json.Unmarshal(b.Bytes(), &line), "log line must be valid JSON")
+		return line
+	}
+
+	line := logged(st.Err())
+	assert.Equal(t, "call ended: NotFound", line[2], "message must be customized")
+	last := getMap(line[len(line)-1])
+	assert.Equal(t, []interface{}{map[string]interface{}{
+		"type": "grpc_lager.testproto.PingRequest", "value": map[string]interface{}{"value": "xxx"},
+	}}, last["grpc.details"], "details must be redacted")
+	assert.NotContains(t, last, "grpc.error_chain", "unwrapped error has no chain")
+
+	line = logged(fmt.Errorf("lookup failed: %w", st.Err()))
+	last = getMap(line[len(line)-1])
+	assert.Len(t, last["grpc.details"], 1, "details found in wrapped error")
+	assert.Equal(t, []interface{}{
+		"lookup failed: rpc error: code = NotFound desc = no such user",
+		"rpc error: code = NotFound desc = no such user",
+	}, last["grpc.error_chain"], "error chain must be logged")
+}
+
+func TestTermination(t *testing.T) {
+	b := &bytes.Buffer{}
+	defer lager.SetOutput(b)()
+	defer saveLevels()()
+	lager.Init("FWNAI")
+
+	interceptor := grpc_lager.UnaryServerInterceptor(grpc_lager.WithTerminationLevels('N', 'F'))
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	for _, tcase := range []struct {
+		ctx   context.Context
+		err   error
+		level string
+		term  string
+	}{
+		{context.Background(), nil, "INFO", grpc_lager.TerminationOK},
+		{context.Background(), status.Error(codes.Canceled, "gone"), "NOTE", grpc_lager.TerminationCanceled},
+		{canceled, errors.New("read failed"), "NOTE", grpc_lager.TerminationCanceled},
+		{context.Background(), status.Error(codes.DeadlineExceeded, "slow"), "FAIL", grpc_lager.TerminationDeadline},
+		{expired, errors.New("read failed"), "FAIL", grpc_lager.TerminationDeadline},
+		{context.Background(), errors.New("read failed"), "FAIL", grpc_lager.TerminationError},
+		{context.Background(), status.Error(codes.Unavailable, "busy"), "WARN", grpc_lager.TerminationError},
+	} {
+		b.Reset()
+		interceptor(tcase.ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/pkg.Svc/Get"},
+			func(ctx context.Context, req interface{}) (interface{}, error) { return nil, tcase.err })
+		assert.Equal(t, tcase.term, grpc_lager.Termination(tcase.ctx, status.Code(tcase.err)), "termination")
+		var line []interface{}
+		require.NoError(t, json.Unmarshal(b.Bytes(), &line), "log line must be valid JSON")
+		assert.Equal(t, tcase.level, line[1], "level for "+tcase.term)
+		assert.Equal(t, tcase.term, getMap(line[len(line)-1])["grpc.termination"], "termination pair")
+	}
+}
+
+func TestMessageSizes(t *testing.T) {
+	b := &bytes.Buffer{}
+	defer lager.SetOutput(b)()
+	defer saveLevels()()
+	lager.Init("FWNAI")
+
+	interceptor := grpc_lager.UnaryServerInterceptor(grpc_lager.WithMessageSizes())
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("ab", "cde", "ab", "f"))
+	interceptor(ctx, &pb_testproto.PingRequest{Value: "12345"}, &grpc.UnaryServerInfo{FullMethod: "/pkg.Svc/Get"},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return &pb_testproto.PingResponse{Value: "123"}, nil
+		})
+	var line []interface{}
+	require.NoError(t, json.Unmarshal(b.Bytes(), &line), "log line must be valid JSON")
+	last := getMap(line[len(line)-1])
+	assert.Equal(t, float64(7), last["grpc.request.size"], "request size")
+	assert.Equal(t, float64(5), last["grpc.response.size"], "response size")
+	assert.Equal(t, float64(8), last["grpc.request.metadata_size"], "metadata size")
+
+	b.Reset()
+	grpc_lager.UnaryServerInterceptor()(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/pkg.Svc/Get"},
+		func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil })
+	assert.NotContains(t, b.String(), "grpc.request.size", "sizes are only logged when enabled")
+}
+
+func TestPanicRecovery(t *testing.T) {
+	b := &bytes.Buffer{}
+	defer lager.SetOutput(b)()
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/pkg.Svc/Get"}
+	panicky := func(ctx context.Context, req interface{}) (interface{}, error) {
+		panic("boom")
+	}
+	assert.PanicsWithValue(t, "boom", func() {
+		grpc_lager.UnaryServerInterceptor()(context.Background(), nil, info, panicky)
+	}, "panics are not recovered by default")
+
+	b.Reset()
+	resp, err := grpc_lager.UnaryServerInterceptor(grpc_lager.WithPanicRecovery())(
+		context.Background(), nil, info, panicky)
+	assert.Nil(t, resp, "no response after panic")
+	assert.Equal(t, codes.Internal, status.Code(err), "panic converted to Internal")
+	assert.Equal(t, grpc_lager.PanicErrorMessage, status.Convert(err).Message(), "panic value not returned")
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	require.Len(t, lines, 2, "panic and final lines logged")
+	var line []interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &line), "log line must be valid JSON")
+	assert.Equal(t, "FAIL", line[1], "panic logged at Fail level")
+	assert.Equal(t, "Recovered from panic in gRPC handler", line[2], "panic message")
+	assert.Equal(t, "boom", getMap(line[3])["panic"], "panic value logged")
+	last := getMap(line[len(line)-1])
+	assert.Equal(t, "Get", last["grpc.method"], "call fields logged")
+	require.Contains(t, last, "_stack", "stack trace logged")
+	assert.Contains(t, last["_stack"].([]interface{})[0], "server_interceptors_test.go", "stack starts at panic")
+
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &line), "log line must be valid JSON")
+	assert.Equal(t, "finished unary call with code Internal", line[2], "final line logged")
+}
+
+func TestModule(t *testing.T) {
+	b := &bytes.Buffer{}
+	defer lager.SetOutput(b)()
+	defer saveLevels()()
+	lager.Init("FWNAI")
+	lager.NewModule("grpc_test").Init("FW")
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/pkg.Svc/Get"}
+	interceptor := grpc_lager.UnaryServerInterceptor(grpc_lager.WithModule("grpc_test"))
+	ok := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "ok", nil
+	}
+	_, err := interceptor(context.Background(), nil, info, ok)
+	require.NoError(t, err)
+	assert.Empty(t, b.String(), "Info disabled for module")
+
+	notFound := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.Internal, "oops")
+	}
+	_, err = interceptor(context.Background(), nil, info, notFound)
+	require.Error(t, err)
+	var line []interface{}
+	require.NoError(t, json.Unmarshal(b.Bytes(), &line), "log line must be valid JSON")
+	assert.Equal(t, "FAIL", line[1], "Fail enabled for module")
+	assert.Equal(t, "mod=grpc_test", line[len(line)-1], "logged via module")
+}
+
+func TestSingleLine(t *testing.T) {
+	log := &bytes.Buffer{}
+	defer lager.SetOutput(log)()
+	defer saveLevels()()
+	lager.Init("FWNAI")
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/grpc_lager.testproto.TestService/Ping"}
+	payloads := grpc_lager.PayloadUnaryServerInterceptor(
+		func(context.Context, string, interface{}) bool { return true })
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return payloads(ctx, req, info, func(context.Context, interface{}) (interface{}, error) {
+			return &pb_testproto.PingResponse{Value: "pong"}, nil
+		})
+	}
+
+	_, err := grpc_lager.UnaryServerInterceptor()(context.Background(), goodPing, info, handler)
+	require.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(log.String(), "\n"), "separate payload lines by default")
+
+	log.Reset()
+	_, err = grpc_lager.UnaryServerInterceptor(grpc_lager.WithSingleLine())(context.Background(), goodPing, info, handler)
+	require.NoError(t, err)
+	out := log.String()
+	assert.Equal(t, 1, strings.Count(out, "\n"), "one line per call")
+	assert.Contains(t, out, "finished unary call with code OK")
+	assert.Contains(t, out, `"grpc.request.content":`)
+	assert.Contains(t, out, `"grpc.response.content":`)
+	assert.Contains(t, out, "pong")
+}
+
+// countingTags counts how often the tags are extracted.
+type countingTags struct {
+	grpc_ctxtags.Tags
+	values int
+}
+
+func (t *countingTags) Values() map[string]interface{} {
+	t.values++
+	return t.Tags.Values()
+}
+
+func TestLazyTags(t *testing.T) {
+	log := &bytes.Buffer{}
+	defer lager.SetOutput(log)()
+	defer saveLevels()()
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/grpc_lager.testproto.TestService/Ping"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &pb_testproto.PingResponse{Value: "pong"}, nil
+	}
+	tags := &countingTags{Tags: grpc_ctxtags.NewTags().Set("user", "ann")}
+	ctx := grpc_ctxtags.SetInContext(context.Background(), tags)
+	interceptor := grpc_lager.UnaryServerInterceptor(grpc_lager.WithLazyTags())
+
+	lager.Init("FWNA")
+	_, err := interceptor(ctx, goodPing, info, handler)
+	require.NoError(t, err)
+	assert.Equal(t, "", log.String(), "Info disabled")
+	assert.Equal(t, 0, tags.values, "tags not extracted for disabled level")
+
+	lager.Init("FWNAI")
+	_, err = interceptor(ctx, goodPing, info, handler)
+	require.NoError(t, err)
+	assert.Equal(t, 1, tags.values, "tags extracted once")
+	assert.Contains(t, log.String(), "finished unary call with code OK")
+	assert.Contains(t, log.String(), `"grpc.code":"OK", "user":"ann"}`)
+}
+
+func TestUserExtractor(t *testing.T) {
+	b := &bytes.Buffer{}
+	defer lager.SetOutput(b)()
+	defer saveLevels()()
+	lager.Init("FWNAI")
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/pkg.Svc/Get"}
+	ok := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+	assert.Equal(t, "", grpc_lager.PeerCertUser(context.Background(), nil), "no peer")
+	ctx := peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{
+		State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{
+			{Subject: pkix.Name{CommonName: "svc-a"}},
+		}}},
+	}})
+	assert.Equal(t, "svc-a", grpc_lager.PeerCertUser(ctx, nil), "client cert")
+
+	grpc_lager.UnaryServerInterceptor(grpc_lager.WithUserExtractor(grpc_lager.PeerCertUser))(ctx, nil, info, ok)
+	var line []interface{}
+	require.NoError(t, json.Unmarshal(b.Bytes(), &line), "log line must be valid JSON")
+	assert.Equal(t, "svc-a", getMap(line[len(line)-1])[lager.UserKey], "user logged")
+
+	b.Reset()
+	grpc_lager.UnaryServerInterceptor(grpc_lager.WithUserExtractor(
+		func(ctx context.Context, req interface{}) string { return "" }))(ctx, nil, info, ok)
+	assert.NotContains(t, b.String(), `"user"`, "no user pair when none found")
+
+	b.Reset()
+	extract := func(ctx context.Context, req interface{}) string {
+		assert.Nil(t, req, "no request message for streams")
+		return "bob"
+	}
+	grpc_lager.StreamServerInterceptor(grpc_lager.WithUserExtractor(extract))(
+		nil, &fakeStream{}, &grpc.StreamServerInfo{FullMethod: "/pkg.Svc/List"},
+		func(srv interface{}, ss grpc.ServerStream) error { return nil })
+	assert.Contains(t, b.String(), `"user":"bob"`, "user logged for stream")
+}
+
+func TestPeerInfo(t *testing.T) {
+	b := &bytes.Buffer{}
+	defer lager.SetOutput(b)()
+	defer saveLevels()()
+	lager.Init("FWNAI")
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/pkg.Svc/Get"}
+	ok := func(ctx context.Context, req interface{}) (interface{}, error) {
+		lager.Info(ctx).MMap("handling")
+		return nil, nil
+	}
+	ctx := peer.NewContext(context.Background(), &peer.Peer{
+		Addr: &net.TCPAddr{IP: net.ParseIP("203.0.113.77"), Port: 5555},
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{
+			{Subject: pkix.Name{CommonName: "svc-a", Organization: []string{"Acme"}}},
+		}}}},
+	})
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("user-agent", "grpc-go/1.0"))
+
+	grpc_lager.UnaryServerInterceptor()(ctx, nil, info, ok)
+	assert.NotContains(t, b.String(), "grpc.peer", "peer info is only logged when enabled")
+
+	b.Reset()
+	grpc_lager.UnaryServerInterceptor(grpc_lager.WithPeerInfo())(ctx, nil, info, ok)
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	require.Len(t, lines, 2, "handler and final lines logged")
+	for _, l := range lines {
+		var line []interface{}
+		require.NoError(t, json.Unmarshal([]byte(l), &line), "log line must be valid JSON")
+		last := getMap(line[len(line)-1])
+		assert.Equal(t, "203.0.113.77", last["grpc.peer.address"], "peer address")
+		assert.Equal(t, "CN=svc-a,O=Acme", last["grpc.peer.subject"], "peer subject")
+		assert.Equal(t, "grpc-go/1.0", last["grpc.user_agent"], "user agent")
+	}
+
+	b.Reset()
+	lager.SetAnonymizeIPs(true)
+	defer lager.SetAnonymizeIPs(false)
+	grpc_lager.UnaryServerInterceptor(grpc_lager.WithPeerInfo())(context.Background(), nil, info, ok)
+	assert.NotContains(t, b.String(), "grpc.peer", "no peer info without a peer")
+	b.Reset()
+	grpc_lager.UnaryServerInterceptor(grpc_lager.WithPeerInfo())(ctx, nil, info, ok)
+	assert.Contains(t, b.String(), `"grpc.peer.address":"203.0.113.0"`, "peer address anonymized")
+}
+
+func TestLogLevelOptions(t *testing.T) {
+	defer saveLevels()()
+	lager.Init("FWNA")
+	b := &bytes.Buffer{}
+	defer lager.SetOutput(b)()
+
+	assert.Equal(t, lager.FAIL, grpc_lager.DefaultCodeToLogLevel(codes.Internal), "default LogLevel")
+	var got lager.LogLevel
+	interceptor := grpc_lager.UnaryServerInterceptor(
+		grpc_lager.WithLogLevels(func(codes.Code) lager.LogLevel { return lager.ACC }),
+		grpc_lager.WithLogLevelMessageProducer(
+			func(ctx context.Context, msg string, lev lager.LogLevel, _ codes.Code, _ error, _ *lager.KVPairs) {
+				got = lev
+				grpc_lager.InterceptorLager(ctx, byte(lev)).MMap(msg)
+			}),
+	)
+	_, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/pkg.Svc/Get"},
+		func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil })
+	require.NoError(t, err, "handler succeeds")
+	assert.Equal(t, lager.ACC, got, "producer gets the LogLevel")
+	assert.Contains(t, b.String(), `"ACCESS"`, "line logged at ACCESS")
+}
+
+func TestUnaryServerInterceptorClock(t *testing.T) {
+	b := &bytes.Buffer{}
+	defer lager.SetOutput(b)()
+	defer saveLevels()()
+	lager.Init("FWNAI")
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	lager.SetClock(func() time.Time { return now })
+	defer lager.SetClock(nil)
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/pkg.Svc/Get"}
+	_, err := grpc_lager.UnaryServerInterceptor()(context.Background(), nil, info,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			now = now.Add(250 * time.Millisecond)
+			return nil, nil
+		})
+	require.NoError(t, err, "handler succeeds")
+	assert.Contains(t, b.String(), `"grpc.start_time":"2024-01-02T03:04:05Z"`, "start time from lager.Now")
+	assert.Contains(t, b.String(), `"grpc.time_ms":250`, "duration from lager.Now")
+}
@@ -53,11 +53,23 @@ type baseSuite struct {
 	timestampFormat string
 }
 
+// saveLevels saves the enabled log levels and returns a function that restores them:
+//
+//	defer saveLevels()()
+func saveLevels() func() {
+	prior := lager.EnabledLevels()
+	if "" == prior {
+		prior = "-" // Since Init("") enables the default levels.
+	}
+	return func() { lager.Init(prior) }
+}
+
 func newBaseSuite(t *testing.T, levels string) *baseSuite {
 	b := &bytes.Buffer{}
 	muB := grpc_testing.NewMutexReadWriter(b)
+	t.Cleanup(saveLevels())
 	lager.Init(levels)
-	lager.SetOutput(muB)
+	t.Cleanup(lager.SetOutput(muB))
 
 	return &baseSuite{
 		buffer:      b,
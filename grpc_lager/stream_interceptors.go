@@ -0,0 +1,185 @@
+package grpc_lager
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/TyeMcQueen/go-lager"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// StreamServerInterceptor returns a new streaming server interceptor that adds Lager pairs to the stream's
+// context and logs a final line when the stream ends (like UnaryServerInterceptor), including the counts and
+// sizes of the messages received and sent.  See WithStreamProgress for also logging while the stream is open.
+// WithSingleLine, WithMessageSizes, and WithPanicRecovery do not apply to streams.
+func StreamServerInterceptor(opts ...Option) grpc.StreamServerInterceptor {
+	o := evaluateServerOpt(opts)
+
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		startTime := lager.Now()
+		ctx := newContextForCall(stream.Context(), info.FullMethod, startTime, o.timestampFormat)
+		if o.peerInfo {
+			ctx = lager.ContextPairs(ctx).Merge(peerPairs(ctx)).InContext(ctx)
+		}
+		if nil != o.module {
+			ctx = context.WithValue(ctx, moduleKey{}, o.module)
+		}
+		if o.lazyTags {
+			ctx = context.WithValue(ctx, lazyTagsKey{}, true)
+		}
+		ws := &countingStream{ServerStream: stream, ctx: ctx, o: o, start: startTime, last: startTime.UnixNano()}
+		stopTicking := func() {}
+		if 0 < o.progressPeriod {
+			stopTicking = ws.ticking()
+		}
+
+		err := handler(srv, ws)
+		stopTicking() // So no progress line can follow the final line.
+		if !o.shouldLog(info.FullMethod, err) {
+			return err
+		}
+		code := o.codeFunc(err)
+		level := o.levelFunc(code)
+		term := Termination(ctx, code)
+		switch term {
+		case TerminationCanceled:
+			level = o.canceledLevel
+		case TerminationDeadline:
+			level = o.deadlineLevel
+		}
+		ctx = lager.AddPairs(ctx, "grpc.termination", term)
+		ctx = lager.ContextPairs(ctx).Merge(ws.counts()).InContext(ctx)
+		duration := o.durationFunc(lager.Now().Sub(startTime))
+		if nil != o.fieldsFunc {
+			ctx = lager.ContextPairs(ctx).Merge(o.fieldsFunc(ctx)).InContext(ctx)
+		}
+		if user := o.userPairs(ctx, nil); nil != user {
+			ctx = lager.ContextPairs(ctx).Merge(user).InContext(ctx)
+		}
+		if o.errorDetails && nil != err {
+			ctx = lager.ContextPairs(ctx).Merge(errorDetailPairs(err, o.redactFunc)).InContext(ctx)
+		}
+		msg := DefaultStreamCodeToMessage(code)
+		if o.customMessage {
+			msg = o.codeMessageFunc(code)
+		}
+		o.messageFunc(ctx, msg, level, code, err, duration)
+
+		return err
+	}
+}
+
+// countingStream wraps a grpc.ServerStream to count the messages (and bytes) received and sent.
+type countingStream struct {
+	grpc.ServerStream
+	ctx   context.Context
+	o     *options
+	start time.Time
+
+	msgs                 int64 // Messages received plus sent.
+	last                 int64 // When progress was last logged (lager.Now().UnixNano()).
+	msgsRecv, msgsSent   int64
+	bytesRecv, bytesSent int64
+}
+
+// Context returns the stream's context with the Lager pairs added by the interceptor.
+func (s *countingStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *countingStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if nil == err {
+		atomic.AddInt64(&s.bytesRecv, messageSize(m))
+		atomic.AddInt64(&s.msgsRecv, 1)
+		s.counted()
+	}
+	return err
+}
+
+func (s *countingStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if nil == err {
+		atomic.AddInt64(&s.bytesSent, messageSize(m))
+		atomic.AddInt64(&s.msgsSent, 1)
+		s.counted()
+	}
+	return err
+}
+
+func messageSize(m interface{}) int64 {
+	if pm, ok := m.(proto.Message); ok {
+		return int64(proto.Size(pm))
+	}
+	return 0
+}
+
+// counted counts one more message and logs a progress line if the total is a multiple of the WithStreamProgress
+// count or if the WithStreamProgress period has passed (per lager.Now) since progress was last logged.
+func (s *countingStream) counted() {
+	total := atomic.AddInt64(&s.msgs, 1)
+	if 0 < s.o.progressEvery && 0 == total%s.o.progressEvery {
+		atomic.StoreInt64(&s.last, lager.Now().UnixNano())
+		s.progress()
+	} else if s.due() {
+		s.progress()
+	}
+}
+
+// due reports whether the WithStreamProgress period has passed since progress was last logged and, if so,
+// records that progress is being logged now (so concurrent callers don't both log it).
+func (s *countingStream) due() bool {
+	if s.o.progressPeriod <= 0 {
+		return false
+	}
+	last, now := atomic.LoadInt64(&s.last), lager.Now().UnixNano()
+	return int64(s.o.progressPeriod) <= now-last && atomic.CompareAndSwapInt64(&s.last, last, now)
+}
+
+// ticking checks whether progress is due each WithStreamProgress period, so idle streams still log progress
+// lines.  It returns a function that stops the checks and only returns once they have stopped.
+func (s *countingStream) ticking() (stop func()) {
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(s.o.progressPeriod)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if s.due() {
+					s.progress()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func (s *countingStream) progress() {
+	lg := InterceptorLager(s.ctx, byte(s.o.progressLevel))
+	if !lg.Enabled() {
+		return
+	}
+	ctx, tags := callTags(s.ctx)
+	ctx = lager.ContextPairs(ctx).Merge(s.counts()).InContext(ctx)
+	InterceptorLager(ctx, byte(s.o.progressLevel)).MMap("streaming call in progress",
+		"grpc.stream.elapsed", lager.Now().Sub(s.start), lager.InlinePairs, tags)
+}
+
+// counts returns the pairs for the message counts and sizes so far.
+func (s *countingStream) counts() lager.AMap {
+	return lager.Pairs(
+		"grpc.stream.msgs_received", atomic.LoadInt64(&s.msgsRecv),
+		"grpc.stream.msgs_sent", atomic.LoadInt64(&s.msgsSent),
+		"grpc.stream.bytes_received", atomic.LoadInt64(&s.bytesRecv),
+		"grpc.stream.bytes_sent", atomic.LoadInt64(&s.bytesSent),
+	)
+}
@@ -0,0 +1,95 @@
+package grpc_lager_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/TyeMcQueen/go-lager"
+	"github.com/TyeMcQueen/go-lager/grpc_lager"
+	pb_testproto "github.com/TyeMcQueen/go-lager/grpc_lager/testproto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// fakeStream delivers 'recv' requests and then io.EOF.
+type fakeStream struct {
+	grpc.ServerStream
+	recv int
+}
+
+func (s *fakeStream) Context() context.Context { return context.Background() }
+
+func (s *fakeStream) SendMsg(m interface{}) error { return nil }
+
+func (s *fakeStream) RecvMsg(m interface{}) error {
+	if 0 == s.recv {
+		return io.EOF
+	}
+	s.recv--
+	m.(*pb_testproto.PingRequest).Value = "ping"
+	return nil
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	log := &bytes.Buffer{}
+	defer lager.SetOutput(log)()
+	defer saveLevels()()
+	lager.Init("FWNAI")
+
+	info := &grpc.StreamServerInfo{FullMethod: "/grpc_lager.testproto.TestService/PingStream"}
+	var handlerCtx context.Context
+	handler := func(srv interface{}, stream grpc.ServerStream) error {
+		handlerCtx = stream.Context()
+		for {
+			req := &pb_testproto.PingRequest{}
+			if err := stream.RecvMsg(req); nil != err {
+				return nil
+			}
+			if err := stream.SendMsg(&pb_testproto.PingResponse{Value: req.Value}); nil != err {
+				return err
+			}
+		}
+	}
+
+	interceptor := grpc_lager.StreamServerInterceptor(grpc_lager.WithStreamProgress(4, 0, lager.INFO))
+	require.NoError(t, interceptor(nil, &fakeStream{recv: 5}, info, handler))
+	v, _ := lager.PairFromContext(handlerCtx, "grpc.method")
+	assert.Equal(t, "PingStream", v, "handler sees the call's pairs")
+
+	lines := strings.Split(strings.TrimSuffix(log.String(), "\n"), "\n")
+	require.Len(t, lines, 3, "two progress lines and a final line")
+	assert.Contains(t, lines[0], "streaming call in progress")
+	assert.Contains(t, lines[0], `"grpc.stream.msgs_received":2, "grpc.stream.msgs_sent":2`)
+	assert.Contains(t, lines[1], `"grpc.stream.msgs_received":4, "grpc.stream.msgs_sent":4`)
+	assert.Contains(t, lines[2], "finished streaming call with code OK")
+	assert.Contains(t, lines[2], `"grpc.termination":"ok"`)
+	assert.Contains(t, lines[2], `"grpc.stream.msgs_received":5, "grpc.stream.msgs_sent":5, "grpc.stream.bytes_received":30`)
+
+	log.Reset()
+	var now int64 // Virtual time, in nanoseconds.
+	lager.SetClock(func() time.Time { return time.Unix(0, atomic.LoadInt64(&now)) })
+	defer lager.SetClock(nil)
+	stepped := func(srv interface{}, stream grpc.ServerStream) error {
+		for {
+			atomic.AddInt64(&now, int64(6*time.Millisecond))
+			req := &pb_testproto.PingRequest{}
+			if err := stream.RecvMsg(req); nil != err {
+				return nil
+			}
+		}
+	}
+	interceptor = grpc_lager.StreamServerInterceptor(grpc_lager.WithStreamProgress(0, 10*time.Millisecond, lager.INFO))
+	require.NoError(t, interceptor(nil, &fakeStream{recv: 5}, info, stepped))
+	lines = strings.Split(strings.TrimSuffix(log.String(), "\n"), "\n")
+	require.Len(t, lines, 3, "a progress line each 10ms of virtual time, then the final line")
+	assert.Contains(t, lines[0], `"grpc.stream.elapsed":"12ms"`)
+	assert.Contains(t, lines[1], `"grpc.stream.elapsed":"24ms"`)
+	assert.Contains(t, lines[2], "finished streaming call with code OK")
+	assert.Contains(t, lines[2], `"grpc.time_ms":36`)
+}
@@ -132,12 +132,14 @@ func (s *InterceptorTestSuite) ServerAddr() string {
 }
 
 func (s *InterceptorTestSuite) SimpleCtx() context.Context {
-	ctx, _ := context.WithTimeout(context.TODO(), 2*time.Second)
+	ctx, cancel := context.WithTimeout(context.TODO(), 2*time.Second)
+	s.T().Cleanup(cancel)
 	return ctx
 }
 
 func (s *InterceptorTestSuite) DeadlineCtx(deadline time.Time) context.Context {
-	ctx, _ := context.WithDeadline(context.TODO(), deadline)
+	ctx, cancel := context.WithDeadline(context.TODO(), deadline)
+	s.T().Cleanup(cancel)
 	return ctx
 }
 
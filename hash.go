@@ -0,0 +1,112 @@
+package lager
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+)
+
+// HashAlgorithm specifies how Hashed() and HashValue() hash values.  See
+// SetHashing().
+type HashAlgorithm int8
+
+const (
+	// HashHMACSHA256 uses HMAC-SHA256 with the salt as the key.  Without
+	// the salt, even values from a small set (like IPv4 addresses) can't be
+	// recovered by hashing every possibility.
+	HashHMACSHA256 HashAlgorithm = iota
+
+	// HashSHA256 uses SHA-256 of the salt followed by the value.
+	HashSHA256
+
+	nHashAlgorithms
+)
+
+// Hashed() is used in place of a key/value pair (it takes up only one slot
+// in the list of pairs, like KV()) to log only a salted hash of a sensitive
+// value (such as an e-mail address or IP address) rather than the value
+// itself.  Lines about the same value can still be correlated (by searching
+// for the same hash) without the logs storing the raw personal data:
+//
+//      lager.Info().MMap("Login failed",
+//          lager.Hashed("email", form.Email, salt), "reason", reason)
+//
+// The hash is logged as lower-case hex digits [see HashValue()] and is only
+// computed if the line is actually logged.  Use SetHashing() to pick the
+// algorithm and to truncate the hashes.  Keep 'salt' secret, the same for
+// all of your services, and not logged.  Hashed() can also be passed to
+// AddPairs(), Pairs(), and PairsBuilder's Add() (where the hash is computed
+// right away).  If it ends up formatted some other way (such as via
+// fmt.Sprint()), then it only shows the key and the hash, never the value
+// or the salt.
+//
+func Hashed(key, value, salt string) interface{} {
+	return hashedPair{key, value, salt}
+}
+
+type hashedPair struct {
+	key, value, salt string
+}
+
+func (p hashedPair) onePair() (string, interface{}, bool) {
+	return p.key, HashValue(p.value, p.salt), true
+}
+
+// String() shows the key and hash, so that formatting a hashedPair can't
+// reveal the value or salt.
+func (p hashedPair) String() string {
+	return "Hashed(" + p.key + ":" + HashValue(p.value, p.salt) + ")"
+}
+
+// GoString() is the same as String(), for "%#v".
+func (p hashedPair) GoString() string { return p.String() }
+
+// HashValue() returns the hash that Hashed() logs for 'value', given the
+// same 'salt'.  It can be used to find the lines for a value or to hash
+// values logged other ways:
+//
+//      lager.SetSubjectPseudonymizer(func(id string) string {
+//          return lager.HashValue(id, salt)
+//      })
+//
+func HashValue(value, salt string) string {
+	g := getGlobals()
+	var h hash.Hash
+	switch g.hashAlg {
+	case HashSHA256:
+		h = sha256.New()
+		h.Write([]byte(salt))
+	default:
+		h = hmac.New(sha256.New, []byte(salt))
+	}
+	h.Write([]byte(value))
+	var sum [sha256.Size]byte
+	digits := hex.EncodeToString(h.Sum(sum[:0]))
+	if 0 < g.hashLen && g.hashLen < len(digits) {
+		digits = digits[:g.hashLen]
+	}
+	return digits
+}
+
+// SetHashing() sets the algorithm used by Hashed() and HashValue() and how
+// many hex digits of each hash to keep (0 for all 64).  The default is
+// HashHMACSHA256 with no truncation.  Shorter hashes are easier to read but
+// are more likely to be shared by different values (16 digits is plenty
+// for correlating values in logs).  Passing in an invalid HashAlgorithm or
+// a negative 'digits' calls panic().
+//
+// Changing either setting changes the hashes logged, so lines logged before
+// the change can't be correlated with ones logged after it.
+//
+func SetHashing(alg HashAlgorithm, digits int) {
+	if alg < 0 || nHashAlgorithms <= alg {
+		panic(fmt.Sprintf("Invalid lager.HashAlgorithm (%d)", alg))
+	} else if digits < 0 {
+		panic(fmt.Sprintf("Invalid hash length (%d)", digits))
+	}
+	updateGlobals(func(g *globals) {
+		g.hashAlg, g.hashLen = alg, digits
+	})
+}
@@ -0,0 +1,54 @@
+package lager
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+)
+
+// When the process started (close enough).
+var _processStart = time.Now()
+
+// Heartbeat() writes a Note log line every 'interval' until 'ctx' is
+// cancelled, so that a daemon that has silently hung can be detected from
+// its logs alone.  It does not return until 'ctx' is cancelled so it is
+// usually called via:
+//
+//      go lager.Heartbeat(ctx, time.Minute, "service", name)
+//
+// Each line has the message "Heartbeat" and includes the pairs from 'ctx',
+// the passed-in key/value 'pairs', and:
+//
+//      "uptime"        E.g. "1h2m3.5s" (advances per Now(), see SetClock())
+//      "goroutines"    The number of goroutines that currently exist.
+//      "heapAlloc"     Bytes allocated to heap objects.
+//      "sys"           Total bytes of memory obtained from the OS.
+//      "numGC"         Number of completed garbage collection cycles.
+//
+// Passing in an 'interval' that is not positive calls panic().
+//
+func Heartbeat(ctx Ctx, interval time.Duration, pairs ...interface{}) {
+	if interval <= 0 {
+		panic(fmt.Sprintf("Invalid lager.Heartbeat() interval (%v)", interval))
+	}
+	began, uptime := Now(), time.Since(_processStart)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			var mem runtime.MemStats
+			runtime.ReadMemStats(&mem)
+			Note(ctx).MMap("Heartbeat",
+				"uptime", (uptime + Now().Sub(began)).Round(time.Millisecond),
+				"goroutines", runtime.NumGoroutine(),
+				"heapAlloc", mem.HeapAlloc,
+				"sys", mem.Sys,
+				"numGC", mem.NumGC,
+				InlinePairs, RawMap(pairs),
+			)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package lager
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HttpStyle specifies which standard format of access log details is
+// returned by HttpInfo().
+type HttpStyle int8
+
+const (
+	// HttpGcp returns the same value as GcpHttp(), which GCP recognizes
+	// when logged under the key "httpRequest".
+	HttpGcp HttpStyle = iota
+
+	// HttpApache returns a string in the Apache "combined" log format:
+	//
+	//      192.0.2.1 - - [02/Jan/2006:15:04:05 +0000] "GET /path HTTP/1.1" \
+	//          200 1234 "https://referer/" "User-Agent"
+	//
+	HttpApache
+
+	// HttpW3C returns a map using the field names from the W3C Extended Log
+	// File Format: "date", "time", "c-ip", "cs-method", "cs-uri-stem",
+	// "cs-version", "sc-status", "cs-bytes", "sc-bytes", "time-taken" (in
+	// seconds), "cs(Referer)", and "cs(User-Agent)".  Fields whose values
+	// are not known are omitted.
+	HttpW3C
+
+	nHttpStyles
+)
+
+// HttpInfo() returns a value for logging that describes an HTTP(S) request
+// (and perhaps its response) in the specified standard format.  So non-GCP
+// users can get standard access logs from the same code.  The arguments
+// are treated the same as for GcpHttp().  As with GcpHttp(), any query
+// parameters are not included.  Passing in an invalid HttpStyle calls
+// panic().
+//
+//      lager.Acc(req.Context()).MMap("Response sent",
+//          "access", lager.HttpInfo(req, resp, &start, lager.HttpApache))
+//
+// For HttpApache and HttpW3C, the time logged is 'start' (if not 'nil')
+// else the current time.
+//
+func HttpInfo(
+	req *http.Request, resp *http.Response, start *time.Time, style HttpStyle,
+) interface{} {
+	info := newHttpReqInfo(req)
+	switch style {
+	case HttpGcp:
+		return info.gcpPairs(resp, start)
+	case HttpApache:
+		return info.apache(resp, start)
+	case HttpW3C:
+		return info.w3c(resp, start)
+	}
+	panic(fmt.Sprintf("Invalid lager.HttpStyle (%d)", style))
+}
+
+// AccessKey is the key that LogAccess() logs the request details under,
+// unless it is passed HttpGcp.
+const AccessKey = "access"
+
+// LogAccess() creates a standard "access log" entry like GcpLogAccess() but
+// with the request details in the specified HttpStyle [see HttpInfo()], so
+// the same middleware can write Apache or W3C style access logs for
+// services not running in GCP.  For HttpGcp, it is the same as
+// GcpLogAccess().  Otherwise, the details are logged under the key "access"
+// (AccessKey) rather than "httpRequest".  Passing in an invalid HttpStyle
+// calls panic().
+//
+//      lager.LogAccess(req, resp, &start, lager.HttpApache).MMap(
+//          "Response sent", "cached", fromCache)
+//
+func LogAccess(
+	req *http.Request, resp *http.Response, pStart *time.Time, style HttpStyle,
+) Lager {
+	key := AccessKey
+	if HttpGcp == style {
+		key = "httpRequest"
+	}
+	ctx := AddPairs(req.Context(), key, HttpInfo(req, resp, pStart, style))
+	if route := RouteTemplate(req); "" != route {
+		ctx = AddPairs(ctx, "route", route)
+	}
+	if user := RequestUser(req); "" != user {
+		ctx = AddPairs(ctx, UserKey, user)
+	}
+	return Acc(ctx)
+}
+
+// Returns the response status (0 if 'resp' is 'nil' but 'start' is not,
+// else -1 if not known), the response size (-1 if not known), and 'start'
+// (or 'nil' if it should be ignored).
+func respDetails(
+	resp *http.Response, start *time.Time,
+) (int, int64, *time.Time) {
+	if nil != start && (*start).IsZero() {
+		start = nil
+	}
+	status := -1
+	respSize := int64(-1)
+	if nil != resp {
+		status = resp.StatusCode
+		respSize = resp.ContentLength
+	} else if nil != start {
+		status = 0
+	}
+	return status, respSize, start
+}
+
+// Returns an Apache "combined" log format string.
+func (i *httpReqInfo) apache(resp *http.Response, start *time.Time) string {
+	status, respSize, start := respDetails(resp, start)
+	when := Now()
+	if nil != start {
+		when = *start
+	}
+	dash := func(s string) string {
+		if "" == s {
+			return "-"
+		}
+		return s
+	}
+	stat, size := "-", "-"
+	if 0 <= status {
+		stat = strconv.Itoa(status)
+	}
+	if 0 <= respSize {
+		size = strconv.FormatInt(respSize, 10)
+	}
+	return fmt.Sprintf("%s - - [%s] %q %s %s %q %q",
+		dash(i.remoteIp), when.Format("02/Jan/2006:15:04:05 -0700"),
+		i.method+" "+strings.TrimSuffix(i.path, "?")+" "+i.proto, stat, size,
+		dash(i.referer), dash(i.userAgent))
+}
+
+// Returns a map using W3C Extended Log File Format field names.
+func (i *httpReqInfo) w3c(resp *http.Response, start *time.Time) RawMap {
+	status, respSize, start := respDetails(resp, start)
+	when := Now()
+	taken := -1.0
+	if nil != start {
+		when = *start
+		taken = Now().Sub(*start).Seconds()
+	}
+	when = when.UTC()
+	return Map(
+		"date", when.Format("2006-01-02"),
+		"time", when.Format("15:04:05"),
+		"c-ip", i.remoteIp,
+		"cs-method", i.method,
+		"cs-uri-stem", strings.TrimSuffix(i.path, "?"),
+		"cs-version", i.proto,
+		Unless(-1 == status, "sc-status"), status,
+		Unless(i.reqSize < 0, "cs-bytes"), i.reqSize,
+		Unless(respSize < 0, "sc-bytes"), respSize,
+		Unless(taken < 0, "time-taken"), taken,
+		Unless("" == i.referer, "cs(Referer)"), i.referer,
+		Unless("" == i.userAgent, "cs(User-Agent)"), i.userAgent,
+	)
+}
+
+// RouteTemplate() returns the route pattern (like "/users/{id}") that
+// matched 'req', which is useful for aggregating access logs.  It returns
+// "" if no route pattern is known.
+//
+// Functions added via AddRouteFunc() are tried first (most recently added
+// first).  Then, for Go 1.23 and later, the pattern that http.ServeMux
+// matched (the Pattern field of http.Request) is used, minus any method and
+// host.  ServeMux sets that field on the Request it is passed, so it is
+// available to middleware that wraps the ServeMux after the handler returns.
+//
+func RouteTemplate(req *http.Request) string {
+	funcs := getGlobals().routeFuncs
+	for i := len(funcs) - 1; 0 <= i; i-- {
+		if route := funcs[i](req); "" != route {
+			return route
+		}
+	}
+	// Not using req.Pattern directly so we still build with Go before 1.23:
+	pat := reflect.ValueOf(req).Elem().FieldByName("Pattern")
+	if !pat.IsValid() || reflect.String != pat.Kind() {
+		return ""
+	}
+	route := pat.String()
+	if i := strings.IndexByte(route, '/'); 0 < i {
+		route = route[i:]
+	}
+	return route
+}
+
+// AddRouteFunc() adds a function that RouteTemplate() uses to find the
+// route pattern that matched a request.  The function should return "" if
+// it finds no route pattern.  For example, for github.com/go-chi/chi:
+//
+//      lager.AddRouteFunc(func(r *http.Request) string {
+//          if rc := chi.RouteContext(r.Context()); nil != rc {
+//              return rc.RoutePattern()
+//          }
+//          return ""
+//      })
+//
+// or for github.com/gorilla/mux (where the logging middleware must be added
+// via the Router's Use() method, since the route is only recorded in the
+// Request passed to handlers):
+//
+//      lager.AddRouteFunc(func(r *http.Request) string {
+//          if route := mux.CurrentRoute(r); nil != route {
+//              tmpl, _ := route.GetPathTemplate()
+//              return tmpl
+//          }
+//          return ""
+//      })
+//
+func AddRouteFunc(routeFunc func(*http.Request) string) {
+	updateGlobals(func(g *globals) {
+		n := len(g.routeFuncs)
+		g.routeFuncs = append(g.routeFuncs[:n:n], routeFunc)
+	})
+}
+
+// UserKey is the key of the pair that GcpLogAccess() uses to log who made
+// a request [see AddUserFunc()].
+const UserKey = "user"
+
+// RequestUser() returns the identity of the principal (user or service)
+// that made a request, as found by the functions added via AddUserFunc()
+// (most recently added first).  It returns "" if no function finds one.
+//
+func RequestUser(req *http.Request) string {
+	funcs := getGlobals().userFuncs
+	for i := len(funcs) - 1; 0 <= i; i-- {
+		if user := (*funcs[i])(req.Context(), req); "" != user {
+			return user
+		}
+	}
+	return ""
+}
+
+// A function added via AddUserFunc() (a pointer so it can be removed).
+type userFunc func(Ctx, *http.Request) string
+
+// AddUserFunc() adds a function that RequestUser() uses to find who made a
+// request, such as the "sub" claim of an already-verified JWT or the name
+// from a client certificate [see ClientCertUser()].  The function should
+// return "" if it finds no identity.  GcpLogAccess() (and so middleware
+// that uses it) then adds a "user" pair (UserKey) to each access log line
+// where an identity is found, so identity logging is done in one place:
+//
+//      lager.AddUserFunc(lager.ClientCertUser)
+//      lager.AddUserFunc(func(ctx context.Context, r *http.Request) string {
+//          if claims := auth.ClaimsFrom(ctx); nil != claims {
+//              return claims.Subject
+//          }
+//          return ""
+//      })
+//
+// The function is passed the request's Context as well as the request so
+// that identities stored in the Context by authentication middleware can
+// be found.  Note that such middleware must run before the access log line
+// is written and must store the identity in a Context the logging
+// middleware can see.
+//
+// The returned func() removes the function again (such as in a test):
+//
+//      defer lager.AddUserFunc(lookupUser)()
+//
+func AddUserFunc(f func(ctx Ctx, req *http.Request) string) (remove func()) {
+	added := userFunc(f)
+	updateGlobals(func(g *globals) {
+		n := len(g.userFuncs)
+		g.userFuncs = append(g.userFuncs[:n:n], &added)
+	})
+	return func() {
+		updateGlobals(func(g *globals) {
+			funcs := make([]*userFunc, 0, len(g.userFuncs))
+			for _, uf := range g.userFuncs {
+				if &added != uf {
+					funcs = append(funcs, uf)
+				}
+			}
+			g.userFuncs = funcs
+		})
+	}
+}
+
+// ClientCertUser() returns the Common Name from the verified client
+// certificate of a request made via mutual TLS, or "" if there is none.  It
+// can be passed to AddUserFunc().
+//
+func ClientCertUser(_ Ctx, req *http.Request) string {
+	if nil == req.TLS || 0 == len(req.TLS.VerifiedChains) ||
+		0 == len(req.TLS.VerifiedChains[0]) {
+		return ""
+	}
+	return req.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// DefaultHeaderPairs lists the context pair keys and response header names
+// that PairsToHeaders() and ExportPairsToHeaders() use when none are given.
+//
+var DefaultHeaderPairs = []string{
+	"requestId", "X-Request-Id",
+	GcpTraceKey, "X-Trace-Id",
+}
+
+// PairsToHeaders() copies the values of selected pairs from 'ctx' into the
+// headers 'h' (usually of a response), so clients can quote identifiers
+// that directly match the server's log lines.  'keyHeaders' is a list of
+// pair keys each followed by the name of the header to set.  If none are
+// given, then DefaultHeaderPairs is used.  Pairs that are missing (or have
+// a 'nil' value) are skipped.
+//
+//      lager.PairsToHeaders(ctx, w.Header(), "requestId", "X-Request-Id")
+//
+// For the GcpTraceKey pair, just the trace ID is copied (not the
+// "projects/{project}/traces/" prefix).  Other values are formatted via S().
+//
+func PairsToHeaders(ctx Ctx, h http.Header, keyHeaders ...string) {
+	if 0 == len(keyHeaders) {
+		keyHeaders = DefaultHeaderPairs
+	}
+	pairs := ContextPairs(ctx)
+	for i := 0; i+1 < len(keyHeaders); i += 2 {
+		key := keyHeaders[i]
+		v, ok := pairs.Get(key)
+		if !ok || nil == v {
+			continue
+		}
+		val := S(v)
+		if GcpTraceKey == key {
+			if j := strings.LastIndex(val, "/traces/"); 0 <= j {
+				val = val[j+len("/traces/"):]
+			}
+		}
+		h.Set(keyHeaders[i+1], val)
+	}
+}
+
+// ExportPairsToHeaders() returns middleware that calls PairsToHeaders()
+// on the request's Context and the response's headers (passing along any
+// 'keyHeaders') before calling 'next'.  So it must be placed after (inside)
+// the middleware that adds the pairs to the request's Context.
+//
+//      handler = lager.ExportPairsToHeaders(handler)
+//
+func ExportPairsToHeaders(
+	next http.Handler, keyHeaders ...string,
+) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		PairsToHeaders(req.Context(), w.Header(), keyHeaders...)
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,214 @@
+package lager
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Instance is an isolated Lager configuration (enabled levels, keys,
+// output, etc.) that is independent of the package-level configuration
+// that lager.Warn() and similar functions use.  See New().
+//
+type Instance struct {
+	mu  *sync.Mutex
+	cfg *atomic.Value // *globals
+}
+
+// Option configures an Instance.  See New().
+//
+type Option func(*globals)
+
+// New() returns an isolated Instance of Lager whose configuration starts
+// from Lager's defaults (ignoring LAGER_* environment variables) and is
+// then adjusted by the passed-in Options.  This lets a library log via
+// Lager without fighting with the application over the package-level
+// configuration.
+//
+//      var log = lager.New(lager.WithLevels("FW"), lager.WithOutput(w))
+//      ...
+//      log.Warn(ctx).MMap("Retrying", "err", err)
+//
+// Nothing done via an Instance changes the package-level configuration and
+// package-level configuration functions like lager.Keys() do not affect an
+// Instance.  Module levels, the flight recorder, PromoteMatching(), and
+// the Exit-related settings are not part of an Instance.
+//
+func New(opts ...Option) *Instance {
+	return newInstance(newGlobals("").updated(func(g *globals) {
+		g.stats = new(lineStats)
+		applyOptions(opts)(g)
+	}))
+}
+
+func newInstance(g *globals) *Instance {
+	in := &Instance{mu: new(sync.Mutex), cfg: new(atomic.Value)}
+	in.cfg.Store(g)
+	return in
+}
+
+// Default() returns the Instance that holds the package-level configuration
+// used by lager.Warn() and similar functions.  Calling Update() on it is
+// the same as using package-level configuration functions like Init().
+//
+func Default() *Instance {
+	getGlobals() // Make sure _globals is initialized.
+	return &Instance{mu: &_globalsMutex, cfg: &_globals}
+}
+
+// Clone() returns a new, isolated Instance that starts with a copy of the
+// configuration of the invoking Instance, adjusted by the passed-in
+// Options.  So tests and multi-tenant servers can run several differently
+// configured Lager pipelines in one process:
+//
+//      audit := lager.Default().Clone(lager.WithOutput(auditFile))
+//
+// The clone does not get the flight recorder [see SetFlightRecorder()]
+// so that DumpRecent() only reports lines from the package-level
+// configuration, nor the PromoteMatching() rules (which could not be
+// removed from it).  Later changes to either Instance do not affect the
+// other.
+//
+func (in *Instance) Clone(opts ...Option) *Instance {
+	return newInstance(in.get().updated(func(g *globals) {
+		g.recorder, g.promotions = nil, nil
+		g.stats = new(lineStats)
+		applyOptions(opts)(g)
+	}))
+}
+
+func applyOptions(opts []Option) func(*globals) {
+	return func(g *globals) {
+		for _, opt := range opts {
+			opt(g)
+		}
+	}
+}
+
+// Update() changes the configuration of the Instance.  Holding on to a
+// Lager obtained from the Instance before the update may ignore the update.
+//
+func (in *Instance) Update(opts ...Option) {
+	defer AutoLock(in.mu)()
+	in.cfg.Store(in.get().updated(applyOptions(opts)))
+}
+
+func (in *Instance) get() *globals {
+	return in.cfg.Load().(*globals)
+}
+
+func (in *Instance) at(lev level, cs []Ctx) Lager {
+	return in.get().forLevel(lev, cs...)
+}
+
+// WithLevels() is an Option that sets which log levels are enabled, like
+// Init() does for the package-level configuration.
+//
+func WithLevels(levels string) Option {
+	return setLevels(levels)
+}
+
+// WithKeys() is an Option that has the Instance write each log line as a
+// JSON map using the given keys, like Keys() does for the package-level
+// configuration.  Passing in all "" values reverts to JSON lists.
+//
+func WithKeys(when, lev, msg, args, ctx, mod string) Option {
+	var keys *keyStrs
+	if "" != when || "" != lev || "" != msg || "" != args ||
+		"" != ctx || "" != mod {
+		keys = &keyStrs{
+			when: when, lev: lev, msg: msg, args: args, ctx: ctx, mod: mod,
+		}
+	}
+	return setKeys(keys)
+}
+
+// WithOutput() is an Option that sets where the Instance writes log lines,
+// like SetOutput() does for the package-level configuration.  Passing in
+// 'nil' reverts to the default (os.Stdout, except for Panic and Exit).
+//
+func WithOutput(w io.Writer) Option {
+	return func(g *globals) {
+		g.dest, g.destOut = w, nil
+		if nil != w {
+			g.destOut = new(outLock)
+		}
+	}
+}
+
+// WithGcp() is an Option that has the Instance log in the format that
+// works best with GCP Cloud Logging, like RunningInGcp() does for the
+// package-level configuration.
+//
+func WithGcp() Option {
+	return func(g *globals) {
+		g.inGcp = true
+		g.levDesc = GcpLevelName
+		setKeys(&keyStrs{
+			when: "time", lev: "severity", msg: "message",
+			args: "data", mod: "module", ctx: "",
+		})(g)
+	}
+}
+
+// WithErrorKey() is an Option that sets the key used when logging errors
+// via lager.Err(), like SetErrorKey().
+//
+func WithErrorKey(key string) Option {
+	if "" == key {
+		key = "err"
+	}
+	return func(g *globals) {
+		g.errKey = key
+	}
+}
+
+// Level() is like lager.Level() but uses the Instance's configuration.
+func (in *Instance) Level(lev byte, cs ...Ctx) Lager {
+	return in.at(levelOf(LogLevel(lev), "Level"), cs)
+}
+
+// AtLevel() is like lager.AtLevel() but uses the Instance's configuration.
+func (in *Instance) AtLevel(lev LogLevel, cs ...Ctx) Lager {
+	return in.at(levelOf(lev, "AtLevel"), cs)
+}
+
+// Panic() is like lager.Panic() but uses the Instance's configuration.
+func (in *Instance) Panic(cs ...Ctx) Lager { return in.at(lPanic, cs) }
+
+// Exit() is like lager.Exit() but uses the Instance's configuration.
+func (in *Instance) Exit(cs ...Ctx) Lager { return in.at(lExit, cs) }
+
+// Fail() is like lager.Fail() but uses the Instance's configuration.
+func (in *Instance) Fail(cs ...Ctx) Lager { return in.at(lFail, cs) }
+
+// Warn() is like lager.Warn() but uses the Instance's configuration.
+func (in *Instance) Warn(cs ...Ctx) Lager { return in.at(lWarn, cs) }
+
+// Note() is like lager.Note() but uses the Instance's configuration.
+func (in *Instance) Note(cs ...Ctx) Lager { return in.at(lNote, cs) }
+
+// Acc() is like lager.Acc() but uses the Instance's configuration.
+func (in *Instance) Acc(cs ...Ctx) Lager { return in.at(lAcc, cs) }
+
+// Info() is like lager.Info() but uses the Instance's configuration.
+func (in *Instance) Info(cs ...Ctx) Lager { return in.at(lInfo, cs) }
+
+// Trace() is like lager.Trace() but uses the Instance's configuration.
+func (in *Instance) Trace(cs ...Ctx) Lager { return in.at(lTrace, cs) }
+
+// Debug() is like lager.Debug() but uses the Instance's configuration.
+func (in *Instance) Debug(cs ...Ctx) Lager { return in.at(lDebug, cs) }
+
+// Obj() is like lager.Obj() but uses the Instance's configuration.
+func (in *Instance) Obj(cs ...Ctx) Lager { return in.at(lObj, cs) }
+
+// Guts() is like lager.Guts() but uses the Instance's configuration.
+func (in *Instance) Guts(cs ...Ctx) Lager { return in.at(lGuts, cs) }
+
+// GetLevels() returns the letters of the enabled log levels (in the order
+// they were given).
+//
+func (in *Instance) GetLevels() string {
+	return in.get().enabled
+}
@@ -0,0 +1,105 @@
+package lager
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/TyeMcQueen/go-lager/gcp-spans"
+)
+
+// InternalErrorBuffer is how many errors the channel returned by
+// InternalErrors() can hold.  Changing it after the first call to
+// InternalErrors() has no effect.
+var InternalErrorBuffer = 64
+
+// The channel returned by InternalErrors() (a chan error, maybe nil).
+var _internalErrs atomic.Value
+
+// Held while creating the channel.
+var _internalMu sync.Mutex
+
+// The number of internal errors dropped because the channel was full.
+var _internalDropped int64
+
+// InternalError describes a problem within Lager itself, such as a log line
+// that could not be written.  See InternalErrors().
+//
+type InternalError struct {
+	// What Lager was doing: "write" (a log line was lost), "fallback" (a
+	// line could not be written to the SetStdoutFallback() file), "encode"
+	// (a value could not be converted to JSON), "stream" (a Stream() value
+	// could not be fully read), "encoder" (a RegisterEncoder() function
+	// panicked), "shadow" (a line failed the SetShadowCheck() check),
+	// "spool" (a SpoolWriter could not save a line to its spool file), or
+	// "spanHook" (a function passed to spans.OnFinish() panicked).
+	Op string
+
+	// The underlying error.
+	Err error
+}
+
+func (e *InternalError) Error() string {
+	return "lager " + e.Op + ": " + e.Err.Error()
+}
+
+func (e *InternalError) Unwrap() error { return e.Err }
+
+// InternalErrors() returns a channel that receives an *InternalError for
+// each problem within Lager itself (lines that could not be written, values
+// that could not be encoded, encoder functions that panicked, etc.), so
+// applications can monitor the health of their logging.  Such problems are
+// otherwise invisible since Lager can't report them by logging.
+//
+//      go func() {
+//          for err := range lager.InternalErrors() {
+//              loggingErrors.WithLabelValues(
+//                  err.(*lager.InternalError).Op).Inc()
+//          }
+//      }()
+//
+// Errors are only recorded once InternalErrors() has been called.  Every
+// call returns the same channel, which is never closed.  The channel holds
+// up to InternalErrorBuffer errors; while it is full, further errors are
+// dropped (and counted, see DroppedInternalErrors()) rather than block
+// logging.
+//
+func InternalErrors() <-chan error {
+	if ch, _ := _internalErrs.Load().(chan error); nil != ch {
+		return ch
+	}
+	defer AutoLock(&_internalMu)()
+	ch, _ := _internalErrs.Load().(chan error)
+	if nil == ch {
+		ch = make(chan error, InternalErrorBuffer)
+		_internalErrs.Store(ch)
+	}
+	return ch
+}
+
+// DroppedInternalErrors() returns how many internal errors were dropped
+// because the channel from InternalErrors() was full.
+//
+func DroppedInternalErrors() int64 {
+	return atomic.LoadInt64(&_internalDropped)
+}
+
+func init() {
+	spans.OnHookPanic(func(p interface{}) {
+		internalError("spanHook",
+			fmt.Errorf("spans.OnFinish() hook panicked: %v", p))
+	})
+}
+
+// Reports an internal error, if anyone is listening.  Never blocks.
+func internalError(op string, err error) {
+	ch, _ := _internalErrs.Load().(chan error)
+	if nil == ch || nil == err {
+		return
+	}
+	select {
+	case ch <- &InternalError{Op: op, Err: err}:
+	default:
+		atomic.AddInt64(&_internalDropped, 1)
+	}
+}
@@ -0,0 +1,49 @@
+package lager
+
+import (
+	"net"
+)
+
+// SetAnonymizeIPs(true) causes the client IP addresses that Lager logs
+// [the "remoteIp" from GcpHttp(), GcpLogAccess(), and HttpInfo(), and
+// anything passed through RemoteIP()] to be truncated [see AnonymizeIP()],
+// for deployments where full client IP addresses are considered personal
+// data that should not be stored in logs.  The default is 'false'.
+//
+func SetAnonymizeIPs(anonymize bool) {
+	updateGlobals(func(g *globals) {
+		g.anonIPs = anonymize
+	})
+}
+
+// AnonymizeIP() truncates an IP address so it no longer identifies a
+// single host.  The last octet of an IPv4 address is zeroed ("10.1.2.3"
+// becomes "10.1.2.0") and all but the first 48 bits of an IPv6 address
+// are zeroed ("2001:db8:1:2::3" becomes "2001:db8:1::").  A string that is
+// not an IP address is returned unchanged.
+//
+func AnonymizeIP(ip string) string {
+	addr := net.ParseIP(ip)
+	if nil == addr {
+		return ip
+	}
+	if v4 := addr.To4(); nil != v4 {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return addr.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// RemoteIP() returns the IP address to log for a client given its network
+// address, such as an http.Request's RemoteAddr or the address of a gRPC
+// peer.  Any port is removed and, if SetAnonymizeIPs(true) was called, the
+// IP address is truncated via AnonymizeIP().
+//
+func RemoteIP(addr string) string {
+	if ip, _, err := net.SplitHostPort(addr); nil == err {
+		addr = ip
+	}
+	if getGlobals().anonIPs {
+		addr = AnonymizeIP(addr)
+	}
+	return addr
+}
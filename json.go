@@ -0,0 +1,163 @@
+package lager
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+// The configuration used when marshaling pairs to JSON.  It has the
+// defaults (so pairs are kept as given and no SetKeyType() rules apply)
+// since the JSON may be stored and later read by a differently configured
+// process.
+var _jsonGlobals = &globals{errKey: "err"}
+
+// MarshalJSON() writes the pairs as a JSON object with the keys in order,
+// the same way the pairs would be written in a log line.  This (along with
+// UnmarshalJSON()) lets an AMap be persisted and replayed, such as by
+// storing the pairs from ContextPairs(ctx) with a queued job so that the
+// worker can do AddPairs() with them.
+//
+func (p *KVPairs) MarshalJSON() ([]byte, error) {
+	return marshalPairs(p), nil
+}
+
+// MarshalJSON() writes the pairs as a JSON object with the keys in order
+// (including any duplicate keys), the same way the pairs would be written
+// in a log line.
+//
+func (m RawMap) MarshalJSON() ([]byte, error) {
+	if nil == m {
+		return []byte("null"), nil
+	}
+	return marshalPairs(m), nil
+}
+
+func marshalPairs(v interface{}) []byte {
+	b := bufPool.Get().(*buffer)
+	b.g, b.delim = _jsonGlobals, ""
+	b.scalar(v)
+	b.delim = ""
+	out := append([]byte(nil), b.buf...)
+	b.reset()
+	bufPool.Put(b)
+	return out
+}
+
+// UnmarshalJSON() replaces the pairs with those from a JSON object, keeping
+// the keys in order.  If a key appears more than once, the last value is
+// used (in the position of the first).  Nested objects become AMaps and
+// lists become ALists.  Numbers become int64 if they are integers that fit
+// and float64 otherwise.
+//
+func (p *KVPairs) UnmarshalJSON(data []byte) error {
+	v, err := unmarshalPairs(data, false)
+	if nil != err {
+		return err
+	}
+	kv, _ := v.(AMap)
+	if nil == kv {
+		kv = &KVPairs{}
+	}
+	*p = *kv
+	return nil
+}
+
+// UnmarshalJSON() replaces the pairs with those from a JSON object, keeping
+// the keys in order (including any duplicate keys).  Nested objects become
+// RawMaps and lists become ALists.  Numbers become int64 if they are
+// integers that fit and float64 otherwise.
+//
+func (m *RawMap) UnmarshalJSON(data []byte) error {
+	v, err := unmarshalPairs(data, true)
+	if nil != err {
+		return err
+	}
+	*m, _ = v.(RawMap)
+	return nil
+}
+
+var errNotObject = errors.New("lager: JSON for pairs must be an object")
+
+func unmarshalPairs(data []byte, raw bool) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	tok, err := dec.Token()
+	if nil != err {
+		return nil, err
+	}
+	if nil == tok {
+		return nil, nil
+	}
+	if json.Delim('{') != tok {
+		return nil, errNotObject
+	}
+	return decodeObject(dec, raw)
+}
+
+// Decodes the rest of an object after its opening '{'.
+func decodeObject(dec *json.Decoder, raw bool) (interface{}, error) {
+	var rm RawMap
+	var kv AMap
+	if !raw {
+		kv = &KVPairs{}
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if nil != err {
+			return nil, err
+		}
+		key, _ := tok.(string)
+		val, err := decodeValue(dec, raw)
+		if nil != err {
+			return nil, err
+		}
+		if raw {
+			rm = append(rm, key, val)
+		} else {
+			kv = kv.AddPairs(key, val)
+		}
+	}
+	if _, err := dec.Token(); nil != err { // The closing '}'
+		return nil, err
+	}
+	if raw {
+		if nil == rm {
+			rm = RawMap{}
+		}
+		return rm, nil
+	}
+	return kv, nil
+}
+
+func decodeValue(dec *json.Decoder, raw bool) (interface{}, error) {
+	tok, err := dec.Token()
+	if nil != err {
+		return nil, err
+	}
+	switch v := tok.(type) {
+	case json.Delim:
+		if '{' == v {
+			return decodeObject(dec, raw)
+		}
+		list := AList{}
+		for dec.More() {
+			val, err := decodeValue(dec, raw)
+			if nil != err {
+				return nil, err
+			}
+			list = append(list, val)
+		}
+		if _, err := dec.Token(); nil != err { // The closing ']'
+			return nil, err
+		}
+		return list, nil
+	case json.Number:
+		if i, err := v.Int64(); nil == err {
+			return i, nil
+		}
+		f, err := v.Float64()
+		return f, err
+	}
+	return tok, nil
+}
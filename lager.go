@@ -3,13 +3,17 @@ package lager
 import (
 	"bytes"
 	"context"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
+	"unicode"
 )
 
 /// TYPES ///
@@ -31,8 +35,9 @@ type globals struct {
 	// The currently enabled log levels (used in module.go).
 	enabled string
 
-	// Optional alternate destination for logs.
-	dest io.Writer
+	// Optional alternate destination for logs and the lock for it.
+	dest    io.Writer
+	destOut *outLock
 
 	// How much of source code file path to include in caller info.
 	pathParts int
@@ -45,6 +50,88 @@ type globals struct {
 
 	// Used when setting Display Name of a Span.
 	spanPrefix string
+
+	// The fraction of new traces whose spans get created and exported.
+	spanExport float64
+
+	// Where lines are counted (see Stats()).
+	stats *lineStats
+
+	// The key used for errors logged via lager.Err() or lager.FailIf().
+	errKey string
+
+	// Which characters get escaped in JSON strings.
+	escMode EscapeMode
+
+	// Whether to quote integers too large to fit in a float64.
+	quoteBigInts bool
+
+	// How to log time.Duration values.
+	durFormat DurationFormat
+
+	// How to order (and dedup) the pairs passed to Map(), MMap(), etc.
+	pairOrder PairOrder
+
+	// Whether to complain about invalid pairs passed to Map(), MMap(), etc.
+	strictPairs bool
+
+	// How each log line is delimited.
+	framing Framing
+
+	// The flight recorder of recent log lines (if enabled).
+	recorder *recorder
+
+	// Holds BuildInfo() pairs if WithBuildInfo() is in effect.
+	buildCtx Ctx
+
+	// What to do when logged keys collide with reserved keys.
+	collisions KeyCollisions
+
+	// Rules for re-leveling lines based on their message.
+	promotions []*promotion
+
+	// The JSON types that values for specific keys are logged as.
+	keyTypes map[string]KeyType
+
+	// Rewrites the keys of logged pairs (if set).
+	keyNorm func(string) string
+
+	// Keys that keyNorm must not change (see SetVerbatimKey()).
+	verbatimKeys map[string]bool
+
+	// The fraction of lines to check with encoding/json.
+	shadowRate float64
+
+	// Which levels are written to os.Stderr (when not using SetOutput()).
+	toStderr [int(nLevels)]bool
+
+	// Functions that can find the route template for a request.
+	routeFuncs []func(*http.Request) string
+
+	// Functions that can find who made a request.
+	userFuncs []*userFunc
+
+	// Whether Fail lines get a pair with the URL of their trace.
+	traceURLOnFail bool
+
+	// Size above which lines are split when in GCP (see SetGcpPayloadLimit).
+	gcpLimit int
+
+	// Turns data subject IDs into what gets logged (see Subject()).
+	pseudonymize func(string) string
+
+	// How Hashed() hashes values and how many hex digits are kept.
+	hashAlg HashAlgorithm
+	hashLen int
+
+	// Whether to truncate logged client IP addresses.
+	anonIPs bool
+
+	// Returns the current time (if not time.Now).
+	clock func() time.Time
+
+	// Whether to add a sequence number to each line.
+	seqNums bool
 }
 
 // 'Lager' is the interface returned from lager.Warn() and the other
@@ -71,12 +158,20 @@ type globals struct {
 // You can use a call to lager.Unless() as a key to make inclusion of that
 // key/value pair optional.
 //
+// You can use a call to lager.Err() in place of a key/value pair to log an
+// error using a consistent key.
+//
+// You can use a call to lager.KV() or lager.UnlessKV() in place of a
+// key/value pair so the key and value can't get separated.
+//
+// You can use a call to lager.Hashed() in place of a key/value pair to log
+// only a salted hash of a sensitive value.
+//
 // A value of type 'func() interface{}' will be called so its return value
 // can be logged; potentially saving an expensive call when the log level
 // is disabled or when lager.Unless() causes the key/value pair to be
-// ignored.  [Note:  If more than about 16KiB of that log line has been
-// generated before such a value is reached, then we only wait 10ms for
-// the function to finish as a lock is held in that case.]
+// ignored.  No lock is held while such a function runs, so it can even
+// log its own lines (which get written before the line that called it).
 //
 type Lager interface {
 
@@ -149,7 +244,11 @@ type Lager interface {
 	//
 	With(ctxs ...context.Context) Lager
 
-	// Enabled() returns 'false' only if this Lager will log nothing.
+	// Enabled() returns 'false' only if this Lager will log nothing.  It
+	// also returns 'false' for a Lager of a disabled level that only feeds
+	// the flight recorder [see SetFlightRecorder()] or whose lines might be
+	// re-leveled [see PromoteMatching()], so code guarded by Enabled() is
+	// skipped unless its lines would be written at their own level.
 	Enabled() bool
 
 	// WithStack() adds a "_stack" key/value pair to the logged context.  The
@@ -165,7 +264,12 @@ type Lager interface {
 	// A 'minDepth' of 0 starts at the line where WithStack() was called and
 	// 1 starts at the line of the caller of the caller of WithStack(), etc.
 	//
-	WithStack(minDepth, stackLen int) Lager
+	// You can also pass in StackOption values to skip frames from some
+	// packages [SkipPackages()], to limit the size of the stack trace
+	// [MaxStackBytes()], or to format a stack trace captured elsewhere
+	// [StackFromPCs() or StackFromFrames()].
+	//
+	WithStack(minDepth, stackLen int, opts ...StackOption) Lager
 
 	// WithCaller() adds "_file", "_line", and "_func" key/value pairs to the
 	// logged context.  A 'depth' of 0 means the line where WithCaller() was
@@ -174,6 +278,13 @@ type Lager interface {
 	//
 	WithCaller(depth int) Lager
 
+	// WithPathParts() returns a Lager that shortens source code file names
+	// (in caller information and stack traces) to the last 'pathParts'
+	// components, overriding SetPathParts() for just this Lager.  This
+	// applies to later calls to WithCaller(), WithStack(), CList(), etc.
+	//
+	WithPathParts(pathParts int) Lager
+
 	// The Println() method is provided for minimal compatibility with
 	// log.Logger, as this method is the one most used by other modules.
 	// It is just an alias for the List() method.
@@ -193,6 +304,9 @@ type Lager interface {
 // The keys to use when writing logs as a JSON map not a list.
 type keyStrs struct {
 	when, lev, msg, args, ctx, mod string
+
+	// Each key already quoted and followed by ':' (see quotedKey()):
+	qWhen, qLev, qMsg, qArgs, qCtx, qMod []byte
 }
 
 // A stub Lager that outputs nothing:
@@ -208,15 +322,132 @@ func (_ noop) CMap(_ ...interface{})              {}
 func (_ noop) MMap(_ string, _ ...interface{})    {}
 func (_ noop) CMMap(_ string, _ ...interface{})   {}
 func (n noop) With(_ ...Ctx) Lager                { return n }
-func (n noop) WithStack(_, _ int) Lager           { return n }
 func (n noop) WithCaller(_ int) Lager             { return n }
+func (n noop) WithPathParts(_ int) Lager          { return n }
 func (_ noop) Enabled() bool                      { return false }
 func (_ noop) Println(_ ...interface{})           {}
 
+func (n noop) WithStack(_, _ int, _ ...StackOption) Lager {
+	return n
+}
+
 func (_ noop) LogLogger(_ ...func(Lager, []byte) []byte) *log.Logger {
 	return log.New(io.Discard, "", 0)
 }
 
+// EscapeMode specifies which characters get escaped in JSON strings.  See
+// SetEscapeMode().
+type EscapeMode int8
+
+const (
+	// EscapeDefault escapes control characters (including U+007F through
+	// U+009F) and characters outside of the Basic Multilingual Plane (as
+	// UTF-16 surrogate pairs) while other non-ASCII characters are written
+	// as UTF-8.
+	EscapeDefault EscapeMode = iota
+
+	// EscapeASCII escapes every non-ASCII character so the output is pure
+	// ASCII.
+	EscapeASCII
+
+	// EscapeUTF8 only escapes what JSON requires to be escaped ('"', '\',
+	// and characters below U+0020) so all other characters are written
+	// as UTF-8.
+	EscapeUTF8
+
+	// EscapeHTML is like EscapeDefault but also escapes '<', '>', '&',
+	// U+2028, and U+2029 so the JSON can be safely embedded in HTML.
+	EscapeHTML
+
+	nEscapeModes
+)
+
+// DurationFormat specifies how time.Duration values are logged.  See
+// SetDurationFormat().
+type DurationFormat int8
+
+const (
+	// DurationString logs a time.Duration as a string like "1m2.5s".
+	DurationString DurationFormat = iota
+
+	// DurationSeconds logs a time.Duration as a number of seconds.
+	DurationSeconds
+
+	// DurationMillis logs a time.Duration as a number of milliseconds.
+	DurationMillis
+
+	// DurationNanos logs a time.Duration as an integer number of
+	// nanoseconds (which is quoted if SetQuoteBigInts(true) is in effect
+	// and the duration is more than about 104 days).
+	DurationNanos
+)
+
+// PairOrder specifies how the key/value pairs passed to Map(), MMap(),
+// lager.Map(), etc. are ordered.  See SetPairOrder().
+type PairOrder int8
+
+const (
+	// PairsAsGiven writes pairs in the order given, including any pairs
+	// with duplicate keys.
+	PairsAsGiven PairOrder = iota
+
+	// PairsDedup writes pairs in the order given except that, for a
+	// duplicated key, only the last value is written but in the position
+	// of the first use of the key (like lager.Pairs() does).
+	PairsDedup
+
+	// PairsSorted is like PairsDedup but the pairs are sorted by key.
+	PairsSorted
+)
+
+// Framing specifies how each log line is delimited in the output stream.
+// See SetFraming().
+type Framing int8
+
+const (
+	// FramingNewline writes each log line as a JSON text followed by a
+	// newline (often called "NDJSON" or "JSON Lines").
+	FramingNewline Framing = iota
+
+	// FramingLength writes each log line prefixed by its length in bytes
+	// (in decimal) and a space, like the "octet counting" of RFC 6587.  The
+	// length includes the newline that still follows each JSON text.
+	FramingLength
+
+	// FramingJSONSeq writes each log line as an RFC 7464 JSON text sequence
+	// element: an ASCII Record Separator (0x1E), the JSON text, a newline.
+	FramingJSONSeq
+
+	nFramings
+)
+
+// KeyType specifies the JSON type that values for a specific key are
+// always logged as.  See SetKeyType().
+type KeyType int8
+
+const (
+	// KeyAsIs logs values for the key as whatever type they are.
+	KeyAsIs KeyType = iota
+
+	// KeyNumber logs values for the key as JSON numbers.  Strings are parsed
+	// as numbers, 'true' and 'false' become 1 and 0, and a time.Duration is
+	// logged as a number of seconds (unless SetDurationFormat() selected a
+	// different numeric format).  Other values are logged as 'null'.
+	KeyNumber
+
+	// KeyString logs values for the key as JSON strings.  A time.Duration
+	// is logged like "1m2.5s" and other non-string values are logged as
+	// a string containing their JSON encoding.
+	KeyString
+
+	// KeyBool logs values for the key as 'true' or 'false'.  Strings are
+	// parsed via strconv.ParseBool() and numbers are 'true' if not zero.
+	// Other values are logged as 'null'.
+	KeyBool
+
+	nKeyTypes
+)
+
 // The type for internal log levels.
 type level int8
 
@@ -235,12 +466,61 @@ const (
 	nLevels
 )
 
+// LogLevel is one letter from "PEFWNAITDOG" that identifies a log level (by
+// the first letter of its name).  It is accepted by AtLevel(),
+// Module.AtLevel(), and PromoteLevel(), the LogLevel versions of Level(),
+// Module.Level(), and PromoteMatching().  Using the constants below (like
+// lager.INFO) rather than letters (like 'I') makes typos compile-time
+// errors.  Since its underlying type is 'byte', a character constant like
+// 'I' can still be passed wherever a LogLevel is expected and a LogLevel
+// can be passed to Level() as byte(lev).
+//
+type LogLevel byte
+
+const (
+	PANIC LogLevel = 'P'
+	EXIT  LogLevel = 'E'
+	FAIL  LogLevel = 'F'
+	WARN  LogLevel = 'W'
+	NOTE  LogLevel = 'N'
+	ACC   LogLevel = 'A'
+	INFO  LogLevel = 'I'
+	TRACE LogLevel = 'T'
+	DEBUG LogLevel = 'D'
+	OBJ   LogLevel = 'O'
+	GUTS  LogLevel = 'G'
+)
+
+// String() returns the name of the log level as it is logged (before any
+// SetLevelNotation() mapping), like "INFO" or "ACCESS", or something like
+// "LogLevel('x')" for an invalid LogLevel.
+//
+func (lev LogLevel) String() string {
+	i := strings.IndexByte("PEFWNAITDOG", byte(unicode.ToUpper(rune(lev))))
+	if i < 0 {
+		return fmt.Sprintf("LogLevel(%q)", rune(lev))
+	}
+	return levNames[level(i)]
+}
+
 // The 'logger' type is the Lager that actually logs.
 type logger struct {
 	lev level    // Log level.
 	kvp AMap     // Extra key/value pairs to append to each log line.
 	mod string   // The module name where the log level is en/disabled.
 	g   *globals // Global configuration at time logger was allocated.
+	// Whether to only record lines (because level is disabled):
+	quiet bool
+	// Whether pathParts overrides g.pathParts (see WithPathParts()):
+	ownParts  bool
+	pathParts int
+	// The log budget of the request being logged about (if any):
+	bud *budget
+	// Whether an Exit line should not exit (see CaptureCrashOutput()):
+	noExit bool
+	// Whether PromoteMatching() rules and budgets are ignored (see
+	// Unfiltered()):
+	unfiltered bool
 }
 
 // fakePanic is just used to reliably identify a panic due to lager.Exit().
@@ -261,6 +541,9 @@ var _globalsMutex sync.Mutex
 // The special value passed to panic() [see ExitViaPanic()].
 var _panicToExit = fakePanic("panic() from lager.Exit()")
 
+// The exit status for RecoverPanicToExit() to use (see ExitCode()).
+var _exitStatus int32 = 1
+
 // How many 'defer lager.ExitViaPanic()()' calls are waiting.
 var _exiters int32 = 0
 
@@ -314,8 +597,14 @@ func getGlobals() *globals {
 func updateGlobals(updater func(*globals)) {
 	_firstInit.Do(firstInit)
 	defer AutoLock(&_globalsMutex)()
-	curr := getGlobals()
-	copy := *curr
+	_globals.Store(getGlobals().updated(updater))
+}
+
+// updated() returns an updated copy of the globals (which are never
+// modified once they are in use).
+//
+func (g *globals) updated(updater func(*globals)) *globals {
+	copy := *g
 	// Copy all loggers so we can change the g pointer only in the new copies:
 	for i, l := range copy.lagers {
 		if pLog, ok := l.(*logger); ok {
@@ -324,13 +613,38 @@ func updateGlobals(updater func(*globals)) {
 		}
 	}
 	updater(&copy)
-	// Update the g pointer in all loggers (after update) to the new globals:
-	for _, l := range copy.lagers {
+	copy.adopt()
+	return &copy
+}
+
+// adopt() updates the g pointer in all loggers to point to 'g'.
+func (g *globals) adopt() {
+	for _, l := range g.lagers {
 		if pLog, ok := l.(*logger); ok {
-			pLog.g = &copy
+			pLog.g = g
 		}
 	}
-	_globals.Store(&copy)
+}
+
+// newGlobals() returns the default configuration, ignoring the environment.
+func newGlobals(levels string) *globals {
+	g := &globals{
+		pathParts:  3,
+		levDesc:    identLevelNotation,
+		errKey:     "err",
+		spanExport: 1.0,
+		stats:      &_stats,
+	}
+	g.lagers[int(lPanic)] = &logger{lev: lPanic}
+	g.lagers[int(lExit)] = &logger{lev: lExit}
+	setLevels(levels)(g)
+
+	parts := strings.Split(os.Args[0], "/")
+	parts = strings.Split(parts[len(parts)-1], "\\")
+	g.spanPrefix = parts[len(parts)-1]
+
+	g.adopt()
+	return g
 }
 
 // firstInit() is called the first time logging is attempted or configuration
@@ -339,30 +653,30 @@ func updateGlobals(updater func(*globals)) {
 // code.
 //
 func firstInit() {
-	g := globals{
-		pathParts: 3,
-		levDesc:   identLevelNotation,
+	levels := envLevels(os.Getenv("LAGER_LEVELS"))
+	if min, ok := minLevel(os.Getenv("LAGER_MIN_LEVEL")); ok {
+		levels = min
 	}
-	g.lagers[int(lPanic)] = &logger{lev: lPanic}
-	g.lagers[int(lExit)] = &logger{lev: lExit}
-	setLevels(os.Getenv("LAGER_LEVELS"))(&g)
+	g := newGlobals(levels)
 
-	g.spanPrefix = os.Getenv("LAGER_SPAN_PREFIX")
-	if "" == g.spanPrefix {
-		parts := strings.Split(os.Args[0], "/")
-		parts = strings.Split(parts[len(parts)-1], "\\")
-		g.spanPrefix = parts[len(parts)-1]
+	if rate, ok := parseSpanExport(os.Getenv("LAGER_SPAN_EXPORT")); ok {
+		g.spanExport = rate
 	}
 
-	// Update the g pointer in all loggers to the new globals:
-	for _, l := range g.lagers {
-		if pLog, ok := l.(*logger); ok {
-			pLog.g = &g
-		}
+	if levs := os.Getenv("LAGER_STDERR_LEVELS"); "" != levs {
+		setStderrLevels(envLevels(levs))(g)
+	}
+
+	if path := os.Getenv("LAGER_STDOUT_FALLBACK"); "" != path {
+		SetStdoutFallback(path)
+	}
+
+	if prefix := os.Getenv("LAGER_SPAN_PREFIX"); "" != prefix {
+		g.spanPrefix = prefix
 	}
 
 	if "" != os.Getenv("LAGER_GCP") {
-		setRunningInGcp(true)(&g)
+		setRunningInGcp(true)(g)
 	}
 
 	if k := os.Getenv("LAGER_KEYS"); "" != k {
@@ -379,10 +693,10 @@ func firstInit() {
 		setKeys(&keyStrs{
 			when: keys[0], lev: keys[1], msg: keys[2],
 			args: keys[3], ctx: keys[4], mod: keys[5],
-		})(&g)
+		})(g)
 	}
 
-	_globals.Store(&g)
+	_globals.Store(g)
 }
 
 // Init() en-/disables log levels.  Pass in a string of letters from
@@ -397,7 +711,15 @@ func firstInit() {
 // Rather than calling Init(), you may prefer to set enabled levels via the
 // LAGER_LEVELS environment variable since that initialization is guaranteed
 // to happen before any logging takes place, even if logging ends up being
-// done in code called from initialization code.
+// done in code called from initialization code.  LAGER_LEVELS can also be
+// a list of level names like "error,warn,info" (see ParseLevels()).  Names
+// of levels that are always enabled, like "CRITICAL" or "panic", enable
+// none of the optional levels.
+//
+// Or you can set LAGER_MIN_LEVEL to the name (or letter) of the least
+// severe level to enable, like "Info" or "D" (see LevelsFrom()).  If it is
+// set to a valid value, then LAGER_LEVELS is ignored.  An invalid value is
+// ignored (since logging may not be possible yet to complain about it).
 //
 func Init(levels string) {
 	updateGlobals(setLevels(levels))
@@ -445,11 +767,130 @@ func setLevels(levels string) func(*globals) {
 	}
 }
 
+// Level names (in lower case) accepted by ParseLevels(), including names
+// used by other loggers (such as log/slog and zap).  Names that map to ""
+// are for levels that are always enabled.
+var levelNames = map[string]string{
+	"panic": "", "dpanic": "", "fatal": "", "exit": "", "critical": "",
+	"crit": "", "alert": "", "emergency": "",
+	"fail": "F", "error": "F", "err": "F",
+	"warn": "W", "warning": "W",
+	"note": "N", "notice": "N",
+	"acc": "A", "access": "A",
+	"info": "I", "trace": "T", "debug": "D",
+	"obj": "O", "object": "O", "guts": "G",
+}
+
+// ParseLevels() takes a list of log level names separated by commas and/or
+// spaces and returns the string of letters to pass to Init() to enable
+// those levels.  Names are not case sensitive.  Besides Lager's own level
+// names (Fail, Warn, Note, Acc, Info, Trace, Debug, Obj, and Guts), it
+// accepts names used by other loggers (like log/slog and zap): "error"
+// and "err" (Fail), "warning" (Warn), "notice" (Note), "access" (Acc),
+// and "object" (Obj).  Names of levels that are always enabled (like
+// "panic", "fatal", and "critical") are accepted but add no letters.
+//
+//      levels, err := lager.ParseLevels("info,warn,error") // "IWF"
+//
+// An error is returned (along with the letters for the valid names) if any
+// names are not recognized.
+//
+func ParseLevels(names string) (string, error) {
+	letters := ""
+	var bad []string
+	for _, name := range strings.FieldsFunc(names, func(r rune) bool {
+		return ',' == r || unicode.IsSpace(r)
+	}) {
+		letter, ok := levelNames[strings.ToLower(name)]
+		if !ok {
+			bad = append(bad, name)
+		} else if !strings.Contains(letters, letter) {
+			letters += letter
+		}
+	}
+	if nil != bad {
+		return letters, fmt.Errorf(
+			"Unknown log level name(s) (%s)", strings.Join(bad, ", "))
+	}
+	return letters, nil
+}
+
+// LevelsFrom() returns the letters to pass to Init() to enable 'min' and
+// all of the more severe log levels, for those who think of log levels as
+// a threshold.  The optional levels, from most to least severe, are Fail,
+// Warn, Note, Acc, Info, Trace, Debug, Obj, and Guts.  So:
+//
+//      lager.Init(lager.LevelsFrom(lager.DEBUG)) // Same as Init("FWNAITD")
+//
+// Passing in PANIC or EXIT returns "-" (which disables all optional log
+// levels).  Passing in any other invalid LogLevel calls panic().
+//
+func LevelsFrom(min LogLevel) string {
+	const order = "FWNAITDOG"
+	switch unicode.ToUpper(rune(min)) {
+	case 'P', 'E':
+		return "-"
+	}
+	i := strings.IndexByte(order, byte(unicode.ToUpper(rune(min))))
+	if i < 0 {
+		panic(fmt.Sprintf(
+			"LevelsFrom() needs one char from \"PEFWNAITDOG\" not %q",
+			rune(min)))
+	}
+	return order[:i+1]
+}
+
+// Returns the levels to pass to Init() for the value of LAGER_MIN_LEVEL
+// (a level name or letter) and whether it was valid.
+func minLevel(min string) (string, bool) {
+	min = strings.TrimSpace(min)
+	if 1 == len(min) &&
+		strings.Contains("PEFWNAITDOG", strings.ToUpper(min)) {
+		return LevelsFrom(LogLevel(min[0])), true
+	}
+	letter, ok := levelNames[strings.ToLower(min)]
+	if !ok {
+		return "", false
+	} else if "" == letter {
+		return "-", true
+	}
+	return LevelsFrom(LogLevel(letter[0])), true
+}
+
+// Returns the levels to pass to Init() for the value of an environment
+// variable like LAGER_LEVELS, which can hold level letters or level names.
+// Each word that is a level name is replaced by its letter (so "INFO" means
+// Info, not Info, Note, Fail, and Obj, and "CRITICAL" adds no letters).
+// Other words are left as letters for Init().  Returns "-" if the value is
+// not empty but only names levels that are always enabled.
+func envLevels(levels string) string {
+	letters := ""
+	for _, word := range strings.FieldsFunc(levels, func(r rune) bool {
+		return ',' == r || unicode.IsSpace(r)
+	}) {
+		if letter, ok := levelNames[strings.ToLower(word)]; ok {
+			letters += letter
+		} else {
+			letters += word
+		}
+	}
+	if "" == letters && "" != strings.TrimSpace(levels) {
+		return "-"
+	}
+	return letters
+}
+
 // SetOutput() causes all future log lines to be written to the passed-in
 // io.Writer.  If 'nil' is passed in, then log lines return to being written
 // to os.Stdout (for most log levels) and to os.Stderr (for Panic and Exit
 // levels).
 //
+// Each log line is written via a single Write() call.  Each destination has
+// its own lock so lines written to it are never interleaved (so the writer
+// need not be safe to use from multiple goroutines) and logging to one
+// writer never waits for lines being written to a different writer.  The
+// writer can even log to itself (the lines get queued).
+//
 // You can temporarily redirect logs via:
 //
 //      defer lager.SetOutput(writer)()
@@ -457,17 +898,49 @@ func setLevels(levels string) func(*globals) {
 //
 func SetOutput(writer io.Writer) func() {
 	var prior io.Writer
+	var priorOut *outLock
+	out := new(outLock)
+	if nil == writer {
+		out = nil
+	}
 	updateGlobals(func(g *globals) {
-		prior = g.dest
-		g.dest = writer
+		prior, priorOut = g.dest, g.destOut
+		g.dest, g.destOut = writer, out
 	})
 	return func() {
 		updateGlobals(func(g *globals) {
-			g.dest = prior
+			g.dest, g.destOut = prior, priorOut
 		})
 	}
 }
 
+// SetStderrLevels() sets which optional log levels are written to
+// os.Stderr rather than os.Stdout, for runtimes (like some in GCP) that
+// treat the two streams differently.  Pass in a string of letters from
+// "FWNAITDOG", as with Init().  Panic and Exit lines always go to
+// os.Stderr.  The default is "" (all other levels go to os.Stdout).  It can
+// also be set via the LAGER_STDERR_LEVELS environment variable (which can
+// also hold level names, like "error,warn").
+//
+//      lager.SetStderrLevels(lager.LevelsFrom(lager.WARN)) // "FW"
+//
+// This has no effect while SetOutput() is in effect.
+//
+func SetStderrLevels(levels string) {
+	updateGlobals(setStderrLevels(levels))
+}
+
+func setStderrLevels(levels string) func(*globals) {
+	return func(g *globals) {
+		g.toStderr = [int(nLevels)]bool{}
+		for _, c := range levels {
+			if strings.ContainsRune("FWNAITDOG", c) {
+				g.toStderr[int(levelOf(LogLevel(c), "SetStderrLevels"))] = true
+			}
+		}
+	}
+}
+
 // SetPathParts() sets how many path components to include in the source
 // code file names when recording caller information or a stack trace.
 // Passing in 1 will cause only the source code file name to be included.
@@ -475,7 +948,8 @@ func SetOutput(writer io.Writer) func() {
 // A 3 adds the directory above that, etc.  A value of 0 (or -1) will include
 // the full path.
 //
-// If you have not called SetPathParts(), it defaults to 3.
+// If you have not called SetPathParts(), it defaults to 3.  See also
+// Lager's WithPathParts() method.
 //
 func SetPathParts(pathParts int) {
 	updateGlobals(func(g *globals) {
@@ -483,6 +957,222 @@ func SetPathParts(pathParts int) {
 	})
 }
 
+// GetPathParts() returns the number of path components included in source
+// code file names (see SetPathParts()).
+//
+func GetPathParts() int {
+	return getGlobals().pathParts
+}
+
+// SetEscapeMode() sets which characters are escaped in JSON strings, since
+// different log ingestion systems have different preferences.  The default
+// is EscapeDefault.  Passing in an invalid EscapeMode calls panic().
+//
+// Non-UTF-8 byte sequences are always logged like "«xABC0»" [see Lager]
+// regardless of the EscapeMode.
+//
+func SetEscapeMode(mode EscapeMode) {
+	if mode < 0 || nEscapeModes <= mode {
+		panic(fmt.Sprintf("Invalid lager.EscapeMode (%d)", mode))
+	}
+	updateGlobals(func(g *globals) {
+		g.escMode = mode
+	})
+}
+
+// SetQuoteBigInts(true) causes integer values whose magnitude is larger
+// than 2^53 to be logged as quoted strings.  Such values can't be exactly
+// represented as a float64 so tools that parse JSON numbers that way (such
+// as JavaScript-based ones) would otherwise silently lose precision.
+//
+func SetQuoteBigInts(quote bool) {
+	updateGlobals(func(g *globals) {
+		g.quoteBigInts = quote
+	})
+}
+
+// SetDurationFormat() sets how time.Duration values are logged.  The
+// default is DurationString.
+//
+func SetDurationFormat(format DurationFormat) {
+	updateGlobals(func(g *globals) {
+		g.durFormat = format
+	})
+}
+
+// SetPairOrder() sets how key/value pairs passed to Map(), MMap(), and
+// similar methods (or to lager.Map()) are ordered.  Using PairsSorted is
+// useful for producing stable output for log-diffing tools or golden tests.
+// The default is PairsAsGiven, which is also the most efficient.  Pairs
+// from contexts are not affected.
+//
+func SetPairOrder(order PairOrder) {
+	updateGlobals(func(g *globals) {
+		g.pairOrder = order
+	})
+}
+
+// SetFraming() sets how each log line is delimited in the output stream,
+// so logs can be streamed into tools that require a specific framing.  The
+// default is FramingNewline.  Passing in an invalid Framing calls panic().
+//
+func SetFraming(framing Framing) {
+	if framing < 0 || nFramings <= framing {
+		panic(fmt.Sprintf("Invalid lager.Framing (%d)", framing))
+	}
+	updateGlobals(func(g *globals) {
+		g.framing = framing
+	})
+}
+
+// SetKeyType() makes values for 'key' always be logged as the specified
+// JSON type, so call sites that log the same key with different types of
+// values don't create mixed-type fields (which can break Elasticsearch
+// mappings, for example).  The rule applies wherever 'key' is used,
+// including in pairs from contexts and in nested maps.  SetKeyType(key,
+// KeyAsIs) removes the rule for 'key'.  Passing in an invalid KeyType calls
+// panic().
+//
+//      lager.SetKeyType("status", lager.KeyNumber)
+//      lager.SetKeyType("latency", lager.KeyString)
+//
+func SetKeyType(key string, kind KeyType) {
+	if kind < 0 || nKeyTypes <= kind {
+		panic(fmt.Sprintf("Invalid lager.KeyType (%d)", kind))
+	}
+	updateGlobals(func(g *globals) {
+		keyTypes := make(map[string]KeyType, len(g.keyTypes)+1)
+		for k, t := range g.keyTypes {
+			keyTypes[k] = t
+		}
+		if KeyAsIs == kind {
+			delete(keyTypes, key)
+		} else {
+			keyTypes[key] = kind
+		}
+		if 0 == len(keyTypes) {
+			keyTypes = nil
+		}
+		g.keyTypes = keyTypes
+	})
+}
+
+// SetKeyNormalizer() sets a function that is applied to every key of the
+// key/value pairs that are logged (including pairs from contexts and in
+// nested maps), so that the output follows a naming convention no matter
+// what keys were used at each call site.  Passing in 'nil' removes it.
+//
+//      lager.SetKeyNormalizer(func(key string) string {
+//          return strings.ToLower(strings.Replace(key, ".", "_", -1))
+//      })
+//
+// Keys with special meaning are not changed: the keys Lager uses for its
+// own parts of each log line [see Keys()], the key set via SetErrorKey(),
+// keys that have a SetKeyType() rule, keys added via SetVerbatimKey(),
+// "httpRequest", and keys starting with "logging.googleapis.com/" [like
+// GcpTraceKey] that GCP treats specially (nor are the keys nested inside
+// of their values).  Other rules from SetKeyType() are matched against the
+// normalized keys.  When pairs are deduplicated [see SetPairOrder()], it
+// is the keys before normalization that are compared.  The function is
+// called for each key of each line logged, so it should be fast.
+//
+func SetKeyNormalizer(normalize func(key string) string) {
+	updateGlobals(func(g *globals) {
+		g.keyNorm = normalize
+	})
+}
+
+// SetVerbatimKey(key, true) makes SetKeyNormalizer() leave 'key' and all
+// of the keys nested inside of its values unchanged.  It is for packages
+// that log structured values that must be read back exactly as they were
+// logged (like the audit package, whose event hashes cover the nested
+// keys).  SetVerbatimKey(key, false) removes 'key' from the set.
+//
+func SetVerbatimKey(key string, verbatim bool) {
+	updateGlobals(func(g *globals) {
+		keys := make(map[string]bool, len(g.verbatimKeys)+1)
+		for k := range g.verbatimKeys {
+			keys[k] = true
+		}
+		if verbatim {
+			keys[key] = true
+		} else {
+			delete(keys, key)
+		}
+		if 0 == len(keys) {
+			keys = nil
+		}
+		g.verbatimKeys = keys
+	})
+}
+
+// StrictPairs(true) enables checking of the key/value pairs passed to the
+// [C][M]Map() methods so that call-site mistakes are caught early (usually
+// only done in development).  It complains if an odd number of items are
+// passed, if a key is not a string (lager.Unless() and similar special keys
+// are allowed), or if a key is one of the key names set via lager.Keys().
+//
+// Inside of a test binary (when the "test.v" flag is defined), such a
+// problem causes a panic().  Otherwise, a Warn log line is written that
+// describes the problem and includes the caller's file and line number.
+//
+func StrictPairs(strict bool) {
+	updateGlobals(func(g *globals) {
+		g.strictPairs = strict
+	})
+}
+
+// checkPairs() implements the checking enabled by StrictPairs(true).
+func (l *logger) checkPairs(method string, pairs []interface{}) {
+	if !l.g.strictPairs {
+		return
+	}
+	problem := ""
+	for i := 0; i < len(pairs) && "" == problem; i++ {
+		switch k := pairs[i].(type) {
+		case skipThisPair, inlinePairs:
+			i++
+		case errPair, exitCodePair:
+		case onePair:
+			if key, _, ok := k.onePair(); ok && l.g.keys.reserved(key) {
+				problem = fmt.Sprintf("reserved key %q", key)
+			}
+		case string:
+			if l.g.keys.reserved(k) {
+				problem = fmt.Sprintf("reserved key %q", k)
+			} else if len(pairs) <= i+1 {
+				problem = fmt.Sprintf("odd number of items (%d)", len(pairs))
+			}
+			i++
+		default:
+			problem = fmt.Sprintf("non-string key (%T)", k)
+			i++
+		}
+	}
+	if "" == problem {
+		return
+	}
+	if nil != flag.Lookup("test.v") {
+		panic(fmt.Sprintf("Invalid pairs passed to %s(): %s", method, problem))
+	}
+	Warn().WithCaller(2).MMap("Invalid pairs passed to Lager method",
+		"method", method, "problem", problem)
+}
+
+// reserved() returns 'true' if 'key' is one of the configured key names.
+func (k *keyStrs) reserved(key string) bool {
+	if nil == k {
+		return false
+	}
+	switch key {
+	case k.when, k.lev, k.args, k.mod:
+		return true
+	case k.msg, k.ctx:
+		return "" != key
+	}
+	return false
+}
+
 // SetLevelNotation() installs a function to map from Lager's level names
 // (like "DEBUG") to other values to indicate log levels.  An example of
 // such a function is GcpLevelName().  If you write such a function, you
@@ -538,14 +1228,15 @@ func ExitViaPanic() func(...func(*int)) {
 // if lager.Exit() has invoked panic() because of ExitViaPanic().
 //
 // If you pass in one or more 'func(*int)' arguments, then they will each be
-// called and passed a pointer to the exit status (initially 1) so that they
-// can change it or just note the impending Exit.  If the final value is
-// negative, then os.Exit() will not be called (useful when testing).
+// called and passed a pointer to the exit status (initially 1, unless set
+// via ExitCode()) so that they can change it or just note the impending
+// Exit.  If the final value is negative, then os.Exit() will not be called
+// (useful when testing).
 //
 func RecoverPanicToExit(handlers ...func(*int)) {
 	atomic.AddInt32(&_exiters, -1)
 	if p := recover(); p == _panicToExit {
-		exit := 1
+		exit := int(atomic.LoadInt32(&_exitStatus))
 		for _, h := range handlers {
 			h(&exit)
 		}
@@ -580,9 +1271,13 @@ func ExitNotExpected(unexpected bool) {
 
 // Gets a Lager based on the internal enum for a log level.
 func forLevel(lev level, cs ...Ctx) Lager {
-	g := getGlobals()
-	l := g.lagers[int(lev)].With(cs...)
-	return l
+	return getGlobals().forLevel(lev, cs...)
+}
+
+// Gets a Lager from this configuration for the internal log level enum.
+func (g *globals) forLevel(lev level, cs ...Ctx) Lager {
+	l := g.withBuild(g.observing(g.lagers[int(lev)], lev, ""), lev).With(cs...)
+	return g.counting(l, lev, "")
 }
 
 // Panic() returns a Lager object that calls panic(), incorporating pairs
@@ -698,32 +1393,72 @@ func Guts(cs ...Ctx) Lager { return forLevel(lGuts, cs...) }
 // Passing in any other character calls panic().
 //
 func Level(lev byte, cs ...Ctx) Lager {
+	return forLevel(levelOf(LogLevel(lev), "Level"), cs...)
+}
+
+// AtLevel() is the same as Level() but takes a LogLevel, like lager.WARN,
+// so a typo in the level is a compile-time error.
+//
+func AtLevel(lev LogLevel, cs ...Ctx) Lager {
+	return forLevel(levelOf(lev, "AtLevel"), cs...)
+}
+
+// Converts a LogLevel to the internal enum, panicking if it is invalid.
+func levelOf(lev LogLevel, caller string) level {
 	switch lev {
 	case 'P', 'p':
-		return forLevel(lPanic, cs...)
+		return lPanic
 	case 'E', 'e':
-		return forLevel(lExit, cs...)
+		return lExit
 	case 'F', 'f':
-		return forLevel(lFail, cs...)
+		return lFail
 	case 'W', 'w':
-		return forLevel(lWarn, cs...)
+		return lWarn
 	case 'N', 'n':
-		return forLevel(lNote, cs...)
+		return lNote
 	case 'A', 'a':
-		return forLevel(lAcc, cs...)
+		return lAcc
 	case 'I', 'i':
-		return forLevel(lInfo, cs...)
+		return lInfo
 	case 'T', 't':
-		return forLevel(lTrace, cs...)
+		return lTrace
 	case 'D', 'd':
-		return forLevel(lDebug, cs...)
+		return lDebug
 	case 'O', 'o':
-		return forLevel(lObj, cs...)
+		return lObj
 	case 'G', 'g':
-		return forLevel(lGuts, cs...)
+		return lGuts
 	}
 	panic(fmt.Sprintf(
-		"Level() must be one char from \"PEFWNAITDOG\" not %q", lev))
+		"%s() must be one char from \"PEFWNAITDOG\" not %q", caller, rune(lev)))
+}
+
+// FailIf() reduces the boilerplate around the ubiquitous 'if nil != err'
+// logging pattern.  If 'err' is not 'nil', then it returns the same Lager
+// as Fail(cs...) but with an added key/value pair as if lager.Err(err) had
+// been included (so using the key set via SetErrorKey(), "err" by default).
+// If 'err' is 'nil', then it returns the same Lager as Debug(cs...).
+//
+//      lager.FailIf(err, ctx).MMap("Saved config", "path", path)
+//
+func FailIf(err error, cs ...Ctx) Lager {
+	if nil == err {
+		return forLevel(lDebug, cs...)
+	}
+	return withPairs(
+		forLevel(lFail, cs...), getGlobals().errKey, errDetails(err))
+}
+
+// withPairs() returns a Lager that adds the passed-in key/value pairs to
+// each log line, unless 'l' is a no-op Lager.
+func withPairs(l Lager, pairs ...interface{}) Lager {
+	pLog, ok := l.(*logger)
+	if !ok {
+		return l
+	}
+	cp := *pLog
+	cp.kvp = cp.kvp.AddPairs(pairs...)
+	return &cp
 }
 
 func (l level) String() string {
@@ -736,6 +1471,14 @@ func (l level) String() string {
 
 // How globals.keys is updated safely.
 func setKeys(keys *keyStrs) func(*globals) {
+	if nil != keys {
+		keys.qWhen = quotedKey(keys.when)
+		keys.qLev = quotedKey(keys.lev)
+		keys.qMsg = quotedKey(keys.msg)
+		keys.qArgs = quotedKey(keys.args)
+		keys.qCtx = quotedKey(keys.ctx)
+		keys.qMod = quotedKey(keys.mod)
+	}
 	return func(g *globals) {
 		g.keys = keys
 	}
@@ -779,6 +1522,19 @@ func Keys(when, lev, msg, args, ctx, mod string) {
 	}))
 }
 
+// SetErrorKey() sets the key used when logging an error via lager.Err()
+// or lager.FailIf().  The default is "err".  Passing in "" restores the
+// default.
+//
+func SetErrorKey(key string) {
+	if "" == key {
+		key = "err"
+	}
+	updateGlobals(func(g *globals) {
+		g.errKey = key
+	})
+}
+
 // GetSpanPrefix() returns a string to be used as the prefix for the Display
 // Name of trace spans.  It defaults to os.Getenv("LAGER_SPAN_PREFIX") or,
 // if that is not set, to the basename of 'os.Args[0]'.
@@ -795,20 +1551,59 @@ func SetSpanPrefix(prefix string) {
 	})
 }
 
+// GetSpanExport() returns the fraction (from 0.0 to 1.0) of new traces for
+// which GcpContextReceivedRequest() and GcpContextSendingRequest() create
+// (and so export) spans.  It defaults to 1.0 or to the value of the
+// LAGER_SPAN_EXPORT environment variable, which can be a number like "0.1"
+// or one of "on", "true", "yes", "off", "false", or "no".
+//
+// Requests that arrive with trace information in their headers are part
+// of a trace that was already sampled by the caller, so new spans are
+// created for them unless the rate is 0.  When spans are not created, the
+// trace and span IDs from the headers are still logged [so log lines are
+// still correlated] and still passed along to dependent services.  For a
+// request without trace headers, new trace and span IDs are generated and
+// used the same way; only exporting the span is skipped.
+//
+func GetSpanExport() float64 {
+	return getGlobals().spanExport
+}
+
+// SetSpanExport() sets the fraction of new traces whose spans are created
+// and exported [see GetSpanExport()].  'rate' is limited to the range
+// 0.0 to 1.0.
+//
+func SetSpanExport(rate float64) {
+	if rate < 0.0 {
+		rate = 0.0
+	} else if 1.0 < rate {
+		rate = 1.0
+	}
+	updateGlobals(func(g *globals) {
+		g.spanExport = rate
+	})
+}
+
 // See the Lager interface for documentation.
-func (l *logger) Enabled() bool { return true }
+func (l *logger) Enabled() bool { return !l.quiet }
 
 // See the Lager interface for documentation.
 func (l *logger) With(ctxs ...Ctx) Lager {
-	kvp := l.kvp
+	kvp, bud := l.kvp, l.bud
 	for _, ctx := range ctxs {
 		kvp = kvp.Merge(ContextPairs(ctx))
+		if b := ctxBudget(ctx); nil != b && !l.unfiltered {
+			bud = b
+		}
+	}
+	if lFail == l.lev && kvp != l.kvp && nil != l.g && l.g.traceURLOnFail {
+		kvp = addTraceURL(kvp)
 	}
-	if kvp == l.kvp {
+	if kvp == l.kvp && bud == l.bud {
 		return l
 	}
 	cp := *l
-	cp.kvp = kvp
+	cp.kvp, cp.bud = kvp, bud
 	return &cp
 }
 
@@ -816,28 +1611,27 @@ func (l *logger) With(ctxs ...Ctx) Lager {
 func (l *logger) start() *buffer {
 	b := bufPool.Get().(*buffer)
 	b.g = l.g
-	switch l.lev {
-	case lPanic, lExit:
-		b.w = os.Stderr
-	default:
-		b.w = os.Stdout
+	if lPanic == l.lev || lExit == l.lev || l.g.toStderr[int(l.lev)] {
+		b.w, b.out = os.Stderr, &stderrLock
+	} else {
+		b.w, b.out = os.Stdout, &stdoutLock
 	}
 	if nil != b.g.dest {
-		b.w = b.g.dest
+		b.w, b.out = b.g.dest, b.g.destOut
 	}
+	b.frame()
+	b.guard = nil != l.g.keys && CollisionsAllowed != l.g.collisions
 
 	if nil == l.g.keys {
 		b.open("[") // ]
 	} else {
 		b.open("{") // }
-		b.quote(l.g.keys.when)
-		b.colon()
+		b.key(l.g.keys.when, l.g.keys.qWhen)
 	}
 	b.timestamp()
 
 	if nil != l.g.keys {
-		b.quote(l.g.keys.lev)
-		b.colon()
+		b.key(l.g.keys.lev, l.g.keys.qLev)
 	}
 	b.scalar(b.g.levDesc(l.lev.String()))
 
@@ -846,7 +1640,7 @@ func (l *logger) start() *buffer {
 
 // Closing steps when actually logging a line.
 func (l *logger) end(b *buffer) {
-	if lExit == l.lev && 0 != atomic.LoadInt32(&_stackWithExit) {
+	if lExit == l.lev && !l.noExit && 0 != atomic.LoadInt32(&_stackWithExit) {
 		// 0: skip end(), 1: skip MMap() etc, 2: get caller of MMap() etc:
 		l = l.WithStack(2, 0).(*logger)
 	}
@@ -856,17 +1650,22 @@ func (l *logger) end(b *buffer) {
 		} else if "" == l.g.keys.ctx {
 			b.pairs(l.kvp)
 		} else {
-			b.pair(l.g.keys.ctx, l.kvp)
+			b.key(l.g.keys.ctx, l.g.keys.qCtx)
+			b.scalar(l.kvp)
 		}
 	}
 
 	if "" != l.mod {
 		if nil == l.g.keys {
-			b.quote("mod=" + l.mod)
+			b.quote("mod=", l.mod)
 		} else {
-			b.pair(l.g.keys.mod, l.mod)
+			b.key(l.g.keys.mod, l.g.keys.qMod)
+			b.quoteCached(l.mod)
 		}
 	}
+	if l.g.seqNums {
+		b.seq()
+	}
 
 	if nil == l.g.keys { // [
 		b.close("]\n")
@@ -875,14 +1674,65 @@ func (l *logger) end(b *buffer) {
 	}
 
 	b.delim = ""
-	b.unlock()
+	more := b.overflow()
+	line := b.line()
+	if rec := l.g.recorder; nil != rec {
+		if lExit == l.lev && !l.noExit || lPanic == l.lev {
+			if recent := rec.recent(); 0 < len(recent) {
+				b.out.write(b.w, recent)
+			}
+		}
+		rec.add(line)
+		for _, m := range more {
+			rec.add(m)
+		}
+	}
+	quiet, overBudget := l.quiet, false
+	if nil != l.bud && !quiet {
+		quiet, overBudget = l.bud.charge(l.lev, len(line))
+	}
+	if !quiet {
+		b.out.write(b.w, line)
+		for _, m := range more {
+			b.out.write(b.w, m)
+		}
+	}
+	var badLine []byte
+	var badErr error
+	if !quiet && l.g.shadowSampled() {
+		if badErr = shadowCheck(l.g.framing, line); nil != badErr {
+			badLine = append(badLine, line...)
+		}
+	}
+	l.g.stats.countLine(l.mod, l.lev, !quiet)
+	if 0 < len(b.renamed) {
+		b.warnCollisions()
+	}
+	exit := 1
+	if nil != b.exit {
+		exit = *b.exit
+	}
+	b.reset()
+	if lExit == l.lev || lPanic == l.lev {
+		b.out.sync(b.w)
+	}
 	bufPool.Put(b)
+	if nil != badErr {
+		l.g.shadowMismatch(badLine, badErr)
+	}
+	if overBudget {
+		l.overBudget()
+	}
 
 	switch l.lev {
 	case lExit:
+		if l.noExit {
+			return
+		}
 		if 0 == atomic.LoadInt32(&_exiters) {
-			os.Exit(1)
+			os.Exit(exit)
 		}
+		atomic.StoreInt32(&_exitStatus, int32(exit))
 		panic(_panicToExit)
 	case lPanic:
 		panic("lager.Panic() logged (see above)")
@@ -899,6 +1749,9 @@ func (l *logger) LogLogger(filters ...func(Lager, []byte) []byte) *log.Logger {
 
 // See the Lager interface for documentation.
 func (l *logger) List(args ...interface{}) {
+	if l = l.active(); nil == l {
+		return
+	}
 	b := l.start()
 	if nil == l.g.keys {
 		if 0 == len(args) {
@@ -909,18 +1762,23 @@ func (l *logger) List(args ...interface{}) {
 			b.scalar(args)
 		}
 	} else if 1 == len(args) && "" != l.g.keys.msg {
-		b.pair(l.g.keys.msg, args[0])
+		b.key(l.g.keys.msg, l.g.keys.qMsg)
+		b.scalar(args[0])
 		if l.g.inGcp && (nil == l.kvp || 0 == len(l.kvp.keys)) {
-			b.pair("json", 1) // Keep jsonPayload.message not textPayload
+			b.ownPair("json", 1) // Keep jsonPayload.message not textPayload
 		}
 	} else {
-		b.pair(l.g.keys.args, args)
+		b.key(l.g.keys.args, l.g.keys.qArgs)
+		b.scalar(args)
 	}
 	l.end(b)
 }
 
 // See the Lager interface for documentation.
 func (l *logger) MList(message string, args ...interface{}) {
+	if l = l.promote(message); nil == l {
+		return
+	}
 	b := l.start()
 	if nil == l.g.keys {
 		if 0 == len(args) {
@@ -929,29 +1787,37 @@ func (l *logger) MList(message string, args ...interface{}) {
 			b.msgList(message, args)
 		}
 	} else if "" != l.g.keys.msg {
-		b.pair(l.g.keys.msg, message)
+		b.key(l.g.keys.msg, l.g.keys.qMsg)
+		b.scalar(message)
 		if 0 < len(args) {
-			b.pair(l.g.keys.args, args)
+			b.key(l.g.keys.args, l.g.keys.qArgs)
+			b.scalar(args)
 		} else if l.g.inGcp && (nil == l.kvp || 0 == len(l.kvp.keys)) {
-			b.pair("json", 1) // Keep jsonPayload.message not textPayload
+			b.ownPair("json", 1) // Keep jsonPayload.message not textPayload
 		}
 	} else if 0 < len(args) {
-		b.quote(l.g.keys.args)
-		b.colon()
+		b.key(l.g.keys.args, l.g.keys.qArgs)
 		b.msgList(message, args)
 	} else {
 		// Put the single item in a list for sake of consistency:
-		b.pair(l.g.keys.args, List(message))
+		b.key(l.g.keys.args, l.g.keys.qArgs)
+		b.scalar(List(message))
 	}
 	l.end(b)
 }
 
 // See the Lager interface for documentation.
 func (l *logger) Map(pairs ...interface{}) {
+	if l = l.active(); nil == l {
+		return
+	}
+	l.checkPairs("Map", pairs)
 	b := l.start()
 	if nil == l.g.keys {
+		b.pairsAt = b.depth + 1
 		b.scalar(RawMap(pairs))
 	} else {
+		b.pairsAt = b.depth
 		b.rawPairs(RawMap(pairs))
 	}
 	l.end(b)
@@ -959,22 +1825,29 @@ func (l *logger) Map(pairs ...interface{}) {
 
 // See the Lager interface for documentation.
 func (l *logger) MMap(message string, pairs ...interface{}) {
+	if l = l.promote(message); nil == l {
+		return
+	}
+	l.checkPairs("MMap", pairs)
 	b := l.start()
 	if nil == l.g.keys {
 		b.scalar(message)
 		if 0 < len(pairs) {
+			b.pairsAt = b.depth + 1
 			b.scalar(RawMap(pairs))
 		}
 	} else {
-		key := l.g.keys.msg
-		if "" == key {
-			key = "msg"
+		if "" == l.g.keys.msg {
+			b.ownPair("msg", message)
+		} else {
+			b.key(l.g.keys.msg, l.g.keys.qMsg)
+			b.scalar(message)
 		}
-		b.pair(key, message)
+		b.pairsAt = b.depth
 		b.rawPairs(RawMap(pairs))
 		if l.g.inGcp && 0 == len(pairs) &&
 			(nil == l.kvp || 0 == len(l.kvp.keys)) {
-			b.pair("json", 1) // Keep jsonPayload.message not textPayload
+			b.ownPair("json", 1) // Keep jsonPayload.message not textPayload
 		}
 	}
 	l.end(b)
@@ -1,19 +1,41 @@
+// Let http.ServeMux use Go 1.22 patterns (see TestRouteTemplate) even
+// though go.mod predates them:
+//go:debug httpmuxgo121=0
+
 package lager_test
 
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"os/exec"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/TyeMcQueen/go-lager"
+	"github.com/TyeMcQueen/go-lager/buffer"
+	"github.com/TyeMcQueen/go-lager/gcp-spans"
 	"github.com/TyeMcQueen/go-tutl"
 )
 
@@ -154,7 +176,7 @@ func TestLager(t *testing.T) {
 	u.Is(true, lager.SetModuleLevels(`mod"test"`, "FW"), "set mod lev")
 	if validJson("mod 1", log.Bytes(), &list, u) {
 		u.Is(5, len(list), "mod 1 len")
-	/*  u.Like(list[0], "mod 1.0",
+		/*  u.Like(list[0], "mod 1.0",
 			"^[0-9]{4}-[0-1][0-9]-[0-3][0-9] ",
 			" [012][0-9]:[0-5][0-9]:[0-5][0-9][.][0-9]+Z$")
 		u.Is("WARN", list[1], "mod 1.1")
@@ -289,10 +311,7 @@ func TestData(t *testing.T) {
 		u.Is("INFO", hash["l"], "log d2.l")
 		u.HasType("string", hash["ugh"], "log d2.ugh type")
 		u.Is("okay", hash["fast"], "log d2.fast")
-		u.Like(hash["slow"], "log.d2.slow",
-			"*func call took more than 10ms while lager lock held",
-			"*(log line was already over 16KiB)",
-		)
+		u.Is("okay", hash["slow"], "log d2.slow")
 	}
 	log.Reset()
 
@@ -366,7 +385,7 @@ func TestData(t *testing.T) {
 		validJson("deadlock 2", lines[1], nil, u)
 	}
 	u.Like(log.Bytes(), "deadlock",
-		`^{.*"func call took.*}\n{.*"deadlock"`)
+		`^{.*"deadlock".*}\n{.*"can't", "ooops"`)
 	log.Reset()
 
 	b := []byte("bytes")
@@ -622,6 +641,477 @@ func TestLevels(t *testing.T) {
 		"*must be", `"PEFWNAITDOG"`, "not 'Q'")
 }
 
+func TestLogLevel(t *testing.T) {
+	u := tutl.New(t)
+	lager.Init("FWNAITDOG")
+	defer lager.Init("")
+
+	levels := []lager.LogLevel{lager.PANIC, lager.EXIT, lager.FAIL,
+		lager.WARN, lager.NOTE, lager.ACC, lager.INFO, lager.TRACE,
+		lager.DEBUG, lager.OBJ, lager.GUTS}
+	for i, lev := range levels {
+		u.Is("PEFWNAITDOG"[i], byte(lev), "LogLevel letter")
+		u.Is(true, lager.AtLevel(lev).Enabled(), "AtLevel("+lev.String()+")")
+		u.Is(true, lager.Level(byte(lev)).Enabled(), "Level("+lev.String()+")")
+	}
+	u.Is("ACCESS", lager.ACC.String(), "ACC name")
+	u.Is("DEBUG", lager.LogLevel('d').String(), "lower-case name")
+	u.Is("LogLevel('Q')", lager.LogLevel('Q').String(), "invalid name")
+
+	mod := lager.NewModule("loglevel").Init("FW")
+	u.Is(true, mod.AtLevel(lager.WARN).Enabled(), "module WARN")
+	u.Is(false, mod.AtLevel(lager.INFO).Enabled(), "module INFO")
+	u.Is(true, mod.Level('W').Enabled(), "module 'W'")
+}
+
+func TestParseLevels(t *testing.T) {
+	u := tutl.New(t)
+	levels, err := lager.ParseLevels("info,warn,error")
+	u.Is(nil, err, "valid names")
+	u.Is("IWF", levels, "info,warn,error")
+
+	levels, err = lager.ParseLevels(" Fail, WARNING notice,Access  DEBUG ")
+	u.Is(nil, err, "mixed case and separators")
+	u.Is("FWNAD", levels, "mixed case and separators")
+
+	levels, err = lager.ParseLevels("fatal,error,err,Trace,obj,guts")
+	u.Is(nil, err, "aliases and always-enabled levels")
+	u.Is("FTOG", levels, "aliases and always-enabled levels")
+
+	levels, err = lager.ParseLevels("info,verbose,FW")
+	u.Like(err, "unknown names", "*unknown", "(verbose, FW)")
+	u.Is("I", levels, "letters for valid names")
+
+	os.Setenv("LAGER_parselevels_LEVELS", "warn, error")
+	defer os.Unsetenv("LAGER_parselevels_LEVELS")
+	lager.NewModule("parselevels")
+	u.Is("'W''F'", lager.GetModuleLevels("parselevels"), "names in env var")
+
+	os.Setenv("LAGER_parseletters_LEVELS", "FWI")
+	defer os.Unsetenv("LAGER_parseletters_LEVELS")
+	lager.NewModule("parseletters")
+	u.Is("'F''W''I'", lager.GetModuleLevels("parseletters"), "letters in env var")
+
+	for i, c := range []struct{ env, want string }{
+		{"CRITICAL", ""},
+		{"FATAL", ""},
+		{"PANIC", ""},
+		{"crit, EXIT", ""},
+		{"INFO", "'I'"},
+		{"NOTE", "'N'"},
+		{"WARN,verbose", "'W'"},
+		{"FW debug", "'F''W''D'"},
+	} {
+		name := fmt.Sprintf("envlevels%d", i)
+		os.Setenv("LAGER_"+name+"_LEVELS", c.env)
+		lager.NewModule(name, "FWNAITDOG")
+		os.Unsetenv("LAGER_" + name + "_LEVELS")
+		u.Is(c.want, lager.GetModuleLevels(name), "env var "+c.env)
+	}
+}
+
+func TestLevelsFrom(t *testing.T) {
+	u := tutl.New(t)
+	u.Is("F", lager.LevelsFrom(lager.FAIL), "from FAIL")
+	u.Is("FWNAI", lager.LevelsFrom(lager.INFO), "from INFO")
+	u.Is("FWNAITD", lager.LevelsFrom('d'), "from 'd'")
+	u.Is("FWNAITDOG", lager.LevelsFrom(lager.GUTS), "from GUTS")
+	u.Is("-", lager.LevelsFrom(lager.EXIT), "from EXIT")
+	u.Like(u.GetPanic(func() { lager.LevelsFrom('X') }), "from 'X'",
+		"*needs one char", "not 'X'")
+}
+
+// Run in a separate process so LAGER_MIN_LEVEL is read at initialization.
+func TestMinLevelEnv(t *testing.T) {
+	u := tutl.New(t)
+	if "" != os.Getenv("LAGER_TEST_CHILD") {
+		enabled := ""
+		for _, lev := range "FWNAITDOG" {
+			if lager.Level(byte(lev)).Enabled() {
+				enabled += string(lev)
+			}
+		}
+		fmt.Printf("enabled=%s.\n", enabled)
+		return
+	}
+	for _, c := range []struct{ min, levels, want string }{
+		{"Debug", "", "FWNAITD"},
+		{"warn", "FWNAI", "FW"},
+		{" T ", "", "FWNAIT"},
+		{"fatal", "", ""},
+		{"bogus", "FI", "FI"},
+		{"", "FI", "FI"},
+		{"", "CRITICAL", ""},
+		{"", "INFO", "I"},
+	} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestMinLevelEnv$")
+		cmd.Env = append(os.Environ(), "LAGER_TEST_CHILD=1",
+			"LAGER_MIN_LEVEL="+c.min, "LAGER_LEVELS="+c.levels)
+		out, err := cmd.CombinedOutput()
+		u.Is(nil, err, "child for "+c.min)
+		u.Like(out, "LAGER_MIN_LEVEL="+c.min,
+			"*enabled="+c.want+".\n")
+	}
+}
+
+func TestFailIf(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+	lager.Keys("t", "l", "msg", "data", "", "mod")
+	defer lager.Keys("", "", "", "", "", "")
+
+	u.Is(false, lager.FailIf(nil).Enabled(), "FailIf(nil) is Debug")
+	u.Is(true, lager.Debug() == lager.FailIf(nil), "FailIf(nil) same as Debug")
+	lager.FailIf(nil).MMap("no error")
+	u.Is("", log.Bytes(), "FailIf(nil) logs nothing")
+
+	ctx := lager.AddPairs(context.Background(), "user", "tye")
+	lager.FailIf(io.EOF, ctx).MMap("Read failed", "path", "/etc/motd")
+	hash := make(map[string]interface{})
+	if validJson("failif", log.Bytes(), &hash, u) {
+		u.Is("FAIL", hash["l"], "failif level")
+		u.Is("map[msg:EOF type:*errors.errorString]", hash["err"],
+			"failif err")
+		u.Is("tye", hash["user"], "failif ctx pair")
+		u.Is("/etc/motd", hash["path"], "failif pair")
+	}
+	u.Like(log.Bytes(), "failif order", `"path":.*"user":.*"err":`)
+}
+
+type stackErr struct{}
+
+func (_ stackErr) Error() string { return "bad thing" }
+
+func (e stackErr) Format(s fmt.State, verb rune) {
+	io.WriteString(s, e.Error())
+	if s.Flag('+') {
+		io.WriteString(s, "\nmain.main\n\tmain.go:12")
+	}
+}
+
+func TestErr(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+	lager.Keys("t", "l", "msg", "data", "", "mod")
+	defer lager.Keys("", "", "", "", "", "")
+
+	lager.Warn().MMap("eof", lager.Err(io.EOF), "after", 1)
+	hash := make(map[string]interface{})
+	if validJson("err eof", log.Bytes(), &hash, u) {
+		u.Is(5, len(hash), "err eof len")
+		u.Is("map[msg:EOF type:*errors.errorString]", hash["err"],
+			"err eof value")
+		u.Is(1, hash["after"], "err eof after")
+	}
+	log.Reset()
+
+	lager.SetErrorKey("error")
+	defer lager.SetErrorKey("")
+	lager.Warn().Map("first", 1, lager.Err(nil), lager.Err(stackErr{}))
+	hash = make(map[string]interface{})
+	if validJson("err stack", log.Bytes(), &hash, u) {
+		u.Is(4, len(hash), "err stack len")
+		u.Is(nil, hash["err"], "err stack old key")
+		u.Is("map[msg:bad thing stack:[main.main \tmain.go:12]"+
+			" type:lager_test.stackErr]", hash["error"], "err stack value")
+	}
+	log.Reset()
+}
+
+func TestLogStartup(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+
+	lager.LogStartup("version", "1.2.3")
+	lager.LogStartup("version", "again")
+	lines := bytes.Split(log.Bytes(), []byte{'\n'})
+	u.Is(2, len(lines), "startup logs once")
+	list := make([]interface{}, 0, 4)
+	if validJson("startup", lines[0], &list, u) {
+		u.Is("Process starting", list[2], "startup message")
+		u.Like(lines[0], "startup config",
+			`{"lager":{"levels":"[A-Z]+", "gcp":(true|false), "modules":{`,
+			`"pathParts":[0-9]+, "spanPrefix":"[^"]*", `+
+				`"spanExport":[0-9.]+, "pid":[0-9]+}, "version":"1.2.3"}`)
+	}
+}
+
+func TestEnvUsage(t *testing.T) {
+	u := tutl.New(t)
+	lager.NewModule("envusage")
+	os.Setenv("LAGER_envusage_LEVELS", "FW")
+	defer os.Unsetenv("LAGER_envusage_LEVELS")
+
+	vars := lager.EnvUsage()
+	byName := make(map[string]lager.EnvVar, len(vars))
+	for _, v := range vars {
+		u.Is(true, "" != v.Description, v.Name+" has description")
+		byName[v.Name] = v
+	}
+	u.Is("LAGER_LEVELS", vars[0].Name, "first var")
+	for _, name := range []string{"LAGER_KEYS", "LAGER_GCP",
+		"LAGER_SPAN_PREFIX", "LAGER_SPAN_EXPORT", "LAGER_STDERR_LEVELS",
+		"LAGER_STDOUT_FALLBACK",
+		"GCP_PROJECT_ID"} {
+		u.Is(name, byName[name].Name, name+" listed")
+	}
+	mod := byName["LAGER_envusage_LEVELS"]
+	u.Is(true, mod.Set, "module var set")
+	u.Is("FW", mod.Value, "module var value")
+	u.Like(mod.Description, "module var description", "envusage module")
+}
+
+func TestHeartbeat(t *testing.T) {
+	u := tutl.New(t)
+	log := buffer.AsyncBuffer{}
+	defer lager.SetOutput(&log)()
+
+	ctx, cancel := context.WithCancel(
+		lager.AddPairs(context.Background(), "svc", "test"))
+	dones := make(chan bool)
+	go func() {
+		lager.Heartbeat(ctx, 5*time.Millisecond, "extra", 1)
+		dones <- true
+	}()
+	time.Sleep(22 * time.Millisecond)
+	cancel()
+	<-dones
+	lines := bytes.Split(log.Bytes(), []byte{'\n'})
+	u.Like(len(lines), "heartbeats", "^[2-6]$")
+	u.Like(lines[0], "heartbeat line", `"Heartbeat", {"uptime":"[0-9.hms]+",`,
+		` "goroutines":[0-9]+, "heapAlloc":[0-9]+, "sys":[0-9]+,`,
+		` "numGC":[0-9]+, "extra":1}, {"svc":"test"}\]`)
+
+	frozen := buffer.AsyncBuffer{}
+	defer lager.SetOutput(&frozen)()
+	now := time.Now()
+	lager.SetClock(func() time.Time { return now })
+	defer lager.SetClock(nil)
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		lager.Heartbeat(ctx, 5*time.Millisecond)
+		dones <- true
+	}()
+	time.Sleep(22 * time.Millisecond)
+	cancel()
+	<-dones
+	uptimes := regexp.MustCompile(`"uptime":"[^"]+"`).FindAllString(
+		frozen.String(), -1)
+	u.Like(len(uptimes), "frozen heartbeats", "^[2-6]$")
+	for i := 1; i < len(uptimes); i++ {
+		u.Is(uptimes[0], uptimes[i], "uptime follows the clock")
+	}
+
+	u.Like(u.GetPanic(func() { lager.Heartbeat(ctx, 0) }),
+		"zero interval", "*Invalid lager.Heartbeat() interval (0s)")
+}
+
+func TestEscapeMode(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+	defer lager.SetEscapeMode(lager.EscapeDefault)
+
+	str := "<&\x7F\u0085\u00E9\u2028\U0001FA52\xFF>"
+	for _, tc := range []struct {
+		mode lager.EscapeMode
+		want string
+	}{
+		{lager.EscapeDefault,
+			"\"<&\\u007F\\u0085\u00E9\u2028\\uD83E\\uDE52«xFF»>\""},
+		{lager.EscapeASCII,
+			`"<&\u007F\u0085\u00E9\u2028\uD83E\uDE52«xFF»>"`},
+		{lager.EscapeUTF8,
+			"\"<&\x7F\u0085\u00E9\u2028\U0001FA52«xFF»>\""},
+		{lager.EscapeHTML,
+			`"\u003C\u0026\u007F\u0085é\u2028\uD83E\uDE52«xFF»\u003E"`},
+	} {
+		lager.SetEscapeMode(tc.mode)
+		lager.Warn().List(str)
+		desc := "escape mode " + u.S(int(tc.mode))
+		if validJson(desc, log.Bytes(), nil, u) {
+			u.Like(log.Bytes(), desc, "*"+tc.want+"]")
+		}
+		log.Reset()
+	}
+	u.Like(u.GetPanic(func() { lager.SetEscapeMode(9) }),
+		"invalid escape mode", "*Invalid lager.EscapeMode (9)")
+}
+
+func TestNumbers(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+
+	big := int64(1)<<53 + 1
+	vals := lager.List(big, -big, uint64(big), 1<<53, uint(7),
+		1500*time.Millisecond)
+	lager.Warn().List(vals)
+	u.Like(log.Bytes(), "defaults",
+		`*[9007199254740993, -9007199254740993, 9007199254740993,`+
+			` 9007199254740992, 7, "1.5s"]]`)
+	log.Reset()
+
+	lager.SetQuoteBigInts(true)
+	defer lager.SetQuoteBigInts(false)
+	for _, tc := range []struct {
+		format lager.DurationFormat
+		want   string
+	}{
+		{lager.DurationSeconds, "1.5"},
+		{lager.DurationMillis, "1500"},
+		{lager.DurationNanos, "1500000000"},
+		{lager.DurationString, `"1.5s"`},
+	} {
+		lager.SetDurationFormat(tc.format)
+		lager.Warn().List(vals)
+		desc := "duration format " + u.S(int(tc.format))
+		validJson(desc, log.Bytes(), nil, u)
+		u.Like(log.Bytes(), desc,
+			`*["9007199254740993", "-9007199254740993", "9007199254740993",`+
+				` 9007199254740992, 7, `+tc.want+`]]`)
+		log.Reset()
+	}
+}
+
+func TestPairOrder(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+	defer lager.SetPairOrder(lager.PairsAsGiven)
+
+	for _, tc := range []struct {
+		order lager.PairOrder
+		want  string
+	}{
+		{lager.PairsAsGiven,
+			`{"b":1, "a":2, "b":3, "c":{"z":1, "y":2}, "x":4, "err":`},
+		{lager.PairsDedup,
+			`{"b":3, "a":2, "c":{"z":1, "y":2}, "x":5, "err":`},
+		{lager.PairsSorted,
+			`{"a":2, "b":3, "c":{"y":2, "z":1}, "err":{`},
+	} {
+		lager.SetPairOrder(tc.order)
+		lager.Warn().MMap("order", "b", 1, "a", 2,
+			lager.Unless(true, "skip"), 0, "b", 3,
+			"c", lager.Map("z", 1, "y", 2),
+			lager.InlinePairs, lager.Map("x", 4),
+			lager.Err(io.EOF),
+			lager.InlinePairs, lager.Pairs("x", 5))
+		desc := "pair order " + u.S(int(tc.order))
+		validJson(desc, log.Bytes(), nil, u)
+		u.Like(log.Bytes(), desc, "*"+tc.want)
+		log.Reset()
+	}
+}
+
+func TestLazyInlinePairs(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+	defer lager.SetPairOrder(lager.PairsAsGiven)
+
+	calls := 0
+	lazy := func() interface{} {
+		calls++
+		return lager.Map("x", 4)
+	}
+	lager.Debug().MMap("hidden", lager.InlinePairs, lazy)
+	u.Is(0, calls, "not called when level disabled")
+	u.Is("", log.String(), "nothing logged")
+
+	for _, order := range []lager.PairOrder{
+		lager.PairsAsGiven, lager.PairsDedup, lager.PairsSorted,
+	} {
+		lager.SetPairOrder(order)
+		lager.Warn().MMap("lazy", "a", 1, lager.InlinePairs, lazy)
+		desc := "lazy inline " + u.S(int(order))
+		validJson(desc, log.Bytes(), nil, u)
+		u.Like(log.Bytes(), desc, `{"a":1, "x":4}`)
+		log.Reset()
+	}
+	u.Is(3, calls, "called once per line")
+}
+
+func TestKV(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+	defer lager.SetPairOrder(lager.PairsAsGiven)
+
+	for _, tc := range []struct {
+		order lager.PairOrder
+		want  string
+	}{
+		{lager.PairsAsGiven, `{"a":1, "b":"two", "a":3, "d":\[4\]}`},
+		{lager.PairsDedup, `{"a":3, "b":"two", "d":\[4\]}`},
+		{lager.PairsSorted, `{"a":3, "b":"two", "d":\[4\]}`},
+	} {
+		lager.SetPairOrder(tc.order)
+		lager.Warn().MMap("kv", lager.KV("a", 1), "b", "two",
+			lager.UnlessKV(true, "c", 2.5), lager.KV("a", int64(3)),
+			lager.Unless(true, lager.KV("e", 5)),
+			lager.Unless(true, lager.Err(io.EOF)),
+			lager.UnlessKV(false, "d", []int{4}))
+		desc := "kv " + u.S(int(tc.order))
+		validJson(desc, log.Bytes(), nil, u)
+		u.Like(log.Bytes(), desc, tc.want)
+		log.Reset()
+	}
+
+	lager.Warn().MMap("unless", lager.Unless(false, lager.KV("a", 1)),
+		lager.Unless(false, testUUID{}), 2, lager.Unless(true, 3), 4, "z", 5)
+	u.Like(log.Bytes(), "generic Unless",
+		`"unless", \{"a":1, "stringer":2, "z":5\}`)
+	log.Reset()
+
+	lager.StrictPairs(true)
+	defer lager.StrictPairs(false)
+	u.Is(nil, u.GetPanic(func() {
+		lager.Warn().MMap("ok", lager.KV("a", 1), lager.UnlessKV(true, "", 0))
+	}), "KV pairs are valid")
+
+	ctx := lager.AddPairs(context.Background(), "n", 7, "err", io.EOF)
+	n, ok := lager.FromContext[int](ctx, "n")
+	u.Is(true, ok, "int found")
+	u.Is(7, n, "int value")
+	_, ok = lager.FromContext[string](ctx, "n")
+	u.Is(false, ok, "wrong type")
+	err, ok := lager.FromContext[error](ctx, "err")
+	u.Is(true, ok, "interface type")
+	u.Is(io.EOF, err, "interface value")
+	_, ok = lager.FromContext[int](ctx, "missing")
+	u.Is(false, ok, "missing")
+}
+
+func TestStrictPairs(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+	lager.Keys("time", "lev", "msg", "data", "", "mod")
+	defer lager.Keys("", "", "", "", "", "")
+
+	lager.Warn().Map("odd", 1, "even")
+	u.Is(true, 0 < log.Len(), "not strict by default")
+	log.Reset()
+
+	lager.StrictPairs(true)
+	defer lager.StrictPairs(false)
+	u.Is(nil, u.GetPanic(func() {
+		lager.Warn().MMap("ok", "a", 1, lager.Unless(true, "b"), 2,
+			lager.Err(nil), lager.InlinePairs, lager.Map("c", 3))
+	}), "valid pairs")
+	u.Like(u.GetPanic(func() { lager.Warn().Map("odd", 1, "even") }),
+		"odd pairs", "*Invalid pairs passed to Map(): odd number of items (3)")
+	u.Like(u.GetPanic(func() { lager.Warn().MMap("non", 1, 2) }),
+		"non-string key", "*MMap(): non-string key (int)")
+	u.Like(u.GetPanic(func() { lager.Warn().CMMap("reserved", "lev", 2) }),
+		"reserved key", `*MMap(): reserved key "lev"`)
+}
+
 func TestPanic(t *testing.T) {
 	u := tutl.New(t)
 	log := bytes.NewBuffer(nil)
@@ -634,17 +1124,2275 @@ func TestPanic(t *testing.T) {
 
 var fakeMessage = "Test logging, but use a somewhat realistic message length."
 
-func BenchmarkLog(b *testing.B) {
+// Log a mix of typical lines via 'l' in parallel.
+func benchLog(b *testing.B, l func() lager.Lager) {
 	defer lager.SetOutput(io.Discard)()
-	lager.Fail().List("Initialize things")
+	l().List("Initialize things")
 	b.ResetTimer()
 	b.ReportAllocs()
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
-			lager.Fail().List()
-			lager.Fail().Map("msg", fakeMessage, "size", 45)
-			lager.Fail().List("Is message short and simple?", true)
-			lager.Fail().Map("Failure", io.EOF, "Pos", 12345, "Percent", 12.345)
+			l().List()
+			l().Map("msg", fakeMessage, "size", 45)
+			l().List("Is message short and simple?", true)
+			l().Map("Failure", io.EOF, "Pos", 12345, "Percent", 12.345)
 		}
 	})
 }
+
+func BenchmarkLog(b *testing.B) {
+	benchLog(b, func() lager.Lager { return lager.Fail() })
+}
+
+// Logs from one goroutine so the destination is never busy, guarding the
+// cost of the uncontended path through the output lock.
+func BenchmarkLogSerial(b *testing.B) {
+	defer lager.SetOutput(io.Discard)()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		lager.Fail().Map("msg", fakeMessage, "size", 45)
+	}
+}
+
+func BenchmarkLogKeys(b *testing.B) {
+	lager.Keys("t", "l", "msg", "data", "", "mod")
+	defer lager.Keys("", "", "", "", "", "")
+	benchLog(b, func() lager.Lager { return lager.Fail() })
+}
+
+func BenchmarkLogContext(b *testing.B) {
+	ctx := lager.AddPairs(context.Background(),
+		"ip", "10.1.2.3", "user", "tye", "reqID", 12345)
+	lager.Keys("t", "l", "msg", "data", "ctx", "mod")
+	defer lager.Keys("", "", "", "", "", "")
+	benchLog(b, func() lager.Lager { return lager.Fail(ctx) })
+}
+
+func BenchmarkLogCaller(b *testing.B) {
+	lager.Keys("t", "l", "msg", "data", "", "mod")
+	defer lager.Keys("", "", "", "", "", "")
+	benchLog(b, func() lager.Lager { return lager.Fail().WithCaller(0) })
+}
+
+func BenchmarkLogGcp(b *testing.B) {
+	lager.RunningInGcp()
+	defer lager.Keys("", "", "", "", "", "")
+	ctx := lager.AddPairs(context.Background(), "ip", "10.1.2.3")
+	benchLog(b, func() lager.Lager { return lager.Fail(ctx) })
+}
+
+func TestOutputLock(t *testing.T) {
+	u := tutl.New(t)
+	log := new(buffer.AsyncBuffer)
+	other := new(buffer.AsyncBuffer)
+	defer lager.SetOutput(log)()
+
+	big := strings.Repeat("x", 20*1024)
+	dones := make(chan bool)
+	for g := 0; g < 8; g++ {
+		go func(g int) {
+			for i := 0; i < 20; i++ {
+				lager.Note().MMap("big", "g", g, "i", i, "big", big)
+				lager.Note().MMap("small", "g", g, "i", i)
+			}
+			dones <- true
+		}(g)
+	}
+	// Logging to a different writer uses a different lock (and some of
+	// the above lines may also go to it):
+	restore := lager.SetOutput(other)
+	lager.Note().MMap("other", "big", big)
+	restore()
+	for g := 0; g < 8; g++ {
+		<-dones
+	}
+
+	all := append(log.ReadAll(), other.ReadAll()...)
+	lines := bytes.Split(all, []byte{'\n'})
+	if u.Is(8*20*2+1+1, len(lines), "lines logged") {
+		for i, line := range lines[:len(lines)-1] {
+			if !validJson(fmt.Sprintf("line %d", i), line, nil, u) {
+				break
+			}
+		}
+	}
+}
+
+func TestFraming(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+	defer lager.SetFraming(lager.FramingNewline)
+
+	lager.Note().MMap("one")
+	line := log.String()
+	u.Like(line, "newline framing", `^\[.*"one"\]\n$`)
+	log.Reset()
+
+	lager.SetFraming(lager.FramingJSONSeq)
+	lager.Note().MMap("one")
+	lager.Note().MMap("two")
+	seq := log.String()
+	u.Like(seq, "json-seq framing", "^\x1e\\[.*\"one\"\\]\n\x1e\\[.*\"two\"")
+	log.Reset()
+
+	lager.SetFraming(lager.FramingLength)
+	lager.Note().MMap("one")
+	u.Like(log.String(), "length framing",
+		fmt.Sprintf(`^%d \[.*"one"\]\n$`, len(line)))
+	log.Reset()
+
+	u.Like(u.GetPanic(func() { lager.SetFraming(lager.Framing(7)) }),
+		"invalid framing", "*Invalid lager.Framing (7)")
+}
+
+// A writer that logs (to itself) the first time it is written to.
+type loggingWriter struct {
+	bytes.Buffer
+	logged bool
+}
+
+func (w *loggingWriter) Write(p []byte) (int, error) {
+	n, err := w.Buffer.Write(p)
+	if !w.logged {
+		w.logged = true
+		lager.Note().MMap("from Write")
+	}
+	return n, err
+}
+
+// A Stringer that logs when stringified.
+type loggingStringer struct{}
+
+func (loggingStringer) String() string {
+	lager.Note().MMap("from String")
+	return "logged"
+}
+
+func TestNestedLogging(t *testing.T) {
+	u := tutl.New(t)
+	log := new(loggingWriter)
+	defer lager.SetOutput(log)()
+
+	lager.Note().MMap("outer", "s", loggingStringer{})
+	lines := strings.Split(log.String(), "\n")
+	if u.Is(4, len(lines), "nested lines") {
+		u.Like(lines[0], "first line", `"from String"`)
+		u.Like(lines[1], "second line", `"from Write"`)
+		u.Like(lines[2], "third line", `"outer"`, `"s":"logged"`)
+	}
+}
+
+// A Write() that logs many lines to the same destination, once.
+type floodingWriter struct {
+	loggingWriter
+}
+
+func (w *floodingWriter) Write(p []byte) (int, error) {
+	n, err := w.Buffer.Write(p)
+	if !w.logged {
+		w.logged = true
+		for i := 0; i < 2000; i++ {
+			lager.Note().MMap("flood", "i", i)
+		}
+	}
+	return n, err
+}
+
+func TestNestedFlood(t *testing.T) {
+	u := tutl.New(t)
+	log := new(floodingWriter)
+	defer lager.SetOutput(log)()
+
+	done := make(chan bool)
+	go func() {
+		lager.Note().MMap("outer")
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("deadlocked when logging many lines from Write()")
+	}
+	lines := strings.Split(strings.TrimSuffix(log.String(), "\n"), "\n")
+	u.Is(2001, len(lines), "outer and flood lines")
+}
+
+// A Writer whose Write() waits until 'release' is closed.
+type blockedWriter struct {
+	bytes.Buffer
+	entered chan bool
+	release chan bool
+}
+
+func (w *blockedWriter) Write(p []byte) (int, error) {
+	if nil != w.entered {
+		close(w.entered)
+		w.entered = nil
+		<-w.release
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestExitWaitsForWriter(t *testing.T) {
+	u := tutl.New(t)
+	log := &blockedWriter{
+		entered: make(chan bool), release: make(chan bool),
+	}
+	defer lager.SetOutput(log)()
+
+	entered := log.entered
+	go lager.Note().MMap("slow")
+	<-entered
+
+	logged := make(chan string, 1)
+	go func() {
+		defer func() { recover() }()
+		defer lager.ExitViaPanic()(func(x *int) {
+			*x = -1
+			logged <- log.String()
+		})
+		lager.Exit().MMap("exiting")
+	}()
+	select {
+	case <-logged:
+		t.Fatal("exited before the slow line was written")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(log.release)
+	u.Like(<-logged, "exit line written before exiting",
+		`"slow"`, `"exiting"`)
+}
+
+// Reports bytes as well as allocations per op since the single-chunk
+// AMaps (see smallPairs) use fewer allocations but more bytes.
+func BenchmarkAddPairs(b *testing.B) {
+	ctx := context.Background()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c := lager.AddPairs(ctx, "reqID", i, "ip", "10.1.2.3")
+		c = lager.AddPairs(c, "user", "tye", "tenant", "acme")
+		c = lager.AddPairs(c, "grpc.service", "svc", "grpc.method", "Get")
+		c = lager.AddPairs(c, "route", "/users/{id}")
+		c = lager.AddPairs(c, "user", "tye2")
+		c = lager.AddPairs(c, "span", "1234", "trace", "5678")
+		_ = lager.ContextPairs(c).Merge(lager.Pairs("grpc.time_ms", 1.5))
+	}
+}
+
+func TestFlightRecorder(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+	defer lager.SetFlightRecorder(0)
+	lager.Init("FWN")
+	defer lager.Init("")
+
+	dump := bytes.NewBuffer(nil)
+	u.Is(nil, lager.DumpRecent(dump), "dump when not enabled")
+	u.Is("", dump.String(), "nothing recorded when not enabled")
+
+	lager.SetFlightRecorder(3)
+	u.Is(false, lager.Debug().Enabled(), "recorded level not enabled")
+	u.Is(true, lager.Note().Enabled(), "enabled level")
+	lager.Debug().MMap("one")
+	lager.Note().MMap("two")
+	lager.Info().MMap("three")
+	lager.NewModule("recorded").Trace().MMap("four")
+	u.Like(log.String(), "only enabled levels written",
+		`^\[.*"NOTE", "two"\]\n$`)
+
+	u.Is(nil, lager.DumpRecent(dump), "dump")
+	u.Like(dump.String(), "dump has last 3 lines",
+		`^\[.*"NOTE", "two"\]\n\[.*"INFO", "three"\]\n`+
+			`\[.*"TRACE", "four", "mod=recorded"\]\n$`)
+	log.Reset()
+
+	u.Is(nil, u.GetPanic(func() {
+		defer lager.ExitViaPanic()(func(x *int) { *x = -1 })
+		lager.Exit().MMap("exiting")
+	}), "exit via panic")
+	u.Like(log.String(), "recent lines dumped before exit",
+		`^\[.*"two"\]\n\[.*"three"\]\n\[.*"four".*\]\n\[.*"EXIT", "exiting"`)
+}
+
+func TestPromoteMatching(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+	lager.Init("FWN")
+	defer lager.Init("")
+
+	undo := lager.PromoteMatching(regexp.MustCompile(`connection refused`), 'W')
+	defer lager.PromoteMatching(regexp.MustCompile(`^noisy`), 'd')()
+	u.Is(false, lager.Info().Enabled(), "promotable level not enabled")
+	lager.Info().MMap("dial: connection refused", "port", 80)
+	u.Like(log.String(), "info promoted",
+		`^\[.*"WARN", "dial: connection refused", {"port":80}\]\n$`)
+	log.Reset()
+
+	lager.NewModule("promoted").Info().CMList("connection refused", 1)
+	u.Like(log.String(), "module info promoted",
+		`^\[.*"WARN", \["connection refused", 1\], {"_file":.*"mod=promoted"`)
+	log.Reset()
+
+	lager.Info().MMap("other")
+	lager.Info().Map("msg", "connection refused")
+	lager.Note().MMap("noisy note")
+	u.Is("", log.String(), "not promoted or demoted")
+
+	lager.Unfiltered(lager.Note()).MMap("noisy but unfiltered")
+	u.Like(log.String(), "unfiltered not demoted",
+		`^\[.*"NOTE", "noisy but unfiltered"\]\n$`)
+	u.Is(false, lager.Unfiltered(lager.Info()).Enabled(),
+		"unfiltered still honors disabled levels")
+	log.Reset()
+
+	undo()
+	lager.Info().MMap("connection refused")
+	u.Is("", log.String(), "rule removed")
+
+	u.Like(u.GetPanic(func() { lager.PromoteMatching(nil, 'E') }),
+		"invalid level", `*needs one char from "FWNAITDOG" not 'E'`)
+}
+
+func TestKeyTypes(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+	lager.SetKeyType("status", lager.KeyNumber)
+	lager.SetKeyType("latency", lager.KeyString)
+	lager.SetKeyType("ok", lager.KeyBool)
+	defer lager.SetKeyType("status", lager.KeyAsIs)
+	defer lager.SetKeyType("latency", lager.KeyAsIs)
+	defer lager.SetKeyType("ok", lager.KeyAsIs)
+
+	lager.Note().MMap("coerced", "status", "404", "latency",
+		1500*time.Millisecond, "ok", 1, "other", "5")
+	u.Like(log.String(), "coerced",
+		`"status":404, "latency":"1.5s", "ok":true, "other":"5"}`)
+	log.Reset()
+
+	lager.Note().MMap("coerced", "status", 2.5, "latency", 17,
+		"ok", "false", "nested", lager.Map("status", " 200 "))
+	u.Like(log.String(), "coerced again",
+		`"status":2.5, "latency":"17", "ok":false, "nested":{"status":200}}`)
+	log.Reset()
+
+	lager.Note().MMap("uncoercible", "status", "oops", "ok", []int{1},
+		"latency", lager.Map("a", 1))
+	u.Like(log.String(), "uncoercible",
+		`"status":null, "ok":null, "latency":"{\\"a\\":1}"}`)
+	log.Reset()
+
+	lager.Note().MMap("stringer", "status", time.March)
+	u.Like(log.String(), "named int with String() method", `"status":3}`)
+	log.Reset()
+
+	lager.SetKeyType("status", lager.KeyAsIs)
+	lager.Note().MMap("as is", "status", "404")
+	u.Like(log.String(), "as is", `"status":"404"}`)
+
+	u.Like(u.GetPanic(func() { lager.SetKeyType("x", lager.KeyType(9)) }),
+		"invalid key type", "*Invalid lager.KeyType (9)")
+}
+
+func TestKeyNormalizer(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+	lager.SetKeyNormalizer(func(key string) string {
+		return strings.ToLower(strings.Replace(key, ".", "_", -1))
+	})
+	defer lager.SetKeyNormalizer(nil)
+	lager.SetKeyType("http_status", lager.KeyNumber)
+	defer lager.SetKeyType("http_status", lager.KeyAsIs)
+
+	ctx := lager.AddPairs(context.Background(), "Req.ID", "r1")
+	lager.Note(ctx).MMap("Normalized", "User.Name", "ann",
+		"HTTP.Status", "404", "nested", lager.Map("Inner.Key", 1))
+	line := log.String()
+	u.Like(line, "normalized",
+		`"user_name":"ann", "http_status":404, "nested":{"inner_key":1}`,
+		`"req_id":"r1"`, "!*User.Name", "!Req[.]ID")
+	log.Reset()
+
+	lager.SetKeyType("Typed.Key", lager.KeyString)
+	defer lager.SetKeyType("Typed.Key", lager.KeyAsIs)
+	req := httptest.NewRequest("GET", "/x", nil)
+	lager.Note().MMap("Reserved", lager.GcpTraceKey, "t",
+		"httpRequest", lager.GcpHttp(req, nil, nil), "Typed.Key", 1,
+		"err", "e", "Other.Key", 2)
+	u.Like(log.String(), "reserved keys not normalized",
+		`"logging.googleapis.com/trace":"t", `,
+		`"httpRequest":{"requestMethod":"GET", "requestUrl":`,
+		`"Typed.Key":"1", "err":"e", "other_key":2}`)
+	log.Reset()
+
+	lager.SetVerbatimKey("Kept.Key", true)
+	lager.Note().MMap("Verbatim", "Kept.Key", lager.Map("Inner.Key", 1))
+	u.Like(log.String(), "verbatim key", `"Kept.Key":{"Inner.Key":1}`)
+	log.Reset()
+	lager.SetVerbatimKey("Kept.Key", false)
+	lager.Note().MMap("Not verbatim", "Kept.Key", 1)
+	u.Like(log.String(), "verbatim key removed", `"kept_key":1`)
+	log.Reset()
+
+	lager.SetKeyNormalizer(nil)
+	lager.Note().MMap("Unchanged", "User.Name", "ann")
+	u.Like(log.String(), "removed", `"User.Name":"ann"`)
+}
+
+func TestGcpHttpCached(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+
+	req := httptest.NewRequest("POST", "/api/v1?q=x", strings.NewReader("hi"))
+	req.Header.Set("User-Agent", "tester")
+	hc := lager.GcpHttpCached(req)
+	u.Is(lager.GcpHttp(req, nil, nil), hc.Request(), "same as GcpHttp")
+	u.Is(true, &hc.Request()[0] == &hc.Request()[0], "computed once")
+
+	ctx := lager.AddPairs(req.Context(), "httpRequest", hc.F())
+	lager.Note(ctx).MMap("handling")
+	u.Like(log.String(), "lazy request details",
+		`{"httpRequest":{"requestMethod":"POST", `+
+			`"requestUrl":"http://example.com/api/v1\?", "protocol":"HTTP/1.1", `+
+			`"requestSize":2, "remoteIp":"192.0.2.1", "userAgent":"tester"}}`)
+
+	start := time.Now()
+	resp := lager.GcpFakeResponse(404, 9, "")
+	log.Reset()
+	lager.Note().MMap("done", "httpRequest", hc.Response(resp, &start))
+	u.Like(log.String(), "response details",
+		`"protocol":"HTTP/1.1", "status":404, "requestSize":2, `+
+			`"responseSize":9, "latency":"0.0\d*s", "remoteIp"`)
+}
+
+func TestHttpInfo(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+
+	req := httptest.NewRequest("GET", "/path?q=x", nil)
+	req.Header.Set("Referer", "https://from/")
+	start := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	resp := lager.GcpFakeResponse(200, 1234, "")
+
+	u.Is(lager.GcpHttp(req, resp, nil),
+		lager.HttpInfo(req, resp, nil, lager.HttpGcp), "gcp style")
+	u.Is(`192.0.2.1 - - [02/Jan/2006:15:04:05 +0000] "GET /path HTTP/1.1"`+
+		` 200 1234 "https://from/" "-"`,
+		lager.HttpInfo(req, resp, &start, lager.HttpApache), "apache style")
+	u.Like(lager.HttpInfo(req, nil, nil, lager.HttpApache),
+		"apache without response", `" - - "https://from/" "-"$`)
+
+	lager.Note().MMap("w3c",
+		"access", lager.HttpInfo(req, resp, &start, lager.HttpW3C))
+	u.Like(log.String(), "w3c style",
+		`{"access":{"date":"2006-01-02", "time":"15:04:05", `+
+			`"c-ip":"192.0.2.1", "cs-method":"GET", "cs-uri-stem":"/path", `+
+			`"cs-version":"HTTP/1.1", "sc-status":200, "cs-bytes":0, "sc-bytes":1234, `+
+			`"time-taken":[0-9.e+]+, "cs\(Referer\)":"https://from/"}}`)
+
+	u.Like(u.GetPanic(func() {
+		lager.HttpInfo(req, nil, nil, lager.HttpStyle(5))
+	}), "invalid style", "*Invalid lager.HttpStyle (5)")
+
+	lager.Init("FWNA")
+	defer lager.Init("")
+	log.Reset()
+	lager.LogAccess(req, resp, &start, lager.HttpApache).MMap("apache")
+	u.Like(log.String(), "apache access line",
+		`"ACCESS", "apache", {"access":"192.0.2.1 - - \[02/Jan/2006:`,
+		`\\"GET /path HTTP/1.1\\" 200 1234 `)
+	log.Reset()
+	lager.LogAccess(req, resp, &start, lager.HttpGcp).MMap("gcp")
+	u.Like(log.String(), "gcp access line",
+		`"ACCESS", "gcp", {"httpRequest":{"requestMethod":"GET"`)
+}
+
+func TestAccessAggregator(t *testing.T) {
+	u := tutl.New(t)
+	log := new(buffer.AsyncBuffer)
+	defer lager.SetOutput(log)()
+
+	agg := lager.NewAccessAggregator(0, 10*time.Millisecond, time.Second)
+	agg.Record("/users/{id}", 200, 5*time.Millisecond)
+	agg.Record("/users/{id}", 404, 500*time.Millisecond)
+	agg.Record("/users/{id}", 200, 2*time.Second)
+	agg.Record("/health", 200, time.Millisecond)
+	agg.Flush()
+	lines := strings.Split(log.String(), "\n")
+	u.Is(3, len(lines), "one line per route")
+	u.Like(lines[0], "health summary", `"ACCESS", "Access summary", `+
+		`{"route":"/health", "seconds":[0-9.e-]+, "count":1, `+
+		`"status":{"200":1}, "latency":{"sum":0.001, "max":0.001, `+
+		`"buckets":\[0.01,1\], "counts":\[1,0,0\]}}`)
+	u.Like(lines[1], "users summary", `"route":"/users/{id}", `,
+		`"count":3, "status":{"200":2, "404":1}, "latency":{"sum":2.505, `+
+			`"max":2, "buckets":\[0.01,1\], "counts":\[1,1,1\]}}`)
+	log.Reset()
+
+	agg.Flush()
+	u.Is("", log.String(), "nothing recorded since flush")
+	agg.Record("/health", 503, time.Millisecond)
+	agg.Close()
+	u.Like(log.String(), "flushed on close", `"status":{"503":1}`)
+	agg.Close()
+
+	log.Reset()
+	agg = lager.NewAccessAggregator(time.Millisecond)
+	agg.Record("/health", 200, time.Millisecond)
+	for i := 0; i < 500 && 0 == log.Len(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	agg.Close()
+	u.Like(log.String(), "periodic flush", `"buckets":\[0.005,0.01,`)
+}
+
+func TestRouteTemplate(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+
+	req := httptest.NewRequest("GET", "/users/17?x=y", nil)
+	u.Is("", lager.RouteTemplate(req), "no route yet")
+
+	inner := ""
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users/{id}",
+		func(w http.ResponseWriter, r *http.Request) {
+			inner = lager.RouteTemplate(r)
+		})
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+	u.Is("/users/{id}", inner, "route from ServeMux in handler")
+	u.Is("/users/{id}", lager.RouteTemplate(req), "route from ServeMux after")
+
+	lager.GcpLogAccess(req, nil, nil).MMap("access")
+	u.Like(log.String(), "access log has route",
+		`"requestUrl":"http://example.com/users/17\?", `,
+		`}, "route":"/users/{id}"}`)
+
+	lager.AddRouteFunc(func(r *http.Request) string {
+		return r.Header.Get("X-Route")
+	})
+	u.Is("/users/{id}", lager.RouteTemplate(req), "route func returned ''")
+	req.Header.Set("X-Route", "/custom")
+	u.Is("/custom", lager.RouteTemplate(req), "route from route func")
+}
+
+func TestPairsToHeaders(t *testing.T) {
+	u := tutl.New(t)
+
+	ctx := lager.AddPairs(context.Background(), "requestId", "req-17",
+		lager.GcpTraceKey, "projects/proj/traces/0123456789abcdef",
+		"user", 42, "none", nil)
+	h := http.Header{}
+	lager.PairsToHeaders(ctx, h)
+	u.Is("req-17", h.Get("X-Request-Id"), "request ID")
+	u.Is("0123456789abcdef", h.Get("X-Trace-Id"), "trace ID")
+
+	h = http.Header{}
+	lager.PairsToHeaders(ctx, h, "user", "X-User", "none", "X-None",
+		"missing", "X-Missing")
+	u.Is(http.Header{"X-User": {"42"}}, h, "selected pairs")
+
+	var seen string
+	handler := lager.ExportPairsToHeaders(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			seen = w.Header().Get("X-Request-Id")
+		}))
+	req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	u.Is("req-17", seen, "set before inner handler")
+	u.Is("0123456789abcdef", rec.Header().Get("X-Trace-Id"), "in response")
+}
+
+func TestTraceURL(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+
+	u.Is("", lager.TraceURL(nil), "nil span")
+	u.Is("", lager.TraceURL(spans.NewROSpan("proj")), "empty span")
+	span, err := spans.NewROSpan("my-proj").Import(
+		"0123456789abcdef0123456789abcdef", 17)
+	u.Is(nil, err, "import span")
+	want := "https://console.cloud.google.com/traces/list" +
+		"?project=my-proj&tid=0123456789abcdef0123456789abcdef"
+	u.Is(want, lager.TraceURL(span), "trace URL")
+
+	ctx := lager.GcpContextAddTrace(context.Background(), span)
+	lager.Fail(ctx).MMap("no url by default")
+	u.Like(log.String(), "default", "!traceUrl")
+	log.Reset()
+
+	lager.SetTraceURLOnFail(true)
+	defer lager.SetTraceURLOnFail(false)
+	lager.Fail(ctx).MMap("failed")
+	lager.Warn(ctx).MMap("warned")
+	lager.Fail().MMap("no trace")
+	lager.NewModule("traced").Fail(ctx).MMap("module failed")
+	lines := strings.Split(log.String(), "\n")
+	u.Is(5, len(lines), "lines")
+	u.Like(lines[0], "fail line", `"traceUrl":"`+regexp.QuoteMeta(want)+`"`)
+	u.Like(lines[1], "warn line", "!traceUrl")
+	u.Like(lines[2], "fail without trace", "!traceUrl")
+	u.Like(lines[3], "module fail line", `"traceUrl":"https://`)
+}
+
+func TestIfSampled(t *testing.T) {
+	u := tutl.New(t)
+	defer lager.SetSpanExport(lager.GetSpanExport())
+
+	calls := 0
+	expensive := func() interface{} {
+		calls++
+		return "details"
+	}
+	bg := context.Background()
+	u.Is(false, lager.TraceSampled(bg), "no span")
+	ctx := lager.IfSampled(bg, "deep", expensive)
+	u.Is(nil, lager.ContextPairs(ctx), "no pairs without span")
+
+	span, err := spans.NewROSpan("proj").Import(
+		"0123456789abcdef0123456789abcdef", 17)
+	u.Is(nil, err, "import span")
+	traced := spans.ContextStoreSpan(bg, span)
+	u.Is(true, lager.TraceSampled(traced), "span stored")
+	ctx = lager.IfSampled(traced, "deep", expensive)
+	v, ok := lager.PairFromContext(ctx, "deep")
+	u.Is(true, ok, "pair added when sampled")
+	u.Is(0, calls, "not called yet")
+	u.Is("details", lager.S(v.(func() interface{})()), "pair value")
+
+	req := httptest.NewRequest("GET", "/", nil)
+	received := func(header string) context.Context {
+		req.Header.Set(spans.TraceHeader, header)
+		ctx, _ := lager.GcpContextReceivedRequest(spans.ContextStoreSpan(
+			bg, plainSpan{spans.NewROSpan("proj"), 0}), req)
+		return ctx
+	}
+	lager.SetSpanExport(0.0)
+	u.Is(false, lager.TraceSampled(received("")), "export disabled")
+	u.Is(false, lager.TraceSampled(received(
+		"0123456789abcdef0123456789abcdef/17")), "no flag, export disabled")
+	ctx = received("0123456789abcdef0123456789abcdef/17;o=1")
+	u.Is(true, lager.TraceSampled(ctx), "header says sampled")
+	ctx = lager.IfSampled(ctx, "deep", expensive)
+	_, ok = lager.PairFromContext(ctx, "deep")
+	u.Is(true, ok, "added when header says sampled")
+
+	lager.SetSpanExport(1.0)
+	u.Is(true, lager.TraceSampled(received(
+		"0123456789abcdef0123456789abcdef/17")), "no flag, exported")
+	ctx = received("0123456789abcdef0123456789abcdef/17;o=0")
+	u.Is(false, lager.TraceSampled(ctx), "header says not sampled")
+	ctx = lager.IfSampled(ctx, "deep", expensive)
+	_, ok = lager.PairFromContext(ctx, "deep")
+	u.Is(false, ok, "not added when not sampled")
+}
+
+// Returns the stack (as program counters) of where it was called.
+func capturePCs() []uintptr {
+	pcs := make([]uintptr, 64)
+	return pcs[:runtime.Callers(1, pcs)]
+}
+
+func TestStackOptions(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+	defer lager.SetPathParts(3)
+	lager.SetPathParts(1)
+
+	stackOf := func(lg lager.Lager) []interface{} {
+		log.Reset()
+		lg.MMap("stack")
+		list := make([]interface{}, 0, 5)
+		if !validJson("stack", log.Bytes(), &list, u) || len(list) < 4 {
+			return nil
+		}
+		stack, _ := list[3].(map[string]interface{})["_stack"].([]interface{})
+		return stack
+	}
+
+	full := stackOf(lager.Fail().WithStack(0, 0))
+	u.Like(fmt.Sprint(full), "full stack",
+		`^\[[0-9]+ lager_test[.]go TestStackOptions [0-9]+ testing[.]go tRunner `)
+
+	stack := stackOf(lager.Fail().WithStack(0, 0,
+		lager.SkipPackages("testing", "runtime")))
+	u.Is(1, len(stack), "testing and runtime frames skipped")
+	u.Like(fmt.Sprint(stack), "skipped stack",
+		`^\[[0-9]+ lager_test[.]go TestStackOptions\]$`)
+
+	stack = stackOf(lager.Fail().WithStack(0, 1,
+		lager.SkipPackages("github.com/TyeMcQueen/go-lager_test")))
+	u.Like(fmt.Sprint(stack), "skipped test package",
+		`^\[[0-9]+ testing[.]go tRunner\]$`)
+
+	stack = stackOf(lager.Fail().WithStack(0, 0, lager.MaxStackBytes(1)))
+	u.Is(1, len(stack), "MaxStackBytes still includes one frame")
+	size := len(full[0].(string)) + len(full[1].(string))
+	stack = stackOf(lager.Fail().WithStack(0, 0, lager.MaxStackBytes(size)))
+	u.Is(2, len(stack), "MaxStackBytes limits frames")
+
+	pcs := capturePCs()
+	stack = stackOf(lager.Fail().WithStack(0, 2, lager.StackFromPCs(pcs)))
+	u.Like(fmt.Sprint(stack), "stack from PCs",
+		`^\[[0-9]+ lager_test[.]go capturePCs [0-9]+ lager_test[.]go `+
+			`TestStackOptions\]$`)
+	stack = stackOf(lager.Fail().WithStack(1, 1,
+		lager.StackFromFrames(runtime.CallersFrames(pcs))))
+	u.Like(fmt.Sprint(stack), "stack from Frames",
+		`^\[[0-9]+ lager_test[.]go TestStackOptions\]$`)
+}
+
+func TestCallerCache(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+	defer lager.SetPathParts(3)
+
+	for _, parts := range []int{1, 2, 1, 0} {
+		lager.SetPathParts(parts)
+		for i := 0; i < 2; i++ {
+			log.Reset()
+			lager.Fail().CList("cached")
+			want := `"_file":"lager_test[.]go", "_line":[0-9]+, ` +
+				`"_func":"TestCallerCache"`
+			if 2 == parts {
+				want = `"_file":"[^/"]+/lager_test[.]go", `
+			} else if 0 == parts {
+				want = `"_file":"/.+/lager_test[.]go", `
+			}
+			u.Like(log.String(), fmt.Sprintf("parts=%d #%d", parts, i), want)
+		}
+	}
+}
+
+func TestWithPathParts(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+	defer lager.SetPathParts(3)
+
+	lager.SetPathParts(3)
+	u.Is(3, lager.GetPathParts(), "GetPathParts")
+	fail := lager.Fail().WithPathParts(1)
+	fail.CList("short")
+	u.Like(log.String(), "caller with 1 part",
+		`"_file":"lager_test[.]go", "_line":[0-9]+, "_func":"TestWithPathParts"`)
+	log.Reset()
+	fail.WithStack(0, 1).List("stack")
+	u.Like(log.String(), "stack with 1 part",
+		`"_stack":\["[0-9]+ lager_test[.]go TestWithPathParts"\]`)
+	log.Reset()
+	fail.With(context.Background()).WithPathParts(2).CList("two")
+	u.Like(log.String(), "caller with 2 parts",
+		`"_file":"[^/"]+/lager_test[.]go", `)
+	log.Reset()
+	lager.Fail().CList("global")
+	u.Like(log.String(), "caller with 3 parts",
+		`"_file":"[^/"]+/[^/"]+/lager_test[.]go", `)
+	u.Is(false, lager.Obj().WithPathParts(1).Enabled(), "disabled")
+}
+
+func TestBuildInfo(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+
+	info := lager.BuildInfo()
+	u.Like(fmt.Sprint(info), "build module", "github.com/TyeMcQueen/go-lager")
+
+	lager.Fail().List("no build")
+	u.Like(log.String(), "no build info by default", "!*build.")
+	log.Reset()
+
+	undo := lager.WithBuildInfo()
+	lager.Fail(lager.AddPairs(context.Background(), "k", "v")).List("build")
+	u.Like(log.String(), "Fail has build info",
+		`, {"build.module":"github.com/TyeMcQueen/go-lager"[^{}]*, "k":"v"}\]`)
+	log.Reset()
+	lager.NewModule("buildinfo").Fail().List("build")
+	u.Like(log.String(), "module Fail has build info", `"build.module":`)
+	log.Reset()
+	lager.Warn().List("no build")
+	u.Like(log.String(), "Warn has no build info", "!*build.")
+	log.Reset()
+
+	undo()
+	lager.Fail().List("no build")
+	u.Like(log.String(), "no build info after undo", "!*build.")
+}
+
+func TestCloudEvent(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+
+	ctx := lager.AddPairs(context.Background(), "reqID", "x7")
+	lager.CloudEvent(ctx, "com.example.order.placed", "/orders",
+		"order", "A123", "total", 99.5)
+	lager.CloudEvent(nil, "com.example.ping", "/ping")
+	lines := bytes.Split(bytes.TrimSpace(log.Bytes()), []byte{'\n'})
+	u.Is(2, len(lines), "one line per event")
+
+	u.Like(lines[0], "envelope order",
+		`^{"specversion":"1[.]0", "type":"com[.]example[.]order[.]placed", `,
+		`"source":"/orders", "id":"[0-9a-f]{32}", "time":"[^"]+", `,
+		`"datacontenttype":"application/json", `,
+		`"data":{"order":"A123", "total":99[.]5, "reqID":"x7"}}$`)
+	var ev map[string]interface{}
+	if validJson("event", lines[0], &ev, u) {
+		when, err := time.Parse(time.RFC3339Nano, ev["time"].(string))
+		u.Is(nil, err, "time is RFC 3339")
+		u.Is(true, time.Since(when) < time.Minute, "time is recent")
+	}
+	u.Like(lines[1], "no data", `, "data":{}}$`)
+	var ev2 map[string]interface{}
+	if validJson("event 2", lines[1], &ev2, u) {
+		u.Is(true, ev["id"] != ev2["id"], "ids differ")
+	}
+}
+
+func TestKeyCollisions(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+	defer lager.SetKeyCollisions(lager.CollisionsAllowed)
+	lager.Keys("time", "severity", "msg", "data", "", "mod")
+	defer lager.Keys("", "", "", "", "", "")
+	ctx := lager.AddPairs(context.Background(), "mod", "ctx")
+
+	lager.Warn(ctx).MMap("as is", "severity", "low", "x", 1)
+	u.Like(log.String(), "collisions allowed by default",
+		`"msg":"as is", "severity":"low", "x":1, "mod":"ctx"}`)
+	log.Reset()
+
+	lager.SetKeyCollisions(lager.CollisionsRenamed)
+	lager.Warn(ctx).MMap("renamed", "severity", "low",
+		"nested", lager.Map("time", 1), lager.InlinePairs, lager.Map("msg", 2))
+	u.Like(log.String(), "collisions renamed",
+		`"severity":"WARN", "msg":"renamed", "severity_":"low", `,
+		`"nested":{"time":1}, "msg_":2, "mod_":"ctx"}`)
+	log.Reset()
+	lager.Warn().MList("no pairs")
+	lager.Warn().List("just", "data")
+	u.Like(log.String(), "own keys not renamed",
+		`"msg":"no pairs"(, "json":1)?}`, `"data":\["just", "data"\]}`)
+	log.Reset()
+
+	lager.SetKeyCollisions(lager.CollisionsWarned)
+	lager.Note().MMap("warned", "time", 1)
+	lager.Note().MMap("warned again", "time", 2)
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	u.Is(3, len(lines), "warned once")
+	u.Like(lines[0], "renamed line", `"msg":"warned", "time_":1}`)
+	u.Like(lines[1], "warning", `"severity":"WARN", `,
+		`"msg":"Logged key collides with a reserved key", `,
+		`"key":"time", "renamedTo":"time_"}`)
+	u.Like(lines[2], "renamed again", `"msg":"warned again", "time_":2}`)
+
+	log.Reset()
+	tctx := lager.AddPairs(context.Background(),
+		lager.GcpTraceKey, "projects/p/traces/t1")
+	lager.Note(tctx).MMap("traced", lager.GcpTraceKey, "projects/p/traces/t2",
+		lager.GcpSpanKey, "s1", "nested", lager.Map(lager.GcpSpanKey, "s2"))
+	lines = strings.Split(strings.TrimSpace(log.String()), "\n")
+	u.Is(2, len(lines), "repeated GCP key warned")
+	u.Like(lines[0], "repeated GCP key renamed",
+		`"logging.googleapis.com/trace":"projects/p/traces/t2", `,
+		`"logging.googleapis.com/spanId":"s1", `,
+		`"nested":{"logging.googleapis.com/spanId":"s2"}, `,
+		`"logging.googleapis.com/trace_":"projects/p/traces/t1"}`)
+	u.Like(lines[1], "repeated GCP key warning",
+		`"key":"logging.googleapis.com/trace", `,
+		`"renamedTo":"logging.googleapis.com/trace_"}`)
+
+	lager.Keys("", "", "", "", "", "")
+	log.Reset()
+	lager.Warn().MMap("list", "severity", "low")
+	u.Like(log.String(), "list format never collides", `{"severity":"low"}`)
+
+	u.Like(u.GetPanic(func() { lager.SetKeyCollisions(3) }),
+		"invalid", "*invalid lager.KeyCollisions (3)")
+}
+
+type recSpan struct {
+	spans.ROSpan
+	name  string
+	attrs map[string]interface{}
+}
+
+func (s *recSpan) GetSpanID() uint64      { return 20 }
+func (s *recSpan) NewSpan() spans.Factory { return s }
+func (s *recSpan) ImportFromHeaders(_ http.Header) spans.Factory {
+	return s
+}
+func (s *recSpan) SetIsServer() spans.Factory { return s }
+func (s *recSpan) SetIsClient() spans.Factory { return s }
+func (s *recSpan) SetDisplayName(name string) spans.Factory {
+	s.name = name
+	return s
+}
+func (s *recSpan) AddAttribute(key string, val interface{}) error {
+	s.attrs[key] = val
+	return nil
+}
+
+func TestSpanOptions(t *testing.T) {
+	u := tutl.New(t)
+	newSpan := func() *recSpan {
+		return &recSpan{spans.NewROSpan("proj"), "", map[string]interface{}{}}
+	}
+
+	sp := newSpan()
+	ctx := spans.ContextStoreSpan(context.Background(), sp)
+	req := httptest.NewRequest("POST", "/user/123?x=1", nil)
+	lager.GcpContextReceivedRequest(ctx, req)
+	u.Is(lager.GetSpanPrefix()+".in.request", sp.name, "default in name")
+	u.Is("POST", sp.attrs["http.method"], "in method")
+	u.Is(nil, sp.attrs["http.route"], "no route by default")
+
+	sp = newSpan()
+	ctx = spans.ContextStoreSpan(context.Background(), sp)
+	req = req.WithContext(ctx)
+	lager.GcpReceivedRequest(&req,
+		lager.SpanName("get.user"), lager.SpanRoute("/user/{id}"))
+	u.Is("get.user", sp.name, "in SpanName")
+	u.Is("/user/{id}", sp.attrs["http.route"], "in SpanRoute")
+	u.Is("POST", sp.attrs["http.method"], "defaults kept")
+
+	sp = newSpan()
+	ctx = spans.ContextStoreSpan(context.Background(), sp)
+	lager.GcpContextSendingRequest(nil, ctx)
+	u.Is(lager.GetSpanPrefix()+".out.request", sp.name, "default out name")
+
+	sp = newSpan()
+	ctx = spans.ContextStoreSpan(context.Background(), sp)
+	_, _, _, err := lager.GcpSendingNewRequest(
+		ctx, "GET", "http://billing/charge", nil,
+		lager.SpanPeerService("billing"), lager.SpanAttribute("retry", 2))
+	u.Is(nil, err, "GcpSendingNewRequest error")
+	u.Is(lager.GetSpanPrefix()+".out.request", sp.name, "out name kept")
+	u.Is("billing", sp.attrs["peer.service"], "SpanPeerService")
+	u.Is(2, sp.attrs["retry"], "SpanAttribute")
+	u.Is("http://billing/charge", sp.attrs["http.url"], "out url")
+}
+
+func TestParentSpanPair(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+
+	sp := &recSpan{spans.NewROSpan("proj"), "", map[string]interface{}{}}
+	lager.Warn(lager.GcpContextAddTrace(context.Background(), sp)).List("a")
+	u.Like(log.String(), "no parent", "!*"+lager.GcpParentSpanKey)
+	log.Reset()
+
+	sp.SetParentSpanID(30, 1)
+	lager.Warn(lager.GcpContextAddTrace(context.Background(), sp)).List("b")
+	u.Like(log.String(), "parent",
+		`"`+lager.GcpParentSpanKey+`":"000000000000001e"`)
+	log.Reset()
+
+	imp, err := spans.NewROSpan("proj").Import(
+		"00000000000000000000000000000001", 20)
+	u.Is(nil, err, "import")
+	ctx := spans.ContextStoreSpan(context.Background(), plainSpan{imp, 20})
+	ctx, _ = lager.GcpContextSendingRequest(nil, ctx)
+	lager.Warn(ctx).List("c")
+	u.Like(log.String(), "parent from sending request",
+		`"`+lager.GcpSpanKey+`":"0000000000000015"`,
+		`"`+lager.GcpParentSpanKey+`":"0000000000000014"`)
+}
+
+// A span type that does not implement spans.Parented.
+type plainSpan struct {
+	spans.Factory
+	id uint64
+}
+
+func (s plainSpan) GetSpanID() uint64          { return s.id }
+func (s plainSpan) SetIsClient() spans.Factory { return s }
+func (s plainSpan) NewSpan() spans.Factory {
+	return plainSpan{s.Factory, s.id + 1}
+}
+func (s plainSpan) ImportFromHeaders(h http.Header) spans.Factory {
+	imp := s.Factory.ImportFromHeaders(h)
+	return plainSpan{imp, imp.GetSpanID()}
+}
+
+func TestSpanExport(t *testing.T) {
+	u := tutl.New(t)
+	defer lager.SetSpanExport(lager.GetSpanExport())
+	u.Is(1.0, lager.GetSpanExport(), "default span export")
+
+	ro, _ := spans.NewROSpan("proj").Import(
+		"00000000000000000000000000000001", 20)
+	newSpan := func() *recSpan {
+		return &recSpan{ro.(spans.ROSpan), "", map[string]interface{}{}}
+	}
+
+	lager.SetSpanExport(0)
+	sp := newSpan()
+	ctx := spans.ContextStoreSpan(context.Background(), sp)
+	ctx, got := lager.GcpContextReceivedRequest(
+		ctx, httptest.NewRequest("GET", "/", nil))
+	u.Is("", sp.name, "no span created when export off")
+	u.Is(sp, got, "imported span returned")
+	u.Like(lager.S(lager.ContextPairs(ctx)), "trace still logged",
+		lager.GcpSpanKey)
+
+	lager.SetSpanExport(1)
+	req := httptest.NewRequest("GET", "http://dep/", nil)
+	lager.GcpContextSendingRequest(req, ctx)
+	u.Is("", sp.name, "no sub-span for unexported request")
+	u.Is(ro.GetCloudContext(), req.Header.Get(spans.TraceHeader),
+		"trace still propagated")
+
+	lager.SetSpanExport(0)
+	ctx = spans.ContextStoreSpan(context.Background(), spans.NewROSpan("proj"))
+	ctx, got = lager.GcpContextReceivedRequest(
+		ctx, httptest.NewRequest("GET", "/", nil))
+	u.Is(true, spans.IsValidTraceID(got.GetTraceID()), "trace ID generated")
+	u.IsNot(0, got.GetSpanID(), "span ID generated")
+	u.Is(false, lager.TraceSampled(ctx), "generated trace not sampled")
+	u.Like(lager.S(lager.ContextPairs(ctx)), "generated trace logged",
+		lager.GcpTraceKey, spans.HexSpanID(got.GetSpanID()))
+	req = httptest.NewRequest("GET", "http://dep/", nil)
+	lager.GcpContextSendingRequest(req, ctx)
+	u.Is(got.GetCloudContext(), req.Header.Get(spans.TraceHeader),
+		"generated trace propagated")
+
+	lager.SetSpanExport(0.5)
+	sp = newSpan()
+	ctx = spans.ContextStoreSpan(context.Background(), sp)
+	lager.GcpContextSendingRequest(nil, ctx)
+	u.Is(lager.GetSpanPrefix()+".out.request", sp.name,
+		"spans always created for sampled traces")
+
+	lager.SetSpanExport(7)
+	u.Is(1.0, lager.GetSpanExport(), "rate capped at 1")
+	lager.SetSpanExport(-1)
+	u.Is(0.0, lager.GetSpanExport(), "rate at least 0")
+}
+
+func TestNamespace(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+	pairs := func(ctx context.Context) string {
+		log.Reset()
+		lager.Warn(ctx).MMap("ns")
+		return log.String()
+	}
+
+	ctx := lager.AddPairs(context.Background(), "id", 1)
+	lib := lager.Namespace(ctx, "lib")
+	lib = lager.AddPairs(lib, "id", 2, "host", "h")
+	u.Like(pairs(lib), "namespaced keys",
+		`{"id":1, "lib.id":2, "lib.host":"h"}`)
+
+	sub := lager.AddPairs(lager.Namespace(lib, "sub"), "id", 3)
+	u.Like(pairs(sub), "nested namespace",
+		`{"id":1, "lib.id":2, "lib.host":"h", "lib.sub.id":3}`)
+
+	app := lager.AddPairs(lager.Namespace(sub, ""), "id", 4)
+	u.Like(pairs(app), "namespace cleared",
+		`{"id":4, "lib.id":2, "lib.host":"h", "lib.sub.id":3}`)
+
+	u.Like(pairs(ctx), "original context unchanged", `{"id":1}`)
+
+	nilNs := lager.AddPairs(lager.Namespace(nil, "nil"), "id", 5)
+	u.Like(pairs(nilNs), "nil Ctx", `{"nil.id":5}`)
+
+	op, _ := lager.StartOperation(lib, "job")
+	u.Like(pairs(op), "operation key not namespaced",
+		`"lib.host":"h", "(logging.googleapis.com/)?operation":{"id":`)
+}
+
+func TestBatch(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+	defer lager.SetDurationFormat(lager.DurationString)
+	lager.SetDurationFormat(lager.DurationString)
+
+	b := lager.Batch(lager.WARN, lager.AddPairs(context.Background(), "r", 1))
+	b.Add("step one", "n", 1)
+	b.Add("step two")
+	u.Is(2, b.Len(), "Len")
+	u.Is("", log.String(), "nothing logged before Close")
+	b.Close("done", "ok", true)
+	b.Add("too late")
+	b.Close("again")
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	u.Is(1, len(lines), "one line")
+	u.Like(lines[0], "batch line", `"WARN", "done", {"ok":true, "events":\[`,
+		`{"msg":"step one", "elapsed":"[^"]+", "n":1}, `,
+		`{"msg":"step two", "elapsed":"[^"]+"}\]`, `"r":1}`)
+
+	log.Reset()
+	b = lager.Batch(lager.GUTS)
+	b.Add("ignored")
+	u.Is(0, b.Len(), "disabled batch records nothing")
+	b.Close("disabled")
+	u.Is("", log.String(), "disabled batch logs nothing")
+}
+
+func TestStartOperation(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+
+	ctx, done := lager.StartOperation(context.Background(), "sync", "n", 2)
+	lager.Warn(ctx).MMap("working")
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			done("changed", 5)
+		}()
+	}
+	wg.Wait()
+	done()
+	op := `"(logging.googleapis.com/)?operation":{`
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	u.Is(3, len(lines), "3 lines")
+	u.Like(lines[0], "start line", `"Operation started", {"n":2, `,
+		op+`"id":"[0-9a-f]{32}", "producer":"sync", "first":true}}`)
+	id := regexp.MustCompile(`"id":"[0-9a-f]+"`).FindString(lines[0])
+	u.Like(lines[1], "line during operation",
+		`"working", {`+op+id+`, "producer":"sync"}}`)
+	u.Like(lines[2], "end line", `"Operation finished", {"duration":`,
+		`"changed":5, `+op+id+`, "producer":"sync", "last":true}}`)
+}
+
+func TestInstance(t *testing.T) {
+	u := tutl.New(t)
+	global := bytes.NewBuffer(nil)
+	defer lager.SetOutput(global)()
+
+	log := bytes.NewBuffer(nil)
+	in := lager.New(lager.WithLevels("FWD"), lager.WithOutput(log),
+		lager.WithKeys("t", "lev", "msg", "data", "", "mod"))
+	u.Is("FWD", in.GetLevels(), "instance levels")
+	in.Debug().MMap("debug on", "x", 1)
+	in.Note().MMap("note off")
+	u.Like(log.String(), "instance output",
+		`"lev":"DEBUG", "msg":"debug on", "x":1}`, "!*note off")
+	u.Is("", global.String(), "instance doesn't use global output")
+
+	lager.Warn().List("global")
+	u.Like(global.String(), "global config unchanged", "*global")
+	u.Is(false, lager.Debug().Enabled(), "global levels unchanged")
+
+	log.Reset()
+	in.Update(lager.WithKeys("", "", "", "", "", ""), lager.WithLevels("I"))
+	u.Is("I", in.GetLevels(), "updated levels")
+	in.AtLevel(lager.INFO).List("as list")
+	u.Like(log.String(), "updated keys", `"INFO", "as list"\]`)
+
+	log.Reset()
+	gcp := lager.New(lager.WithOutput(log), lager.WithGcp())
+	gcp.Warn().MMap("in gcp")
+	u.Like(log.String(), "gcp instance",
+		`"severity":"400", "message":"in gcp", "json":1}`)
+
+	u.Like(u.GetPanic(func() { in.Level('Q') }), "invalid level",
+		"Level[(][)] must be one char")
+}
+
+func TestClone(t *testing.T) {
+	u := tutl.New(t)
+	global := bytes.NewBuffer(nil)
+	defer lager.SetOutput(global)()
+
+	log := bytes.NewBuffer(nil)
+	def := lager.Default()
+	u.Is(lager.Warn().Enabled(), def.Warn().Enabled(), "Default matches")
+	clone := def.Clone(lager.WithOutput(log), lager.WithLevels("FWND"))
+	clone.Debug().List("clone debug")
+	u.Like(log.String(), "clone output", "*clone debug")
+	u.Is("", global.String(), "clone has own output")
+	u.Is(false, lager.Debug().Enabled(), "package levels unchanged")
+
+	def.Warn().List("via default")
+	u.Like(global.String(), "Default uses package output", "*via default")
+
+	defer lager.Init("")
+	def.Update(lager.WithLevels("FWNAD"))
+	u.Is(true, lager.Debug().Enabled(), "Default().Update() changes package")
+	u.Is("FWND", clone.GetLevels(), "clone unaffected by Default update")
+
+	other := clone.Clone(lager.WithLevels("F"))
+	u.Is("F", other.GetLevels(), "clone of clone")
+	u.Is("FWND", clone.GetLevels(), "original clone unchanged")
+
+	log.Reset()
+	undo := lager.PromoteMatching(regexp.MustCompile(`^hello$`), 'D')
+	promoted := def.Clone(lager.WithOutput(log))
+	undo()
+	promoted.Warn().MMap("hello")
+	u.Like(log.String(), "clone has no promotions", `"WARN", "hello"`)
+}
+
+func TestStats(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+	defer lager.Init("")
+	lager.Init("FWN")
+	u.Is("FWN", lager.EnabledLevels(), "EnabledLevels")
+
+	before := lager.Stats()
+	lager.Warn().List("counted")
+	lager.Warn().List("counted")
+	lager.Debug().List("suppressed")
+	lager.Debug().Enabled() // Not a line, so not counted.
+	mod := lager.NewModule("statsmod", "F")
+	mod.Fail().List("module line")
+	mod.Warn().List("module suppressed")
+	after := lager.Stats()
+
+	u.Is(before[""][lager.WARN].Emitted+2, after[""][lager.WARN].Emitted,
+		"emitted count")
+	u.Is(before[""][lager.DEBUG].Suppressed+1,
+		after[""][lager.DEBUG].Suppressed, "suppressed count")
+	u.Is(lager.LevelCounts{Emitted: 1}, after["statsmod"][lager.FAIL],
+		"module emitted")
+	u.Is(lager.LevelCounts{Suppressed: 1}, after["statsmod"][lager.WARN],
+		"module suppressed")
+	_, ok := after["statsmod"][lager.INFO]
+	u.Is(false, ok, "zero counts omitted")
+
+	in := lager.New(lager.WithLevels("F"), lager.WithOutput(log))
+	in.Fail().List("instance line")
+	in.Warn().List("instance suppressed")
+	in.Warn().List("instance suppressed")
+	u.Is(after, lager.Stats(), "instance lines not in global counts")
+	u.Is(map[string]map[lager.LogLevel]lager.LevelCounts{"": {
+		lager.FAIL: {Emitted: 1}, lager.WARN: {Suppressed: 2},
+	}}, in.Stats(), "instance counts")
+	u.Is(0, len(in.Clone().Stats()), "clone starts with zero counts")
+	u.Is(after, lager.Default().Stats(), "Default() has global counts")
+
+	// Once any rule exists, disabled levels give quiet loggers instead:
+	defer lager.PromoteMatching(regexp.MustCompile(`^nothing$`), 'W')()
+	lager.Debug().MMap("suppressed")
+	lager.Debug().List("suppressed")
+	lager.Info().MMap("nothing")
+	u.Is(after[""][lager.DEBUG].Suppressed+2,
+		lager.Stats()[""][lager.DEBUG].Suppressed,
+		"suppressed count with promotion rules")
+	u.Is(after[""][lager.WARN].Emitted+1,
+		lager.Stats()[""][lager.WARN].Emitted, "promoted line counted")
+}
+
+func TestOnce(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+
+	for i := 0; i < 3; i++ {
+		lager.Once("test-once", lager.Warn()).MMap("once", "i", i)
+	}
+	u.Is(1, strings.Count(log.String(), `"once"`), "Once logs once")
+	u.Like(log.String(), "first call logs", `"i":0`)
+
+	log.Reset()
+	for i := 0; i < 3; i++ {
+		lager.OncePer("test-per", time.Hour, lager.Warn()).MMap("per")
+	}
+	u.Is(1, strings.Count(log.String(), `"per"`), "OncePer within interval")
+
+	log.Reset()
+	for i := 0; i < 3; i++ {
+		lager.OncePer("test-per0", 0, lager.Warn()).MMap("always")
+	}
+	u.Is(3, strings.Count(log.String(), `"always"`), "OncePer zero interval")
+
+	log.Reset()
+	lager.Once("test-shared", lager.Warn()).MMap("once shared")
+	lager.OncePer("test-shared", time.Hour, lager.Warn()).MMap("per shared")
+	u.Like(log.String(), "separate key spaces",
+		`"once shared"`, `"per shared"`)
+
+	log.Reset()
+	lager.Once("test-disabled", lager.Debug()).MMap("disabled")
+	lager.OncePer("test-disabled", time.Hour, lager.Debug()).MMap("disabled")
+	lager.Once("test-disabled", lager.Warn()).MMap("now enabled")
+	lager.OncePer("test-disabled", time.Hour, lager.Warn()).MMap("per enabled")
+	u.Like(log.String(), "disabled level does not use up key",
+		"!*disabled", `"now enabled"`, `"per enabled"`)
+}
+
+func TestAssert(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+
+	u.Is(true, lager.Assert(true, "fine"), "Assert true")
+	u.Is(true, lager.Check(nil, "fine"), "Check nil")
+	u.Is("", log.String(), "nothing logged when ok")
+
+	u.Is(false, lager.Assert(1 > 2, "Math broke", "x", 1), "Assert false")
+	u.Like(log.String(), "Assert line", `"FAIL", "Math broke", {"x":1}`,
+		`"_file":"[^"]*lager_test.go"`, `"_stack":\["[0-9]+ [^"]*lager_test.go `)
+	log.Reset()
+
+	u.Is(false, lager.Check(io.EOF, "Read failed", "f", "a"), "Check err")
+	u.Like(log.String(), "Check line", `"Read failed", {"err":{"msg":"EOF"`,
+		`"f":"a"}`)
+
+	lager.SetAssertPanics(true)
+	defer lager.SetAssertPanics(false)
+	u.Like(u.GetPanic(func() { lager.Assert(false, "dev") }),
+		"panics in dev mode", "Assertion failed: dev")
+	u.Is(nil, u.GetPanic(func() { lager.Assert(true, "dev") }),
+		"no panic when ok")
+}
+
+func TestPairFromContext(t *testing.T) {
+	u := tutl.New(t)
+	ctx := context.Background()
+	_, ok := lager.PairFromContext(ctx, "id")
+	u.Is(false, ok, "no pairs")
+
+	ctx = lager.AddPairs(ctx, "id", "r-1", "n", uint8(7), "b", []byte("x"),
+		"big", uint64(math.MaxUint64), "f", 1.5)
+	val, ok := lager.PairFromContext(ctx, "f")
+	u.Is(true, ok, "found")
+	u.Is(1.5, val, "value")
+	_, ok = lager.PairFromContext(ctx, "missing")
+	u.Is(false, ok, "missing key")
+
+	s, ok := lager.StringFromContext(ctx, "id")
+	u.Is("r-1", s, "string value")
+	u.Is(true, ok, "string ok")
+	s, _ = lager.StringFromContext(ctx, "b")
+	u.Is("x", s, "[]byte value")
+	_, ok = lager.StringFromContext(ctx, "n")
+	u.Is(false, ok, "not a string")
+
+	n, ok := lager.IntFromContext(ctx, "n")
+	u.Is(7, n, "int value")
+	u.Is(true, ok, "int ok")
+	_, ok = lager.IntFromContext(ctx, "big")
+	u.Is(false, ok, "uint64 too big")
+	_, ok = lager.IntFromContext(ctx, "id")
+	u.Is(false, ok, "not an int")
+}
+
+func TestPairsBuilder(t *testing.T) {
+	u := tutl.New(t)
+
+	var pb lager.PairsBuilder
+	u.Is(nil, pb.AMap(), "empty AMap")
+	bg := context.Background()
+	u.Is(bg, pb.InContext(bg), "empty InContext")
+
+	pb.Add("a", 1, "b", "two").Add("a", 3, "odd")
+	u.Is(3, pb.Len(), "len")
+	m := pb.AMap()
+	u.Is(lager.Pairs("a", 3, "b", "two", "odd", nil), m, "AMap")
+	pb.Merge(lager.Pairs("b", 4, "c", 5)).Merge(nil)
+	u.Is(lager.Pairs("a", 3, "b", "two", "odd", nil), m, "AMap not changed")
+	u.Is(lager.Pairs("a", 3, "b", 4, "odd", nil, "c", 5), pb.AMap(), "merged")
+
+	ctx := lager.AddPairs(bg, "x", 0, "a", 0)
+	ctx = pb.InContext(ctx)
+	u.Is(lager.Pairs("x", 0, "a", 3, "b", 4, "odd", nil, "c", 5),
+		lager.ContextPairs(ctx), "InContext")
+	pb.Reset()
+	u.Is(0, pb.Len(), "reset")
+	pb.Add("id", "req-1")
+	ctx = pb.InContext(lager.Namespace(bg, "mw"))
+	u.Is(lager.Pairs("mw.id", "req-1"), lager.ContextPairs(ctx), "namespace")
+
+	allocs := testing.AllocsPerRun(100, func() {
+		pb.Reset()
+		pb.Add("method", "GET", "path", "/", "requestId", "req-2")
+	})
+	u.Is(0.0, allocs, "reuse allocates nothing")
+	allocs = testing.AllocsPerRun(100, func() { pb.AMap() })
+	u.Is(1.0, allocs, "AMap allocates once")
+}
+
+func TestKVPairsAccessors(t *testing.T) {
+	u := tutl.New(t)
+	var empty lager.AMap
+	u.Is(0, empty.Len(), "nil Len")
+	u.Is(0, len(empty.Keys()), "nil Keys")
+	_, ok := empty.Get("a")
+	u.Is(false, ok, "nil Get")
+	empty.Range(func(string, interface{}) bool {
+		t.Error("Range called f on nil AMap")
+		return true
+	})
+
+	kv := lager.Pairs("a", 1, "b", "two", "c", 3.5)
+	u.Is(3, kv.Len(), "Len")
+	keys := kv.Keys()
+	u.Is("[a b c]", fmt.Sprint(keys), "Keys")
+	keys[0] = "changed"
+	u.Is("a", kv.Keys()[0], "Keys returns a copy")
+	val, ok := kv.Get("b")
+	u.Is("two", val, "Get value")
+	u.Is(true, ok, "Get found")
+	_, ok = kv.Get("z")
+	u.Is(false, ok, "Get missing")
+
+	seen := ""
+	kv.Range(func(k string, v interface{}) bool {
+		seen += k + "=" + lager.S(v) + " "
+		return "b" != k
+	})
+	u.Is("a=1 b=two ", seen, "Range stops when f returns false")
+}
+
+func TestPairsJSON(t *testing.T) {
+	u := tutl.New(t)
+	kv := lager.Pairs("z", 1, "a", "two", "m", lager.Map("y", true, "b", nil),
+		"l", lager.List(1.5, "x"))
+	buf, err := json.Marshal(kv)
+	u.Is(nil, err, "marshal AMap err")
+	want := `{"z":1,"a":"two","m":{"y":true,"b":null},"l":[1.5,"x"]}`
+	u.Is(want, string(buf), "marshal AMap")
+
+	var back lager.KVPairs
+	u.Is(nil, json.Unmarshal(buf, &back), "unmarshal AMap err")
+	u.Is("[z a m l]", fmt.Sprint(back.Keys()), "unmarshal AMap keys")
+	z, _ := back.Get("z")
+	u.Is(int64(1), z, "integers become int64")
+	m, _ := back.Get("m")
+	u.Is("[y b]", fmt.Sprint(m.(lager.AMap).Keys()), "nested object order")
+	again, _ := json.Marshal(&back)
+	u.Is(want, string(again), "AMap round trip")
+
+	raw := lager.Map("k", 1, "k", 2.5)
+	buf, err = json.Marshal(raw)
+	u.Is(nil, err, "marshal RawMap err")
+	u.Is(`{"k":1,"k":2.5}`, string(buf), "marshal RawMap keeps duplicates")
+	var rm lager.RawMap
+	u.Is(nil, json.Unmarshal(buf, &rm), "unmarshal RawMap err")
+	u.Is("[k 1 k 2.5]", fmt.Sprint(rm), "unmarshal RawMap")
+
+	u.Is(nil, json.Unmarshal([]byte(`{"k":1,"j":2,"k":3}`), &back),
+		"unmarshal dups err")
+	u.Is("[k j]", fmt.Sprint(back.Keys()), "last dup wins in first position")
+	k, _ := back.Get("k")
+	u.Is(int64(3), k, "last dup value")
+
+	u.Like(json.Unmarshal([]byte(`[1,2]`), &back), "err for list",
+		"*must be an object")
+	u.Like(json.Unmarshal([]byte(`"x"`), &rm), "err for string",
+		"*must be an object")
+
+	ctx := lager.AddPairs(context.Background(), "reqID", "r1")
+	buf, _ = json.Marshal(lager.ContextPairs(ctx))
+	var stored lager.KVPairs
+	u.Is(nil, json.Unmarshal(buf, &stored), "unmarshal stored err")
+	ctx = stored.InContext(context.Background())
+	id, _ := lager.StringFromContext(ctx, "reqID")
+	u.Is("r1", id, "pairs replayed into worker context")
+}
+
+func TestRequestBudget(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+	lager.Init("FWNAITD")
+	defer lager.Init("FWNA")
+
+	ctx := context.Background()
+	u.Is(ctx, lager.RequestBudget(ctx), "budgets disabled by default")
+
+	lager.SetRequestBudget(3, 0)
+	defer lager.SetRequestBudget(0, 0)
+	ctx = lager.RequestBudget(lager.AddPairs(ctx, "reqID", "r1"))
+	u.Is(ctx, lager.RequestBudget(ctx), "budget not replaced")
+
+	lager.Debug(ctx).MMap("one")
+	lager.Info(ctx).MMap("two")
+	lager.Trace(ctx).MMap("three")
+	u.Is(3, strings.Count(log.String(), "\n"), "within budget")
+	log.Reset()
+
+	lager.Debug(ctx).MMap("four")
+	u.Is(1, strings.Count(log.String(), "\n"), "only summary line")
+	u.Like(log.String(), "summary",
+		"exceeded its log budget", `"lineBudget":3`, `"r1"`, "!four")
+	log.Reset()
+
+	lager.Debug(ctx).MMap("five")
+	lager.Warn(ctx).MMap("six")
+	u.Like(log.String(), "after budget", "six", "!five", "!*budget")
+	log.Reset()
+
+	lager.Debug().MMap("no request")
+	u.Like(log.String(), "no budget without context", "no request")
+	log.Reset()
+
+	lager.SetRequestBudget(0, 100)
+	ctx = lager.RequestBudget(context.Background())
+	lager.Debug(ctx).MMap("short")
+	lager.Debug(ctx).MMap(strings.Repeat("long", 30))
+	u.Like(log.String(), "byte budget",
+		"short", "!longlong", `"byteBudget":100`)
+}
+
+func TestAppendJSONString(t *testing.T) {
+	u := tutl.New(t)
+	u.Is(`pre"a\"b\\c\n"`, lager.AppendJSONString([]byte("pre"), "a\"b\\c\n"),
+		"escapes")
+	u.Is(`"bad«xC0»byte"`, lager.AppendJSONString(nil, "bad\xC0byte"),
+		"invalid UTF-8")
+
+	defer lager.SetEscapeMode(lager.EscapeDefault)
+	lager.SetEscapeMode(lager.EscapeASCII)
+	u.Is(`"caf\u00E9"`, lager.AppendJSONString(nil, "café"), "ASCII mode")
+
+	for _, mode := range []lager.EscapeMode{
+		lager.EscapeDefault, lager.EscapeASCII, lager.EscapeUTF8,
+		lager.EscapeHTML,
+	} {
+		lager.SetEscapeMode(mode)
+		for _, s := range []string{
+			"", "plain words", "tab\tand\x00nul", "<&>  ",
+			"emoji \U0001F600", "\u0085\u009f ", strings.Repeat("ab", 40),
+		} {
+			var back string
+			quoted := lager.AppendJSONString(nil, s)
+			u.Is(nil, json.Unmarshal(quoted, &back),
+				"valid JSON for "+strconv.Quote(s))
+			u.Is(s, back, "round trip for "+strconv.Quote(s))
+		}
+	}
+}
+
+func FuzzAppendJSONString(f *testing.F) {
+	for _, s := range []string{
+		"", "plain words", "a\"b\\c\n", "tab\tand\x00nul", "<&>\u2028 ",
+		"emoji \U0001F600", "\u0085\u009f ", "bad\xC0byte", "\xED\xA0\x80",
+		"\xF4\x90\x80\x80", strings.Repeat("ab", 40),
+	} {
+		f.Add(s)
+	}
+	defer lager.SetEscapeMode(lager.EscapeDefault)
+	f.Fuzz(func(t *testing.T, s string) {
+		for _, mode := range []lager.EscapeMode{
+			lager.EscapeDefault, lager.EscapeASCII, lager.EscapeUTF8,
+			lager.EscapeHTML,
+		} {
+			lager.SetEscapeMode(mode)
+			quoted := lager.AppendJSONString([]byte("x"), s)
+			if 'x' != quoted[0] {
+				t.Fatalf("mode %d: prefix lost for %q", mode, s)
+			}
+			var back string
+			if err := json.Unmarshal(quoted[1:], &back); nil != err {
+				t.Fatalf("mode %d: invalid JSON %s for %q: %v",
+					mode, quoted[1:], s, err)
+			}
+			if utf8.ValidString(s) && back != s {
+				t.Fatalf("mode %d: %q round-tripped as %q", mode, s, back)
+			} else if !utf8.ValidString(back) {
+				t.Fatalf("mode %d: %q decoded to invalid UTF-8", mode, s)
+			}
+			// Non-UTF-8 bytes are always logged like "«xC0»":
+			ascii := lager.EscapeASCII == mode && utf8.ValidString(s)
+			for _, c := range quoted {
+				if c < ' ' || ascii && 0x80 <= c {
+					t.Fatalf("mode %d: unescaped byte %#x in %s for %q",
+						mode, c, quoted, s)
+				}
+			}
+		}
+	})
+}
+
+type testUUID [4]byte
+
+func (id testUUID) String() string { return "stringer" }
+
+type testMoney struct{ cents int64 }
+
+func TestRegisterEncoder(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+	uuidType := reflect.TypeOf(testUUID{})
+	moneyType := reflect.TypeOf(testMoney{})
+	lager.RegisterEncoder(uuidType, func(enc *lager.Encoder, v interface{}) {
+		id := v.(testUUID)
+		enc.String(hex.EncodeToString(id[:]))
+		enc.String("ignored")
+	})
+	lager.RegisterEncoder(moneyType, func(enc *lager.Encoder, v interface{}) {
+		m := v.(testMoney)
+		enc.Map("units", m.cents/100, "cents", m.cents%100)
+	})
+	defer lager.RegisterEncoder(uuidType, nil)
+	defer lager.RegisterEncoder(moneyType, nil)
+
+	id := testUUID{0xde, 0xad, 0xbe, 0xef}
+	ctx := lager.AddPairs(context.Background(), "reqID", id)
+	lager.Warn(ctx).MMap("Encoded", "id", id, "total", testMoney{1234},
+		"list", lager.List(id))
+	u.Like(log.String(), "encoded",
+		`"id":"deadbeef", "total":{"units":12, "cents":34}`,
+		`"list":\["deadbeef"\]`, `"reqID":"deadbeef"`, "!stringer",
+		"!ignored")
+	log.Reset()
+
+	lager.RegisterEncoder(moneyType, func(*lager.Encoder, interface{}) {})
+	lager.Warn().MMap("Nothing", "total", testMoney{1})
+	u.Like(log.String(), "no value written", `"total":null`)
+	log.Reset()
+
+	lager.RegisterEncoder(uuidType, nil)
+	lager.Warn().MMap("Removed", "id", id)
+	u.Like(log.String(), "removed", `"id":"stringer"`)
+	log.Reset()
+
+	type centser interface{ Cents() int64 }
+	ifaceType := reflect.TypeOf((*centser)(nil)).Elem()
+	lager.RegisterEncoder(ifaceType, func(enc *lager.Encoder, v interface{}) {
+		enc.Int(v.(centser).Cents())
+	})
+	defer lager.RegisterEncoder(ifaceType, nil)
+	lager.Warn().MMap("Interface", "p", testPrice{250}, "m", testMoney{1})
+	u.Like(log.String(), "interface encoder", `"p":250, "m":null`)
+}
+
+type testPrice struct{ cents int64 }
+
+func (p testPrice) Cents() int64 { return p.cents }
+
+// Returns its content a few bytes at a time (splitting UTF-8 sequences).
+type trickleReader struct {
+	data []byte
+	err  error
+}
+
+func (r *trickleReader) Read(p []byte) (int, error) {
+	if 0 == len(r.data) {
+		if nil != r.err {
+			return 0, r.err
+		}
+		return 0, io.EOF
+	}
+	n := copy(p[:2], r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestStream(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+
+	text := "line \"one\"\nstill é \U0001F600 ok\xC0!"
+	lager.Warn().MMap("Streamed", "r", lager.Stream(&trickleReader{
+		data: []byte(text)}))
+	want := string(lager.AppendJSONString(nil, text))
+	u.Like(log.String(), "reader", `"r":`+regexp.QuoteMeta(want)+`}`)
+	log.Reset()
+
+	lager.Warn().MMap("Streamed", "w", lager.Stream(strings.NewReader("ab")),
+		"e", lager.Stream(&trickleReader{data: []byte("par\xC3"),
+			err: io.ErrUnexpectedEOF}),
+		"x", lager.Stream(17))
+	u.Like(log.String(), "writer-to and errors", `"w":"ab"`,
+		`"e":"par«xC3»«error: unexpected EOF»"`, `"x":17`)
+}
+
+func TestLines(t *testing.T) {
+	u := tutl.New(t)
+	u.Is("[]", fmt.Sprint(lager.Lines("")), "empty")
+	u.Is("[]", fmt.Sprint(lager.Lines("\n")), "just newline")
+	u.Is("[one]", fmt.Sprint(lager.Lines("one")), "one line")
+	u.Is(3, len(lager.Lines("a\r\n\nc\n")), "blank line kept")
+
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+	lager.Warn().MMap("Output", "out", lager.Lines("a\r\n\tb\n\nc\n"))
+	u.Like(log.String(), "logged", `"out":\["a", "\\tb", "", "c"\]`)
+}
+
+// Run in separate processes so one can crash.
+func TestCaptureCrashOutput(t *testing.T) {
+	u := tutl.New(t)
+	if path := os.Getenv("LAGER_TEST_CRASH"); "" != path {
+		if err := lager.CaptureCrashOutput(path); nil != err {
+			fmt.Println("capture failed:", err)
+			return
+		}
+		if "" != os.Getenv("LAGER_TEST_CRASH_NOW") {
+			go func() { panic("crash test boom") }()
+			select {}
+		}
+		fmt.Println("no crash")
+		return
+	}
+	path := t.TempDir() + "/crash.out"
+	child := func(crash string) ([]byte, error) {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestCaptureCrashOutput$")
+		cmd.Env = append(os.Environ(), "LAGER_TEST_CRASH="+path,
+			"LAGER_TEST_CRASH_NOW="+crash)
+		return cmd.CombinedOutput()
+	}
+
+	out, err := child("")
+	if bytes.Contains(out, []byte("requires Go 1.23")) {
+		t.Skip("CaptureCrashOutput() requires Go 1.23")
+	}
+	u.Is(nil, err, "no crash, no file")
+	u.Like(out, "first run", "no crash", "!crashed")
+
+	out, err = child("1")
+	u.Is(true, nil != err, "crashed")
+	u.Like(out, "crash output on stderr", "crash test boom")
+	saved, _ := os.ReadFile(path)
+	u.Like(saved, "crash output in file", "panic: crash test boom",
+		"goroutine")
+
+	out, err = child("")
+	u.Is(nil, err, "next run")
+	u.Like(out, "crash logged", `"EXIT", "Prior run crashed"`,
+		`"crashOutput":\["panic: crash test boom"`,
+		`"crashFile":"`+regexp.QuoteMeta(path)+`"`, "no crash")
+	saved, _ = os.ReadFile(path)
+	u.Is(0, len(saved), "file truncated")
+
+	out, err = child("")
+	u.Is(nil, err, "later run")
+	u.Like(out, "nothing to log", "!crashed")
+}
+
+func TestExitCode(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+	exitWith := func(pairs ...interface{}) (status int) {
+		defer lager.ExitViaPanic()(func(x *int) { status, *x = *x, -1 })
+		lager.Exit().MMap("Exiting", pairs...)
+		return -2
+	}
+
+	u.Is(1, exitWith("a", 1), "default status")
+	u.Is(3, exitWith("a", 1, lager.ExitCode(3)), "ExitCode")
+	u.Like(log.String(), "logged", `"a":1, "exitCode":3`)
+	u.Is(1, exitWith(), "status reset after ExitCode")
+	u.Is(4, exitWith(lager.ExitCode(2), lager.ExitCode(4)), "last wins")
+	u.Is(1, exitWith("m", lager.Map(lager.ExitCode(6))), "nested ignored")
+	u.Like(log.String(), "nested logged", `"m":\{"exitCode":6\}`)
+	u.Is(2, exitWith(lager.ExitCode(2), "l", lager.List(lager.Map(
+		lager.ExitCode(8)))), "nested in list ignored")
+	u.Is(3, exitWith(lager.InlinePairs, lager.Map(lager.ExitCode(3))),
+		"inlined honored")
+	lager.Keys("t", "l", "m", "data", "", "mod")
+	u.Is(3, exitWith(lager.ExitCode(3)), "keys")
+	u.Is(1, exitWith("m", lager.Map(lager.ExitCode(6))), "keys nested")
+	lager.Keys("", "", "", "", "", "")
+
+	lager.SetPairOrder(lager.PairsSorted)
+	defer lager.SetPairOrder(lager.PairsAsGiven)
+	u.Is(5, exitWith("z", 1, lager.ExitCode(5)), "sorted pairs")
+	u.Is(1, exitWith("m", lager.Map(lager.ExitCode(6))), "sorted nested")
+
+	if "" != os.Getenv("LAGER_TEST_EXIT_CODE") {
+		lager.Exit().MMap("Direct", lager.ExitCode(7))
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestExitCode$")
+	cmd.Env = append(os.Environ(), "LAGER_TEST_EXIT_CODE=1")
+	err := cmd.Run()
+	ee, ok := err.(*exec.ExitError)
+	u.Is(true, ok, "child exited with error")
+	if ok {
+		u.Is(7, ee.ExitCode(), "direct os.Exit status")
+	}
+}
+
+// Run in a separate process so stdout can be closed.
+func TestStdoutFallback(t *testing.T) {
+	u := tutl.New(t)
+	if path := os.Getenv("LAGER_TEST_FALLBACK"); "" != path {
+		os.Stdout.Close()
+		lager.Warn().MMap("First lost line")
+		lager.Warn().MMap("Second lost line")
+		return
+	}
+	path := t.TempDir() + "/fallback.log"
+	cmd := exec.Command(os.Args[0], "-test.run=^TestStdoutFallback$")
+	cmd.Env = append(os.Environ(), "LAGER_TEST_FALLBACK="+path,
+		"LAGER_STDOUT_FALLBACK="+path)
+	u.Is(nil, cmd.Run(), "child ran")
+	saved, err := os.ReadFile(path)
+	u.Is(nil, err, "fallback file written")
+	lines := strings.Split(strings.TrimSuffix(string(saved), "\n"), "\n")
+	if u.Is(3, len(lines), "fallback lines") {
+		u.Like(lines[0], "note", `"NOTE"`, "using fallback file",
+			`"stream":"stdout"`, "*closed", `"fallback":"`)
+		u.Like(lines[1], "first", "First lost line")
+		u.Like(lines[2], "second", "Second lost line")
+	}
+}
+
+// Run in a separate process so stdout and stderr can be captured.
+func TestStderrLevels(t *testing.T) {
+	u := tutl.New(t)
+	if "" != os.Getenv("LAGER_TEST_STDERR") {
+		lager.Keys("t", "l", "msg", "data", "", "mod")
+		lager.Fail().MMap("to-stderr-1")
+		lager.Warn().MMap("to-stderr-2")
+		lager.Note().MMap("to-stdout-1")
+		lager.SetStderrLevels("N")
+		lager.Warn().MMap("to-stdout-2")
+		lager.Note().MMap("to-stderr-3")
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestStderrLevels$")
+	cmd.Env = append(os.Environ(), "LAGER_TEST_STDERR=1",
+		"LAGER_STDERR_LEVELS=error,warn")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	u.Is(nil, cmd.Run(), "child ran")
+	u.Like(stderr.String(), "stderr",
+		"to-stderr-1", "to-stderr-2", "to-stderr-3", "!to-stdout")
+	u.Like(stdout.String(), "stdout",
+		"to-stdout-1", "to-stdout-2", "!to-stderr")
+}
+
+func TestWriteFaults(t *testing.T) {
+	u := tutl.New(t)
+
+	n, err := lager.FaultyWriter(1.0, nil).Write([]byte("x"))
+	u.Is(0, n, "faulty write size")
+	u.Is(lager.ErrInjectedFault, err, "default error")
+	var buf bytes.Buffer
+	n, err = lager.FaultyWriter(0.0, io.EOF, &buf).Write([]byte("x"))
+	u.Is(1, n, "passed-through write size")
+	u.Is(nil, err, "passed-through write")
+	u.Is("x", buf.String(), "written to wrapped writer")
+	n, err = lager.FaultyWriter(1.0, io.EOF, &buf).Write([]byte("y"))
+	u.Is(io.EOF, err, "given error")
+	u.Is("x", buf.String(), "failed write not passed through")
+
+	restore := lager.SetOutput(&buf)
+	buf.Reset()
+	faults := lager.WriteFaults()
+	lager.SetWriteFaults(1.0, io.ErrShortWrite)
+	defer lager.SetWriteFaults(0.0, nil)
+	lager.Warn().MMap("lost")
+	u.Is("", buf.String(), "line not written")
+	u.Is(faults+1, lager.WriteFaults(), "fault counted")
+	lager.SetWriteFaults(0.0, nil)
+	lager.Warn().MMap("kept")
+	u.Like(buf.String(), "line written", "kept")
+	restore()
+
+	path := t.TempDir() + "/fallback.log"
+	lager.SetStdoutFallback(path)
+	defer lager.SetStdoutFallback("")
+	lager.SetWriteFaults(1.0, io.ErrClosedPipe)
+	lager.Warn().MMap("To fallback")
+	lager.SetWriteFaults(0.0, nil)
+	saved, err := os.ReadFile(path)
+	u.Is(nil, err, "fallback file written")
+	u.Like(string(saved), "fallback", "using fallback file",
+		`"stream":"stdout"`, "closed pipe", "To fallback")
+}
+
+type panicky struct{}
+
+func TestInternalErrors(t *testing.T) {
+	u := tutl.New(t)
+	errs := lager.InternalErrors()
+	u.Is(errs, lager.InternalErrors(), "same channel")
+	for 0 < len(errs) {
+		<-errs
+	}
+	next := func() *lager.InternalError {
+		select {
+		case err := <-errs:
+			ie, _ := err.(*lager.InternalError)
+			return ie
+		default:
+			return nil
+		}
+	}
+
+	var buf bytes.Buffer
+	defer lager.SetOutput(&buf)()
+	lager.SetWriteFaults(1.0, io.ErrShortWrite)
+	lager.Warn().MMap("lost")
+	lager.SetWriteFaults(0.0, nil)
+	if ie := next(); u.Is(true, nil != ie, "write error reported") {
+		u.Is("write", ie.Op, "write op")
+		u.Is(io.ErrShortWrite, ie.Err, "write err")
+		u.Is(true, errors.Is(ie, io.ErrShortWrite), "unwraps")
+		u.Is("lager write: short write", ie.Error(), "message")
+	}
+
+	lager.Warn().MMap("bad", "val", func() {})
+	if ie := next(); u.Is(true, nil != ie, "encode error reported") {
+		u.Is("encode", ie.Op, "encode op")
+	}
+
+	typ := reflect.TypeOf(panicky{})
+	lager.RegisterEncoder(typ, func(enc *lager.Encoder, v interface{}) {
+		enc.String("partial")
+		panic("oops")
+	})
+	defer lager.RegisterEncoder(typ, nil)
+	buf.Reset()
+	lager.Warn().MMap("Panicky", "p", panicky{}, "after", 1)
+	u.Like(buf.String(), "panic logged",
+		`"p":"! encoder for lager_test.panicky panicked: oops", "after":1}`)
+	u.Is(false, strings.Contains(buf.String(), "partial"), "partial dropped")
+	if ie := next(); u.Is(true, nil != ie, "panic reported") {
+		u.Is("encoder", ie.Op, "encoder op")
+	}
+
+	stop := spans.OnFinish(func(_ spans.Factory, _ time.Duration) {
+		panic("bad hook")
+	})
+	spans.RunFinishHooks(spans.NewROSpan("proj"), time.Second)
+	stop()
+	if ie := next(); u.Is(true, nil != ie, "hook panic reported") {
+		u.Is("spanHook", ie.Op, "hook op")
+		u.Like(ie.Err, "hook err", "*OnFinish() hook panicked: bad hook")
+	}
+	u.Is(nil, next(), "no more errors")
+}
+
+func TestVerify(t *testing.T) {
+	u := tutl.New(t)
+	var buf bytes.Buffer
+	u.Is(nil, lager.Verify(&buf), "default config verifies")
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	u.Is(11, len(lines), "one line per level")
+	u.Like(buf.String(), "verify lines",
+		`"PANIC", "Verifying logging", \{"string":"Quote`,
+		`"EXIT", "Verifying logging"`, `"GUTS", "Verifying logging"`,
+		`"stream":"streamed\\n"`, `"lazy":"computed"`)
+	u.Is(nil, lager.Verify(nil), "discarded lines still verified")
+
+	lager.SetSequenceNumbers(true)
+	var seqLog bytes.Buffer
+	restore := lager.SetOutput(&seqLog)
+	lager.Warn().MMap("before")
+	stats := lager.Stats()
+	u.Is(nil, lager.Verify(nil), "verify with sequence numbers")
+	u.Is(stats, lager.Stats(), "Verify() lines not counted")
+	lager.Warn().MMap("after")
+	restore()
+	lager.SetSequenceNumbers(false)
+	seqs := regexp.MustCompile(`seq=(\d+)`).FindAllStringSubmatch(
+		seqLog.String(), -1)
+	if u.Is(2, len(seqs), "sequence numbers") {
+		before, _ := strconv.Atoi(seqs[0][1])
+		u.Is(u.S(before+1), seqs[1][1], "Verify() uses no sequence numbers")
+	}
+
+	lager.Keys("t", "l", "", "data", "", "mod")
+	buf.Reset()
+	u.Is(nil, lager.Verify(&buf), "keyed config verifies")
+	u.Like(buf.String(), "keyed lines", `"l":"GUTS", "msg":"Verifying`)
+	lager.Keys("", "", "", "", "", "")
+
+	typ := reflect.TypeOf(time.March)
+	lager.RegisterEncoder(typ, func(enc *lager.Encoder, v interface{}) {
+		enc.RawJSON([]byte("{bad"))
+	})
+	defer lager.RegisterEncoder(typ, nil)
+	u.Like(lager.Verify(nil), "bad encoder detected",
+		"^lager.Verify: PANIC line: invalid character")
+}
+
+func TestGcpOverflow(t *testing.T) {
+	u := tutl.New(t)
+	var log bytes.Buffer
+	defer lager.SetOutput(&log)()
+	lager.RunningInGcp()
+	defer lager.SetLevelNotation(nil)
+	defer lager.Keys("", "", "", "", "", "")
+	lager.SetGcpPayloadLimit(400)
+	defer lager.SetGcpPayloadLimit(0)
+
+	lager.Warn().MMap("Small", "a", 1)
+	u.Like(log.String(), "small line", "!overflow")
+	log.Reset()
+
+	big := strings.Repeat("x", 150)
+	lager.Warn().MMap("Big", "a", big, "b", big, "c", big, "d", 4)
+	lines := strings.Split(strings.TrimSuffix(log.String(), "\n"), "\n")
+	if !u.Is(3, len(lines), "split into lines") {
+		t.Log(log.String())
+		return
+	}
+	id := regexp.MustCompile(`"overflowId":"[0-9a-f]{16}"`).
+		FindString(lines[0])
+	u.IsNot("", id, "overflow ID")
+	for i, line := range lines {
+		var v map[string]interface{}
+		u.Is(nil, json.Unmarshal([]byte(line), &v), "line is valid JSON")
+		u.Is(true, len(line) <= 400, "line fits")
+		u.Like(line, "line "+strconv.Itoa(i),
+			`^\{"time":"[^"]+", "severity":"400", "message":"Big", `)
+		u.Is(true, strings.Contains(line, id), "line has ID")
+	}
+	u.Like(lines[0], "first line",
+		`"a":"x+", "overflowId":"[^"]+", "overflowParts":2\}$`)
+	u.Like(lines[1], "second line", `, "overflowPart":1, "b":"x+"\}$`)
+	u.Like(lines[2], "third line", `, "overflowPart":2, "c":"x+", "d":4\}$`)
+	log.Reset()
+
+	span, err := spans.NewROSpan("proj").Import(
+		"0123456789abcdef0123456789abcdef", 20)
+	u.Is(nil, err, "import span")
+	ctx := lager.GcpContextAddTrace(context.Background(), span)
+	lager.SetGcpPayloadLimit(500)
+	lager.Warn(ctx).MMap("Traced", "a", big, "b", big)
+	lines = strings.Split(strings.TrimSuffix(log.String(), "\n"), "\n")
+	if u.Is(2, len(lines), "traced line split") {
+		trace := `"` + lager.GcpTraceKey + `":"projects/proj/traces/0123`
+		span := `"` + lager.GcpSpanKey + `":"0000000000000014"`
+		u.Like(lines[0], "trace kept in first line", trace, span,
+			`"a":"x+", "`+lager.GcpTraceKey)
+		u.Like(lines[1], "trace repeated in follow-up line", trace, span,
+			`"overflowPart":1, "b":"x+"\}$`)
+	}
+	log.Reset()
+
+	lager.SetGcpPayloadLimit(-1)
+	lager.Warn().MMap("Big", "a", big, "b", big, "c", big)
+	u.Is(1, strings.Count(log.String(), "\n"), "splitting disabled")
+	log.Reset()
+
+	lager.SetGcpPayloadLimit(100)
+	lager.Warn().MMap("Huge", "a", big)
+	u.Like(log.String(), "lone huge pair",
+		`"message":"Huge", "overflowId":"[^"]+", "overflowParts":1\}\n`,
+		`"message":"Huge", "overflowId":"[^"]+", "overflowPart":1, "a":"x+"\}`)
+}
+
+func TestRequestUser(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+
+	req := httptest.NewRequest("GET", "/who", nil)
+	u.Is("", lager.ClientCertUser(req.Context(), req), "no TLS")
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{
+		{Subject: pkix.Name{CommonName: "svc-a"}},
+	}}}
+	u.Is("svc-a", lager.ClientCertUser(req.Context(), req), "client cert")
+
+	lager.GcpLogAccess(req, nil, nil).MMap("no user func")
+	u.Like(log.String(), "no user func", `!"user"`)
+	log.Reset()
+
+	defer lager.AddUserFunc(lager.ClientCertUser)()
+	remove := lager.AddUserFunc(
+		func(ctx context.Context, r *http.Request) string {
+			return r.Header.Get("X-Test-User")
+		})
+	u.Is("svc-a", lager.RequestUser(req), "falls back to earlier func")
+	req.Header.Set("X-Test-User", "ann")
+	u.Is("ann", lager.RequestUser(req), "latest func first")
+	lager.GcpLogAccess(req, nil, nil).MMap("with user")
+	u.Like(log.String(), "access log has user", `"user":"ann"\}\]`)
+
+	remove()
+	u.Is("svc-a", lager.RequestUser(req), "removed func not used")
+	remove()
+	u.Is("svc-a", lager.RequestUser(req), "removing twice is harmless")
+}
+
+func TestSubject(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+
+	ctx := context.Background()
+	u.Is(ctx, lager.Subject(ctx, ""), "no subject")
+	u.Is("", lager.SubjectFromContext(ctx), "no subject in context")
+	ctx = lager.Subject(lager.Namespace(ctx, "db"), "cust-17")
+	u.Is("cust-17", lager.SubjectFromContext(ctx), "subject in context")
+	lager.Warn(ctx).MMap("Updated")
+	u.Like(log.String(), "subject logged",
+		`"Updated", \{"dataSubject":"cust-17"\}`)
+	log.Reset()
+
+	lager.SetSubjectPseudonymizer(func(id string) string {
+		return "p-" + strings.ToUpper(id)
+	})
+	defer lager.SetSubjectPseudonymizer(nil)
+	u.Is("p-CUST-18", lager.SubjectPseudonym("cust-18"), "pseudonym")
+	ctx = lager.Subject(ctx, "cust-18")
+	u.Is("p-CUST-18", lager.SubjectFromContext(ctx), "subject replaced")
+	lager.Warn(ctx).MMap("Deleted")
+	u.Like(log.String(), "pseudonym logged",
+		`"Deleted", \{"dataSubject":"p-CUST-18"\}`, "!cust-1")
+	lager.SetSubjectPseudonymizer(nil)
+	u.Is("cust-18", lager.SubjectPseudonym("cust-18"), "pseudonymizer reset")
+}
+
+func TestHashed(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+
+	mac := hmac.New(sha256.New, []byte("salt"))
+	mac.Write([]byte("ann@example.com"))
+	want := hex.EncodeToString(mac.Sum(nil))
+	u.Is(want, lager.HashValue("ann@example.com", "salt"), "HMAC default")
+	lager.Warn().MMap("Login",
+		lager.Hashed("email", "ann@example.com", "salt"), "ok", false)
+	u.Like(log.String(), "hashed pair",
+		`"Login", \{"email":"`+want+`", "ok":false\}`, "!ann@")
+	log.Reset()
+
+	hashed := lager.Hashed("email", "ann@example.com", "salt")
+	ctx := lager.AddPairs(context.Background(), hashed, "ok", true)
+	u.Is([]string{"email", "ok"}, lager.ContextPairs(ctx).Keys(), "AddPairs")
+	v, _ := lager.PairFromContext(ctx, "email")
+	u.Is(want, v, "AddPairs hashes value")
+	v, _ = lager.PairFromContext(ctx, "ok")
+	u.Is(true, v, "AddPairs pair after Hashed()")
+	ctx = lager.AddPairs(lager.Namespace(ctx, "db"), hashed, "n", 1)
+	v, _ = lager.PairFromContext(ctx, "db.email")
+	u.Is(want, v, "AddPairs in Namespace")
+	v, _ = lager.PairFromContext(ctx, "db.n")
+	u.Is(1, v, "AddPairs in Namespace after Hashed()")
+	v, _ = lager.Pairs("a", 1, hashed).Get("email")
+	u.Is(want, v, "Pairs")
+	pb := new(lager.PairsBuilder).Add(hashed, "ok", 1)
+	u.Is([]string{"email", "ok"}, pb.AMap().Keys(), "PairsBuilder")
+	v, _ = pb.AMap().Get("email")
+	u.Is(want, v, "PairsBuilder hashes value")
+	for _, f := range []string{"%v", "%+v", "%#v", "%s"} {
+		u.Like(fmt.Sprintf(f, hashed), "formatted "+f,
+			"!ann@", "!salt", "^Hashed[(]email:"+want+"[)]$")
+	}
+
+	lager.SetHashing(lager.HashSHA256, 16)
+	defer lager.SetHashing(lager.HashHMACSHA256, 0)
+	sum := sha256.Sum256([]byte("salt10.1.2.3"))
+	want = hex.EncodeToString(sum[:])[:16]
+	u.Is(want, lager.HashValue("10.1.2.3", "salt"), "truncated SHA-256")
+	lager.Warn().MMap("Hit", lager.Hashed("ip", "10.1.2.3", "salt"))
+	u.Like(log.String(), "truncated hash logged", `\{"ip":"`+want+`"\}`)
+	lager.SetHashing(lager.HashSHA256, 100)
+	u.Is(64, len(lager.HashValue("x", "")), "no more digits than hash")
+
+	u.Like(u.GetPanic(func() { lager.SetHashing(lager.HashAlgorithm(9), 0) }),
+		"bad algorithm", `Invalid lager.HashAlgorithm \(9\)`)
+	u.Like(u.GetPanic(func() { lager.SetHashing(lager.HashSHA256, -1) }),
+		"bad length", `Invalid hash length \(-1\)`)
+}
+
+func TestAnonymizeIPs(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+
+	u.Is("10.1.2.0", lager.AnonymizeIP("10.1.2.3"), "IPv4")
+	u.Is("2001:db8:1::", lager.AnonymizeIP("2001:db8:1:2::3"), "IPv6")
+	u.Is("10.1.2.0", lager.AnonymizeIP("::ffff:10.1.2.3"), "IPv4 in IPv6")
+	u.Is("pipe", lager.AnonymizeIP("pipe"), "not an IP")
+	u.Is("10.1.2.3", lager.RemoteIP("10.1.2.3:4567"), "port removed")
+	u.Is("2001:db8::9", lager.RemoteIP("[2001:db8::9]:443"), "IPv6 port")
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "203.0.113.77:5555"
+	lager.GcpLogAccess(req, nil, nil).MMap("full")
+	u.Like(log.String(), "full IP", `"remoteIp":"203\.0\.113\.77"`)
+	log.Reset()
+
+	lager.SetAnonymizeIPs(true)
+	defer lager.SetAnonymizeIPs(false)
+	u.Is("203.0.113.0", lager.RemoteIP(req.RemoteAddr), "anonymized")
+	lager.GcpLogAccess(req, nil, nil).MMap("anonymized")
+	u.Like(log.String(), "anonymized IP", `"remoteIp":"203\.0\.113\.0"`)
+	u.Like(lager.HttpInfo(req, nil, nil, lager.HttpApache), "apache",
+		`^203\.0\.113\.0 `)
+}
+
+func TestSetClock(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+
+	now := time.Date(2024, 1, 2, 3, 4, 5, 678900000, time.FixedZone("X", 3600))
+	lager.SetClock(func() time.Time { return now })
+	defer lager.SetClock(nil)
+	u.Is(now, lager.Now(), "Now() uses clock")
+
+	lager.Warn().MMap("Fixed")
+	u.Is(`["2024-01-02 02:04:05.6789Z", "WARN", "Fixed"]`+"\n",
+		log.String(), "deterministic timestamp")
+	log.Reset()
+
+	start := lager.Now()
+	now = now.Add(1500 * time.Millisecond)
+	req := httptest.NewRequest("GET", "/", nil)
+	lager.GcpLogAccess(req, nil, &start).MMap("Access")
+	u.Like(log.String(), "virtual latency", `"latency":"1\.5000s"`)
+	log.Reset()
+
+	lager.SetClock(nil)
+	u.Is(true, time.Since(lager.Now()) < time.Minute, "real clock restored")
+}
+
+func TestSequenceNumbers(t *testing.T) {
+	u := tutl.New(t)
+	log := bytes.NewBuffer(nil)
+	defer lager.SetOutput(log)()
+
+	lager.Warn().MMap("Unnumbered")
+	u.Like(log.String(), "off by default", "!seq")
+	log.Reset()
+
+	lager.SetSequenceNumbers(true)
+	defer lager.SetSequenceNumbers(false)
+	lager.Warn().MMap("First", "a", 1)
+	lager.Warn().List("Second")
+	lager.NewModule("seqmod").Warn().MMap("Third")
+	lines := strings.Split(strings.TrimSuffix(log.String(), "\n"), "\n")
+	if !u.Is(3, len(lines), "lines logged") {
+		return
+	}
+	re := regexp.MustCompile(`, "seq=(\d+)"\]$`)
+	var seqs []int
+	for _, line := range lines {
+		m := re.FindStringSubmatch(line)
+		if u.Is(2, len(m), "seq in "+line) {
+			n, _ := strconv.Atoi(m[1])
+			seqs = append(seqs, n)
+		}
+	}
+	if u.Is(3, len(seqs), "seqs found") {
+		u.Is(seqs[0]+1, seqs[1], "second follows first")
+		u.Is(seqs[1]+1, seqs[2], "third follows second")
+	}
+	u.Like(lines[2], "after mod", `"mod=seqmod", "seq=`)
+	log.Reset()
+
+	lager.Keys("t", "l", "msg", "data", "", "mod")
+	defer lager.Keys("", "", "", "", "", "")
+	lager.Warn().MMap("Keyed", "a", 1)
+	u.Like(log.String(), "keyed seq",
+		`"msg":"Keyed", "a":1, "seq":`+strconv.Itoa(seqs[2]+1)+`\}`)
+}
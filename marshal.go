@@ -7,12 +7,17 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"reflect"
+	"runtime"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode/utf16"
 	"unicode/utf8"
+	"unsafe"
 )
 
 /// TYPES ///
@@ -20,11 +25,21 @@ import (
 // An unshared, temporary structure for efficiently logging one line.
 type buffer struct {
 	scratch [16 * 1024]byte // Space so we can allocate memory only rarely.
-	buf     []byte          // Bytes not yet written (a slice into above).
+	buf     []byte          // The line so far (usually a slice into above).
 	w       io.Writer       // Usually os.Stdout, else os.Stderr.
+	out     *outLock        // The lock for 'w'.
 	delim   string          // Delimiter to go before next value.
-	locked  bool            // Whether we had to lock outMu.
+	from    int             // Where the line starts in 'buf' (see frame()).
 	g       *globals
+	depth   int      // How deeply nested the next value is.
+	guard   bool     // Whether to rename colliding keys (see userKey()).
+	exit    *int     // Exit status from ExitCode() (if any).
+	pairsAt int      // How deeply nested the line's own pairs are.
+	renamed []string // Keys renamed by userKey() (to warn about).
+	special []string // GCP keys written at the top level (see userKey()).
+	// How many values being written have keys that must not be normalized:
+	verbatim int
+	tops     []int // Where each top-level pair starts (see overflow()).
 }
 
 // A Stringer just has a String() method that returns its stringification.
@@ -41,76 +56,276 @@ var bufPool = sync.Pool{New: func() interface{} {
 	return b
 }}
 
-// A lock in case a log line is too large to buffer.
-var outMu sync.RWMutex
+// The lock for one output destination.  Each log line is written with a
+// single Write() call, never interleaved with other lines.  Lines written to
+// different destinations never contend for the same lock.
+//
+// If a line is logged from inside of the Write() method of the destination
+// (or from anything it calls), then the new line is queued and written by
+// the same goroutine once its current Write() returns.  So a Write() method
+// can log to the same destination without deadlocking.  Lines logged from
+// other goroutines wait for the destination to be free.  The stack is only
+// checked for an enclosing Write() when the destination is busy, so logging
+// to a free destination costs just a lock.
+type outLock struct {
+	mu      sync.Mutex
+	cond    sync.Cond // Signaled when the destination becomes free.
+	busy    bool      // Whether some goroutine is writing lines.
+	pending [][]byte  // Lines logged from inside of Write(), to be written.
+}
+
+// See SetOutput() for other destinations.
+var stdoutLock, stderrLock outLock
+
+// A buffer that grew larger than this is not kept for reuse.
+const maxPooledBuf = 64 * 1024
 
 // The (JSON) delimiter between values:
 const comma = ", "
 
 /// FUNCS ///
 
-var noEsc [256]bool
+// An escaper decides which characters get escaped inside of JSON strings.
+// Each EscapeMode has one (see escapers) and other encoders can define
+// their own while sharing the rest of the escaping logic.
+type escaper struct {
+	noEsc [256]bool         // Which bytes (mostly ASCII) need no escaping.
+	keep  func(r rune) bool // Whether a valid, non-ASCII rune needs no escaping.
+	words bool              // Whether plainWords() can be used (see init()).
+}
+
+// The escaper to use for each EscapeMode:
+var escapers [nEscapeModes]escaper
 var hexDigits = "0123456789ABCDEF"
 
 func init() {
-	for c := ' '; c < 127; c++ {
-		noEsc[c] = true
+	for m := range escapers {
+		noEsc := &escapers[m].noEsc
+		for c := ' '; c < 127; c++ {
+			noEsc[c] = true
+		}
+		noEsc['"'] = false
+		noEsc['\\'] = false
+	}
+	escapers[EscapeDefault].keep = func(r rune) bool {
+		return 0xA0 <= r && r <= 0xFFFF
+	}
+	escapers[EscapeASCII].keep = func(r rune) bool { return false }
+	escapers[EscapeUTF8].noEsc[0x7F] = true
+	escapers[EscapeUTF8].keep = func(r rune) bool { return true }
+	html := &escapers[EscapeHTML]
+	html.noEsc['<'] = false
+	html.noEsc['>'] = false
+	html.noEsc['&'] = false
+	html.keep = func(r rune) bool {
+		return 0xA0 <= r && r <= 0xFFFF && 0x2028 != r && 0x2029 != r
+	}
+	for m := range escapers {
+		escapers[m].words = plainWordsOkay(&escapers[m].noEsc)
 	}
-	noEsc['"'] = false
-	noEsc['\\'] = false
 }
 
-// Called when we need to flush early, to prevent interleaved log lines.
-func (b *buffer) lock() {
-	if !b.locked {
-		outMu.Lock()
-		b.locked = true
+// Returns 'true' if every byte that plainWords() accepts needs no escaping.
+func plainWordsOkay(noEsc *[256]bool) bool {
+	for c := ' '; c < 0x7F; c++ {
+		if !noEsc[c] && '"' != c && '\\' != c {
+			return false
+		}
 	}
-	if 0 < len(b.buf) {
-		b.w.Write(b.buf)
-		b.buf = b.scratch[0:0]
+	return true
+}
+
+const lowBits = 0x0101010101010101
+const highBits = 0x8080808080808080
+
+// plainWords() returns how many leading bytes of 's' are in 8-byte words
+// that contain no control characters, '"', '\\', DEL, nor non-ASCII.  That
+// is, it quickly skips runs of bytes that never need escaping.
+func plainWords(s string) int {
+	i := 0
+	for ; i+8 <= len(s); i += 8 {
+		w := s[i : i+8]
+		x := uint64(w[0]) | uint64(w[1])<<8 | uint64(w[2])<<16 |
+			uint64(w[3])<<24 | uint64(w[4])<<32 | uint64(w[5])<<40 |
+			uint64(w[6])<<48 | uint64(w[7])<<56
+		quote := x ^ (lowBits * '"')
+		slash := x ^ (lowBits * '\\')
+		bad := (x - lowBits*' ') &^ x     // High bit set for bytes < ' '.
+		bad |= (quote - lowBits) &^ quote // ... for '"'.
+		bad |= (slash - lowBits) &^ slash // ... for '\\'.
+		bad |= x + lowBits | x            // ... for bytes >= 0x7F.
+		if 0 != bad&highBits {
+			break
+		}
 	}
+	return i
 }
 
-// Called when finished composing a log line.
-func (b *buffer) unlock() {
-	if !b.locked {
-		outMu.RLock()
-		defer outMu.RUnlock()
+// Write one log line to 'w'.  If the line is being logged from inside of
+// w.Write(), then it is queued to be written once w.Write() returns (since
+// waiting would deadlock).  Otherwise, we wait until no other goroutine is
+// writing to 'w'.
+func (o *outLock) write(w io.Writer, line []byte) {
+	o.mu.Lock()
+	if nil == o.cond.L {
+		o.cond.L = &o.mu
 	}
-	if 0 < len(b.buf) {
-		b.w.Write(b.buf)
-		b.buf = b.scratch[0:0]
+	if o.busy && insideWrite() {
+		o.pending = append(o.pending, append([]byte(nil), line...))
+		o.mu.Unlock()
+		return
 	}
-	if b.locked {
-		b.locked = false
-		outMu.Unlock()
+	for o.busy {
+		o.cond.Wait()
 	}
+	o.busy = true
+	o.mu.Unlock()
+	o.writeAll(w, [][]byte{line}, nil)
 }
 
-// Append a slice of bytes to the log line.
-func (b *buffer) writeBytes(s []byte) {
-	if cap(b.buf) < len(b.buf)+len(s) {
-		b.lock() // Can't fit line in buffer; lock output mutex and flush.
+// Called by the goroutine that set o.busy to write 'lines', then to call
+// f.Flush() (if 'f' is not nil), and then to write any lines that get
+// queued, until none remain.
+func (o *outLock) writeAll(
+	w io.Writer, lines [][]byte, f interface{ Flush() error },
+) {
+	for {
+		for _, line := range lines {
+			writeLine(w, line)
+		}
+		if nil != f {
+			f.Flush()
+			f = nil
+		}
+		o.mu.Lock()
+		lines = o.pending
+		o.pending = nil
+		if 0 == len(lines) {
+			o.busy = false
+			o.cond.Broadcast()
+		}
+		o.mu.Unlock()
+		if 0 == len(lines) {
+			return
+		}
 	}
-	if cap(b.buf) < len(s) {
-		b.w.Write(s) // Next chunk won't fit in buffer, just write it.
+}
+
+// sync() waits until any lines being written (or queued) to 'w' have been
+// written and then, if 'w' has a Flush() method (like a CompressWriter or a
+// bufio.Writer), calls Flush().  Done after logging a Panic or Exit line
+// since the process may end soon.  If called from inside of w.Write(), then
+// the queued lines are written immediately, as waiting would deadlock.
+func (o *outLock) sync(w io.Writer) {
+	o.mu.Lock()
+	if nil == o.cond.L {
+		o.cond.L = &o.mu
+	}
+	if o.busy && insideWrite() {
+		lines := o.pending
+		o.pending = nil
+		o.mu.Unlock()
+		for _, line := range lines {
+			writeLine(w, line)
+		}
+		return
+	}
+	for o.busy {
+		o.cond.Wait()
+	}
+	f, ok := w.(interface{ Flush() error })
+	if !ok {
+		o.mu.Unlock()
+		return
+	}
+	o.busy = true
+	o.mu.Unlock()
+	o.writeAll(w, nil, f)
+}
+
+// Reports whether the calling goroutine is inside of a Write() (or Flush())
+// made by writeAll().  Only called when a destination is found to be busy,
+// so logging to a free destination never pays for walking the stack.
+func insideWrite() bool {
+	var pcs [128]uintptr
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs[:])])
+	for {
+		f, more := frames.Next()
+		if strings.HasSuffix(f.Function, ".(*outLock).writeAll") {
+			return true
+		} else if !more {
+			return false
+		}
+	}
+}
+
+// Room reserved for the length prefix when using FramingLength.
+const lengthRoom = 20
+
+// Called when starting a log line to add what goes before it for the
+// selected Framing.
+func (b *buffer) frame() {
+	switch b.g.framing {
+	case FramingJSONSeq:
+		b.buf = append(b.buf, 0x1E)
+	case FramingLength:
+		// The length isn't known yet, so leave room for it:
+		b.buf = b.buf[:len(b.buf)+lengthRoom]
+		b.from = len(b.buf)
+	}
+}
+
+// Called when finished composing a log line.  The whole line is composed
+// before the lock is taken so the lock is never held while user code (like
+// a String() method) runs.
+func (b *buffer) flush() {
+	if line := b.line(); 0 < len(line) {
+		b.out.write(b.w, line)
+	}
+	b.reset()
+}
+
+// Returns the composed log line, including what goes before it for the
+// selected Framing.
+func (b *buffer) line() []byte {
+	if 0 < b.from {
+		// Fill in the length prefix just before the line:
+		var digs [lengthRoom]byte
+		prefix := strconv.AppendInt(digs[:0], int64(len(b.buf)-b.from), 10)
+		prefix = append(prefix, ' ')
+		b.from -= len(prefix)
+		copy(b.buf[b.from:], prefix)
+	}
+	return b.buf[b.from:]
+}
+
+// Empties the buffer so it can be reused for another line.
+func (b *buffer) reset() {
+	b.from = 0
+	b.depth = 0
+	b.guard = false
+	b.renamed = b.renamed[:0]
+	b.special = b.special[:0]
+	b.verbatim = 0
+	b.tops = b.tops[:0]
+	b.exit = nil
+	b.pairsAt = 0
+	if maxPooledBuf < cap(b.buf) {
+		b.buf = b.scratch[0:0]
 	} else {
-		b.buf = append(b.buf, s...)
+		b.buf = b.buf[0:0]
 	}
 }
 
+// Append a slice of bytes to the log line.
+func (b *buffer) writeBytes(s []byte) {
+	b.buf = append(b.buf, s...)
+}
+
 // Append strings to the log line.
 func (b *buffer) write(strs ...string) {
 	for _, s := range strs {
-		if cap(b.buf) < len(b.buf)+len(s) {
-			b.lock()
-		}
-		if cap(b.buf) < len(s) {
-			io.WriteString(b.w, s)
-		} else {
-			b.buf = append(b.buf, s...)
-		}
+		b.buf = append(b.buf, s...)
 	}
 }
 
@@ -148,7 +363,9 @@ func (b *buffer) writeByteHex(c byte) {
 	b.buf[len(b.buf)-1] = hexDigits[c&0xF]
 }
 
-func (b *buffer) nonUtf8Chars(s string) int {
+// Append the hex values of invalid UTF-8 bytes, like "«xC0»".  Returns
+// the number of bytes from 's' that were consumed.
+func (b *buffer) nonUtf8(s string) int {
 	b.write("«x")
 	i := 0
 	for {
@@ -166,24 +383,6 @@ func (b *buffer) nonUtf8Chars(s string) int {
 	return i
 }
 
-func (b *buffer) nonUtf8Bytes(s []byte) int {
-	b.write("«x")
-	i := 0
-	for {
-		b.writeByteHex(s[i])
-		i++
-		if i == len(s) {
-			break
-		}
-		r, rl := utf8.DecodeRune(s[i:])
-		if !(r == utf8.RuneError && 1 == rl || 0x110000 <= r) {
-			break
-		}
-	}
-	b.write("»")
-	return i
-}
-
 // Append a quoted (JSON) string to the log line.  If more than one string
 // is passed in, then they are concatenated together.
 func (b *buffer) quote(strs ...string) {
@@ -195,6 +394,24 @@ func (b *buffer) quote(strs ...string) {
 	b.delim = comma
 }
 
+// AppendJSONString() appends 's' to 'dst' as a quoted JSON string, escaped
+// exactly as Lager escapes strings in log lines (using the current
+// EscapeMode, see SetEscapeMode()), and returns the extended slice.  Bytes
+// that are not valid UTF-8 are written like "«xC0»".
+//
+// This lets other code produce JSON that matches Lager's output and lets
+// the escaping be tested (or fuzzed) apart from the logging pipeline.
+//
+func AppendJSONString(dst []byte, s string) []byte {
+	b := bufPool.Get().(*buffer)
+	b.buf = append(dst, '"')
+	b.escapeWith(&escapers[getGlobals().escMode], s)
+	dst = append(b.buf, '"')
+	b.buf = b.scratch[:0] // Don't let the pool retain 'dst'.
+	bufPool.Put(b)
+	return dst
+}
+
 // Append a quoted (JSON) string (from a byte slice) to the log line.
 func (b *buffer) quoteBytes(s []byte) {
 	b.write(b.delim, `"`)
@@ -202,133 +419,105 @@ func (b *buffer) quoteBytes(s []byte) {
 	b.write(`"`)
 }
 
-// Append an escaped string as part of a quoted JSON string.
-func (b *buffer) escape(s string) {
-	beg := 0
-	for i := 0; i < len(s); i++ {
-		c := s[i]
-		if noEsc[c] {
-			continue
-		}
-		b.write(s[beg:i])
-		if c < 128 {
-			b.escape1Rune(rune(c))
-			beg = i + 1
-		} else if r, rl := utf8.DecodeRuneInString(
-			s[i:],
-		); r == utf8.RuneError && 1 == rl || 0x110000 <= r {
-			beg = i + b.nonUtf8Chars(s[i:])
-			i = beg - 1
-		} else {
-			beg = i + rl
-			if 0xFFFF < r {
-				surr1, surr2 := utf16.EncodeRune(r)
-				b.escape1Rune(surr1)
-				b.escape1Rune(surr2)
-			} else if r < 0xA0 {
-				b.escape1Rune(r)
-			} else {
-				b.write(s[i:beg])
-			}
-			i = beg - 1
-		}
+// Append the escaped form of a valid, non-ASCII rune.
+func (b *buffer) escapeRune(r rune) {
+	if 0xFFFF < r {
+		surr1, surr2 := utf16.EncodeRune(r)
+		b.escape1Rune(surr1)
+		b.escape1Rune(surr2)
+	} else {
+		b.escape1Rune(r)
 	}
-	b.write(s[beg:])
+}
+
+// Append an escaped string as part of a quoted JSON string, using the
+// escaper for the current EscapeMode.
+func (b *buffer) escape(s string) {
+	b.escapeWith(&escapers[b.g.escMode], s)
 }
 
 // Append an escaped string (from a byte slice), part of a quoted JSON string.
 func (b *buffer) escapeBytes(s []byte) {
+	// Safe since the string is not retained beyond this call:
+	b.escape(*(*string)(unsafe.Pointer(&s)))
+}
+
+// Append an escaped string as part of a quoted JSON string, using the
+// passed-in escaper to decide which characters to escape.
+func (b *buffer) escapeWith(esc *escaper, s string) {
 	beg := 0
+	wordAt := 0 // Where to next try plainWords(), if esc.words.
 	for i := 0; i < len(s); i++ {
+		if esc.words && wordAt <= i {
+			i += plainWords(s[i:])
+			if len(s) <= i {
+				break
+			}
+			wordAt = i + 8
+		}
 		c := s[i]
-		if noEsc[c] {
+		if esc.noEsc[c] {
 			continue
 		}
-		b.writeBytes(s[beg:i])
+		b.write(s[beg:i])
 		if c < 128 {
 			b.escape1Rune(rune(c))
 			beg = i + 1
-		} else if r, rl := utf8.DecodeRune(
+		} else if r, rl := utf8.DecodeRuneInString(
 			s[i:],
 		); r == utf8.RuneError && 1 == rl || 0x110000 <= r {
-			beg = i + b.nonUtf8Bytes(s[i:])
+			beg = i + b.nonUtf8(s[i:])
 			i = beg - 1
 		} else {
 			beg = i + rl
-			if 0xFFFF < r {
-				surr1, surr2 := utf16.EncodeRune(r)
-				b.escape1Rune(surr1)
-				b.escape1Rune(surr2)
-			} else if r < 0xA0 {
-				b.escape1Rune(r)
+			if esc.keep(r) {
+				b.write(s[i:beg])
 			} else {
-				b.writeBytes(s[i:beg])
+				b.escapeRune(r)
 			}
 			i = beg - 1
 		}
 	}
-	b.writeBytes(s[beg:])
+	b.write(s[beg:])
 }
 
-// Append a 2-digit value to the buffer (with leading '0').
-func (b *buffer) int2(val int) {
-	// Not needed so long as calls to int2() remain protected:
-	//  if cap(b.buf) < len(b.buf) + 2 {
-	//      b.lock()
-	//  }
-	l := len(b.buf)
-	b.buf = b.buf[0 : 2+l]
-	b.buf[l] = '0' + byte(val/10)
-	b.buf[l+1] = '0' + byte(val%10)
+// Append a 2-digit value (with leading '0').
+func appendInt2(buf []byte, val int) []byte {
+	return append(buf, '0'+byte(val/10), '0'+byte(val%10))
 }
 
 // Append a decimal value of specified length with leading '0's.
-func (b *buffer) int(val int, digits int) {
-	// Not needed so long as calls to int() remain protected:
-	//  if cap(b.buf) < len(b.buf) + digits {
-	//      b.lock()
-	//  }
-	bef := len(b.buf)
-	b.buf = strconv.AppendInt(b.buf, int64(val), 10)
-	aft := len(b.buf)
-	l := aft - bef
-	// Prepend leading '0's to get desired length:
-	if l < digits {
-		b.buf = b.buf[0 : bef+digits]
-		copy(b.buf[bef+digits-l:bef+digits], b.buf[bef:aft])
-		for i := bef; i < bef+digits-l; i++ {
-			b.buf[i] = '0'
-		}
-	}
-}
-
-// Append a quoted UTC timestamp to the log line.
+func appendDigits(buf []byte, val int, digits int) []byte {
+	var digs [20]byte
+	num := strconv.AppendInt(digs[:0], int64(val), 10)
+	for l := len(num); l < digits; l++ {
+		buf = append(buf, '0')
+	}
+	return append(buf, num...)
+}
+
+// Append a quoted UTC timestamp to the log line.  It is composed in a local
+// array and then appended all at once, since this is done for every line.
 func (b *buffer) timestamp() {
-	// Never needed since timestamp is always first:
-	//  if cap(b.buf) < len(b.buf)+22 {
-	//      b.lock()
-	//  }
-	now := time.Now().In(time.UTC)
-	b.write(`"`)
+	now := b.g.now().In(time.UTC)
+	var stamp [32]byte
+	ts := append(stamp[:0], '"')
 	yr, mo, day := now.Date()
-	b.buf = strconv.AppendInt(b.buf, int64(yr), 10)
-	b.write("-")
-	b.int2(int(mo))
-	b.write("-")
-	b.int2(day)
+	ts = strconv.AppendInt(ts, int64(yr), 10)
+	ts = appendInt2(append(ts, '-'), int(mo))
+	ts = appendInt2(append(ts, '-'), day)
 	if nil == b.g.keys {
-		b.write(" ") // Use easier-for-humans-to-read format
+		ts = append(ts, ' ') // Use easier-for-humans-to-read format
 	} else {
-		b.write("T") // Use standard format (GCP cares)
+		ts = append(ts, 'T') // Use standard format (GCP cares)
 	}
-	b.int2(now.Hour())
-	b.write(":")
-	b.int2(now.Minute())
-	b.write(":")
-	b.int2(now.Second())
-	b.write(".")
-	b.int(now.Nanosecond()/100000, 4)
-	b.write(`Z"`)
+	hr, min, sec := now.Clock()
+	ts = appendInt2(ts, hr)
+	ts = appendInt2(append(ts, ':'), min)
+	ts = appendInt2(append(ts, ':'), sec)
+	ts = appendDigits(append(ts, '.'), now.Nanosecond()/100000, 4)
+	ts = append(ts, 'Z', '"')
+	b.buf = append(b.buf, ts...)
 	b.delim = comma
 }
 
@@ -336,6 +525,7 @@ func (b *buffer) timestamp() {
 func (b *buffer) open(punct string) {
 	b.write(b.delim, punct)
 	b.delim = ""
+	b.depth++
 }
 
 // Append the key/value separator ":" to the log line.
@@ -348,15 +538,258 @@ func (b *buffer) colon() {
 func (b *buffer) close(punct string) {
 	b.write(punct)
 	b.delim = comma
+	b.depth--
+}
+
+// plainQuoted() returns `"s"` if 's' needs no escaping in any EscapeMode.
+// Otherwise it returns 'nil'.  Pass in 'extra' to reserve room to append.
+func plainQuoted(s string, extra int) []byte {
+	for i := 0; i < len(s); i++ {
+		for m := range escapers {
+			if !escapers[m].noEsc[s[i]] {
+				return nil
+			}
+		}
+	}
+	q := make([]byte, 0, len(s)+2+extra)
+	q = append(q, '"')
+	q = append(q, s...)
+	return append(q, '"')
+}
+
+// quotedKey() returns `"key":` if 'key' needs no escaping in any EscapeMode.
+// Otherwise it returns 'nil'.
+func quotedKey(key string) []byte {
+	q := plainQuoted(key, 1)
+	if nil == q {
+		return nil
+	}
+	return append(q, ':')
+}
+
+// Strings (mostly keys) that are likely to be logged repeatedly and their
+// plainQuoted() forms.  Holds a map[string][]byte that is replaced, never
+// modified, so lookups need no lock.
+var quotedCache atomic.Value
+var quotedMu sync.Mutex
+
+// At most this many strings are added to quotedCache.
+const maxQuotedCache = 4096
+
+// cachedQuote() returns plainQuoted(s), usually from quotedCache.
+func cachedQuote(s string) []byte {
+	cache, _ := quotedCache.Load().(map[string][]byte)
+	if q, ok := cache[s]; ok {
+		return q
+	}
+	q := plainQuoted(s, 0)
+	if len(cache) < maxQuotedCache {
+		quotedMu.Lock()
+		defer quotedMu.Unlock()
+		cache, _ = quotedCache.Load().(map[string][]byte)
+		if _, ok := cache[s]; !ok && len(cache) < maxQuotedCache {
+			cp := make(map[string][]byte, len(cache)+1)
+			for k, v := range cache {
+				cp[k] = v
+			}
+			cp[s] = q
+			quotedCache.Store(cp)
+		}
+	}
+	return q
+}
+
+// Append a quoted string that is likely to be logged repeatedly (like a
+// key), skipping escaping it when it is in quotedCache.
+func (b *buffer) quoteCached(s string) {
+	q := cachedQuote(s)
+	if nil == q {
+		b.quote(s)
+		return
+	}
+	b.write(b.delim)
+	b.buf = append(b.buf, q...)
+	b.delim = comma
+}
+
+// Append a key and the following ":", given the result of quotedKey(key).
+func (b *buffer) key(key string, quoted []byte) {
+	b.top()
+	if nil == quoted {
+		b.quoteCached(key)
+		b.colon()
+		return
+	}
+	b.write(b.delim)
+	b.buf = append(b.buf, quoted...)
+	b.delim = ""
 }
 
 // Append a single key/value pair:
 func (b *buffer) pair(k string, v interface{}) {
-	b.quote(k)
+	b.top()
+	k = b.normKey(k)
+	b.quoteCached(b.userKey(k))
+	b.colon()
+	b.value(k, v)
+}
+
+// Appends the value for 'key'.  If 'key' is one that SetKeyNormalizer()
+// must not change, then the keys nested in the value are not changed
+// either (so the fields of "httpRequest" keep the names GCP expects).
+func (b *buffer) value(key string, v interface{}) {
+	fixed := nil != b.g.keyNorm && b.g.fixedKey(key)
+	if fixed {
+		b.verbatim++
+	}
+	b.scalar(b.coerce(key, v))
+	if fixed {
+		b.verbatim--
+	}
+}
+
+// Append a key/value pair where the key is one Lager chose (so is never
+// normalized nor renamed):
+func (b *buffer) ownPair(k string, v interface{}) {
+	b.top()
+	b.quoteCached(k)
 	b.colon()
 	b.scalar(v)
 }
 
+// Applies the SetKeyNormalizer() function (if any) to a logged key.
+func (b *buffer) normKey(key string) string {
+	if 0 < b.verbatim {
+		return key
+	}
+	return b.g.normKey(key)
+}
+
+// Applies the SetKeyNormalizer() function (if any) to a logged key, unless
+// it is a key that has special meaning and so must not change.
+func (g *globals) normKey(key string) string {
+	if nil == g.keyNorm || g.fixedKey(key) {
+		return key
+	}
+	return g.keyNorm(key)
+}
+
+// Whether 'key' is one that SetKeyNormalizer() must not change: one with
+// special meaning to GCP, one with a SetKeyType() rule, one added via
+// SetVerbatimKey(), the SetErrorKey() key, or one of the keys set via
+// Keys().
+func (g *globals) fixedKey(key string) bool {
+	if gcpSpecialKey(key) || g.verbatimKeys[key] {
+		return true
+	} else if _, ok := g.keyTypes[key]; ok {
+		return true
+	}
+	return key == g.errKey || g.keys.reserved(key)
+}
+
+// Applies the SetKeyType() rule for 'key' (if any) to 'v'.
+func (b *buffer) coerce(key string, v interface{}) interface{} {
+	kind, ok := b.g.keyTypes[key]
+	if !ok {
+		return v
+	}
+	if f, ok := v.(func() interface{}); ok {
+		v = f()
+	}
+	if nil == v {
+		return nil
+	}
+	switch kind {
+	case KeyNumber:
+		return b.coerceNumber(v)
+	case KeyString:
+		return b.coerceString(v)
+	case KeyBool:
+		return coerceBool(v)
+	}
+	return v
+}
+
+func (b *buffer) coerceNumber(v interface{}) interface{} {
+	switch x := v.(type) {
+	case time.Duration:
+		if DurationString == b.g.durFormat {
+			return x.Seconds()
+		}
+		return x
+	case bool:
+		if x {
+			return 1
+		}
+		return 0
+	case []byte:
+		v = string(x)
+	}
+	// Convert named types to plain ones, in case they have String() methods:
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		return rv.Uint()
+	case reflect.Float32:
+		return float32(rv.Float())
+	case reflect.Float64:
+		return rv.Float()
+	case reflect.String:
+		s := strings.TrimSpace(rv.String())
+		if i, err := strconv.ParseInt(s, 10, 64); nil == err {
+			return i
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if nil == err && !math.IsInf(f, 0) && !math.IsNaN(f) {
+			return f
+		}
+	}
+	return nil
+}
+
+func (b *buffer) coerceString(v interface{}) interface{} {
+	if d, ok := v.(time.Duration); ok {
+		return d.String()
+	}
+	tmp := bufPool.Get().(*buffer)
+	tmp.g, tmp.delim = b.g, ""
+	tmp.scalar(v)
+	tmp.delim = ""
+	s := string(tmp.buf)
+	tmp.reset()
+	bufPool.Put(tmp)
+	if strings.HasPrefix(s, `"`) {
+		return v // Already logged as a string.
+	}
+	return s
+}
+
+func coerceBool(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Bool:
+		return rv.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		return 0 != rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		return 0 != rv.Uint()
+	case reflect.Float32, reflect.Float64:
+		return 0 != rv.Float()
+	case reflect.String:
+		s := strings.TrimSpace(rv.String())
+		if t, err := strconv.ParseBool(s); nil == err {
+			return t
+		}
+	}
+	return nil
+}
+
 // Append the key/value pairs from AMap:
 func (b *buffer) pairs(m AMap) {
 	if nil != m {
@@ -368,58 +801,122 @@ func (b *buffer) pairs(m AMap) {
 
 // Append the key/value pairs from a RawMap:
 func (b *buffer) rawPairs(m RawMap) {
-	skipping := false
-	inlining := false
-	for i, elt := range m {
-		if 0 == 1&i {
-			if _, ok := elt.(skipThisPair); ok {
-				skipping = true
-			} else if _, ok := elt.(inlinePairs); ok {
-				inlining = true
-			} else {
-				b.quote(S(elt))
-				b.colon()
+	if PairsAsGiven != b.g.pairOrder {
+		kv := b.collectPairs(nil, m)
+		if PairsSorted == b.g.pairOrder {
+			kv = kv.sorted()
+		}
+		b.pairs(kv)
+		return
+	}
+	for i := 0; i < len(m); i++ {
+		switch k := m[i].(type) {
+		case skipThisPair:
+			i++
+		case errPair:
+			if nil != k.err {
+				b.pair(b.g.errKey, errDetails(k.err))
 			}
-		} else if skipping {
-			skipping = false
-		} else if inlining {
-			switch m := elt.(type) {
-			case RawMap:
-				b.rawPairs(m)
-			case KVPairs:
-				b.pairs(&m)
-			case AMap:
-				b.pairs(m)
-			default:
-				b.pair("cannot-inline", elt)
+		case exitCodePair:
+			b.exitCode(k.code)
+			b.pair("exitCode", k.code)
+		case onePair:
+			if key, val, ok := k.onePair(); ok {
+				b.pair(key, val)
+			}
+		case inlinePairs:
+			i++
+			if i < len(m) {
+				b.inlinePairs(m[i])
+			}
+		default:
+			b.top()
+			key := b.normKey(S(k))
+			b.quoteCached(b.userKey(key))
+			b.colon()
+			i++
+			if i < len(m) {
+				b.value(key, m[i])
+			} else {
+				b.scalar(nil)
 			}
-			inlining = false
-		} else {
-			b.scalar(elt)
 		}
 	}
-	if 1 == 1&len(m) && !skipping {
-		b.scalar(nil)
+}
+
+// Notes the exit status requested via ExitCode(), unless it is nested
+// inside of some value (rather than being one of the line's own pairs).
+func (b *buffer) exitCode(code int) {
+	if b.pairsAt == b.depth {
+		b.exit = &code
+	}
+}
+
+// Add the key/value pairs from a RawMap to an AMap (so duplicates are
+// removed), handling special keys the same way rawPairs() does.
+func (b *buffer) collectPairs(kv AMap, m RawMap) AMap {
+	for i := 0; i < len(m); i++ {
+		switch k := m[i].(type) {
+		case skipThisPair:
+			i++
+		case errPair:
+			if nil != k.err {
+				kv = kv.AddPairs(b.g.errKey, errDetails(k.err))
+			}
+		case exitCodePair:
+			b.exitCode(k.code)
+			kv = kv.AddPairs("exitCode", k.code)
+		case onePair:
+			if key, val, ok := k.onePair(); ok {
+				kv = kv.AddPairs(key, val)
+			}
+		case inlinePairs:
+			i++
+			if i < len(m) {
+				switch v := lazy(m[i]).(type) {
+				case RawMap:
+					kv = b.collectPairs(kv, v)
+				case KVPairs:
+					kv = kv.Merge(&v)
+				case AMap:
+					kv = kv.Merge(v)
+				default:
+					kv = kv.AddPairs("cannot-inline", v)
+				}
+			}
+		default:
+			var val interface{}
+			if i+1 < len(m) {
+				val = m[i+1]
+			}
+			kv = kv.AddPairs(S(k), val)
+			i++
+		}
 	}
+	return kv
 }
 
-// Call a function but only give it a very short time to finish if we
-// are holding the lager output lock.
-func (b *buffer) timeBoxedCall(f func() interface{}) (value interface{}) {
-	if !b.locked {
+// Returns the value to log in place of 'v', calling it if it is a
+// 'func() interface{}'.
+func lazy(v interface{}) interface{} {
+	if f, ok := v.(func() interface{}); ok {
 		return f()
 	}
+	return v
+}
 
-	values := make(chan interface{}, 1)
-	go func() { values <- f() }()
-	timeouts := time.After(10 * time.Millisecond)
-	select {
-	case value = <-values:
-	case <-timeouts:
-		value = "func call took more than 10ms while lager lock held" +
-			" (log line was already over 16KiB)"
+// Append the key/value pairs from a value that followed lager.InlinePairs:
+func (b *buffer) inlinePairs(v interface{}) {
+	switch m := lazy(v).(type) {
+	case RawMap:
+		b.rawPairs(m)
+	case KVPairs:
+		b.pairs(&m)
+	case AMap:
+		b.pairs(m)
+	default:
+		b.pair("cannot-inline", v)
 	}
-	return
 }
 
 func (b *buffer) inlineList(args []interface{}) {
@@ -435,16 +932,58 @@ func (b *buffer) msgList(msg string, args []interface{}) {
 	b.close("]")
 }
 
+// Integers with larger magnitudes can't be represented exactly by a
+// float64 (which is what JavaScript and many JSON parsers use).
+const maxSafeInt = 1 << 53
+
+// Append an integer, quoting it if needed [see SetQuoteBigInts()].
+func (b *buffer) appendInt(v int64) {
+	if b.g.quoteBigInts && (maxSafeInt < v || v < -maxSafeInt) {
+		b.buf = append(b.buf, '"')
+		b.buf = strconv.AppendInt(b.buf, v, 10)
+		b.buf = append(b.buf, '"')
+	} else {
+		b.buf = strconv.AppendInt(b.buf, v, 10)
+	}
+}
+
+// Append an unsigned integer, quoting it if needed.
+func (b *buffer) appendUint(v uint64) {
+	if b.g.quoteBigInts && maxSafeInt < v {
+		b.buf = append(b.buf, '"')
+		b.buf = strconv.AppendUint(b.buf, v, 10)
+		b.buf = append(b.buf, '"')
+	} else {
+		b.buf = strconv.AppendUint(b.buf, v, 10)
+	}
+}
+
+// Append a time.Duration in the format chosen via SetDurationFormat().
+func (b *buffer) duration(d time.Duration) {
+	switch b.g.durFormat {
+	case DurationSeconds:
+		b.buf = strconv.AppendFloat(b.buf, d.Seconds(), 'f', -1, 64)
+	case DurationMillis:
+		b.buf = strconv.AppendFloat(
+			b.buf, float64(d)/float64(time.Millisecond), 'f', -1, 64)
+	case DurationNanos:
+		b.appendInt(int64(d))
+	default:
+		b.quote(d.String())
+	}
+}
+
 // Append a JSON-encoded scalar value to the log line.
 func (b *buffer) scalar(s interface{}) {
 	if f, ok := s.(func() interface{}); ok {
-		s = b.timeBoxedCall(f)
+		s = f()
+	}
+	if enc := encoderFor(s); nil != enc {
+		b.encode(enc, s)
+		return
 	}
 	b.write(b.delim)
 	b.delim = ""
-	if cap(b.buf) < len(b.buf)+64 {
-		b.lock() // Leave room for strconv.AppendFloat() or similar
-	}
 	switch v := s.(type) {
 	case nil:
 		b.write("null")
@@ -453,7 +992,7 @@ func (b *buffer) scalar(s interface{}) {
 	case []byte:
 		b.quoteBytes(v)
 	case int:
-		b.buf = strconv.AppendInt(b.buf, int64(v), 10)
+		b.appendInt(int64(v))
 	case int8:
 		b.buf = strconv.AppendInt(b.buf, int64(v), 10)
 	case int16:
@@ -461,9 +1000,9 @@ func (b *buffer) scalar(s interface{}) {
 	case int32:
 		b.buf = strconv.AppendInt(b.buf, int64(v), 10)
 	case int64:
-		b.buf = strconv.AppendInt(b.buf, v, 10)
+		b.appendInt(v)
 	case uint:
-		b.buf = strconv.AppendUint(b.buf, uint64(v), 10)
+		b.appendUint(uint64(v))
 	case uint8:
 		b.buf = strconv.AppendUint(b.buf, uint64(v), 10)
 	case uint16:
@@ -471,7 +1010,7 @@ func (b *buffer) scalar(s interface{}) {
 	case uint32:
 		b.buf = strconv.AppendUint(b.buf, uint64(v), 10)
 	case uint64:
-		b.buf = strconv.AppendUint(b.buf, v, 10)
+		b.appendUint(v)
 	case float32:
 		needsQuotes := math.IsInf(float64(v), 0) || math.IsNaN(float64(v))
 		if needsQuotes {
@@ -527,6 +1066,17 @@ func (b *buffer) scalar(s interface{}) {
 			b.pair(k, v[k])
 		}
 		b.close("}")
+	case time.Duration:
+		b.duration(v)
+	case Streamed:
+		switch v.src.(type) {
+		case io.WriterTo, io.Reader:
+			b.write(`"`)
+			b.stream(v)
+			b.write(`"`)
+		default:
+			b.scalar(v.src)
+		}
 	case error:
 		b.quote(v.Error())
 	case Stringer:
@@ -534,6 +1084,7 @@ func (b *buffer) scalar(s interface{}) {
 	default:
 		buf, err := json.Marshal(v)
 		if nil != err {
+			internalError("encode", err)
 			b.quote("! ", err.Error(), "; ", fmt.Sprintf("%#v", v))
 		} else {
 			b.writeBytes(buf)
@@ -93,7 +93,7 @@ func NewModule(name string, defaultLevels ...string) *Module {
 	} else if 0 != len(defaultLevels) {
 		panic("Passed more than one defaultLevel string to lager.NewModule()")
 	}
-	env := os.Getenv("LAGER_" + name + "_LEVELS")
+	env := envLevels(os.Getenv("LAGER_" + name + "_LEVELS"))
 	if "" != env {
 		levels = env
 	}
@@ -146,12 +146,13 @@ func (m *Module) Init(levels string) *Module {
 }
 
 func (m *Module) modLevel(lev level, cs ...Ctx) Lager {
-	l := m.lagers[int(lev)]
+	g := getGlobals()
+	l := g.withBuild(g.observing(m.lagers[int(lev)], lev, m.name), lev)
 	if pReal, ok := l.(*logger); ok {
-		pReal.g = getGlobals()
+		pReal.g = g
 	}
 	l = l.With(cs...)
-	return l
+	return g.counting(l, lev, m.name)
 }
 
 // Returns a Lager object that calls panic().  The JSON log line is first
@@ -242,3 +243,8 @@ func (m *Module) Level(lev byte, cs ...Ctx) Lager {
 	panic(fmt.Sprintf(
 		"Level() must be one char from \"PEFWNAITDOG\" not %q", lev))
 }
+
+// AtLevel() is the same as Level() but takes a LogLevel, like lager.WARN.
+func (m *Module) AtLevel(lev LogLevel, cs ...Ctx) Lager {
+	return m.Level(byte(lev), cs...)
+}
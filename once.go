@@ -0,0 +1,71 @@
+package lager
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The keys for which Once() already allowed a line to be logged.
+var _onceKeys sync.Map
+
+// When each OncePer() key last allowed a line to be logged (*int64 holding
+// Unix nanoseconds).  Kept apart from Once() keys so using the same key
+// with both does not mix them up.
+var _oncePerKeys sync.Map
+
+// Once() returns 'l' the first time it is called with a given 'key' and
+// returns a Lager that does nothing on every later call with that 'key'.
+// So a deprecation warning or a configuration fallback is only logged once
+// per process:
+//
+//      lager.Once("legacy-config", lager.Warn(ctx)).MMap(
+//          "Using deprecated config file", "path", path)
+//
+// Keys are shared across the whole process, so use keys specific to your
+// package.  See also OncePer(), whose keys are separate from these.
+//
+// If 'l' is for a disabled log level [so l.Enabled() is 'false'], then 'l'
+// is returned and 'key' is not used up, so the line is still logged once
+// the level is enabled.
+//
+func Once(key string, l Lager) Lager {
+	if !l.Enabled() {
+		return l
+	} else if _, loaded := _onceKeys.LoadOrStore(key, true); loaded {
+		return noop{}
+	}
+	return l
+}
+
+// OncePer() is like Once() except that it returns 'l' again once 'every'
+// has passed since the last time it returned 'l' for 'key'.  So a warning
+// that would otherwise be logged constantly is logged at most once per
+// interval:
+//
+//      lager.OncePer("cache-miss", time.Minute, lager.Warn()).MMap(
+//          "Cache unavailable; using database", "err", err)
+//
+// As with Once(), a disabled 'l' is just returned and does not restart the
+// interval.
+//
+func OncePer(key string, every time.Duration, l Lager) Lager {
+	if !l.Enabled() {
+		return l
+	}
+	now := Now().UnixNano()
+	v, loaded := _oncePerKeys.LoadOrStore(key, &now)
+	if !loaded {
+		return l
+	}
+	last := v.(*int64)
+	for {
+		prev := atomic.LoadInt64(last)
+		if now-prev < int64(every) {
+			return noop{}
+		}
+		if atomic.CompareAndSwapInt64(last, prev, now) {
+			return l
+		}
+	}
+}
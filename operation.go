@@ -0,0 +1,59 @@
+package lager
+
+import (
+	"sync"
+)
+
+// GcpOperationKey is the key that GCP Cloud Logging uses to group log
+// entries that are part of one (long-running) operation.
+//
+const GcpOperationKey = "logging.googleapis.com/operation"
+
+// StartOperation() writes a Note log line marking the start of an
+// operation, such as a batch job or a multi-step request, and returns a
+// Context and a function that writes a Note log line marking the end of
+// the operation, including a "duration" pair.  The Note level is used (and
+// is enabled by default) since the start and end lines are what tie the
+// operation's lines together.
+//
+//      ctx, done := lager.StartOperation(ctx, "nightly-sync", "shard", n)
+//      defer done()
+//
+// The returned Context holds an "operation" pair so every line logged with
+// it (including the start and end lines) can be grouped.  Its value is a
+// map holding a random "id" and "producer" set to 'name'.  On the start
+// line, the map also has "first":true and, on the end line, "last":true.
+//
+// If RunningInGcp() is in effect, then GcpOperationKey is used instead of
+// "operation" so that GCP Cloud Logging will group the lines together.
+//
+// The 'pairs' are logged on the start line.  Pairs passed to the returned
+// function are logged on the end line.  Only the first call to the
+// returned function logs anything, even if it is called from several
+// goroutines at once.
+//
+func StartOperation(
+	ctx Ctx, name string, pairs ...interface{},
+) (Ctx, func(...interface{})) {
+	key := "operation"
+	if getGlobals().inGcp {
+		key = GcpOperationKey
+	}
+	id := randomID()
+	op := func(extra ...interface{}) RawMap {
+		return Map(append([]interface{}{"id", id, "producer", name},
+			extra...)...)
+	}
+	start := Now()
+	Note(ctx).MMap("Operation started",
+		InlinePairs, RawMap(pairs), key, op("first", true))
+
+	var once sync.Once
+	return rawPairs(ctx, key, op()), func(pairs ...interface{}) {
+		once.Do(func() {
+			Note(ctx).MMap("Operation finished",
+				"duration", Now().Sub(start),
+				InlinePairs, RawMap(pairs), key, op("last", true))
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package lager
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strconv"
+)
+
+// DefaultGcpPayloadLimit is the default size (in bytes) above which log
+// lines get split when running in GCP [see SetGcpPayloadLimit()].  GCP
+// Cloud Logging rejects entries larger than 256KB; this leaves room for the
+// metadata that gets added to each entry.
+const DefaultGcpPayloadLimit = 250 * 1024
+
+// GcpOverflowKey is the key of the pair that links a log line that was
+// split [see SetGcpPayloadLimit()] to its follow-up lines.
+const GcpOverflowKey = "overflowId"
+
+// Room for the pairs added to each line when a line is split, like:
+//      , "overflowId":"0123456789abcdef", "overflowParts":123}\n
+const overflowRoom = 64
+
+// SetGcpPayloadLimit() sets the size (in bytes) above which a log line gets
+// split when running in GCP [see RunningInGcp()], since Cloud Logging
+// rejects entries larger than 256KB rather than truncating them.  Passing
+// in 0 restores the default of DefaultGcpPayloadLimit.  Passing in a
+// negative value disables splitting.
+//
+// When a line is too large, the pairs that don't fit are moved into
+// follow-up lines.  Each follow-up line repeats the time, severity, message,
+// and the trace and span IDs (GcpTraceKey and GcpSpanKey pairs, if any) and
+// holds as many of the remaining pairs as fit.  Pairs that GCP treats
+// specially [those with keys starting with "logging.googleapis.com/" and
+// "httpRequest"] are never moved.  The original
+// line gets "overflowId" (GcpOverflowKey) and "overflowParts" (the number
+// of follow-up lines) pairs added and each follow-up line gets the same
+// "overflowId" and its "overflowPart" number (starting at 1):
+//
+//      {"time":..., "severity":"200", "message":"Loaded", "config":{...},
+//          "overflowId":"3f9c0a7b12d4e6f8", "overflowParts":1}
+//      {"time":..., "severity":"200", "message":"Loaded",
+//          "overflowId":"3f9c0a7b12d4e6f8", "overflowPart":1, "rules":[...]}
+//
+// so you can find all of the pieces with a query like
+// 'jsonPayload.overflowId="3f9c0a7b12d4e6f8"'.  Only whole pairs are moved
+// (not parts of a value), so a single pair that is too large still results
+// in a line that is too large.
+//
+func SetGcpPayloadLimit(limit int) {
+	updateGlobals(func(g *globals) {
+		g.gcpLimit = limit
+	})
+}
+
+// Returns the size above which lines should be split (or 0 for never).
+func (g *globals) payloadLimit() int {
+	switch {
+	case !g.inGcp || nil == g.keys || g.gcpLimit < 0:
+		return 0
+	case 0 == g.gcpLimit:
+		return DefaultGcpPayloadLimit
+	}
+	return g.gcpLimit
+}
+
+// Records where a top-level pair starts (its delimiter), in case the line
+// needs to be split.
+func (b *buffer) top() {
+	if 1 == b.depth && b.g.inGcp {
+		b.tops = append(b.tops, len(b.buf))
+	}
+}
+
+// If the (complete) log line is too large [see SetGcpPayloadLimit()], then
+// overflow() moves the pairs that don't fit into new follow-up lines, which
+// it returns (already framed).
+func (b *buffer) overflow() [][]byte {
+	limit := b.g.payloadLimit()
+	hdr := 2 // The time and severity.
+	if limit <= 0 || len(b.buf)-b.from <= limit || len(b.tops) <= hdr {
+		return nil
+	}
+	msg := []byte(strconv.Quote(b.g.keys.msg) + ":")
+	if "" == b.g.keys.msg {
+		msg = []byte(`"msg":`)
+	}
+	if seg := b.buf[b.tops[hdr]:]; bytes.HasPrefix(
+		bytes.TrimPrefix(seg, []byte(comma)), msg,
+	) {
+		hdr++
+	}
+	if len(b.tops) <= hdr {
+		return nil
+	}
+
+	// Copy the header and pairs, as 'b.buf' gets truncated:
+	end := len(b.buf) - len("}\n")
+	header := append([]byte("{"), b.buf[b.tops[0]:b.tops[hdr]]...)
+	segs := make([][]byte, 0, len(b.tops)-hdr)
+	for i := hdr; i < len(b.tops); i++ {
+		next := end
+		if i+1 < len(b.tops) {
+			next = b.tops[i+1]
+		}
+		segs = append(segs, append([]byte(nil), b.buf[b.tops[i]:next]...))
+	}
+
+	// GCP's special pairs (like GcpTraceKey and "httpRequest") are never
+	// moved and the trace and span IDs are repeated in each follow-up line
+	// so that GCP still associates every piece with the request:
+	size := len(header) + overflowRoom
+	kept := make([]bool, len(segs))
+	var repeat []byte
+	for i, seg := range segs {
+		if key, ok := segKey(seg); ok && gcpSpecialKey(key) {
+			kept[i] = true
+			size += len(seg)
+			if GcpTraceKey == key || GcpSpanKey == key {
+				repeat = append(repeat, seg...)
+			}
+		}
+	}
+	var moved [][]byte
+	for i, seg := range segs {
+		if kept[i] {
+			continue
+		} else if 0 == len(moved) && size+len(seg) <= limit {
+			kept[i] = true
+			size += len(seg)
+		} else {
+			moved = append(moved, seg)
+		}
+	}
+	if 0 == len(moved) {
+		return nil
+	}
+	follow := append(header[:len(header):len(header)], repeat...)
+
+	// Group the moved pairs into follow-up lines:
+	var parts [][][]byte
+	for 0 < len(moved) {
+		size, n := len(follow)+overflowRoom, 0
+		for n < len(moved) && (0 == n || size+len(moved[n]) <= limit) {
+			size += len(moved[n])
+			n++
+		}
+		parts = append(parts, moved[:n])
+		moved = moved[n:]
+	}
+
+	id := fmt.Sprintf("%016x", rand.Uint64())
+	b.buf = b.buf[:b.tops[hdr]]
+	for i, seg := range segs {
+		if kept[i] {
+			b.writeBytes(seg)
+		}
+	}
+	b.write(comma, `"`, GcpOverflowKey, `":"`, id, `"`, comma,
+		`"overflowParts":`, strconv.Itoa(len(parts)), "}\n")
+
+	lines := make([][]byte, len(parts))
+	for i, part := range parts {
+		f := bufPool.Get().(*buffer)
+		f.g = b.g
+		f.frame()
+		f.writeBytes(follow)
+		f.write(comma, `"`, GcpOverflowKey, `":"`, id, `"`, comma,
+			`"overflowPart":`, strconv.Itoa(i+1))
+		for _, seg := range part {
+			f.writeBytes(seg)
+		}
+		f.write("}\n")
+		lines[i] = append([]byte(nil), f.line()...)
+		f.reset()
+		bufPool.Put(f)
+	}
+	return lines
+}
+
+// Returns the key of a top-level pair recorded by top() [which starts with
+// its delimiter], if it can be found.
+func segKey(seg []byte) (string, bool) {
+	seg = bytes.TrimPrefix(seg, []byte(comma))
+	if len(seg) < 2 || '"' != seg[0] {
+		return "", false
+	}
+	end := bytes.IndexByte(seg[1:], '"')
+	if end < 0 {
+		return "", false
+	}
+	return string(seg[1 : 1+end]), true
+}
@@ -0,0 +1,133 @@
+package lager
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// One rule added via PromoteMatching().
+type promotion struct {
+	re  *regexp.Regexp
+	lev level
+}
+
+// PromoteMatching() adds a rule so that any log line whose message matches
+// 're' is logged at a different log level.  'lev' is one letter from
+// "FWNAITDOG" (as for Level()).  For example, to escalate an Info line from
+// some library to a Warn line:
+//
+//      lager.PromoteMatching(regexp.MustCompile(`connection refused`), 'W')
+//
+// Despite the name, a rule can also lower the level of a line.  The message
+// is the one passed to [C]MMap() or [C]MList().  Rules are checked in the
+// order they were added and only the first matching rule is applied.  Lines
+// are checked even if their original level is not enabled.  Whether the line
+// is written depends on whether the new log level is enabled (for the
+// module, if any, that the line was logged via).
+//
+// It returns a function that removes the rule.  Passing in a level other
+// than those listed above calls panic().
+//
+// Note that while any rules exist, lines logged via disabled levels using
+// [C]MMap() or [C]MList() must be checked, which costs some CPU time.  But
+// Enabled() still returns 'false' for disabled levels, so lines logged only
+// when Enabled() returns 'true' are never promoted.
+//
+func PromoteMatching(re *regexp.Regexp, lev byte) func() {
+	i := strings.IndexByte("FWNAITDOG", byte(strings.ToUpper(string(lev))[0]))
+	if i < 0 {
+		panic(fmt.Sprintf(
+			"PromoteMatching() needs one char from \"FWNAITDOG\" not %q", lev))
+	}
+	p := &promotion{re: re, lev: lFail + level(i)}
+	updateGlobals(func(g *globals) {
+		n := len(g.promotions)
+		g.promotions = append(g.promotions[:n:n], p)
+	})
+	return func() {
+		updateGlobals(func(g *globals) {
+			kept := make([]*promotion, 0, len(g.promotions))
+			for _, q := range g.promotions {
+				if q != p {
+					kept = append(kept, q)
+				}
+			}
+			g.promotions = kept
+		})
+	}
+}
+
+// PromoteLevel() is the same as PromoteMatching() but takes a LogLevel,
+// like lager.WARN.
+//
+func PromoteLevel(re *regexp.Regexp, lev LogLevel) func() {
+	return PromoteMatching(re, byte(lev))
+}
+
+// Unfiltered() returns a Lager that writes every line that its log level
+// allows, ignoring any PromoteMatching() rules and any log budget from a
+// Ctx (see RequestBudget()).  It is for lines that must not be dropped nor
+// re-leveled once it is known that they are enabled, such as the events
+// logged by the audit package:
+//
+//      l := lager.Unfiltered(mod.Note(ctx))
+//      if l.Enabled() {
+//          l.MMap("Permission granted", "user", user)
+//      }
+//
+// A Lager not created by this package is returned unchanged.
+//
+func Unfiltered(l Lager) Lager {
+	lg, ok := l.(*logger)
+	if !ok || lg.unfiltered {
+		return l
+	}
+	cp := *lg
+	cp.unfiltered, cp.bud = true, nil
+	return &cp
+}
+
+// Returns the logger to use for a line with the given message, applying
+// the first matching PromoteMatching() rule (if any).  Returns 'nil' if the
+// line should be ignored.
+func (l *logger) promote(message string) *logger {
+	if l.unfiltered {
+		return l.active()
+	}
+	for _, p := range l.g.promotions {
+		if !p.re.MatchString(message) {
+			continue
+		}
+		if p.lev != l.lev {
+			cp := *l
+			cp.lev = p.lev
+			cp.quiet = !l.g.isEnabled(p.lev, l.mod)
+			l = &cp
+		}
+		break
+	}
+	return l.active()
+}
+
+// Returns 'nil' if 'l' would do nothing with a log line, after counting
+// the line as suppressed [see Stats()].
+func (l *logger) active() *logger {
+	if l.quiet && nil == l.g.recorder {
+		l.g.stats.countLine(l.mod, l.lev, false)
+		return nil
+	}
+	return l
+}
+
+// Returns whether a log level is enabled (for the named module, if any).
+func (g *globals) isEnabled(lev level, mod string) bool {
+	lagers := &g.lagers
+	if "" != mod {
+		if m := getMod(mod); nil != m {
+			lagers = &m.lagers
+		}
+	}
+	_, off := lagers[int(lev)].(noop)
+	return !off
+}
@@ -0,0 +1,107 @@
+package lager
+
+import (
+	"io"
+	"sync"
+)
+
+// A ring buffer of the most recent log lines (see SetFlightRecorder()).
+type recorder struct {
+	mu    sync.Mutex
+	lines [][]byte // The recorded lines, oldest at 'next' once full.
+	next  int      // Where the next line gets recorded.
+	full  bool     // Whether 'lines' has wrapped around.
+}
+
+// SetFlightRecorder() enables a "flight recorder" that keeps the most recent
+// 'lines' log lines in memory, including lines logged at levels that are
+// not enabled (which are recorded but not written).  This gives you
+// post-mortem context without paying for the output of always-on Debug
+// (or other verbose) logging.  Passing in 0 disables the flight recorder.
+// Each call discards any previously recorded lines.
+//
+// Just before a Panic or Exit log line is written, the recorded lines are
+// written to the same destination (in one Write() call).  This means that
+// recorded lines from enabled levels will appear in the output twice.  You
+// can also call DumpRecent() at any time.
+//
+// Note that log lines from disabled levels still cost the CPU time required
+// to format them while the flight recorder is enabled.  But Enabled() still
+// returns 'false' for disabled levels, so lines logged only when Enabled()
+// returns 'true' are not recorded.
+//
+func SetFlightRecorder(lines int) {
+	var rec *recorder
+	if 0 < lines {
+		rec = &recorder{lines: make([][]byte, lines)}
+	}
+	updateGlobals(func(g *globals) {
+		g.recorder = rec
+	})
+}
+
+// DumpRecent() writes the log lines kept by the flight recorder to 'w',
+// oldest first, in a single Write() call.  It writes nothing if the flight
+// recorder is not enabled (see SetFlightRecorder()).
+//
+func DumpRecent(w io.Writer) error {
+	rec := getGlobals().recorder
+	if nil == rec {
+		return nil
+	}
+	recent := rec.recent()
+	if 0 == len(recent) {
+		return nil
+	}
+	_, err := w.Write(recent)
+	return err
+}
+
+// Returns a Lager that can only record lines or have them re-leveled (if
+// the flight recorder is enabled or PromoteMatching() rules exist and 'l' is
+// a no-op Lager), else returns 'l'.  Its Enabled() method still returns
+// 'false' since it writes nothing at its own level.
+func (g *globals) observing(l Lager, lev level, mod string) Lager {
+	if nil == g.recorder && 0 == len(g.promotions) {
+		return l
+	}
+	if _, ok := l.(noop); !ok {
+		return l
+	}
+	return &logger{lev: lev, mod: mod, g: g, quiet: true}
+}
+
+// Record a copy of one (framed) log line.
+func (r *recorder) add(line []byte) {
+	defer AutoLock(&r.mu)()
+	r.lines[r.next] = append(r.lines[r.next][:0], line...)
+	r.next++
+	if len(r.lines) <= r.next {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// Returns a copy of the recorded lines, oldest first, concatenated.
+func (r *recorder) recent() []byte {
+	defer AutoLock(&r.mu)()
+	var older [][]byte
+	if r.full {
+		older = r.lines[r.next:]
+	}
+	size := 0
+	for _, line := range older {
+		size += len(line)
+	}
+	for _, line := range r.lines[:r.next] {
+		size += len(line)
+	}
+	recent := make([]byte, 0, size)
+	for _, line := range older {
+		recent = append(recent, line...)
+	}
+	for _, line := range r.lines[:r.next] {
+		recent = append(recent, line...)
+	}
+	return recent
+}
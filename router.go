@@ -0,0 +1,130 @@
+package lager
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// RouteWriter is an io.Writer that sends each log line to a destination
+// chosen based on the value of one key/value pair in the line, such as
+// writing the lines for each tenant to a separate file.  Use
+// NewRouteWriter() to create one and then pass it to SetOutput().
+//
+type RouteWriter struct {
+	find  []byte // Like `"tenant":"`
+	def   io.Writer
+	route func(value string) io.Writer
+
+	mu    sync.Mutex
+	dests map[string]io.Writer
+}
+
+// NewRouteWriter() returns a RouteWriter that looks in each log line for a
+// pair with the given 'key' and a string value.  The first time each value
+// is seen, 'route' is called to get the io.Writer for lines with that value
+// and the result is remembered.  Lines without such a pair, or for which
+// 'route' returned 'nil', are written to 'def'.
+//
+//      files := lager.NewRouteWriter("tenant", os.Stdout,
+//          func(tenant string) io.Writer {
+//              f, err := os.OpenFile(
+//                  "logs/"+tenant+".log", os.O_CREATE|os.O_APPEND|os.O_WRONLY,
+//                  0644)
+//              if nil != err {
+//                  return nil
+//              }
+//              return f
+//          })
+//      defer files.Close()
+//      defer lager.SetOutput(files)()
+//
+// The pair can be at any depth but, if the key appears more than once in a
+// line, the first occurrence is used.  So pick a key that is unlikely to be
+// used for anything else (or use AddPairs() to put the pair into a Context
+// that is logged at the start of each line).
+//
+// Since 'route' is called while Lager holds its output lock, it must not
+// write log lines via Lager (which would deadlock).
+//
+func NewRouteWriter(
+	key string, def io.Writer, route func(value string) io.Writer,
+) *RouteWriter {
+	find, _ := json.Marshal(key)
+	find = append(find, ':', '"')
+	return &RouteWriter{
+		find:  find,
+		def:   def,
+		route: route,
+		dests: make(map[string]io.Writer),
+	}
+}
+
+// Write() writes one log line to the destination chosen for it.
+func (r *RouteWriter) Write(line []byte) (int, error) {
+	return r.dest(line).Write(line)
+}
+
+func (r *RouteWriter) dest(line []byte) io.Writer {
+	val, ok := r.value(line)
+	if !ok {
+		return r.def
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w, ok := r.dests[val]
+	if !ok {
+		w = r.route(val)
+		r.dests[val] = w
+	}
+	if nil == w {
+		return r.def
+	}
+	return w
+}
+
+// value() finds the string value for our key in 'line'.  A quote can only
+// appear unescaped in JSON as part of a string delimiter, so `"key":"`
+// can't match text inside of some other string value.
+//
+func (r *RouteWriter) value(line []byte) (string, bool) {
+	start := bytes.Index(line, r.find)
+	if start < 0 {
+		return "", false
+	}
+	start += len(r.find) - 1 // Include the opening quote.
+	for end := start + 1; end < len(line); end++ {
+		switch line[end] {
+		case '\\':
+			end++
+		case '"':
+			var val string
+			if nil != json.Unmarshal(line[start:end+1], &val) {
+				return "", false
+			}
+			return val, true
+		}
+	}
+	return "", false
+}
+
+// Close() closes each destination returned by the 'route' function that
+// implements io.Closer (but not the default writer) and returns the first
+// error encountered.  Values seen after Close() will cause 'route' to be
+// called again.
+//
+func (r *RouteWriter) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var first error
+	for val, w := range r.dests {
+		if c, ok := w.(io.Closer); ok {
+			if err := c.Close(); nil != err && nil == first {
+				first = err
+			}
+		}
+		delete(r.dests, val)
+	}
+	return first
+}
@@ -0,0 +1,57 @@
+package lager_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/TyeMcQueen/go-lager"
+	"github.com/TyeMcQueen/go-tutl"
+)
+
+type closeBuf struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (c *closeBuf) Close() error {
+	c.closed = true
+	return errors.New("closed")
+}
+
+func TestRouteWriter(t *testing.T) {
+	u := tutl.New(t)
+	def := bytes.NewBuffer(nil)
+	dests := map[string]*closeBuf{}
+	calls := 0
+	r := lager.NewRouteWriter("tenant", def, func(val string) io.Writer {
+		calls++
+		if "skip" == val {
+			return nil
+		}
+		dests[val] = &closeBuf{}
+		return dests[val]
+	})
+	defer lager.SetOutput(r)()
+
+	ctx := context.Background()
+	a := lager.AddPairs(ctx, "tenant", "a")
+	lager.Warn(a).MMap("one")
+	lager.Warn(a).MMap("two", "msg", `"tenant":"b"`)
+	lager.Warn(lager.AddPairs(ctx, "tenant", `q"b`)).MMap("three")
+	lager.Warn().MMap("four")
+	lager.Warn().MMap("five", "tenant", 5)
+	lager.Warn(lager.AddPairs(ctx, "tenant", "skip")).MMap("six")
+	lager.Warn(lager.AddPairs(ctx, "tenant", "skip")).MMap("seven")
+
+	u.Is(3, calls, "route called once per value")
+	u.Like(dests["a"].String(), "tenant a", "*one", "*two")
+	u.Like(dests[`q"b`].String(), "escaped value", "*three", "!*two")
+	u.Like(def.String(), "default", "*four", "*five", "*six", "*seven",
+		"!*one", "!*three")
+
+	u.Like(r.Close(), "Close error", "closed")
+	u.Is(true, dests["a"].closed, "destinations closed")
+}
@@ -0,0 +1,41 @@
+package lager
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// The sequence number of the most recent log line composed.
+var _lineSeq int64
+
+// SetSequenceNumbers(true) adds a sequence number to each log line, which
+// increases by 1 for each line composed by the process, so the order of
+// lines can be reconstructed even when their timestamps are the same (they
+// only have 0.1ms resolution) or when a log sink reorders them.  When Keys()
+// are set (such as when RunningInGcp()), it is logged as a "seq" pair.
+// Otherwise it is added after the other values, similar to "mod=":
+//
+//      ["2024-01-02 03:04:05.6789Z", "INFO", "Started", "seq=17"]
+//
+// Numbering starts at 1 and continues even if sequence numbers are turned
+// off and back on.  Lines that are composed but not written [see
+// SetFlightRecorder() and RequestBudget()] use up numbers, leaving gaps.
+//
+func SetSequenceNumbers(include bool) {
+	updateGlobals(func(g *globals) {
+		g.seqNums = include
+	})
+}
+
+// Appends the next sequence number to the log line.
+func (b *buffer) seq() {
+	n := atomic.AddInt64(&_lineSeq, 1)
+	if nil != b.g.keys {
+		b.ownPair("seq", n)
+		return
+	}
+	b.write(b.delim, `"seq=`)
+	b.buf = strconv.AppendInt(b.buf, n, 10)
+	b.write(`"`)
+	b.delim = comma
+}
@@ -0,0 +1,83 @@
+package lager
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"sync/atomic"
+)
+
+// Set while a shadow check mismatch is being logged, so that line is not
+// itself checked.
+var _shadowReporting int32
+
+// The number of lines that failed a shadow check.
+var _shadowMismatches int64
+
+// SetShadowCheck() sets the fraction of log lines (from 0.0 to 1.0) that
+// are also parsed with encoding/json after being written, as a safety net
+// for Lager's own JSON encoder when new types of values get logged.  The
+// default is 0.0 (no checking).  'rate' is limited to the range 0.0 to 1.0.
+//
+//      lager.SetShadowCheck(0.01) // Check 1% of log lines.
+//
+// If a checked line is not valid JSON, then a Fail line is logged holding
+// the parse error and the invalid line (as a string).  ShadowMismatches()
+// reports how many lines failed the check.  Lines that are only recorded
+// [see SetFlightRecorder()] are not checked.
+//
+func SetShadowCheck(rate float64) {
+	if rate < 0.0 {
+		rate = 0.0
+	} else if 1.0 < rate {
+		rate = 1.0
+	}
+	updateGlobals(func(g *globals) {
+		g.shadowRate = rate
+	})
+}
+
+// ShadowMismatches() returns the number of log lines that were found to be
+// invalid JSON by the check enabled via SetShadowCheck().
+//
+func ShadowMismatches() int64 {
+	return atomic.LoadInt64(&_shadowMismatches)
+}
+
+// Whether the line just composed should be shadow checked.
+func (g *globals) shadowSampled() bool {
+	rate := g.shadowRate
+	if rate <= 0.0 || 0 != atomic.LoadInt32(&_shadowReporting) {
+		return false
+	}
+	return 1.0 <= rate || rand.Float64() < rate
+}
+
+// Returns the JSON text from a (framed) log line.
+func unframe(framing Framing, line []byte) []byte {
+	switch framing {
+	case FramingJSONSeq:
+		line = bytes.TrimPrefix(line, []byte{0x1E})
+	case FramingLength:
+		if i := bytes.IndexByte(line, ' '); 0 <= i {
+			line = line[i+1:]
+		}
+	}
+	return line
+}
+
+// Parses the log line with encoding/json and returns the error (if any).
+func shadowCheck(framing Framing, line []byte) error {
+	var v interface{}
+	return json.Unmarshal(unframe(framing, line), &v)
+}
+
+// Logs that a log line failed the shadow check.
+func (g *globals) shadowMismatch(line []byte, err error) {
+	atomic.AddInt64(&_shadowMismatches, 1)
+	internalError("shadow", err)
+	atomic.AddInt32(&_shadowReporting, 1)
+	defer atomic.AddInt32(&_shadowReporting, -1)
+	g.forLevel(lFail).MMap("Lager wrote a log line that is not valid JSON",
+		"err", err, "line", string(unframe(g.framing, line)))
+}
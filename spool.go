@@ -0,0 +1,488 @@
+package lager
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// SpoolWriter writes log lines to a primary io.Writer (such as a network
+// connection to a log collector) but spools lines to a file on disk when the
+// primary writer returns errors or falls behind, then replays the spooled
+// lines (in order) once the primary writer recovers.  So an outage of a
+// log sink does not lose log lines.  Use NewSpoolWriter() to create one and
+// then pass it to SetOutput().
+//
+type SpoolWriter struct {
+	primary io.Writer
+	path    string
+	queue   chan []byte
+	stop    chan struct{}
+	done    chan struct{}
+
+	mu          sync.Mutex
+	cond        sync.Cond
+	retry       time.Duration
+	timeout     time.Duration
+	spool       *os.File // Open for appending and reading.
+	spooling    bool     // Whether new lines must go to the spool file.
+	readAt      int64    // Where the next spooled line to replay starts.
+	failed      []byte   // A line to replay before those in the spool file.
+	queued      int      // Lines in 'queue' not yet written.
+	sending     []byte   // The queued line being written to 'primary'.
+	sendSpooled bool     // Whether 'sending' was also spooled.
+	closed      bool
+	abandoned   bool  // Whether Close() timed out.
+	closeErr    error // From closing 'spool'.
+}
+
+// The name of the spool file within the directory passed to
+// NewSpoolWriter().
+const SpoolFileName = "lager.spool"
+
+// At most this many lines wait in memory to be written to the primary
+// writer before lines start being spooled to disk.
+const spoolQueueLen = 1024
+
+// MaxSpoolLine is the size of the largest line that a SpoolWriter will
+// spool to disk.  A spool file that claims to hold a larger line is treated
+// as corrupt.
+const MaxSpoolLine = 16 * 1024 * 1024
+
+// ErrSpoolTimeout is returned by a SpoolWriter's Flush() or Close() when
+// the primary writer did not finish writing lines in time.
+var ErrSpoolTimeout = errors.New("lager: spool's primary writer timed out")
+
+// ErrSpoolLineTooLong is returned by a SpoolWriter's Write() when a line
+// that needs to be spooled is larger than MaxSpoolLine.
+var ErrSpoolLineTooLong = errors.New("lager: line too long to spool")
+
+// NewSpoolWriter() returns a SpoolWriter that writes to 'primary' and that
+// spools to a file named SpoolFileName in 'dir' (which must already exist).
+// If the spool file contains lines left from a prior process, then they get
+// replayed before any new lines are written.
+//
+// Write() never blocks waiting for 'primary'.  Lines are written to
+// 'primary' from a separate goroutine.  If that falls too far behind or
+// if 'primary' returns an error, then lines are appended to the spool file
+// instead.  Replaying spooled lines is retried every second (see
+// SetRetryInterval()) until it succeeds.
+//
+// Close() should be called before the process exits.  Lager calls Flush()
+// after writing a Panic or Exit line, which waits for queued lines to be
+// written (to 'primary' or to the spool file).  Neither waits longer than
+// 5 seconds (see SetTimeout()) for a 'primary' that has stopped responding.
+//
+func NewSpoolWriter(primary io.Writer, dir string) (*SpoolWriter, error) {
+	path := filepath.Join(dir, SpoolFileName)
+	spool, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if nil != err {
+		return nil, err
+	}
+	size, err := spooledSize(spool)
+	if nil == err {
+		// Drop any partial (or corrupt) line left by a crash so new lines
+		// get appended after the complete ones:
+		err = spool.Truncate(size)
+	}
+	if nil == err {
+		_, err = spool.Seek(size, io.SeekStart)
+	}
+	if nil != err {
+		spool.Close()
+		return nil, err
+	}
+	sw := &SpoolWriter{
+		primary:  primary,
+		path:     path,
+		queue:    make(chan []byte, spoolQueueLen),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		retry:    time.Second,
+		timeout:  5 * time.Second,
+		spool:    spool,
+		spooling: 0 < size,
+	}
+	sw.cond.L = &sw.mu
+	go sw.writer()
+	return sw, nil
+}
+
+// Returns the size of the complete, valid spooled lines at the start of
+// 'spool'.
+func spooledSize(spool *os.File) (int64, error) {
+	info, err := spool.Stat()
+	if nil != err {
+		return 0, err
+	}
+	var head [4]byte
+	at := int64(0)
+	for at+4 <= info.Size() {
+		if _, err := spool.ReadAt(head[:], at); nil != err {
+			return 0, err
+		}
+		size := int64(binary.BigEndian.Uint32(head[:]))
+		if MaxSpoolLine < size || info.Size() < at+4+size {
+			break
+		}
+		at += 4 + size
+	}
+	return at, nil
+}
+
+// SetRetryInterval() sets how long to wait after the primary writer
+// returns an error before trying to replay spooled lines again.
+//
+func (sw *SpoolWriter) SetRetryInterval(d time.Duration) {
+	defer AutoLock(&sw.mu)()
+	sw.retry = d
+}
+
+// SetTimeout() sets how long Flush() and Close() wait for the primary
+// writer to finish writing queued lines.  When that time passes, the
+// unwritten lines are saved to the spool file instead (to be replayed
+// later) and ErrSpoolTimeout is returned.  The line that the primary writer
+// was in the middle of writing is also saved, so it may end up being
+// written twice.  The default is 5 seconds.
+//
+func (sw *SpoolWriter) SetTimeout(d time.Duration) {
+	defer AutoLock(&sw.mu)()
+	sw.timeout = d
+}
+
+// Spooling() returns 'true' if new lines are currently being spooled to
+// disk rather than being written to the primary writer.
+//
+func (sw *SpoolWriter) Spooling() bool {
+	defer AutoLock(&sw.mu)()
+	return sw.spooling
+}
+
+// Write() queues 'line' to be written to the primary writer or appends it
+// to the spool file.  It only returns an error if the SpoolWriter was
+// closed or if writing to the spool file fails.
+//
+func (sw *SpoolWriter) Write(line []byte) (int, error) {
+	defer AutoLock(&sw.mu)()
+	if sw.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if !sw.spooling {
+		select {
+		case sw.queue <- append([]byte(nil), line...):
+			sw.queued++
+			return len(line), nil
+		default:
+			// The primary writer is falling behind.  Spool the queued
+			// lines first so the lines stay in order:
+			sw.spooling = true
+			sw.spoolQueue()
+		}
+	}
+	if err := sw.append(line); nil != err {
+		return 0, err
+	}
+	return len(line), nil
+}
+
+// Append one line to the spool file.  'sw.mu' must be locked.
+func (sw *SpoolWriter) append(line []byte) error {
+	if MaxSpoolLine < len(line) {
+		return ErrSpoolLineTooLong
+	}
+	rec := make([]byte, 4+len(line))
+	binary.BigEndian.PutUint32(rec, uint32(len(line)))
+	copy(rec[4:], line)
+	_, err := sw.spool.Write(rec)
+	return err
+}
+
+// Append one line to the spool file from the queue (so there is no caller
+// to return an error to), reporting a line that gets lost via
+// InternalErrors().  'sw.mu' must be locked.
+func (sw *SpoolWriter) keep(line []byte) {
+	if err := sw.append(line); nil != err {
+		internalError("spool", err)
+	}
+}
+
+// Flush() waits until all queued lines have been written to the primary
+// writer or to the spool file.  If that takes longer than the timeout [see
+// SetTimeout()], then the unwritten lines are spooled and ErrSpoolTimeout
+// is returned.
+//
+func (sw *SpoolWriter) Flush() error {
+	defer AutoLock(&sw.mu)()
+	if !sw.waitFor(func() bool { return 0 == sw.queued || sw.closed }) {
+		sw.spoolPending()
+		return ErrSpoolTimeout
+	}
+	return nil
+}
+
+// Waits until 'done()' returns 'true' or the timeout passes (and then
+// returns 'false').  'sw.mu' must be locked.
+func (sw *SpoolWriter) waitFor(done func() bool) bool {
+	if done() {
+		return true
+	}
+	expired := false
+	timer := time.AfterFunc(sw.timeout, func() {
+		defer AutoLock(&sw.mu)()
+		expired = true
+		sw.cond.Broadcast()
+	})
+	defer timer.Stop()
+	for !done() {
+		if expired {
+			return false
+		}
+		sw.cond.Wait()
+	}
+	return true
+}
+
+// Saves the line being written to the primary writer and any queued lines
+// to the spool file, since the primary writer is not responding.  'sw.mu'
+// must be locked.
+func (sw *SpoolWriter) spoolPending() {
+	if nil != sw.sending && !sw.sendSpooled {
+		sw.sendSpooled = true
+		sw.keep(sw.sending)
+	}
+	sw.spooling = true
+	sw.spoolQueue()
+}
+
+// Close() writes any queued lines (to the primary writer or to the spool
+// file) and stops the SpoolWriter.  Any lines that could not yet be
+// replayed remain in the spool file to be replayed by the next
+// SpoolWriter created for the same directory.  If the primary writer does
+// not finish in time [see SetTimeout()], then the unwritten lines are
+// spooled and ErrSpoolTimeout is returned.
+//
+func (sw *SpoolWriter) Close() error {
+	sw.mu.Lock()
+	if sw.closed {
+		sw.mu.Unlock()
+		return nil
+	}
+	sw.closed = true
+	timeout := sw.timeout
+	sw.mu.Unlock()
+	close(sw.stop)
+	select {
+	case <-sw.done:
+		return sw.closeErr
+	case <-time.After(timeout):
+	}
+	defer AutoLock(&sw.mu)()
+	sw.abandoned = true
+	sw.spoolPending()
+	sw.keepFailed()
+	return ErrSpoolTimeout
+}
+
+// The goroutine that writes lines to the primary writer.  It closes the
+// spool file when it finishes.
+func (sw *SpoolWriter) writer() {
+	defer close(sw.done)
+	defer func() {
+		defer AutoLock(&sw.mu)()
+		sw.closeErr = sw.spool.Close()
+	}()
+	for {
+		if sw.Spooling() {
+			if !sw.replay() {
+				select {
+				case <-sw.stop:
+					sw.drain()
+					return
+				case <-time.After(sw.retryInterval()):
+				}
+			}
+			continue
+		}
+		select {
+		case line := <-sw.queue:
+			sw.send(line)
+		case <-sw.stop:
+			sw.drain()
+			return
+		}
+	}
+}
+
+func (sw *SpoolWriter) retryInterval() time.Duration {
+	defer AutoLock(&sw.mu)()
+	return sw.retry
+}
+
+// Write one queued line to the primary writer.  On failure, start spooling
+// and make it the first line to be replayed.
+func (sw *SpoolWriter) send(line []byte) {
+	sw.mu.Lock()
+	sw.sending = line
+	sw.mu.Unlock()
+	_, err := sw.primary.Write(line)
+	defer AutoLock(&sw.mu)()
+	spooled := sw.sendSpooled
+	sw.sending, sw.sendSpooled = nil, false
+	sw.queued--
+	if nil != err && !spooled {
+		sw.failed = line
+		sw.spooling = true
+		sw.spoolQueue()
+	}
+	sw.cond.Broadcast()
+}
+
+// Move all queued lines to the spool file.  'sw.mu' must be locked.
+func (sw *SpoolWriter) spoolQueue() {
+	for {
+		select {
+		case line := <-sw.queue:
+			sw.queued--
+			sw.keep(line)
+		default:
+			return
+		}
+	}
+}
+
+// Called when closing to write any remaining queued lines, making one last
+// attempt to replay spooled lines first.
+func (sw *SpoolWriter) drain() {
+	for !sw.Spooling() || sw.replay() {
+		select {
+		case line := <-sw.queue:
+			sw.send(line)
+		default:
+			return
+		}
+	}
+	defer AutoLock(&sw.mu)()
+	if sw.abandoned {
+		return
+	}
+	sw.spoolQueue()
+	sw.keepFailed()
+	sw.cond.Broadcast()
+}
+
+// Put the line that failed to be written at the front of the spool file so
+// it will be replayed first.  'sw.mu' must be locked.
+func (sw *SpoolWriter) keepFailed() {
+	if nil == sw.failed {
+		return
+	}
+	end, err := sw.spool.Seek(0, io.SeekEnd)
+	var rest []byte
+	if nil == err {
+		rest = make([]byte, end-sw.readAt)
+		_, err = sw.spool.ReadAt(rest, sw.readAt)
+	}
+	if nil == err {
+		err = sw.spool.Truncate(0)
+	}
+	if nil == err {
+		_, err = sw.spool.Seek(0, io.SeekStart)
+	}
+	if nil != err {
+		// The failed line is lost but the spool file is intact:
+		internalError("spool", err)
+		return
+	}
+	sw.readAt = 0
+	sw.keep(sw.failed)
+	if _, err := sw.spool.Write(rest); nil != err {
+		internalError("spool", err)
+	}
+	sw.failed = nil
+}
+
+// Replay spooled lines to the primary writer until the spool is empty (and
+// then stop spooling and return 'true') or until the primary writer fails
+// (and return 'false').
+func (sw *SpoolWriter) replay() bool {
+	sw.mu.Lock()
+	failed := sw.failed
+	sw.mu.Unlock()
+	if nil != failed {
+		if _, err := sw.primary.Write(failed); nil != err {
+			return false
+		}
+		sw.mu.Lock()
+		if sw.abandoned {
+			sw.mu.Unlock()
+			return false
+		}
+		sw.failed = nil
+		sw.mu.Unlock()
+	}
+
+	for {
+		sw.mu.Lock()
+		if sw.abandoned {
+			// Close() timed out and saved what was left to the spool.
+			sw.mu.Unlock()
+			return false
+		}
+		line, err := sw.readSpooled()
+		if io.EOF == err {
+			// Replayed everything (perhaps except for a partial line
+			// from a crash or a corrupt spool file) so start over with
+			// an empty spool file:
+			err = sw.spool.Truncate(0)
+			if nil == err {
+				_, err = sw.spool.Seek(0, io.SeekStart)
+			}
+			if nil == err {
+				sw.readAt = 0
+				sw.spooling = false
+			}
+			sw.mu.Unlock()
+			return nil == err
+		}
+		sw.mu.Unlock()
+		if nil != err {
+			return false
+		}
+
+		if _, err := sw.primary.Write(line); nil != err {
+			return false
+		}
+		sw.mu.Lock()
+		if !sw.abandoned {
+			sw.readAt += int64(4 + len(line))
+		}
+		sw.mu.Unlock()
+	}
+}
+
+// Reads the next spooled line to replay.  Returns io.EOF if there are no
+// more (complete) lines or if the spool file is corrupt.  'sw.mu' must be
+// locked.
+func (sw *SpoolWriter) readSpooled() ([]byte, error) {
+	var head [4]byte
+	if _, err := sw.spool.ReadAt(head[:], sw.readAt); nil != err {
+		return nil, err
+	}
+	info, err := sw.spool.Stat()
+	if nil != err {
+		return nil, err
+	}
+	size := int64(binary.BigEndian.Uint32(head[:]))
+	if MaxSpoolLine < size || info.Size() < sw.readAt+4+size {
+		return nil, io.EOF
+	}
+	line := make([]byte, size)
+	if _, err := sw.spool.ReadAt(line, sw.readAt+4); nil != err {
+		return nil, err
+	}
+	return line, nil
+}
@@ -0,0 +1,176 @@
+package lager_test
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TyeMcQueen/go-lager"
+	"github.com/TyeMcQueen/go-tutl"
+)
+
+// A writer that fails while 'down' is set.
+type flakyWriter struct {
+	mu   sync.Mutex
+	down bool
+	text strings.Builder
+}
+
+func (fw *flakyWriter) Write(p []byte) (int, error) {
+	defer lager.AutoLock(&fw.mu)()
+	if fw.down {
+		return 0, errors.New("outage")
+	}
+	return fw.text.Write(p)
+}
+
+func (fw *flakyWriter) setDown(down bool) {
+	defer lager.AutoLock(&fw.mu)()
+	fw.down = down
+}
+
+func (fw *flakyWriter) String() string {
+	defer lager.AutoLock(&fw.mu)()
+	return fw.text.String()
+}
+
+func TestSpoolWriter(t *testing.T) {
+	u := tutl.New(t)
+	dir := t.TempDir()
+	primary := new(flakyWriter)
+	sw, err := lager.NewSpoolWriter(primary, dir)
+	u.Is(nil, err, "new spool writer")
+	sw.SetRetryInterval(time.Millisecond)
+
+	sw.Write([]byte("one\n"))
+	sw.Flush()
+	u.Is("one\n", primary.String(), "written to primary")
+	u.Is(false, sw.Spooling(), "not spooling")
+
+	primary.setDown(true)
+	sw.Write([]byte("two\n"))
+	sw.Flush()
+	u.Is(true, sw.Spooling(), "spooling during outage")
+	sw.Write([]byte("three\n"))
+	sw.Flush()
+	u.Is("one\n", primary.String(), "nothing written during outage")
+
+	primary.setDown(false)
+	for i := 0; i < 500 && sw.Spooling(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	u.Is(false, sw.Spooling(), "replayed")
+	u.Is("one\ntwo\nthree\n", primary.String(), "replayed in order")
+
+	sw.Write([]byte("four\n"))
+	u.Is(nil, sw.Close(), "close")
+	u.Is("one\ntwo\nthree\nfour\n", primary.String(), "written on close")
+	_, err = sw.Write([]byte("late\n"))
+	u.Is(io.ErrClosedPipe, err, "write after close")
+}
+
+func TestSpoolLeftover(t *testing.T) {
+	u := tutl.New(t)
+	dir := t.TempDir()
+	primary := new(flakyWriter)
+	primary.setDown(true)
+	sw, err := lager.NewSpoolWriter(primary, dir)
+	u.Is(nil, err, "new spool writer")
+	sw.Write([]byte("left\n"))
+	sw.Write([]byte("over\n"))
+	u.Is(nil, sw.Close(), "close during outage")
+	u.Is("", primary.String(), "nothing written during outage")
+
+	primary.setDown(false)
+	sw, err = lager.NewSpoolWriter(primary, dir)
+	u.Is(nil, err, "reopen spool writer")
+	u.Is(true, sw.Spooling(), "leftover spool")
+	sw.Write([]byte("new\n"))
+	u.Is(nil, sw.Close(), "close")
+	u.Is("left\nover\nnew\n", primary.String(), "leftovers replayed first")
+}
+
+// A writer whose Write() blocks until 'release' is closed.
+type wedgedWriter struct {
+	release chan struct{}
+	flakyWriter
+}
+
+func (ww *wedgedWriter) Write(p []byte) (int, error) {
+	<-ww.release
+	return ww.flakyWriter.Write(p)
+}
+
+func TestSpoolTimeout(t *testing.T) {
+	u := tutl.New(t)
+	dir := t.TempDir()
+	primary := &wedgedWriter{release: make(chan struct{})}
+	sw, err := lager.NewSpoolWriter(primary, dir)
+	u.Is(nil, err, "new spool writer")
+	sw.SetTimeout(20 * time.Millisecond)
+	sw.Write([]byte("stuck\n"))
+	sw.Write([]byte("queued\n"))
+	start := time.Now()
+	u.Is(lager.ErrSpoolTimeout, sw.Flush(), "flush times out")
+	u.Is(true, sw.Spooling(), "spooling after timeout")
+	sw.Write([]byte("later\n"))
+	u.Is(lager.ErrSpoolTimeout, sw.Close(), "close times out")
+	u.Is(true, time.Since(start) < 5*time.Second, "did not wait long")
+	close(primary.release)
+
+	replay := new(flakyWriter)
+	sw, err = lager.NewSpoolWriter(replay, dir)
+	u.Is(nil, err, "reopen spool writer")
+	u.Is(nil, sw.Close(), "close")
+	u.Is("stuck\nqueued\nlater\n", replay.String(), "unwritten lines spooled")
+}
+
+func TestSpoolLost(t *testing.T) {
+	u := tutl.New(t)
+	errs := lager.InternalErrors()
+	for 0 < len(errs) {
+		<-errs
+	}
+	dir := t.TempDir()
+	primary := &wedgedWriter{release: make(chan struct{})}
+	sw, err := lager.NewSpoolWriter(primary, dir)
+	u.Is(nil, err, "new spool writer")
+	sw.SetTimeout(20 * time.Millisecond)
+	sw.Write([]byte("stuck\n"))
+	sw.Write(make([]byte, lager.MaxSpoolLine+1))
+	u.Is(lager.ErrSpoolTimeout, sw.Flush(), "flush times out")
+	var ie *lager.InternalError
+	select {
+	case err := <-errs:
+		ie, _ = err.(*lager.InternalError)
+	default:
+	}
+	if u.Is(true, nil != ie, "lost line reported") {
+		u.Is("spool", ie.Op, "spool op")
+		u.Is(lager.ErrSpoolLineTooLong, ie.Err, "spool err")
+	}
+	close(primary.release)
+	u.Is(nil, sw.Close(), "close")
+}
+
+func TestSpoolCorrupt(t *testing.T) {
+	u := tutl.New(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, lager.SpoolFileName)
+	for _, data := range []string{
+		"\xFF\xFF\xFF\xFFhuge", "\x00\x00\x10\x00truncated",
+	} {
+		u.Is(nil, os.WriteFile(path, []byte(data), 0600), "write spool")
+		primary := new(flakyWriter)
+		sw, err := lager.NewSpoolWriter(primary, dir)
+		u.Is(nil, err, "open corrupt spool")
+		sw.Write([]byte("new\n"))
+		u.Is(nil, sw.Close(), "close")
+		u.Is("new\n", primary.String(), "corrupt spool discarded")
+	}
+}
@@ -5,23 +5,131 @@ import (
 	"os"
 	"runtime"
 	"strings"
+	"sync"
 )
 
 var _pathSep = string(os.PathSeparator)
 
+// StackOption customizes the stack trace added by WithStack().
+type StackOption func(*stackOpts)
+
+type stackOpts struct {
+	skipPkgs []string
+	maxBytes int
+	frames   *runtime.Frames
+}
+
+// SkipPackages() returns a StackOption that omits stack frames for functions
+// from the listed packages (by import path, like "example.com/app/logs"),
+// such as your own wrappers around Lager.  Skipped frames do not count
+// toward WithStack()'s 'stackLen' (but do count toward its 'minDepth').
+//
+func SkipPackages(pkgs ...string) StackOption {
+	return func(o *stackOpts) {
+		o.skipPkgs = append(o.skipPkgs, pkgs...)
+	}
+}
+
+// MaxStackBytes() returns a StackOption that stops adding frames to the
+// stack trace once adding another would make the total length of the
+// strings in it exceed 'n' bytes (but at least one frame is included).
+//
+func MaxStackBytes(n int) StackOption {
+	return func(o *stackOpts) {
+		o.maxBytes = n
+	}
+}
+
+// StackFromPCs() returns a StackOption that has WithStack() format the
+// stack trace in 'pcs' (like from runtime.Callers() or from a
+// runtime/pprof profile) rather than the current stack.  WithStack()'s
+// 'minDepth' is then how many frames to skip from the start of 'pcs'.
+//
+func StackFromPCs(pcs []uintptr) StackOption {
+	return func(o *stackOpts) {
+		o.frames = runtime.CallersFrames(pcs)
+	}
+}
+
+// StackFromFrames() is like StackFromPCs() but takes the *runtime.Frames
+// [from runtime.CallersFrames()].  Since a *runtime.Frames can only be
+// iterated over once, the returned StackOption can only be used once.
+//
+func StackFromFrames(frames *runtime.Frames) StackOption {
+	return func(o *stackOpts) {
+		o.frames = frames
+	}
+}
+
+// Returns the import path of the package of a function name as reported
+// by runtime.Frame.Function, like "example.com/pkg" for
+// "example.com/pkg.(*Type).Method".
+func funcPackage(funcname string) string {
+	slash := strings.LastIndex(funcname, "/")
+	dot := strings.Index(funcname[slash+1:], ".")
+	if dot < 0 {
+		return funcname
+	}
+	return funcname[:slash+1+dot]
+}
+
+// Returns the frames of the current stack, starting 'skip' frames up from
+// the caller of callers().
+func callers(skip int) *runtime.Frames {
+	pcs := make([]uintptr, 32)
+	for {
+		n := runtime.Callers(2+skip, pcs)
+		if n < len(pcs) {
+			return runtime.CallersFrames(pcs[:n])
+		}
+		pcs = make([]uintptr, 2*len(pcs))
+	}
+}
+
 func caller(depth, pathparts int) (file string, line int, funcname string) {
-	pcs := make([]uintptr, 1)
-	if n := runtime.Callers(3+depth, pcs); n < 1 {
+	var pcs [1]uintptr
+	if n := runtime.Callers(3+depth, pcs[:]); n < 1 {
 		return
 	}
-	frame, _ := runtime.CallersFrames(pcs).Next()
+	frame, _ := runtime.CallersFrames(pcs[:]).Next()
+	return shortFrame(frame, pathparts)
+}
+
+// Identifies a (possibly inlined) call site along with how much of the file
+// name to keep.  Inlined frames can share a PC but not a function.
+type frameKey struct {
+	pc    uintptr
+	fn    string
+	parts int
+}
+
+// The shortened names for a call site.
+type frameNames struct {
+	file, fn string
+}
+
+// Caches the shortened names for each call site (frameKey) so repeated
+// logging from the same line need not redo the string work.  The number
+// of call sites is bounded by the size of the program.
+var _frameCache sync.Map
+
+// Returns the file name (shortened to the last 'pathparts' components),
+// line number, and function name (without the package) for 'frame'.
+func shortFrame(
+	frame runtime.Frame, pathparts int,
+) (file string, line int, funcname string) {
 	if 0 == frame.PC {
 		return
 	}
+	key := frameKey{pc: frame.PC, fn: frame.Function, parts: pathparts}
+	if x, ok := _frameCache.Load(key); ok {
+		names := x.(frameNames)
+		return names.file, frame.Line, names.fn
+	}
 	file, line, funcname = frame.File, frame.Line, frame.Function
 
-	if fnparts := strings.Split(funcname, "."); 0 < len(fnparts) {
-		funcname = fnparts[len(fnparts)-1]
+	if i := strings.LastIndex(funcname, "."); 0 <= i {
+		funcname = funcname[i+1:]
 	}
 	if 0 < pathparts {
 		parts := strings.Split(file, _pathSep)
@@ -30,12 +138,13 @@ func caller(depth, pathparts int) (file string, line int, funcname string) {
 			file = strings.Join(parts[l-pathparts:l], _pathSep)
 		}
 	}
+	_frameCache.Store(key, frameNames{file: file, fn: funcname})
 	return file, line, funcname
 }
 
 // See the Lager interface for documentation.
 func (l *logger) WithCaller(depth int) Lager {
-	file, line, fn := caller(depth, l.g.pathParts)
+	file, line, fn := caller(depth, l.parts())
 	if 0 == line {
 		return l
 	}
@@ -45,27 +154,79 @@ func (l *logger) WithCaller(depth int) Lager {
 }
 
 // See the Lager interface for documentation.
-func (l *logger) WithStack(minDepth, stackLen int) Lager {
+func (l *logger) WithStack(minDepth, stackLen int, opts ...StackOption) Lager {
+	o := stackOpts{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	frames := o.frames
+	if nil == frames {
+		frames = callers(1 + minDepth)
+	} else {
+		for i := 0; i < minDepth; i++ {
+			if _, more := frames.Next(); !more {
+				break
+			}
+		}
+	}
+
+	parts := l.parts()
 	stack := make([]string, 0)
-	for depth := minDepth; true; depth++ {
-		if 0 < stackLen && stackLen <= depth-minDepth {
+	size := 0
+	for more := true; more; {
+		if 0 < stackLen && stackLen <= len(stack) {
 			break
 		}
-		file, line, fn := caller(depth, l.g.pathParts)
+		var frame runtime.Frame
+		frame, more = frames.Next()
+		if 0 < len(o.skipPkgs) && skipFrame(frame, o.skipPkgs) {
+			continue
+		}
+		file, line, fn := shortFrame(frame, parts)
 		if 0 == line {
 			break
 		}
-		if "" == fn {
-			stack = append(stack, fmt.Sprintf("%d %s", line, file))
-		} else {
-			stack = append(stack, fmt.Sprintf("%d %s %s", line, file, fn))
+		s := fmt.Sprintf("%d %s", line, file)
+		if "" != fn {
+			s += " " + fn
+		}
+		if 0 < o.maxBytes && 0 < len(stack) && o.maxBytes < size+len(s) {
+			break
 		}
+		size += len(s)
+		stack = append(stack, s)
 	}
 	cp := *l
 	cp.kvp = cp.kvp.Merge(Pairs("_stack", stack))
 	return &cp
 }
 
+// See the Lager interface for documentation.
+func (l *logger) WithPathParts(pathParts int) Lager {
+	cp := *l
+	cp.ownParts, cp.pathParts = true, pathParts
+	return &cp
+}
+
+// Returns how many path components to keep in source code file names.
+func (l *logger) parts() int {
+	if l.ownParts {
+		return l.pathParts
+	}
+	return l.g.pathParts
+}
+
+// Whether 'frame' is for a function from one of the packages in 'pkgs'.
+func skipFrame(frame runtime.Frame, pkgs []string) bool {
+	pkg := funcPackage(frame.Function)
+	for _, p := range pkgs {
+		if p == pkg {
+			return true
+		}
+	}
+	return false
+}
+
 // See the Lager interface for documentation.
 func (l *logger) CList(args ...interface{}) {
 	l.WithCaller(1).List(args...)
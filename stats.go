@@ -0,0 +1,157 @@
+package lager
+
+import (
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// LevelCounts holds the number of log lines written and suppressed for one
+// log level.  See Stats().
+//
+type LevelCounts struct {
+	Emitted    int64
+	Suppressed int64
+}
+
+// Counters for lines at each level for one module (or none).
+type levelCounters struct {
+	emitted    [int(nLevels)]int64
+	suppressed [int(nLevels)]int64
+}
+
+// Counters for the lines logged via one configuration (the package-level
+// one or one Instance).
+type lineStats struct {
+	root levelCounters
+	mods sync.Map // module name -> *levelCounters
+}
+
+// The counters for the package-level configuration.
+var _stats lineStats
+
+func (s *lineStats) countersFor(mod string) *levelCounters {
+	if "" == mod {
+		return &s.root
+	}
+	if c, ok := s.mods.Load(mod); ok {
+		return c.(*levelCounters)
+	}
+	c, _ := s.mods.LoadOrStore(mod, new(levelCounters))
+	return c.(*levelCounters)
+}
+
+// Counts a written line (or a suppressed one, if 'written' is false).
+func (s *lineStats) countLine(mod string, lev level, written bool) {
+	c := s.countersFor(mod)
+	if written {
+		atomic.AddInt64(&c.emitted[int(lev)], 1)
+	} else {
+		atomic.AddInt64(&c.suppressed[int(lev)], 1)
+	}
+}
+
+// Returns a Lager that counts each line it is asked to log as suppressed if
+// 'l' is a Lager that does nothing, else returns 'l'.
+func (g *globals) counting(l Lager, lev level, mod string) Lager {
+	if _, ok := l.(noop); ok {
+		return mute{&g.stats.countersFor(mod).suppressed[int(lev)]}
+	}
+	return l
+}
+
+// A Lager that outputs nothing but counts each line that it does not log.
+type mute struct {
+	n *int64
+}
+
+func (m mute) List(_ ...interface{})             { m.count() }
+func (m mute) CList(_ ...interface{})            { m.count() }
+func (m mute) MList(_ string, _ ...interface{})  { m.count() }
+func (m mute) CMList(_ string, _ ...interface{}) { m.count() }
+func (m mute) Map(_ ...interface{})              { m.count() }
+func (m mute) CMap(_ ...interface{})             { m.count() }
+func (m mute) MMap(_ string, _ ...interface{})   { m.count() }
+func (m mute) CMMap(_ string, _ ...interface{})  { m.count() }
+func (m mute) Println(_ ...interface{})          { m.count() }
+func (m mute) With(_ ...Ctx) Lager               { return m }
+func (m mute) WithCaller(_ int) Lager            { return m }
+func (m mute) WithPathParts(_ int) Lager         { return m }
+func (_ mute) Enabled() bool                     { return false }
+
+func (m mute) WithStack(_, _ int, _ ...StackOption) Lager {
+	return m
+}
+
+func (_ mute) LogLogger(_ ...func(Lager, []byte) []byte) *log.Logger {
+	return log.New(io.Discard, "", 0)
+}
+
+func (m mute) count() { atomic.AddInt64(m.n, 1) }
+
+// Stats() returns the number of log lines written and suppressed, per log
+// level, since the process started.  The returned map is indexed by module
+// name, with "" used for lines not logged via a Module.  Only levels with
+// a non-zero count are included.  Lines logged via an Instance from New()
+// or Clone() are not included [see Instance.Stats()].
+//
+// A line is counted as suppressed each time a line is logged at a disabled
+// log level [such as calling lager.Debug().MMap() when Debug is disabled]
+// or when a line is only kept by the flight recorder.  Just getting a Lager
+// for a disabled level [such as to call Enabled()] counts nothing.  So a
+// test can assert that no failures were logged:
+//
+//      if n := lager.Stats()[""][lager.FAIL].Emitted; 0 != n {
+//          t.Errorf("%d failures logged", n)
+//      }
+//
+func Stats() map[string]map[LogLevel]LevelCounts {
+	return _stats.snapshot()
+}
+
+// Stats() is like lager.Stats() but only counts the lines logged via the
+// Instance (and any Instance that shares its counts).  An Instance from
+// New() or Clone() starts with its own counts of zero, while Default()
+// reports the same counts as lager.Stats().
+//
+func (in *Instance) Stats() map[string]map[LogLevel]LevelCounts {
+	return in.get().stats.snapshot()
+}
+
+func (s *lineStats) snapshot() map[string]map[LogLevel]LevelCounts {
+	stats := make(map[string]map[LogLevel]LevelCounts)
+	add := func(mod string, c *levelCounters) {
+		var levs map[LogLevel]LevelCounts
+		for i := 0; i < int(nLevels); i++ {
+			lc := LevelCounts{
+				Emitted:    atomic.LoadInt64(&c.emitted[i]),
+				Suppressed: atomic.LoadInt64(&c.suppressed[i]),
+			}
+			if 0 == lc.Emitted && 0 == lc.Suppressed {
+				continue
+			}
+			if nil == levs {
+				levs = make(map[LogLevel]LevelCounts)
+			}
+			levs[LogLevel("PEFWNAITDOG"[i])] = lc
+		}
+		if nil != levs {
+			stats[mod] = levs
+		}
+	}
+	add("", &s.root)
+	s.mods.Range(func(k, v interface{}) bool {
+		add(k.(string), v.(*levelCounters))
+		return true
+	})
+	return stats
+}
+
+// EnabledLevels() returns the letters for the currently enabled log levels
+// (from "FWNAITDOG"), like "FWNA".  Panic and Exit are always enabled and
+// so are not included.  See GetModuleLevels() for the levels of a Module.
+//
+func EnabledLevels() string {
+	return getGlobals().enabled
+}
@@ -0,0 +1,97 @@
+package lager
+
+import (
+	"io"
+	"unicode/utf8"
+)
+
+// Streamed is a value whose content is copied into a log line (as a JSON
+// string) from an io.WriterTo or io.Reader.  See Stream().
+//
+type Streamed struct {
+	src interface{}
+}
+
+// Stream() returns a value that, when logged, copies the content of 'src'
+// into the log line as a JSON string, escaping it as it is copied.  So a
+// payload (such as a request body) does not first have to be read into a
+// string (or []byte) just to be logged.  'src' should be an io.WriterTo or
+// an io.Reader; anything else is logged as if Stream() had not been used.
+//
+//      lager.Debug(ctx).MMap("Bad response", "body", lager.Stream(resp.Body))
+//
+// Content is copied when the line is logged, which consumes it (for an
+// io.Reader) and happens at most once.  If the copy fails, the string ends
+// with the error text, like "«error: unexpected EOF»".  Bytes that are not
+// valid UTF-8 are written like "«xC0»", even if split across reads.
+//
+// Values are only streamed when wrapped via Stream() because reading from
+// any io.Reader that happened to be logged (like a file or a connection)
+// could block or consume data that other code needs.
+//
+// Note that the content is not streamed to the log's destination.  Each
+// log line is still built in memory and then written all at once (so
+// lines from different goroutines never interleave).  So the full,
+// escaped content is held in memory while the line is built.
+//
+func Stream(src interface{}) Streamed {
+	return Streamed{src: src}
+}
+
+// An io.Writer that appends what is written to it, escaped, to the log
+// line being built in a buffer.  Nothing is written to the log destination
+// until the whole line has been built.
+type escAppender struct {
+	b    *buffer
+	part []byte // Start of a UTF-8 sequence split across writes.
+}
+
+func (w *escAppender) Write(p []byte) (int, error) {
+	n := len(p)
+	if 0 < len(w.part) {
+		// Complete the pending sequence one byte at a time:
+		for !utf8.FullRune(w.part) && 0 < len(p) {
+			w.part = append(w.part, p[0])
+			p = p[1:]
+		}
+		if !utf8.FullRune(w.part) {
+			return n, nil // Still incomplete; wait for more.
+		}
+		w.b.escapeBytes(w.part)
+		w.part = w.part[:0]
+	}
+	// Hold back a trailing, incomplete UTF-8 sequence:
+	keep := 0
+	for i := len(p) - 1; 0 <= i && len(p)-i < utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				keep = len(p) - i
+			}
+			break
+		}
+	}
+	w.b.escapeBytes(p[:len(p)-keep])
+	w.part = append(w.part, p[len(p)-keep:]...)
+	return n, nil
+}
+
+// Appends the content of a Streamed value as a quoted JSON string.
+func (b *buffer) stream(s Streamed) {
+	w := &escAppender{b: b}
+	var err error
+	switch src := s.src.(type) {
+	case io.WriterTo:
+		_, err = src.WriteTo(w)
+	case io.Reader:
+		_, err = io.Copy(w, src)
+	}
+	if 0 < len(w.part) {
+		b.escapeBytes(w.part)
+	}
+	if nil != err {
+		internalError("stream", err)
+		b.write("«error: ")
+		b.escape(err.Error())
+		b.write("»")
+	}
+}
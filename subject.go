@@ -0,0 +1,67 @@
+package lager
+
+// SubjectKey is the key of the pair that Subject() adds to identify the
+// data subject (the person whose personal data is involved) of log lines.
+const SubjectKey = "dataSubject"
+
+// Subject() returns a Context that causes each line logged with it to
+// include a "dataSubject" pair (SubjectKey) identifying the person whose
+// personal data the lines may contain.  Lines can then be found (and
+// purged or exported) per data subject, such as when handling a privacy
+// (GDPR) request to erase or access someone's data.
+//
+//      ctx = lager.Subject(ctx, customer.ID)
+//      lager.Info(ctx).MMap("Updated address", "city", addr.City)
+//
+// The ID is passed through the function set via SetSubjectPseudonymizer()
+// (if any) before being logged, so the raw ID need not be stored in the
+// logs.  The key is never prefixed by a Namespace() and a later call to
+// Subject() replaces the data subject.  If 'id' is "", then 'ctx' is
+// returned unchanged.
+//
+// To find the lines for a data subject, search for the value returned by
+// SubjectPseudonym(), such as with the GCP Cloud Logging query:
+//
+//      jsonPayload.dataSubject="PSEUDONYM"
+//
+func Subject(ctx Ctx, id string) Ctx {
+	if "" == id {
+		return ctx
+	}
+	return ContextPairs(ctx).AddPairs(SubjectKey, SubjectPseudonym(id)).
+		InContext(ctx)
+}
+
+// SubjectFromContext() returns the (pseudonymized) data subject that was
+// added via Subject(), or "" if there is none.
+//
+func SubjectFromContext(ctx Ctx) string {
+	id, _ := StringFromContext(ctx, SubjectKey)
+	return id
+}
+
+// SetSubjectPseudonymizer() sets the function that Subject() uses to turn
+// a data subject's ID into the value that gets logged, such as a keyed hash
+// [see HashValue()] or a lookup in a table of pseudonyms.  This lets logs be
+// searched or purged per data subject without storing the raw ID in them.
+// Passing in 'nil' restores the default of logging the ID as given.
+//
+// The function must always return the same value for the same ID, or the
+// lines for a data subject could not all be found.  It should be set
+// before any logging is done, for the same reason.
+//
+func SetSubjectPseudonymizer(pseudonymize func(id string) string) {
+	updateGlobals(func(g *globals) {
+		g.pseudonymize = pseudonymize
+	})
+}
+
+// SubjectPseudonym() returns the value that Subject() logs for 'id', for
+// use by tools that search or purge the logs of a data subject.
+//
+func SubjectPseudonym(id string) string {
+	if f := getGlobals().pseudonymize; nil != f {
+		return f(id)
+	}
+	return id
+}
@@ -0,0 +1,220 @@
+package lager
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// One value logged by Verify() and what it should parse back as (if
+// 'check' is set), formatted via fmt.Sprint().
+type verifySample struct {
+	key   string
+	val   interface{}
+	want  string
+	check bool
+}
+
+// Returns the values logged by Verify(), one of each type that gets special
+// handling.
+func verifySamples() []verifySample {
+	str := "Quote\" back\\ tab\t nl\n ctl\x01 é ☃ 😀 </script>"
+	return []verifySample{
+		{"string", str, str, true},
+		{"empty", "", "", true},
+		{"invalidUtf8", "bad\xC0byte", "bad«xC0»byte", true},
+		{"bytes", []byte("raw\x00bytes"), "", false},
+		{"nil", nil, "<nil>", true},
+		{"true", true, "true", true},
+		{"false", false, "false", true},
+		{"int", -42, "-42", true},
+		{"int8", int8(math.MinInt8), "-128", true},
+		{"int16", int16(math.MinInt16), "-32768", true},
+		{"int32", int32(math.MinInt32), "-2147483648", true},
+		{"int64", int64(math.MinInt64), "-9223372036854775808", true},
+		{"uint", uint(42), "42", true},
+		{"uint8", uint8(math.MaxUint8), "255", true},
+		{"uint16", uint16(math.MaxUint16), "65535", true},
+		{"uint32", uint32(math.MaxUint32), "4294967295", true},
+		{"uint64", uint64(math.MaxUint64), "18446744073709551615", true},
+		{"float32", float32(1.5), "1.5", true},
+		{"float64", -2.25e-10, "-2.25e-10", true},
+		{"nan", math.NaN(), "NaN", true},
+		{"inf", math.Inf(-1), "-Inf", true},
+		{"duration", 1500 * time.Millisecond, "", false},
+		{"date", time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC), "", false},
+		{"error", errors.New("failed"), "failed", true},
+		{"stringer", time.March, "March", true},
+		{"strings", []string{"a", "b"}, "[a b]", true},
+		{"list", List(1, "two", nil), "[1 two <nil>]", true},
+		{"map", Map("k", "v", "n", List()), "map[k:v n:[]]", true},
+		{"pairs", Pairs("k", "v"), "map[k:v]", true},
+		{"goMap", map[string]interface{}{"b": 2, "a": 1}, "map[a:1 b:2]", true},
+		{"struct", struct {
+			Name string `json:"name"`
+		}{"x"}, "map[name:x]", true},
+		{"stream", Stream(strings.NewReader("streamed\n")), "streamed\n", true},
+		{"lazy", func() interface{} { return "computed" }, "computed", true},
+		{"nested", Map("list", List(Map("deep", true))),
+			"map[list:[map[deep:true]]]", true},
+	}
+}
+
+// Verify() writes one log line at every log level (even ones that are not
+// enabled), each holding a value of every type that Lager handles
+// specially, to 'w' (or nowhere, if 'w' is 'nil').  It then parses each line
+// with encoding/json to verify that the current configuration [Keys(),
+// SetFraming(), SetEscapeMode(), etc.] produces valid JSON that reads back
+// as expected.  It returns an error describing the first problem found (or
+// 'nil').  This is intended for a service's start-up self-check or for a
+// command-line flag:
+//
+//      if *verifyLogging {
+//          if err := lager.Verify(os.Stdout); nil != err {
+//              fmt.Fprintln(os.Stderr, err)
+//              os.Exit(1)
+//          }
+//          os.Exit(0)
+//      }
+//
+// The Exit line does not exit and the Panic line does not panic.  The
+// lines are not kept by the flight recorder [see SetFlightRecorder()], are
+// not re-leveled [see PromoteMatching()], are not counted by Stats() (so
+// they can't trigger EscalateOnFailures()), do not use up sequence numbers
+// [see SetSequenceNumbers()], and are not charged to any RequestBudget().
+//
+func Verify(w io.Writer) error {
+	vw := &verifyWriter{w: w}
+	g := getGlobals().updated(func(g *globals) {
+		g.dest, g.destOut = vw, new(outLock)
+		g.recorder, g.promotions, g.shadowRate = nil, nil, 0.0
+		g.stats, g.seqNums = new(lineStats), false
+		setLevels("FWNAITDOG")(g)
+	})
+
+	var samples []verifySample
+	levs := make([]level, 0, int(nLevels))
+	for lev := lPanic; lev < nLevels; lev++ {
+		samples = verifySamples() // Fresh, since Stream()s get used up.
+		levs = append(levs, lev)
+		verifyLine(g, lev, samples)
+	}
+
+	if len(vw.lines) != len(levs) {
+		return fmt.Errorf("lager.Verify: wrote %d lines, not %d",
+			len(vw.lines), len(levs))
+	}
+	for i, line := range vw.lines {
+		if err := g.verifyParse(levs[i], line, samples); nil != err {
+			return fmt.Errorf("lager.Verify: %s line: %w", levs[i], err)
+		}
+	}
+	return nil
+}
+
+// Logs one Verify() line, without exiting or panicking.
+func verifyLine(g *globals, lev level, samples []verifySample) {
+	pairs := make([]interface{}, 0, 2*len(samples))
+	for _, s := range samples {
+		pairs = append(pairs, s.key, s.val)
+	}
+	if lPanic == lev {
+		defer func() { recover() }()
+	}
+	lag := g.lagers[int(lev)]
+	if l, ok := lag.(*logger); ok {
+		cp := *l
+		cp.noExit, cp.bud = true, nil
+		lag = &cp
+	}
+	lag.MMap("Verifying logging", pairs...)
+}
+
+// Checks that one line written by Verify() parses as expected.
+func (g *globals) verifyParse(
+	lev level, line []byte, samples []verifySample,
+) error {
+	dec := json.NewDecoder(bytes.NewReader(unframe(g.framing, line)))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); nil != err {
+		return err
+	}
+	var levDesc interface{}
+	switch top := v.(type) {
+	case []interface{}:
+		if 1 < len(top) {
+			levDesc = top[1]
+		}
+	case map[string]interface{}:
+		if nil != g.keys {
+			levDesc = top[g.keys.lev]
+		}
+	}
+	if want := g.levDesc(lev.String()); want != levDesc {
+		return fmt.Errorf("level logged as %v not %q", levDesc, want)
+	}
+
+	key := g.normKey
+	found := findMapWith(v, key(samples[0].key))
+	if nil == found {
+		return fmt.Errorf("no %q pair found", samples[0].key)
+	}
+	for _, s := range samples {
+		got, ok := found[key(s.key)]
+		if !ok {
+			return fmt.Errorf("no %q pair found", s.key)
+		}
+		_, typed := g.keyTypes[s.key]
+		renamed := nil != g.keyNorm && strings.HasPrefix(s.want, "map[")
+		if !s.check || typed || renamed {
+			continue // Can't predict how the value was changed.
+		}
+		if fmt.Sprint(got) != s.want {
+			return fmt.Errorf("%q logged as %q not %q",
+				s.key, fmt.Sprint(got), s.want)
+		}
+	}
+	return nil
+}
+
+// Returns the first JSON object within 'v' that contains 'key' (or 'nil').
+func findMapWith(v interface{}, key string) map[string]interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if _, ok := v[key]; ok {
+			return v
+		}
+		for _, val := range v {
+			if m := findMapWith(val, key); nil != m {
+				return m
+			}
+		}
+	case []interface{}:
+		for _, val := range v {
+			if m := findMapWith(val, key); nil != m {
+				return m
+			}
+		}
+	}
+	return nil
+}
+
+// Records each line written by Verify() and passes it through to 'w'.
+type verifyWriter struct {
+	w     io.Writer
+	lines [][]byte
+}
+
+func (vw *verifyWriter) Write(line []byte) (int, error) {
+	vw.lines = append(vw.lines, append([]byte(nil), line...))
+	if nil == vw.w {
+		return len(line), nil
+	}
+	return vw.w.Write(line)
+}